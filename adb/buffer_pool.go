@@ -0,0 +1,64 @@
+package adb
+
+import "sync"
+
+//Payloads are pooled in power of two size classes from 512 bytes up to 1MiB, the biggest payload adb uses.
+//Bigger payloads are allocated and left to the garbage collector.
+const (
+	minPooledPayload = 512
+	maxPooledPayload = 1024 * 1024
+)
+
+var payloadPools = newPayloadPools()
+
+var headerPool = sync.Pool{New: func() interface{} { return new([PacketHeaderSize]byte) }}
+
+func newPayloadPools() []*sync.Pool {
+	pools := make([]*sync.Pool, 0)
+	for size := minPooledPayload; size <= maxPooledPayload; size *= 2 {
+		size := size
+		pools = append(pools, &sync.Pool{New: func() interface{} {
+			buffer := make([]byte, size)
+			return &buffer
+		}})
+	}
+	return pools
+}
+
+//poolFor returns the pool of the smallest size class that fits size bytes.
+func poolFor(size int) (*sync.Pool, bool) {
+	index := 0
+	for class := minPooledPayload; class < size; class *= 2 {
+		index++
+	}
+	if index >= len(payloadPools) {
+		return nil, false
+	}
+	return payloadPools[index], true
+}
+
+//newPooledPacket returns a packet with header and a payload of header.DataLength bytes taken from the pool.
+//The payload is not cleared, it has to be filled completely.
+func newPooledPacket(header PacketHeader) Packet {
+	size := int(header.DataLength)
+	if size == 0 {
+		return Packet{Header: header, Payload: []byte{}}
+	}
+	pool, ok := poolFor(size)
+	if !ok {
+		return Packet{Header: header, Payload: make([]byte, size)}
+	}
+	buffer := pool.Get().(*[]byte)
+	return Packet{Header: header, Payload: (*buffer)[:size], buffer: buffer}
+}
+
+//Release returns the payload of a packet read by ReadPacketFromTCP or a USBPacketReader to the pool once
+//the packet was written. Neither the packet nor its payload may be used afterwards and it must be released only once.
+//Packets with payloads that are not from the pool are left to the garbage collector.
+func (p Packet) Release() {
+	if p.buffer == nil {
+		return
+	}
+	pool, _ := poolFor(cap(*p.buffer))
+	pool.Put(p.buffer)
+}
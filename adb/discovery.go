@@ -2,6 +2,7 @@ package adb
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/google/gousb"
 
@@ -12,15 +13,35 @@ const adbInterfaceProtocol gousb.Protocol = 0x1
 const adbInterfaceSubclass gousb.Class = 0x42
 
 //DeviceInfo contains all relevant information we can get from USB for one Android device.
+//Bus, Ports and Address describe where the device is plugged in, see PortPath.
+//If the device reports no serial or the same serial as another device, SerialNumber is made up
+//from the port path and SerialWarning says why.
 type DeviceInfo struct {
 	SerialNumber string
 	ProductName  string
 	VID          gousb.ID
 	PID          gousb.ID
 	UsbInfo      string
+	Bus          int
+	Ports        []int
+	Address      int
+	//Mode is the USB mode the device is in, only devices in ModeADB are bridged
+	Mode string
+	//SerialWarning is SerialMissing or SerialDuplicate if SerialNumber was made up, empty otherwise
+	SerialWarning string `json:",omitempty"`
+	//NetworkAddress is the host:port of adbd for devices attached over the network, empty for USB devices
+	NetworkAddress string `json:",omitempty"`
 }
 
+const (
+	//SerialMissing is set for devices whose serial could not be read or is empty
+	SerialMissing = "missing"
+	//SerialDuplicate is set for devices reporting the same serial as another connected device
+	SerialDuplicate = "duplicate"
+)
+
 //ListDevices looks for physical Android devices connected to the USB host and returns a slice of AndroidDeviceInfo or an error.
+//Besides devices with an ADB interface it also returns Android devices in other modes, see DeviceInfo.Mode.
 func ListDevices() ([]DeviceInfo, error) {
 	ctx := gousb.NewContext()
 	defer func() {
@@ -36,7 +57,7 @@ func findDevices(ctx *gousb.Context) ([]DeviceInfo, error) {
 	devices, err := ctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
 		// this function is called for every device present.
 		// Returning true means the device should be opened.
-		return isAndroidDevice(desc)
+		return ClassifyMode(desc) != ""
 	})
 	defer closeDevices(devices)
 
@@ -102,27 +123,132 @@ func mapToAndroidDevice(devices []*gousb.Device) ([]DeviceInfo, error) {
 		log.Tracef("Getting serial for: %s", device.String())
 		serial, err := device.SerialNumber()
 		if err != nil {
-			log.Warnf("error getting serial: %v skipping device", err)
-			lastErr = err
-			continue
+			log.Warnf("error getting serial of %s: %v", device.String(), err)
+			serial = ""
 		}
 		log.Tracef("Got serial: %s", serial)
 
 		log.Tracef("Getting product name for: %s", device.String())
 		product, err := device.Product()
 		if err != nil {
-			log.Warnf("error getting serial: %v skipping device", err)
-			lastErr = err
-			continue
+			log.Warnf("error getting product name of %s: %v", device.String(), err)
 		}
 		log.Tracef("Got product name: %s", product)
 
-		androidDevices = append(androidDevices, DeviceInfo{
+		androidDevice := DeviceInfo{
 			SerialNumber: serial,
 			ProductName:  product,
 			VID:          device.Desc.Vendor,
 			PID:          device.Desc.Product,
-			UsbInfo:      device.String()})
+			UsbInfo:      device.String(),
+			Mode:         ClassifyMode(device.Desc)}
+		locate(&androidDevice, device)
+		if serial == "" {
+			androidDevice.SerialWarning = SerialMissing
+		}
+		androidDevices = append(androidDevices, androidDevice)
 	}
+	MakeSerialsUnique(androidDevices)
 	return androidDevices, lastErr
 }
+
+//MakeSerialsUnique gives devices without serial or with the serial of another device a serial made up from
+//their port path, so every device gets its own bridge.
+func MakeSerialsUnique(devices []DeviceInfo) {
+	count := map[string]int{}
+	for _, device := range devices {
+		count[device.SerialNumber]++
+	}
+	for i := range devices {
+		device := &devices[i]
+		if device.SerialWarning == "" && count[device.SerialNumber] > 1 {
+			device.SerialWarning = SerialDuplicate
+		}
+		if device.SerialWarning == "" {
+			continue
+		}
+		device.serialFromLocation()
+	}
+}
+
+//serialFromLocation makes up the serial of a device with SerialWarning from its port path.
+func (d *DeviceInfo) serialFromLocation() {
+	location := d.PortPath()
+	if location == "" {
+		//not stable across re-enumeration, but better than mixing up devices
+		location = fmt.Sprintf("%d-addr%d", d.Bus, d.Address)
+	}
+	if d.SerialWarning == SerialMissing {
+		d.SerialNumber = "usb-" + location
+	} else {
+		d.SerialNumber = d.SerialNumber + "@" + location
+	}
+	log.WithFields(log.Fields{"serial": d.SerialNumber, "warning": d.SerialWarning}).Debug("device has no unique serial, identifying it by its USB port")
+}
+
+//SerialTracker keeps the serials made up by MakeSerialsUnique stable across device lists. MakeSerialsUnique only
+//sees the devices connected right now, so a device would switch between its serial and one made up from its port path
+//whenever another device with the same serial is plugged in or removed.
+type SerialTracker struct {
+	duplicates map[string]bool
+}
+
+//NewSerialTracker creates a SerialTracker that has not seen any duplicate serials yet.
+func NewSerialTracker() *SerialTracker {
+	return &SerialTracker{duplicates: map[string]bool{}}
+}
+
+//Track remembers the serials of devices that were ever reported by more than one device and identifies devices with such
+//a serial by their port path from then on, also when they are the only one connected. known are the devices in use already,
+//they keep their serial, so a bridged device is not renamed when a device with the same serial is plugged in next to it.
+func (t *SerialTracker) Track(devices []DeviceInfo, known []DeviceInfo) {
+	for _, device := range devices {
+		if device.SerialWarning == SerialDuplicate {
+			t.duplicates[device.ReportedSerial()] = true
+		}
+	}
+	for i := range devices {
+		device := &devices[i]
+		if device.SerialWarning == SerialMissing || !t.duplicates[device.ReportedSerial()] {
+			continue
+		}
+		if isKnownUnderSerial(*device, known) {
+			device.SerialNumber = device.ReportedSerial()
+			device.SerialWarning = ""
+			continue
+		}
+		if device.SerialWarning == "" {
+			device.SerialWarning = SerialDuplicate
+			device.serialFromLocation()
+		}
+	}
+}
+
+//isKnownUnderSerial is true if known contains device at the same port identified by its reported serial.
+func isKnownUnderSerial(device DeviceInfo, known []DeviceInfo) bool {
+	if device.PortPath() == "" {
+		return false
+	}
+	for _, other := range known {
+		if other.SerialWarning == "" && other.NetworkAddress == "" && other.SerialNumber == device.ReportedSerial() &&
+			other.PortPath() == device.PortPath() {
+			return true
+		}
+	}
+	return false
+}
+
+//ReportedSerial returns the serial the device reports over USB, which differs from SerialNumber if that was made up.
+func (d DeviceInfo) ReportedSerial() string {
+	switch d.SerialWarning {
+	case SerialMissing:
+		return ""
+	case SerialDuplicate:
+		if index := strings.LastIndex(d.SerialNumber, "@"); index != -1 {
+			return d.SerialNumber[:index]
+		}
+		return d.SerialNumber
+	default:
+		return d.SerialNumber
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/danielpaulus/go-adb/adb"
+	"github.com/google/gousb"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
@@ -31,3 +32,85 @@ func TestDiscovery(t *testing.T) {
 		}
 	}
 }
+
+func TestMakeSerialsUnique(t *testing.T) {
+	devices := []adb.DeviceInfo{
+		{SerialNumber: "0123456789ABCDEF", Bus: 1, Ports: []int{1}},
+		{SerialNumber: "unique", Bus: 1, Ports: []int{2}},
+		{SerialNumber: "0123456789ABCDEF", Bus: 1, Ports: []int{3, 1}},
+		{SerialNumber: "", Bus: 2, Ports: []int{4}, SerialWarning: adb.SerialMissing},
+		{SerialNumber: "", Bus: 2, Address: 7, SerialWarning: adb.SerialMissing},
+	}
+	adb.MakeSerialsUnique(devices)
+
+	assert.Equal(t, "0123456789ABCDEF@1-1", devices[0].SerialNumber)
+	assert.Equal(t, adb.SerialDuplicate, devices[0].SerialWarning)
+	assert.Equal(t, "0123456789ABCDEF", devices[0].ReportedSerial())
+	assert.Equal(t, "unique", devices[1].SerialNumber)
+	assert.Equal(t, "", devices[1].SerialWarning)
+	assert.Equal(t, "unique", devices[1].ReportedSerial())
+	assert.Equal(t, "0123456789ABCDEF@1-3.1", devices[2].SerialNumber)
+	assert.Equal(t, "usb-2-4", devices[3].SerialNumber)
+	assert.Equal(t, "", devices[3].ReportedSerial())
+	assert.Equal(t, "usb-2-addr7", devices[4].SerialNumber)
+}
+
+func usbDesc(vid gousb.ID, pid gousb.ID, interfaces ...gousb.InterfaceSetting) *gousb.DeviceDesc {
+	descs := make([]gousb.InterfaceDesc, len(interfaces))
+	for i, alt := range interfaces {
+		descs[i] = gousb.InterfaceDesc{Number: i, AltSettings: []gousb.InterfaceSetting{alt}}
+	}
+	return &gousb.DeviceDesc{Vendor: vid, Product: pid, Configs: map[int]gousb.ConfigDesc{1: {Number: 1, Interfaces: descs}}}
+}
+
+func TestClassifyMode(t *testing.T) {
+	bulk := map[gousb.EndpointAddress]gousb.EndpointDesc{0x81: {Direction: gousb.EndpointDirectionIn}, 0x01: {Direction: gousb.EndpointDirectionOut}}
+	adbInterface := gousb.InterfaceSetting{Class: gousb.ClassVendorSpec, SubClass: 0x42, Protocol: 0x01, Endpoints: bulk}
+	fastbootInterface := gousb.InterfaceSetting{Class: gousb.ClassVendorSpec, SubClass: 0x42, Protocol: 0x03, Endpoints: bulk}
+	mtpInterface := gousb.InterfaceSetting{Class: gousb.ClassPTP, SubClass: 0x01, Protocol: 0x01}
+	storageInterface := gousb.InterfaceSetting{Class: gousb.ClassMassStorage, SubClass: 0x06, Protocol: 0x50}
+
+	assert.Equal(t, adb.ModeADB, adb.ClassifyMode(usbDesc(0x1234, 1, mtpInterface, adbInterface)))
+	assert.Equal(t, adb.ModeFastboot, adb.ClassifyMode(usbDesc(0x18d1, 0x4ee0, fastbootInterface)))
+	assert.Equal(t, adb.ModeMTP, adb.ClassifyMode(usbDesc(0x18d1, 0x4ee1, mtpInterface)))
+	assert.Equal(t, adb.ModeNoInterface, adb.ClassifyMode(usbDesc(0x18d1, 0x4ee1)))
+	assert.Equal(t, adb.ModeEDL, adb.ClassifyMode(usbDesc(0x05c6, 0x9008, gousb.InterfaceSetting{Class: gousb.ClassVendorSpec, SubClass: 0xff, Protocol: 0xff})))
+	assert.Equal(t, "", adb.ClassifyMode(usbDesc(0x04e8, 0x61f5, storageInterface)))
+	assert.Equal(t, "", adb.ClassifyMode(usbDesc(0x1234, 1, mtpInterface)))
+	assert.Equal(t, "USB debugging disabled", adb.ModeHint(adb.ModeMTP))
+}
+
+func TestSerialTrackerKeepsIdentities(t *testing.T) {
+	tracker := adb.NewSerialTracker()
+	list := func(devices ...adb.DeviceInfo) []adb.DeviceInfo {
+		adb.MakeSerialsUnique(devices)
+		return devices
+	}
+	first := adb.DeviceInfo{SerialNumber: "0123456789ABCDEF", Bus: 1, Ports: []int{1}}
+	second := adb.DeviceInfo{SerialNumber: "0123456789ABCDEF", Bus: 1, Ports: []int{2}}
+
+	devices := list(first)
+	tracker.Track(devices, nil)
+	assert.Equal(t, "0123456789ABCDEF", devices[0].SerialNumber)
+	known := devices
+
+	//the bridged device keeps its serial, the new one gets its port path
+	devices = list(first, second)
+	tracker.Track(devices, known)
+	assert.Equal(t, "0123456789ABCDEF", devices[0].SerialNumber)
+	assert.Equal(t, "", devices[0].SerialWarning)
+	assert.Equal(t, "0123456789ABCDEF@1-2", devices[1].SerialNumber)
+	known = devices
+
+	//the device left alone keeps its port path
+	devices = list(second)
+	tracker.Track(devices, known)
+	assert.Equal(t, "0123456789ABCDEF@1-2", devices[0].SerialNumber)
+	assert.Equal(t, adb.SerialDuplicate, devices[0].SerialWarning)
+
+	//once replugged, the first device is identified by its port path as well
+	devices = list(first)
+	tracker.Track(devices, devices[:0])
+	assert.Equal(t, "0123456789ABCDEF@1-1", devices[0].SerialNumber)
+	assert.Equal(t, "0123456789ABCDEF", devices[0].ReportedSerial())
+}
@@ -0,0 +1,25 @@
+package adb
+
+import (
+	"context"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Spake2Exchange exposes the SPAKE2 exchange of pairing to the tests of adb_test. It returns the message for the other
+//side and a function deriving the key from the message of the other side.
+func Spake2Exchange(alice bool, myName []byte, theirName []byte, password []byte, random io.Reader) ([]byte, func([]byte) ([]byte, error), error) {
+	exchange, err := newSpake2(alice, myName, theirName, password, random)
+	if err != nil {
+		return nil, nil, err
+	}
+	return exchange.myMessage, exchange.processMessage, nil
+}
+
+//TransferAdapter creates a UsbAdapter whose bulk transfers go to in and out instead of a device, for benchmarks.
+func TransferAdapter(in transferReader, out transferWriter, maxPacketSize int) *UsbAdapter {
+	transfers, cancel := context.WithCancel(context.Background())
+	return &UsbAdapter{in: in, out: out, packetOut: out, inPacketSize: maxPacketSize, outPacketSize: maxPacketSize,
+		transfers: transfers, cancelTransfers: cancel, injectedLog: log.NewEntry(log.StandardLogger())}
+}
@@ -0,0 +1,325 @@
+package adb
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gousb"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	//FastbootPortOffset is added to the port of a device to get the port its fastboot bridge listens on
+	FastbootPortOffset = 1000
+	//the fastboot TCP protocol starts with both sides sending FB and a two digit version
+	fastbootHandshake = "FB01"
+	//every fastboot TCP message starts with its length as 8 byte big endian
+	fastbootHeaderSize = 8
+	//responses are at most 256 bytes, but uploads send bigger transfers
+	fastbootReadSize = 1024 * 1024
+	//downloads are written to USB in chunks of this size
+	fastbootWriteSize = 1024 * 1024
+)
+
+//FastbootTransport is a connection to the fastboot interface of a device. Every Write sends one USB transfer,
+//every Read returns the data of one USB transfer.
+type FastbootTransport interface {
+	io.ReadWriteCloser
+}
+
+//FastbootOpener opens the FastbootTransport of a device, OpenFastbootUSB is used for real devices.
+type FastbootOpener func(device DeviceInfo) (FastbootTransport, error)
+
+//FastbootBridge exposes the fastboot interface of a device in the bootloader on a TCP port using the
+//fastboot TCP protocol, so the stock client can be used with fastboot -s tcp:host:port.
+//The USB interface is only claimed while a client is connected, so fastboot over USB keeps working otherwise.
+type FastbootBridge struct {
+	device   DeviceInfo
+	port     int
+	open     FastbootOpener
+	listener net.Listener
+	conn     net.Conn
+	closed   bool
+	mux      sync.Mutex
+}
+
+//NewFastbootBridge creates a FastbootBridge for device that will listen on port and use open to connect to the device.
+func NewFastbootBridge(device DeviceInfo, port int, open FastbootOpener) *FastbootBridge {
+	return &FastbootBridge{device: device, port: port, open: open}
+}
+
+func (f *FastbootBridge) log() *log.Entry {
+	return log.WithFields(log.Fields{"port": f.port, "serial": f.device.SerialNumber, "mode": ModeFastboot})
+}
+
+//GetSerialNumber returns the serial usb number of the device this bridge is responsible for.
+func (f *FastbootBridge) GetSerialNumber() string {
+	return f.device.SerialNumber
+}
+
+//GetPort returns the TCP port the bridge listens on.
+func (f *FastbootBridge) GetPort() int {
+	return f.port
+}
+
+//GetStateName returns listening, connected if a client is using the bridge or closed.
+func (f *FastbootBridge) GetStateName() string {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.closed {
+		return "closed"
+	}
+	if f.conn != nil {
+		return "connected"
+	}
+	return "listening"
+}
+
+//Start opens the TCP port and accepts one fastboot client at a time.
+func (f *FastbootBridge) Start() error {
+	listener, err := startTcp(f.port)
+	if err != nil {
+		return err
+	}
+	f.mux.Lock()
+	f.listener = listener
+	f.mux.Unlock()
+	f.log().Infof("fastboot available on port %d", f.port)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			f.serve(conn)
+		}
+	}()
+	return nil
+}
+
+//Close stops accepting clients, a connected client is disconnected.
+func (f *FastbootBridge) Close() error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.closed = true
+	if f.conn != nil {
+		f.conn.Close()
+	}
+	if f.listener == nil {
+		return nil
+	}
+	return f.listener.Close()
+}
+
+func (f *FastbootBridge) setConn(conn net.Conn) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.conn = conn
+}
+
+//serve forwards fastboot TCP messages of one client to USB transfers and USB transfers back as TCP messages.
+func (f *FastbootBridge) serve(conn net.Conn) {
+	defer conn.Close()
+	f.log().WithFields(log.Fields{"remote": conn.RemoteAddr().String()}).Info("fastboot client connected")
+	f.setConn(conn)
+	defer f.setConn(nil)
+
+	err := fastbootHandshakeTCP(conn)
+	if err != nil {
+		f.log().Warnf("fastboot handshake failed: %v", err)
+		return
+	}
+	transport, err := f.open(f.device)
+	if err != nil {
+		f.log().Errorf("failed opening fastboot interface: %v", err)
+		return
+	}
+	defer transport.Close()
+
+	usbDone := make(chan struct{})
+	go func() {
+		defer close(usbDone)
+		err := copyTransfersToTCP(transport, conn)
+		if err != nil {
+			f.log().Debugf("stopped reading from fastboot interface: %v", err)
+		}
+		//unblocks reading from the client
+		conn.Close()
+	}()
+	err = copyTCPToTransfers(conn, transport)
+	if err != nil && err != io.EOF {
+		f.log().Warnf("fastboot client connection failed: %v", err)
+	}
+	//unblocks reading from USB
+	transport.Close()
+	<-usbDone
+	f.log().Info("fastboot client disconnected")
+}
+
+func fastbootHandshakeTCP(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	handshake := make([]byte, len(fastbootHandshake))
+	_, err := io.ReadFull(conn, handshake)
+	if err != nil {
+		return err
+	}
+	if string(handshake[:2]) != "FB" {
+		return fmt.Errorf("invalid fastboot handshake %x", handshake)
+	}
+	_, err = conn.Write([]byte(fastbootHandshake))
+	return err
+}
+
+func copyTCPToTransfers(conn net.Conn, transport FastbootTransport) error {
+	header := make([]byte, fastbootHeaderSize)
+	buffer := make([]byte, fastbootWriteSize)
+	for {
+		_, err := io.ReadFull(conn, header)
+		if err != nil {
+			return err
+		}
+		remaining := binary.BigEndian.Uint64(header)
+		for remaining > 0 {
+			chunk := buffer
+			if remaining < uint64(len(chunk)) {
+				chunk = chunk[:remaining]
+			}
+			_, err := io.ReadFull(conn, chunk)
+			if err != nil {
+				return err
+			}
+			_, err = transport.Write(chunk)
+			if err != nil {
+				return err
+			}
+			remaining -= uint64(len(chunk))
+		}
+	}
+}
+
+func copyTransfersToTCP(transport FastbootTransport, conn net.Conn) error {
+	buffer := make([]byte, fastbootHeaderSize+fastbootReadSize)
+	for {
+		n, err := transport.Read(buffer[fastbootHeaderSize:])
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+		binary.BigEndian.PutUint64(buffer, uint64(n))
+		_, err = conn.Write(buffer[:fastbootHeaderSize+n])
+		if err != nil {
+			return err
+		}
+	}
+}
+
+//fastbootUSB is the FastbootTransport for real devices, it claims the fastboot interface of the device.
+type fastbootUSB struct {
+	ctx       *gousb.Context
+	device    *gousb.Device
+	config    *gousb.Config
+	iface     *gousb.Interface
+	in        *gousb.InEndpoint
+	out       *gousb.OutEndpoint
+	transfers context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+}
+
+//OpenFastbootUSB opens the device and claims its fastboot interface.
+func OpenFastbootUSB(device DeviceInfo) (FastbootTransport, error) {
+	transfers, cancel := context.WithCancel(context.Background())
+	transport := &fastbootUSB{ctx: gousb.NewContext(), transfers: transfers, cancel: cancel}
+	err := transport.connect(device)
+	if err != nil {
+		transport.Close()
+		return nil, err
+	}
+	return transport, nil
+}
+
+func (t *fastbootUSB) connect(device DeviceInfo) error {
+	usbDevice, err := OpenDevice(t.ctx, device)
+	if err != nil {
+		return err
+	}
+	t.device = usbDevice
+	usbDevice.SetAutoDetach(true)
+	confignum, err := usbDevice.ActiveConfigNum()
+	if err != nil {
+		return err
+	}
+	t.config, err = usbDevice.Config(confignum)
+	if err != nil {
+		return err
+	}
+	ifaceNumber, alt, found := findFastbootInterface(t.config.Desc)
+	if !found {
+		return errors.New("device has no fastboot interface")
+	}
+	t.iface, err = t.config.Interface(ifaceNumber, alt.Alternate)
+	if err != nil {
+		return err
+	}
+	in, _, err := findBulkEndpoint(alt, gousb.EndpointDirectionIn)
+	if err != nil {
+		return err
+	}
+	out, _, err := findBulkEndpoint(alt, gousb.EndpointDirectionOut)
+	if err != nil {
+		return err
+	}
+	t.in, err = t.iface.InEndpoint(in)
+	if err != nil {
+		return err
+	}
+	t.out, err = t.iface.OutEndpoint(out)
+	return err
+}
+
+func findFastbootInterface(confDesc gousb.ConfigDesc) (int, gousb.InterfaceSetting, bool) {
+	for _, iface := range confDesc.Interfaces {
+		for _, alt := range iface.AltSettings {
+			if isFastbootInterface(alt) {
+				return iface.Number, alt, true
+			}
+		}
+	}
+	return 0, gousb.InterfaceSetting{}, false
+}
+
+//Read and Write use a context, so pending transfers are cancelled on Close.
+func (t *fastbootUSB) Read(p []byte) (int, error) {
+	return t.in.ReadContext(t.transfers, p)
+}
+
+func (t *fastbootUSB) Write(p []byte) (int, error) {
+	return t.out.WriteContext(t.transfers, p)
+}
+
+//Close releases the interface and closes the device, it is safe to call more than once.
+func (t *fastbootUSB) Close() error {
+	t.closeOnce.Do(func() {
+		t.cancel()
+		if t.iface != nil {
+			t.iface.Close()
+		}
+		if t.config != nil {
+			t.config.Close()
+		}
+		if t.device != nil {
+			t.device.Close()
+		}
+		t.ctx.Close()
+	})
+	return nil
+}
@@ -0,0 +1,145 @@
+package adb_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/danielpaulus/go-adb/adb"
+	"github.com/stretchr/testify/assert"
+)
+
+//fakeFastbootDevice answers fastboot commands like a device in the bootloader would over USB
+type fakeFastbootDevice struct {
+	responses   chan string
+	commands    []string
+	downloading int
+	downloaded  []byte
+	closed      chan struct{}
+	closeOnce   sync.Once
+	mux         sync.Mutex
+}
+
+func newFakeFastbootDevice() *fakeFastbootDevice {
+	return &fakeFastbootDevice{responses: make(chan string, 10), closed: make(chan struct{})}
+}
+
+func (d *fakeFastbootDevice) Write(p []byte) (int, error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.downloading > 0 {
+		d.downloaded = append(d.downloaded, p...)
+		d.downloading -= len(p)
+		if d.downloading <= 0 {
+			d.responses <- "OKAY"
+		}
+		return len(p), nil
+	}
+	command := string(p)
+	d.commands = append(d.commands, command)
+	switch {
+	case command == "getvar:product":
+		d.responses <- "OKAYfakephone"
+	case strings.HasPrefix(command, "download:"):
+		size, _ := strconv.ParseInt(strings.TrimPrefix(command, "download:"), 16, 32)
+		d.downloading = int(size)
+		d.responses <- fmt.Sprintf("DATA%08x", size)
+	case strings.HasPrefix(command, "flash:"):
+		d.responses <- "INFOwriting " + strings.TrimPrefix(command, "flash:")
+		d.responses <- "OKAY"
+	default:
+		d.responses <- "FAILunknown command"
+	}
+	return len(p), nil
+}
+
+func (d *fakeFastbootDevice) Read(p []byte) (int, error) {
+	select {
+	case response := <-d.responses:
+		return copy(p, response), nil
+	case <-d.closed:
+		return 0, io.EOF
+	}
+}
+
+func (d *fakeFastbootDevice) Close() error {
+	d.closeOnce.Do(func() { close(d.closed) })
+	return nil
+}
+
+func sendFastbootMessage(t *testing.T, conn net.Conn, data []byte) {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint64(header, uint64(len(data)))
+	_, err := conn.Write(append(header, data...))
+	assert.NoError(t, err)
+}
+
+func readFastbootMessage(t *testing.T, conn net.Conn) string {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, 8)
+	_, err := io.ReadFull(conn, header)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	message := make([]byte, binary.BigEndian.Uint64(header))
+	_, err = io.ReadFull(conn, message)
+	assert.NoError(t, err)
+	return string(message)
+}
+
+func TestFastbootBridge(t *testing.T) {
+	const port = 62100
+	device := newFakeFastbootDevice()
+	info := adb.DeviceInfo{SerialNumber: "fastboot-serial", Mode: adb.ModeFastboot}
+	bridge := adb.NewFastbootBridge(info, port, func(adb.DeviceInfo) (adb.FastbootTransport, error) { return device, nil })
+	if !assert.NoError(t, bridge.Start()) {
+		return
+	}
+	defer bridge.Close()
+	assert.Equal(t, "listening", bridge.GetStateName())
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("FB01"))
+	assert.NoError(t, err)
+	handshake := make([]byte, 4)
+	_, err = io.ReadFull(conn, handshake)
+	assert.NoError(t, err)
+	assert.Equal(t, "FB01", string(handshake))
+
+	sendFastbootMessage(t, conn, []byte("getvar:product"))
+	assert.Equal(t, "OKAYfakephone", readFastbootMessage(t, conn))
+	assert.Equal(t, "connected", bridge.GetStateName())
+
+	image := []byte("0123456789abcdef0123")
+	sendFastbootMessage(t, conn, []byte(fmt.Sprintf("download:%08x", len(image))))
+	assert.Equal(t, "DATA00000014", readFastbootMessage(t, conn))
+	sendFastbootMessage(t, conn, image[:10])
+	sendFastbootMessage(t, conn, image[10:])
+	assert.Equal(t, "OKAY", readFastbootMessage(t, conn))
+
+	sendFastbootMessage(t, conn, []byte("flash:boot"))
+	assert.Equal(t, "INFOwriting boot", readFastbootMessage(t, conn))
+	assert.Equal(t, "OKAY", readFastbootMessage(t, conn))
+
+	device.mux.Lock()
+	assert.Equal(t, image, device.downloaded)
+	assert.Equal(t, []string{"getvar:product", "download:00000014", "flash:boot"}, device.commands)
+	device.mux.Unlock()
+
+	conn.Close()
+	select {
+	case <-device.closed:
+	case <-time.After(5 * time.Second):
+		t.Error("bridge did not release the fastboot interface after the client disconnected")
+	}
+}
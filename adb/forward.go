@@ -0,0 +1,286 @@
+package adb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	//ErrInvalidSocket is returned for sockets that are not given like adb does, f.ex. tcp:9222
+	ErrInvalidSocket = errors.New("invalid socket")
+	//ErrForwardNotFound is returned when removing a forward that does not exist
+	ErrForwardNotFound = errors.New("forward not found")
+	//ErrSocketNotAllowed is returned for host sockets outside of what SetForwardSocketDir allows and for reverse forwards
+	//to other hosts than localhost
+	ErrSocketNotAllowed = errors.New("socket not allowed")
+)
+
+var (
+	forwardAddress   = "127.0.0.1"
+	forwardSocketDir = ""
+)
+
+//SetForwardAddress makes forwards of tcp:<port> listen on the IP address instead of 127.0.0.1,
+//f.ex. 0.0.0.0 makes them reachable from other hosts.
+func SetForwardAddress(address string) error {
+	if net.ParseIP(address) == nil {
+		return fmt.Errorf("invalid forward address '%s'", address)
+	}
+	forwardAddress = address
+	return nil
+}
+
+//SetForwardSocketDir allows forwards of localfilesystem:<path> to create sockets in dir, relative paths are in dir.
+//Without it or with an empty dir, forwards of localfilesystem sockets are rejected.
+func SetForwardSocketDir(dir string) error {
+	if dir == "" {
+		forwardSocketDir = ""
+		return nil
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	forwardSocketDir = abs
+	return nil
+}
+
+//Forward is a host socket forwarded to a service of the device, both given like adb does,
+//f.ex. tcp:9222 and localabstract:chrome_devtools_remote.
+type Forward struct {
+	Local       string `json:"local"`
+	Remote      string `json:"remote"`
+	Connections int    `json:"connections"`
+}
+
+//Forwards does what adb forward does without an adb server: it listens on host sockets and opens a stream
+//through the Session of the bridge for every connection. Forwards are kept while the device is offline,
+//connections accepted meanwhile are closed right away.
+type Forwards struct {
+	session  *Session
+	forwards []*forward
+	mux      sync.Mutex
+}
+
+type forward struct {
+	local       string
+	remote      string
+	listener    net.Listener
+	connections map[net.Conn]struct{}
+}
+
+//NewForwards creates Forwards opening streams with session.
+func NewForwards(session *Session) *Forwards {
+	return &Forwards{session: session, forwards: make([]*forward, 0)}
+}
+
+//Add starts forwarding local to remote. local is tcp:<port>, localfilesystem:<path> or localabstract:<name>,
+//tcp:0 picks a free port. TCP ports are opened on the address set with SetForwardAddress and paths must be in the
+//directory set with SetForwardSocketDir. remote is any socket of the device adb accepts, f.ex. tcp:8080 or localabstract:<name>.
+//If local is forwarded already, it is forwarded to remote from now on like adb does.
+func (f *Forwards) Add(local string, remote string) (Forward, error) {
+	if !strings.Contains(remote, ":") || strings.HasPrefix(remote, ":") {
+		return Forward{}, fmt.Errorf("%w: %s", ErrInvalidSocket, remote)
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if existing := f.find(local); existing != nil {
+		existing.remote = remote
+		f.session.log().Infof("forwarding %s to %s", local, remote)
+		return existing.info(), nil
+	}
+	listener, err := listenSocket(local)
+	if err != nil {
+		return Forward{}, err
+	}
+	if tcp, ok := listener.Addr().(*net.TCPAddr); ok {
+		local = fmt.Sprintf("tcp:%d", tcp.Port)
+	}
+	forward := &forward{local: local, remote: remote, listener: listener, connections: map[net.Conn]struct{}{}}
+	f.forwards = append(f.forwards, forward)
+	go f.serve(forward)
+	f.session.log().Infof("forwarding %s to %s", local, remote)
+	return forward.info(), nil
+}
+
+//Remove stops forwarding local and closes its connections.
+func (f *Forwards) Remove(local string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	for i, forward := range f.forwards {
+		if forward.local == local {
+			forward.close()
+			f.forwards = append(f.forwards[:i], f.forwards[i+1:]...)
+			f.session.log().Infof("stopped forwarding %s", local)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrForwardNotFound, local)
+}
+
+//List returns all forwards in the order they were added.
+func (f *Forwards) List() []Forward {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	result := make([]Forward, len(f.forwards))
+	for i, forward := range f.forwards {
+		result[i] = forward.info()
+	}
+	return result
+}
+
+//Close removes all forwards.
+func (f *Forwards) Close() {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	for _, forward := range f.forwards {
+		forward.close()
+	}
+	f.forwards = make([]*forward, 0)
+}
+
+//find returns the forward of local, it must be called with mux locked.
+func (f *Forwards) find(local string) *forward {
+	for _, forward := range f.forwards {
+		if forward.local == local {
+			return forward
+		}
+	}
+	return nil
+}
+
+func (f *Forwards) serve(forward *forward) {
+	for {
+		conn, err := forward.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.relay(forward, conn)
+	}
+}
+
+//relay copies data between conn and a new stream to the remote of forward until one side closes.
+func (f *Forwards) relay(forward *forward, conn net.Conn) {
+	f.mux.Lock()
+	remote := forward.remote
+	forward.connections[conn] = struct{}{}
+	f.mux.Unlock()
+	defer func() {
+		conn.Close()
+		f.mux.Lock()
+		delete(forward.connections, conn)
+		f.mux.Unlock()
+	}()
+	stream, err := f.session.Open(remote)
+	if err != nil {
+		f.session.log().WithFields(log.Fields{"local": forward.local, "remote": remote}).Warnf("failed forwarding connection: %v", err)
+		return
+	}
+	deviceDone := make(chan struct{})
+	go func() {
+		defer close(deviceDone)
+		io.Copy(conn, stream)
+		//unblocks reading from conn
+		conn.Close()
+	}()
+	io.Copy(stream, conn)
+	//unblocks reading from the stream
+	stream.Close()
+	<-deviceDone
+}
+
+func (fw *forward) info() Forward {
+	return Forward{Local: fw.local, Remote: fw.remote, Connections: len(fw.connections)}
+}
+
+func (fw *forward) close() {
+	fw.listener.Close()
+	for conn := range fw.connections {
+		conn.Close()
+	}
+}
+
+//listenSocket listens on a host socket given like adb does, tcp:<port>, localfilesystem:<path> or localabstract:<name>.
+//TCP ports are opened on the forward address, localhost unless SetForwardAddress was called.
+func listenSocket(socket string) (net.Listener, error) {
+	parts := strings.SplitN(socket, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSocket, socket)
+	}
+	switch parts[0] {
+	case "tcp":
+		port, err := strconv.Atoi(parts[1])
+		if err != nil || port < 0 || port > 65535 {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidSocket, socket)
+		}
+		return net.Listen("tcp", net.JoinHostPort(forwardAddress, strconv.Itoa(port)))
+	case "localfilesystem":
+		path, err := forwardSocketPath(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	case "localabstract":
+		return net.Listen("unix", "@"+parts[1])
+	}
+	return nil, fmt.Errorf("%w: %s", ErrInvalidSocket, socket)
+}
+
+//forwardSocketPath returns the path of a localfilesystem socket, which must be in the directory set with SetForwardSocketDir.
+func forwardSocketPath(path string) (string, error) {
+	if forwardSocketDir == "" {
+		return "", fmt.Errorf("%w: localfilesystem:%s, no socket directory is configured", ErrSocketNotAllowed, path)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(forwardSocketDir, path)
+	}
+	path = filepath.Clean(path)
+	if !strings.HasPrefix(path, forwardSocketDir+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: localfilesystem:%s is not in %s", ErrSocketNotAllowed, path, forwardSocketDir)
+	}
+	return path, nil
+}
+
+//dialSocket connects to a host socket given like adb does, tcp:<port> on localhost or tcp:<host>:<port> with a
+//loopback host.
+func dialSocket(socket string) (net.Conn, error) {
+	address, err := socketAddress(socket)
+	if err != nil {
+		return nil, err
+	}
+	return net.DialTimeout("tcp", address, networkDialTimeout)
+}
+
+//socketAddress returns the address of a host socket the device may connect to. Only TCP on the loopback interface is
+//allowed, other hosts or unix sockets would let anyone who can reach the REST api connect the device to them.
+func socketAddress(socket string) (string, error) {
+	parts := strings.SplitN(socket, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", fmt.Errorf("%w: %s", ErrInvalidSocket, socket)
+	}
+	switch parts[0] {
+	case "tcp":
+		if _, err := strconv.Atoi(parts[1]); err == nil {
+			return net.JoinHostPort("127.0.0.1", parts[1]), nil
+		}
+		host, _, err := net.SplitHostPort(parts[1])
+		if err != nil {
+			return "", fmt.Errorf("%w: %s", ErrInvalidSocket, socket)
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return "", fmt.Errorf("%w: %s is not on localhost", ErrSocketNotAllowed, socket)
+		}
+		return parts[1], nil
+	case "localfilesystem", "localabstract":
+		return "", fmt.Errorf("%w: %s, only tcp sockets on localhost are allowed", ErrSocketNotAllowed, socket)
+	}
+	return "", fmt.Errorf("%w: %s", ErrInvalidSocket, socket)
+}
@@ -0,0 +1,80 @@
+package adb_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/danielpaulus/go-adb/adb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwardsRelayToDeviceService(t *testing.T) {
+	device := startFakeDevice(t)
+	defer adb.SetKeyStore(nil)
+	device.services["localabstract:chrome_devtools_remote"] = echoService
+	forwards := adb.NewForwards(device.session)
+	defer forwards.Close()
+
+	forward, err := forwards.Add("tcp:0", "localabstract:chrome_devtools_remote")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, strings.HasPrefix(forward.Local, "tcp:"))
+	assert.NotEqual(t, "tcp:0", forward.Local)
+	address := "127.0.0.1:" + strings.TrimPrefix(forward.Local, "tcp:")
+
+	conn, err := net.Dial("tcp", address)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.Write([]byte("hello"))
+	assert.NoError(t, err)
+	reply := make([]byte, 5)
+	_, err = io.ReadFull(conn, reply)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(reply))
+	assert.Equal(t, []adb.Forward{{Local: forward.Local, Remote: "localabstract:chrome_devtools_remote", Connections: 1}}, forwards.List())
+
+	assert.NoError(t, forwards.Remove(forward.Local))
+	_, err = conn.Read(reply)
+	assert.Error(t, err)
+	assert.Equal(t, 0, len(forwards.List()))
+	_, err = net.Dial("tcp", address)
+	assert.Error(t, err)
+	assert.True(t, errors.Is(forwards.Remove(forward.Local), adb.ErrForwardNotFound))
+}
+
+func TestForwardsRejectInvalidSockets(t *testing.T) {
+	forwards := adb.NewForwards(adb.NewSession(0, "fake", func(adb.Packet) error { return adb.ErrDeviceOffline }))
+	for _, local := range []string{"9222", "tcp:", "tcp:abc", "udp:9222"} {
+		_, err := forwards.Add(local, "tcp:9222")
+		assert.True(t, errors.Is(err, adb.ErrInvalidSocket), local)
+	}
+	_, err := forwards.Add("tcp:0", "chrome_devtools_remote")
+	assert.True(t, errors.Is(err, adb.ErrInvalidSocket))
+}
+
+func TestForwardsRestrictFileSystemSockets(t *testing.T) {
+	forwards := adb.NewForwards(adb.NewSession(0, "fake", func(adb.Packet) error { return adb.ErrDeviceOffline }))
+	defer forwards.Close()
+	_, err := forwards.Add("localfilesystem:devtools", "tcp:9222")
+	assert.True(t, errors.Is(err, adb.ErrSocketNotAllowed))
+
+	dir := t.TempDir()
+	assert.NoError(t, adb.SetForwardSocketDir(dir))
+	defer adb.SetForwardSocketDir("")
+	_, err = forwards.Add("localfilesystem:devtools", "tcp:9222")
+	if assert.NoError(t, err) {
+		_, err = os.Stat(filepath.Join(dir, "devtools"))
+		assert.NoError(t, err)
+	}
+	for _, local := range []string{"localfilesystem:../devtools", "localfilesystem:" + filepath.Join(os.TempDir(), "devtools"), "localfilesystem:" + dir} {
+		_, err = forwards.Add(local, "tcp:9222")
+		assert.True(t, errors.Is(err, adb.ErrSocketNotAllowed), local)
+	}
+}
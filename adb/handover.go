@@ -0,0 +1,153 @@
+package adb
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+//BridgeHandover contains everything a new go-adb process needs to take over a bridge
+//from the previous go-adb process during a zero downtime upgrade.
+//The file descriptors are inherited by the new process through exec.
+type BridgeHandover struct {
+	Device DeviceInfo
+	Port   int
+	State  string
+	//ListenerFd is the TCP listener of a UsbTcpBridge that is online or a NetworkBridge, 0 if there is none
+	ListenerFd int `json:",omitempty"`
+	//Pid, StatusFd, OutputFd and ControlFd describe the running go-adb single process of a bridge
+	//started with --procperdevice, Pid is 0 if there is none
+	Pid       int `json:",omitempty"`
+	StatusFd  int `json:",omitempty"`
+	OutputFd  int `json:",omitempty"`
+	ControlFd int `json:",omitempty"`
+	Restarts  int `json:",omitempty"`
+	Crashes   int `json:",omitempty"`
+}
+
+//InheritableCopy duplicates f into a file descriptor that is not closed on exec.
+//All file descriptors created by go have FD_CLOEXEC set, dup() returns one without it.
+func InheritableCopy(f *os.File) (*os.File, error) {
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), f.Name()), nil
+}
+
+//Handover returns the state of the bridge and a copy of its TCP listener, if it is online, that survives exec.
+//The caller has to keep the returned files open until exec.
+//The bridge should be closed afterwards so the USB device is released for the new process.
+func (u *UsbTcpBridge) Handover() (BridgeHandover, []*os.File, error) {
+	handover := BridgeHandover{Device: u.device, Port: u.port, State: u.GetStateName()}
+	u.mux.Lock()
+	listener := u.tcpServer
+	u.mux.Unlock()
+	return handoverListener(handover, listener)
+}
+
+//handoverListener adds an inheritable copy of listener to handover, if there is one.
+func handoverListener(handover BridgeHandover, listener net.Listener) (BridgeHandover, []*os.File, error) {
+	if listener == nil {
+		return handover, nil, nil
+	}
+	tcpListener, ok := listener.(*net.TCPListener)
+	if !ok {
+		return handover, nil, errors.New("bridge is not listening on TCP")
+	}
+	listenerFile, err := tcpListener.File()
+	if err != nil {
+		return handover, nil, err
+	}
+	defer listenerFile.Close()
+	inherited, err := InheritableCopy(listenerFile)
+	if err != nil {
+		return handover, nil, err
+	}
+	handover.ListenerFd = int(inherited.Fd())
+	return handover, []*os.File{inherited}, nil
+}
+
+//NewUsbTcpBridgeFromHandover creates a notInitialized UsbTcpBridge that will accept connections
+//on the TCP listener it inherited from the previous go-adb process, so its port stays bound during the upgrade.
+func NewUsbTcpBridgeFromHandover(handover BridgeHandover) (*UsbTcpBridge, error) {
+	bridge := NewUsbTcpBridge(handover.Device, handover.Port)
+	listener, err := inheritedListener(handover)
+	bridge.inheritedTCP = listener
+	return bridge, err
+}
+
+//inheritedListener returns the TCP listener passed in handover or nil if there is none.
+func inheritedListener(handover BridgeHandover) (net.Listener, error) {
+	if handover.ListenerFd == 0 {
+		return nil, nil
+	}
+	listenerFile := os.NewFile(uintptr(handover.ListenerFd), "listener")
+	defer listenerFile.Close()
+	return net.FileListener(listenerFile)
+}
+
+//Handover returns the state of the bridge process and copies of its status, output and control pipes that survive exec.
+//Because exec keeps the pid, the new go-adb process is still the parent of the bridge process and can adopt it.
+//The caller has to keep the returned files open until exec.
+func (s *subProcessBridge) Handover() (BridgeHandover, []*os.File, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	_, state := GetState(s.currentState)
+	handover := BridgeHandover{Device: s.device, Port: s.port, State: state, Restarts: s.restarts, Crashes: s.crashes}
+	if s.child == nil {
+		return handover, nil, nil
+	}
+	status, err := InheritableCopy(s.child.status)
+	if err != nil {
+		return handover, nil, err
+	}
+	output, err := InheritableCopy(s.child.output)
+	if err != nil {
+		status.Close()
+		return handover, nil, err
+	}
+	files := []*os.File{status, output}
+	if s.child.control != nil {
+		control, err := InheritableCopy(s.child.control)
+		if err != nil {
+			status.Close()
+			output.Close()
+			return handover, nil, err
+		}
+		handover.ControlFd = int(control.Fd())
+		files = append(files, control)
+	}
+	handover.Pid = s.child.process.Pid
+	handover.StatusFd = int(status.Fd())
+	handover.OutputFd = int(output.Fd())
+	return handover, files, nil
+}
+
+//AdoptSubProcessBridge creates a subprocess bridge that, once started, takes over the bridge process
+//of the previous go-adb process described by handover instead of starting a new one.
+func AdoptSubProcessBridge(handover BridgeHandover, goadbPath string, limits ProcessLimits) (*subProcessBridge, error) {
+	bridge := NewSubProcessBridge(handover.Device, handover.Port, goadbPath, limits)
+	bridge.restarts = handover.Restarts
+	bridge.crashes = handover.Crashes
+	if state, ok := stateFromName(handover.State); ok {
+		bridge.currentState = state
+	}
+	if handover.Pid == 0 {
+		return bridge, nil
+	}
+	process, err := os.FindProcess(handover.Pid)
+	if err != nil {
+		return bridge, err
+	}
+	bridge.adopted = &childProcess{
+		process: process,
+		status:  os.NewFile(uintptr(handover.StatusFd), "status"),
+		output:  os.NewFile(uintptr(handover.OutputFd), "output"),
+	}
+	if handover.ControlFd != 0 {
+		bridge.adopted.control = os.NewFile(uintptr(handover.ControlFd), "control")
+	}
+	return bridge, nil
+}
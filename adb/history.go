@@ -0,0 +1,41 @@
+package adb
+
+import "time"
+
+const stateHistorySize = 100
+
+//StateTransition records one state change of a bridge together with the time it happened.
+//Transitions into the recovering state contain the recovery step that was taken.
+type StateTransition struct {
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	Time     time.Time `json:"time"`
+	Recovery string    `json:"recovery,omitempty"`
+}
+
+//StateHistory is a fixed size ring buffer keeping the most recent StateTransitions of a bridge.
+//Once it is full, the oldest transition is overwritten. It is safe for concurrent use.
+type StateHistory struct {
+	ring ring
+}
+
+//NewStateHistory creates a StateHistory that holds at most size transitions.
+func NewStateHistory(size int) *StateHistory {
+	return &StateHistory{ring: newRing(size)}
+}
+
+//Add appends a transition, overwriting the oldest one if the buffer is full.
+func (h *StateHistory) Add(transition StateTransition) {
+	h.ring.add(transition)
+}
+
+//Last returns up to n of the most recent transitions, oldest first.
+//If n is zero or negative, all stored transitions are returned.
+func (h *StateHistory) Last(n int) []StateTransition {
+	values := h.ring.last(n)
+	result := make([]StateTransition, len(values))
+	for i, value := range values {
+		result[i] = value.(StateTransition)
+	}
+	return result
+}
@@ -0,0 +1,41 @@
+package adb_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/danielpaulus/go-adb/adb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateHistory(t *testing.T) {
+	history := adb.NewStateHistory(3)
+	assert.Equal(t, 0, len(history.Last(0)))
+
+	states := []string{"detached", "connectedUSB", "online", "disconnected"}
+	from := "notInitialized"
+	for _, to := range states {
+		history.Add(adb.StateTransition{From: from, To: to, Time: time.Now()})
+		from = to
+	}
+
+	all := history.Last(0)
+	if assert.Equal(t, 3, len(all)) {
+		assert.Equal(t, "connectedUSB", all[0].To)
+		assert.Equal(t, "disconnected", all[2].To)
+	}
+	last := history.Last(1)
+	if assert.Equal(t, 1, len(last)) {
+		assert.Equal(t, "online", last[0].From)
+	}
+}
+
+func TestLogBuffer(t *testing.T) {
+	buffer := adb.NewLogBuffer(2)
+	buffer.Append("a")
+	assert.Equal(t, []string{"a"}, buffer.Lines(5))
+	buffer.Append("b")
+	buffer.Append("c")
+	assert.Equal(t, []string{"b", "c"}, buffer.Lines(0))
+	assert.Equal(t, []string{"c"}, buffer.Lines(1))
+}
@@ -0,0 +1,137 @@
+package adb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/google/gousb"
+)
+
+const (
+	//IdentityBySerial identifies devices by their USB serial number, a device keeps its bridge and port in every USB slot
+	IdentityBySerial = "serial"
+	//IdentityByPortPath identifies devices by the physical USB port they are plugged into, every slot keeps its port
+	//no matter which device is plugged in
+	IdentityByPortPath = "port"
+	//IdentityBySerialAndPortPath requires serial and port path to match, moving a device to another slot makes it a new device
+	IdentityBySerialAndPortPath = "both"
+)
+
+var identityMode = IdentityBySerial
+
+//SetIdentityMode configures how devices are told apart by the DeviceDetector and OpenDevice.
+//mode must be one of IdentityBySerial, IdentityByPortPath or IdentityBySerialAndPortPath.
+func SetIdentityMode(mode string) error {
+	switch mode {
+	case IdentityBySerial, IdentityByPortPath, IdentityBySerialAndPortPath:
+		identityMode = mode
+		return nil
+	default:
+		return fmt.Errorf("unknown identity mode '%s', use '%s', '%s' or '%s'", mode, IdentityBySerial, IdentityByPortPath, IdentityBySerialAndPortPath)
+	}
+}
+
+//GetIdentityMode returns the identity mode set with SetIdentityMode.
+func GetIdentityMode() string {
+	return identityMode
+}
+
+//Identity returns the key identifying this device according to the identity mode. If the port path
+//of a device is unknown, it is identified by serial only.
+func (d DeviceInfo) Identity() string {
+	path := d.PortPath()
+	if path == "" {
+		return d.SerialNumber
+	}
+	switch identityMode {
+	case IdentityByPortPath:
+		return path
+	case IdentityBySerialAndPortPath:
+		return d.SerialNumber + "@" + path
+	default:
+		return d.SerialNumber
+	}
+}
+
+//PortPath returns the physical location of the device as bus and the chain of hub ports, f.ex. 1-2.3
+//is port 3 of the hub on port 2 of the root hub of bus 1. It is empty if the location is unknown.
+func (d DeviceInfo) PortPath() string {
+	if len(d.Ports) == 0 {
+		return ""
+	}
+	ports := make([]string, len(d.Ports))
+	for i, port := range d.Ports {
+		ports[i] = strconv.Itoa(port)
+	}
+	return fmt.Sprintf("%d-%s", d.Bus, strings.Join(ports, "."))
+}
+
+//ParsePortPath is the inverse of DeviceInfo.PortPath, it returns the bus and the port chain of path.
+func ParsePortPath(path string) (int, []int, error) {
+	parts := strings.SplitN(path, "-", 2)
+	if len(parts) != 2 {
+		return 0, nil, fmt.Errorf("invalid USB port path '%s'", path)
+	}
+	bus, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid bus in USB port path '%s'", path)
+	}
+	chain := strings.Split(parts[1], ".")
+	ports := make([]int, len(chain))
+	for i, port := range chain {
+		ports[i], err = strconv.Atoi(port)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid port in USB port path '%s'", path)
+		}
+	}
+	return bus, ports, nil
+}
+
+//findSysfsPath returns the name of the sysfs directory of the device with the given bus number and address,
+//which is its port path.
+func findSysfsPath(sysfsRoot string, bus int, address int) (string, error) {
+	entries, err := ioutil.ReadDir(sysfsRoot)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		path := entry.Name()
+		//interfaces contain a colon, root hubs are named usbN and have no parent port
+		if strings.Contains(path, ":") || strings.HasPrefix(path, "usb") {
+			continue
+		}
+		entryBus, err := readSysfsInt(sysfsRoot, path, "busnum")
+		if err != nil || entryBus != bus {
+			continue
+		}
+		entryAddress, err := readSysfsInt(sysfsRoot, path, "devnum")
+		if err != nil || entryAddress != address {
+			continue
+		}
+		return path, nil
+	}
+	return "", fmt.Errorf("no USB device %d:%d in %s", bus, address, sysfsRoot)
+}
+
+//locate adds bus, address and port chain of usbDevice to device. The port chain stays empty if
+//it cannot be found in sysfs.
+func locate(device *DeviceInfo, usbDevice *gousb.Device) {
+	locateDesc(device, usbDevice.Desc)
+}
+
+//locateDesc is locate for a device that was not opened yet.
+func locateDesc(device *DeviceInfo, desc *gousb.DeviceDesc) {
+	device.Bus = desc.Bus
+	device.Address = desc.Address
+	path, err := findSysfsPath(sysfsUsbDevices, device.Bus, device.Address)
+	if err != nil {
+		return
+	}
+	_, ports, err := ParsePortPath(path)
+	if err != nil {
+		return
+	}
+	device.Ports = ports
+}
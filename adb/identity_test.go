@@ -0,0 +1,40 @@
+package adb_test
+
+import (
+	"testing"
+
+	"github.com/danielpaulus/go-adb/adb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPortPath(t *testing.T) {
+	device := adb.DeviceInfo{SerialNumber: "serial", Bus: 1, Ports: []int{2, 3}}
+	assert.Equal(t, "1-2.3", device.PortPath())
+	assert.Equal(t, "", adb.DeviceInfo{SerialNumber: "serial"}.PortPath())
+
+	bus, ports, err := adb.ParsePortPath("3-1.4.2")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 3, bus)
+		assert.Equal(t, []int{1, 4, 2}, ports)
+	}
+	_, _, err = adb.ParsePortPath("usb1")
+	assert.Error(t, err)
+	_, _, err = adb.ParsePortPath("1-2.x")
+	assert.Error(t, err)
+}
+
+func TestIdentity(t *testing.T) {
+	defer adb.SetIdentityMode(adb.IdentityBySerial)
+	device := adb.DeviceInfo{SerialNumber: "serial", Bus: 1, Ports: []int{2, 3}}
+	unknownPath := adb.DeviceInfo{SerialNumber: "other"}
+
+	assert.Equal(t, "serial", device.Identity())
+	assert.NoError(t, adb.SetIdentityMode(adb.IdentityByPortPath))
+	assert.Equal(t, "1-2.3", device.Identity())
+	assert.Equal(t, "other", unknownPath.Identity())
+	assert.NoError(t, adb.SetIdentityMode(adb.IdentityBySerialAndPortPath))
+	assert.Equal(t, "serial@1-2.3", device.Identity())
+
+	assert.Error(t, adb.SetIdentityMode("imei"))
+	assert.Equal(t, adb.IdentityBySerialAndPortPath, adb.GetIdentityMode())
+}
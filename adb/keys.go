@@ -0,0 +1,314 @@
+package adb
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	adbKeyBits     = 2048
+	adbKeyFile     = "adbkey"
+	adbPubKeyFile  = "adbkey.pub"
+	pairedFile     = "paired.json"
+	adbKeyComment  = "go-adb"
+	rsaModulusSize = adbKeyBits / 8
+)
+
+//PairedDevice is a device go-adb paired with using wireless debugging pairing.
+type PairedDevice struct {
+	//GUID is the name the device sent during pairing, it is the same as its mDNS instance name
+	GUID string
+	//Address is the host:port of the pairing service of the device
+	Address string
+	Paired  time.Time
+}
+
+//KeyStore holds the RSA key go-adb authenticates itself with to devices and the devices it paired with.
+//With a directory, the key is kept in the adbkey files adb uses and paired devices in paired.json,
+//without, everything is kept in memory and pairings are lost when go-adb exits.
+type KeyStore struct {
+	dir         string
+	key         *rsa.PrivateKey
+	certificate tls.Certificate
+	paired      []PairedDevice
+	mux         sync.Mutex
+}
+
+var keyStore *KeyStore
+var keyStoreMux sync.Mutex
+
+//SetKeyStore makes go-adb use store for pairing and TLS connections to devices.
+func SetKeyStore(store *KeyStore) {
+	keyStoreMux.Lock()
+	defer keyStoreMux.Unlock()
+	keyStore = store
+}
+
+//GetKeyStore returns the KeyStore set with SetKeyStore. Without one, a key is generated on first use and kept in memory.
+func GetKeyStore() (*KeyStore, error) {
+	keyStoreMux.Lock()
+	defer keyStoreMux.Unlock()
+	if keyStore != nil {
+		return keyStore, nil
+	}
+	log.Warn("no key directory configured, pairings are lost when go-adb exits")
+	store, err := OpenKeyStore("")
+	if err != nil {
+		return nil, err
+	}
+	keyStore = store
+	return keyStore, nil
+}
+
+//keyStoreDir returns the directory of the KeyStore set with SetKeyStore, empty if there is none or it is kept in memory.
+func keyStoreDir() string {
+	keyStoreMux.Lock()
+	defer keyStoreMux.Unlock()
+	if keyStore == nil {
+		return ""
+	}
+	return keyStore.dir
+}
+
+//pairedKeyStore returns the KeyStore if go-adb paired with the device at address. It does not create a KeyStore.
+func pairedKeyStore(address string) (*KeyStore, bool) {
+	keyStoreMux.Lock()
+	store := keyStore
+	keyStoreMux.Unlock()
+	if store == nil || !store.PairedWith(address) {
+		return nil, false
+	}
+	return store, true
+}
+
+//OpenKeyStore loads the key and paired devices from dir, a key is generated and saved if there is none.
+//If dir is empty, a new key is generated and nothing is saved.
+func OpenKeyStore(dir string) (*KeyStore, error) {
+	store := &KeyStore{dir: dir, paired: make([]PairedDevice, 0)}
+	key, err := store.loadKey()
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := selfSignedCertificate(key)
+	if err != nil {
+		return nil, err
+	}
+	store.key = key
+	store.certificate = certificate
+	if dir == "" {
+		return store, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, pairedFile))
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &store.paired)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing %s: %w", pairedFile, err)
+	}
+	return store, nil
+}
+
+func (k *KeyStore) loadKey() (*rsa.PrivateKey, error) {
+	if k.dir == "" {
+		return rsa.GenerateKey(rand.Reader, adbKeyBits)
+	}
+	path := filepath.Join(k.dir, adbKeyFile)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return k.generateKey()
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s contains no PEM encoded key", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing %s: %w", path, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an RSA key", path)
+	}
+	return key, nil
+}
+
+//generateKey creates adbkey and adbkey.pub in the format adb uses, so the key can be shared with adb.
+func (k *KeyStore) generateKey() (*rsa.PrivateKey, error) {
+	log.Infof("generating adb key in %s", k.dir)
+	key, err := rsa.GenerateKey(rand.Reader, adbKeyBits)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(k.dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(filepath.Join(k.dir, adbKeyFile), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: encoded}), 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(filepath.Join(k.dir, adbPubKeyFile), []byte(adbPublicKey(&key.PublicKey)+"\n"), 0644)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+//selfSignedCertificate creates the certificate go-adb presents in TLS connections, devices only check its public key.
+func selfSignedCertificate(key *rsa.PrivateKey) (tls.Certificate, error) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: adbKeyComment},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+//adbPublicKey encodes key like adbkey.pub, which is the format devices expect during pairing: the base64 encoded
+//mincrypt RSAPublicKey struct with modulus size in words, -1/n[0] mod 2^32, the modulus, R^2 mod n and the exponent,
+//all little endian, followed by a comment.
+func adbPublicKey(key *rsa.PublicKey) string {
+	encoded := make([]byte, 0, 8+2*rsaModulusSize+4)
+	encoded = appendUint32(encoded, rsaModulusSize/4)
+	word := new(big.Int).Lsh(big.NewInt(1), 32)
+	n0inv := new(big.Int).ModInverse(new(big.Int).Mod(key.N, word), word)
+	n0inv.Sub(word, n0inv)
+	encoded = appendUint32(encoded, uint32(n0inv.Uint64()))
+	encoded = append(encoded, reverse(key.N.FillBytes(make([]byte, rsaModulusSize)))...)
+	rr := new(big.Int).Exp(big.NewInt(2), big.NewInt(2*adbKeyBits), key.N)
+	encoded = append(encoded, reverse(rr.FillBytes(make([]byte, rsaModulusSize)))...)
+	encoded = appendUint32(encoded, uint32(key.E))
+	return base64.StdEncoding.EncodeToString(encoded) + " " + adbKeyComment
+}
+
+func appendUint32(data []byte, value uint32) []byte {
+	encoded := make([]byte, 4)
+	binary.LittleEndian.PutUint32(encoded, value)
+	return append(data, encoded...)
+}
+
+func reverse(data []byte) []byte {
+	for i, j := 0, len(data)-1; i < j; i, j = i+1, j-1 {
+		data[i], data[j] = data[j], data[i]
+	}
+	return data
+}
+
+//Certificate returns the self-signed certificate of the key.
+func (k *KeyStore) Certificate() tls.Certificate {
+	return k.certificate
+}
+
+//PublicKey returns the public key in the adbkey.pub format.
+func (k *KeyStore) PublicKey() string {
+	return adbPublicKey(&k.key.PublicKey)
+}
+
+//sign signs the token a device sends in an Auth packet, adb signs it like a SHA-1 digest.
+func (k *KeyStore) sign(token []byte) ([]byte, error) {
+	return rsa.SignPKCS1v15(nil, k.key, crypto.SHA1, token)
+}
+
+//TLSConfig returns the configuration go-adb uses for TLS connections to devices. Devices use self-signed certificates
+//and adbd does not present the certificate of its pairing service, so like adb, go-adb does not verify them.
+//Pairing only makes the device trust the key of go-adb, it does not authenticate the device to go-adb.
+func (k *KeyStore) TLSConfig() *tls.Config {
+	return &tls.Config{
+		Certificates:       []tls.Certificate{k.certificate},
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS13,
+	}
+}
+
+//AddPaired records device, replacing an earlier pairing with the same GUID.
+func (k *KeyStore) AddPaired(device PairedDevice) error {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	paired := make([]PairedDevice, 0, len(k.paired)+1)
+	for _, other := range k.paired {
+		if other.GUID != device.GUID {
+			paired = append(paired, other)
+		}
+	}
+	k.paired = append(paired, device)
+	if k.dir == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(k.paired, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(k.dir, pairedFile)
+	err = ioutil.WriteFile(path+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+	//device processes running as another user than go-adb read the pairings too, see ProcessLimits.Chown
+	if info, err := os.Stat(k.dir); err == nil {
+		if owner, ok := info.Sys().(*syscall.Stat_t); ok && int(owner.Uid) != os.Getuid() {
+			os.Chown(path+".tmp", int(owner.Uid), int(owner.Gid))
+		}
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+//Paired returns all paired devices.
+func (k *KeyStore) Paired() []PairedDevice {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	return append([]PairedDevice{}, k.paired...)
+}
+
+//PairedWith is true if a device on the host of address was paired. Devices use another port for pairing
+//than for adb, so only the host is compared.
+func (k *KeyStore) PairedWith(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	for _, device := range k.Paired() {
+		pairedHost, _, err := net.SplitHostPort(device.Address)
+		if err == nil && pairedHost == host {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package adb
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//ProcessLimits restrict the resources and privileges of bridge processes started with --procperdevice.
+//Zero values mean no limit.
+type ProcessLimits struct {
+	//MaxMemory is applied as RLIMIT_AS in bytes. Go reserves a lot of virtual memory,
+	//so prefer CgroupMemoryMax if cgroups are available.
+	MaxMemory uint64
+	//MaxFiles is applied as RLIMIT_NOFILE
+	MaxFiles uint64
+	//Nice is the scheduling priority of the process, from -20 to 19
+	Nice int
+	//CgroupParent is a directory in the cgroup v2 hierarchy, f.ex. /sys/fs/cgroup/go-adb.slice
+	//every device process is moved into its own cgroup below it.
+	CgroupParent string
+	//CgroupMemoryMax is written to memory.max of the device cgroup in bytes
+	CgroupMemoryMax uint64
+	//Credential is the uid and gid the process runs with, nil keeps the privileges of go-adb
+	Credential *syscall.Credential
+}
+
+//Chown gives dir and everything in it to Credential, so device processes running as it can write there.
+//It does nothing if the processes keep the privileges of go-adb.
+func (l ProcessLimits) Chown(dir string) error {
+	if l.Credential == nil {
+		return nil
+	}
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, int(l.Credential.Uid), int(l.Credential.Gid))
+	})
+}
+
+//childArgs returns the go-adb single arguments that make the child apply the limits to itself.
+//rlimits and nice values are inherited, so the child applies them before it starts using the device.
+func (l ProcessLimits) childArgs() []string {
+	args := make([]string, 0)
+	if l.MaxMemory > 0 {
+		args = append(args, fmt.Sprintf("--maxmem=%d", l.MaxMemory))
+	}
+	if l.MaxFiles > 0 {
+		args = append(args, fmt.Sprintf("--maxfiles=%d", l.MaxFiles))
+	}
+	if l.Nice != 0 {
+		args = append(args, fmt.Sprintf("--nice=%d", l.Nice))
+	}
+	return args
+}
+
+//WaitForStart blocks until the parent go-adb process closed the start pipe fd, which it does once it moved this process
+//into its cgroup. go-adb single processes call it before they use the device, so they run limited from the start.
+func WaitForStart(fd int) error {
+	startPipe := os.NewFile(uintptr(fd), "start")
+	defer startPipe.Close()
+	_, err := io.Copy(ioutil.Discard, startPipe)
+	return err
+}
+
+//ApplyLimits applies the rlimits and the nice value of l to the current process.
+//It is called by go-adb single processes on startup.
+func ApplyLimits(l ProcessLimits) error {
+	if l.MaxMemory > 0 {
+		err := syscall.Setrlimit(syscall.RLIMIT_AS, &syscall.Rlimit{Cur: l.MaxMemory, Max: l.MaxMemory})
+		if err != nil {
+			return fmt.Errorf("failed setting memory limit: %w", err)
+		}
+	}
+	if l.MaxFiles > 0 {
+		err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &syscall.Rlimit{Cur: l.MaxFiles, Max: l.MaxFiles})
+		if err != nil {
+			return fmt.Errorf("failed setting file limit: %w", err)
+		}
+	}
+	if l.Nice != 0 {
+		return setNice(l.Nice)
+	}
+	return nil
+}
+
+//setNice changes the nice value of all threads of this process. On Linux, setpriority
+//only changes the calling thread and the go runtime already started a few threads.
+func setNice(nice int) error {
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return syscall.Setpriority(syscall.PRIO_PROCESS, 0, nice)
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		err = syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice)
+		if err != nil {
+			return fmt.Errorf("failed setting nice value: %w", err)
+		}
+	}
+	return nil
+}
+
+//deviceCgroup returns the cgroup directory for the bridge process on the given port.
+func (l ProcessLimits) deviceCgroup(port int) string {
+	return filepath.Join(l.CgroupParent, fmt.Sprintf("go-adb-%d", port))
+}
+
+//joinCgroup creates the device cgroup if needed, applies the memory limit and moves pid into it.
+func (l ProcessLimits) joinCgroup(port int, pid int) error {
+	if l.CgroupParent == "" {
+		return nil
+	}
+	dir := l.deviceCgroup(port)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	if l.CgroupMemoryMax > 0 {
+		//the memory controller has to be enabled for children of the parent cgroup, it might already be
+		err := ioutil.WriteFile(filepath.Join(l.CgroupParent, "cgroup.subtree_control"), []byte("+memory"), 0644)
+		if err != nil {
+			log.Debugf("could not enable memory controller in %s: %v", l.CgroupParent, err)
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, "memory.max"), []byte(strconv.FormatUint(l.CgroupMemoryMax, 10)), 0644)
+		if err != nil {
+			return fmt.Errorf("failed setting memory.max of %s: %w", dir, err)
+		}
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+}
+
+//removeCgroup deletes the device cgroup, which only works once the process has exited.
+func (l ProcessLimits) removeCgroup(port int) {
+	if l.CgroupParent == "" {
+		return
+	}
+	err := os.Remove(l.deviceCgroup(port))
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnf("failed removing cgroup: %v", err)
+	}
+}
+
+//resourceUsage returns the CPU time used by this process in seconds and its current resident memory in bytes.
+func resourceUsage() (float64, int64) {
+	var usage syscall.Rusage
+	err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+	if err != nil {
+		return 0, 0
+	}
+	cpu := float64(usage.Utime.Nano()+usage.Stime.Nano()) / 1e9
+	//maxrss is the peak value in KB, statm has the current number of resident pages
+	rss := int64(usage.Maxrss) * 1024
+	statm, err := ioutil.ReadFile("/proc/self/statm")
+	if err == nil {
+		fields := strings.Fields(string(statm))
+		if len(fields) > 1 {
+			pages, err := strconv.ParseInt(fields[1], 10, 64)
+			if err == nil {
+				rss = pages * int64(os.Getpagesize())
+			}
+		}
+	}
+	return cpu, rss
+}
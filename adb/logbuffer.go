@@ -0,0 +1,103 @@
+package adb
+
+import (
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const logBufferSize = 500
+
+//LogBuffer is a fixed size ring buffer keeping the most recent log lines of a bridge in memory.
+//It is safe for concurrent use.
+type LogBuffer struct {
+	ring ring
+}
+
+//NewLogBuffer creates a LogBuffer that holds at most size lines.
+func NewLogBuffer(size int) *LogBuffer {
+	return &LogBuffer{ring: newRing(size)}
+}
+
+//Append adds a line, overwriting the oldest one if the buffer is full.
+func (l *LogBuffer) Append(line string) {
+	l.ring.add(line)
+}
+
+//Lines returns up to n of the most recent lines, oldest first.
+//If n is zero or negative, all stored lines are returned.
+func (l *LogBuffer) Lines(n int) []string {
+	values := l.ring.last(n)
+	result := make([]string, len(values))
+	for i, value := range values {
+		result[i] = value.(string)
+	}
+	return result
+}
+
+//bridgeLogHook is a logrus hook that copies every log entry carrying a "port" field
+//into the deviceLog of the bridge running on that port.
+type bridgeLogHook struct {
+	logs map[int]*deviceLog
+	mux  sync.RWMutex
+}
+
+var logHook = &bridgeLogHook{logs: make(map[int]*deviceLog)}
+var installLogHook sync.Once
+
+//deviceLogForPort returns the deviceLog for the bridge on the given port, creating it
+//if needed. Bridges are identified by port because serials are not guaranteed to be unique.
+//Every bridge has to call releaseDeviceLog once it is closed.
+func deviceLogForPort(port int, serial string) *deviceLog {
+	installLogHook.Do(func() { log.AddHook(logHook) })
+	logHook.mux.Lock()
+	defer logHook.mux.Unlock()
+	deviceLog, ok := logHook.logs[port]
+	if !ok {
+		deviceLog = newDeviceLog(port, serial)
+		logHook.logs[port] = deviceLog
+	}
+	deviceLog.bridges++
+	return deviceLog
+}
+
+//releaseDeviceLog is called by bridges when they are closed. Once no bridge uses the deviceLog of port anymore,
+//it stops receiving log lines and its file is closed. A replacing bridge on the same port can still share it.
+func releaseDeviceLog(port int) {
+	logHook.mux.Lock()
+	defer logHook.mux.Unlock()
+	deviceLog, ok := logHook.logs[port]
+	if !ok {
+		return
+	}
+	deviceLog.bridges--
+	if deviceLog.bridges > 0 {
+		return
+	}
+	delete(logHook.logs, port)
+	deviceLog.close()
+}
+
+func (h *bridgeLogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *bridgeLogHook) Fire(entry *log.Entry) error {
+	port, ok := entry.Data["port"].(int)
+	if !ok {
+		return nil
+	}
+	h.mux.RLock()
+	deviceLog, ok := h.logs[port]
+	h.mux.RUnlock()
+	if !ok {
+		return nil
+	}
+	line, err := entry.String()
+	if err != nil {
+		return err
+	}
+	deviceLog.writeLine(strings.TrimSuffix(line, "\n"))
+	return nil
+}
@@ -0,0 +1,222 @@
+package adb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	//logcatRetryDelay is how long Logcat waits before reopening a stream the device closed
+	logcatRetryDelay = 5 * time.Second
+	//logcatOfflineDelay is how long Logcat waits for the device to come online before it tries again itself
+	logcatOfflineDelay = time.Minute
+	//logEntryHeaderV1 is the size of the logger_entry header of old devices, which set hdr_size to 0
+	logEntryHeaderV1 = 20
+	//logEntryMaxHeader is far bigger than the headers of all known versions
+	logEntryMaxHeader = 100
+)
+
+//logPriorities are the letters logcat prints for the priorities of log entries, 0 and 1 are unknown and default
+var logPriorities = "??VDIWEFS"
+
+//LogEntry is one entry of the log of the device.
+type LogEntry struct {
+	Time     time.Time `json:"time"`
+	Pid      int32     `json:"pid"`
+	Tid      uint32    `json:"tid"`
+	Priority string    `json:"priority"`
+	Tag      string    `json:"tag"`
+	Message  string    `json:"message"`
+}
+
+//readLogEntry reads one entry in the binary format of logcat -B, which is a logger_entry header
+//followed by the priority, the tag and the message.
+func readLogEntry(reader io.Reader) (LogEntry, error) {
+	header := make([]byte, logEntryMaxHeader)
+	_, err := io.ReadFull(reader, header[:4])
+	if err != nil {
+		return LogEntry{}, err
+	}
+	length := int(binary.LittleEndian.Uint16(header))
+	headerSize := int(binary.LittleEndian.Uint16(header[2:]))
+	if headerSize == 0 {
+		headerSize = logEntryHeaderV1
+	}
+	if headerSize < logEntryHeaderV1 || headerSize > logEntryMaxHeader {
+		return LogEntry{}, fmt.Errorf("invalid log entry header size %d", headerSize)
+	}
+	_, err = io.ReadFull(reader, header[4:headerSize])
+	if err != nil {
+		return LogEntry{}, err
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return LogEntry{}, err
+	}
+	entry := LogEntry{
+		Pid:  int32(binary.LittleEndian.Uint32(header[4:])),
+		Tid:  binary.LittleEndian.Uint32(header[8:]),
+		Time: time.Unix(int64(binary.LittleEndian.Uint32(header[12:])), int64(binary.LittleEndian.Uint32(header[16:]))).UTC(),
+	}
+	if len(payload) == 0 {
+		return entry, nil
+	}
+	priority := int(payload[0])
+	if priority >= len(logPriorities) {
+		priority = 0
+	}
+	entry.Priority = logPriorities[priority : priority+1]
+	parts := bytes.SplitN(payload[1:], []byte{0}, 2)
+	entry.Tag = string(parts[0])
+	if len(parts) == 2 {
+		entry.Message = string(bytes.TrimRight(parts[1], "\x00\n"))
+	}
+	return entry, nil
+}
+
+//Logcat keeps a logcat -B stream of the device open and writes its entries to a LogcatArchive. The stream is closed
+//when the adb connection of the device is reset, f.ex. by a client or a reboot, Logcat opens it again afterwards and
+//continues after the last archived entry.
+type Logcat struct {
+	session *Session
+	archive *LogcatArchive
+	wake    chan struct{}
+	done    chan struct{}
+	stream  *Stream
+	closed  bool
+	mux     sync.Mutex
+}
+
+//StartLogcat starts archiving the log of the device of session to archive.
+func StartLogcat(session *Session, archive *LogcatArchive) *Logcat {
+	logcat := &Logcat{session: session, archive: archive, wake: make(chan struct{}, 1), done: make(chan struct{})}
+	//a client connecting resets the connection and closes the stream, it is opened again once the device answered the client
+	session.whenOnline(logcat.Connect)
+	go logcat.run()
+	return logcat
+}
+
+//Archive returns the archive the entries are written to.
+func (l *Logcat) Archive() *LogcatArchive {
+	return l.archive
+}
+
+//Connect tells Logcat that the device came online, so it opens its stream right away.
+func (l *Logcat) Connect() {
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+//Close stops streaming and closes the archive.
+func (l *Logcat) Close() error {
+	l.mux.Lock()
+	if l.closed {
+		l.mux.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.done)
+	stream := l.stream
+	l.mux.Unlock()
+	if stream != nil {
+		stream.Close()
+	}
+	return l.archive.Close()
+}
+
+func (l *Logcat) run() {
+	for {
+		var retry <-chan time.Time
+		opened, err := l.follow()
+		switch {
+		case errors.Is(err, ErrKeyNotAccepted):
+			//asking again would show the USB debugging prompt over and over, wait until a client brings the device online
+			l.session.log().Warnf("logcat waits for a client to connect: %v", err)
+		case !opened:
+			//the device is offline or did not accept go-adb yet, it is not asked again until it comes online
+			retry = time.After(logcatOfflineDelay)
+			l.session.log().Debugf("logcat waits for the device: %v", err)
+		case err != nil:
+			retry = time.After(logcatRetryDelay)
+			l.session.log().Warnf("logcat stopped: %v", err)
+		default:
+			retry = time.After(logcatRetryDelay)
+		}
+		select {
+		case <-l.done:
+			return
+		case <-l.wake:
+		case <-retry:
+		}
+	}
+}
+
+//newestEntry returns the time of the newest entry in the log of the device, the zero time if it is empty or unknown.
+func (l *Logcat) newestEntry() time.Time {
+	if l.archive.Last().IsZero() {
+		//the whole log is read anyway
+		return time.Time{}
+	}
+	stream, err := l.session.Open("exec:logcat -B -d -t 1")
+	if err != nil {
+		return time.Time{}
+	}
+	defer stream.Close()
+	reader := bufio.NewReaderSize(stream, sessionMaxData)
+	newest := time.Time{}
+	for {
+		//-t counts the entries of every log buffer on some versions
+		entry, err := readLogEntry(reader)
+		if err != nil {
+			return newest
+		}
+		if entry.Time.After(newest) {
+			newest = entry.Time
+		}
+	}
+}
+
+//follow archives the entries of one logcat stream until it is closed, it returns false if the stream was not opened.
+func (l *Logcat) follow() (bool, error) {
+	command := "exec:logcat -B"
+	if since := l.archive.Resume(l.newestEntry()); !since.IsZero() {
+		command += fmt.Sprintf(" -T %d.%09d", since.Unix(), since.Nanosecond())
+	}
+	stream, err := l.session.Open(command)
+	if err != nil {
+		return false, err
+	}
+	l.mux.Lock()
+	if l.closed {
+		l.mux.Unlock()
+		stream.Close()
+		return true, nil
+	}
+	l.stream = stream
+	l.mux.Unlock()
+	defer stream.Close()
+	l.session.log().Info("archiving logcat")
+	reader := bufio.NewReaderSize(stream, sessionMaxData)
+	for {
+		entry, err := readLogEntry(reader)
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return true, err
+		}
+		err = l.archive.Append(entry)
+		if err != nil {
+			return true, err
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package adb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	//logcatArchiveBackups is the number of rotated files of a LogcatArchive, the size of each is the maximum size
+	//of the archive divided by the number of files
+	logcatArchiveBackups = 4
+	//logcatFollowBuffer is how many entries a follower may fall behind before it is dropped
+	logcatFollowBuffer = 1000
+)
+
+//LogFilter selects log entries, zero values match everything.
+type LogFilter struct {
+	//Since matches entries logged after it
+	Since time.Time
+	//Tag matches entries with exactly this tag
+	Tag string
+}
+
+//Matches is true if entry is selected by the filter.
+func (f LogFilter) Matches(entry LogEntry) bool {
+	if !f.Since.IsZero() && !entry.Time.After(f.Since) {
+		return false
+	}
+	return f.Tag == "" || entry.Tag == f.Tag
+}
+
+//LogcatArchive keeps the log entries of one device as JSON lines in a file, rotated to file.1, file.2.. so all files
+//together stay below the maximum size. Entries are kept across restarts of go-adb, the oldest are removed first.
+type LogcatArchive struct {
+	file *rotatingFile
+	last time.Time
+	//atLast counts the archived entries logged at last, several entries can have the same time
+	atLast map[logEntryKey]int
+	//overlap counts the entries at last a resumed stream sends again, see Resume
+	overlap   map[logEntryKey]int
+	followers map[chan LogEntry]struct{}
+	mux       sync.Mutex
+}
+
+//logEntryKey tells apart the entries logged at the same time.
+type logEntryKey struct {
+	time    int64
+	pid     int32
+	tid     uint32
+	tag     string
+	message string
+}
+
+func (e LogEntry) key() logEntryKey {
+	return logEntryKey{time: e.Time.UnixNano(), pid: e.Pid, tid: e.Tid, tag: e.Tag, message: e.Message}
+}
+
+//OpenLogcatArchive opens the archive of the device called name in dir, f.ex. its identity, and appends to the entries
+//archived before.
+func OpenLogcatArchive(dir string, name string, maxSize int64) (*LogcatArchive, error) {
+	path := filepath.Join(dir, safeFileName(name)+".logcat")
+	file, err := openRotatingFile(path, maxSize/(logcatArchiveBackups+1), logcatArchiveBackups)
+	if err != nil {
+		return nil, err
+	}
+	archive := &LogcatArchive{file: file, atLast: map[logEntryKey]int{}, followers: map[chan LogEntry]struct{}{}}
+	for _, path := range archive.paths() {
+		for _, entry := range lastLogEntries(path) {
+			archive.track(entry)
+		}
+	}
+	return archive, nil
+}
+
+//paths returns the files of the archive, oldest first.
+func (a *LogcatArchive) paths() []string {
+	paths := make([]string, 0, logcatArchiveBackups+1)
+	for i := logcatArchiveBackups; i > 0; i-- {
+		paths = append(paths, fmt.Sprintf("%s.%d", a.file.path, i))
+	}
+	return append(paths, a.file.path)
+}
+
+//lastLogEntries returns the last complete entry of the file in path and the entries before it logged at the same time.
+func lastLogEntries(path string) []LogEntry {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil
+	}
+	//entries are short, the last one is in the last 64KB
+	offset := info.Size() - 64*1024
+	if offset < 0 {
+		offset = 0
+	}
+	data := make([]byte, info.Size()-offset)
+	_, err = file.ReadAt(data, offset)
+	if err != nil {
+		return nil
+	}
+	lines := bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n"))
+	entries := make([]LogEntry, 0, 1)
+	for i := len(lines) - 1; i >= 0; i-- {
+		var entry LogEntry
+		if json.Unmarshal(lines[i], &entry) != nil || (len(entries) > 0 && !entry.Time.Equal(entries[0].Time)) {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+//Resume returns the time a logcat stream continuing the archive starts at, the zero time if the whole log of the device
+//has to be read. The entries at that time already archived are dropped when the stream sends them again. newest is the
+//time of the newest entry the device has, if it is older than the archive the clock of the device went back, f.ex.
+//after a reboot, and its entries would be skipped, so the archive continues with the whole log of the device instead.
+func (a *LogcatArchive) Resume(newest time.Time) time.Time {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if !newest.IsZero() && newest.Before(a.last) {
+		a.last = time.Time{}
+		a.atLast = map[logEntryKey]int{}
+	}
+	a.overlap = make(map[logEntryKey]int, len(a.atLast))
+	for key, count := range a.atLast {
+		a.overlap[key] = count
+	}
+	return a.last
+}
+
+//Append archives entry and passes it to the followers. After Resume, the entries already archived are dropped
+//until the stream is past the time it continued at.
+func (a *LogcatArchive) Append(entry LogEntry) error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if len(a.overlap) > 0 {
+		key := entry.key()
+		if a.overlap[key] > 0 && entry.Time.Equal(a.last) {
+			a.overlap[key]--
+			return nil
+		}
+		if entry.Time.After(a.last) {
+			a.overlap = nil
+		}
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	err = a.file.writeLine(string(line))
+	if err != nil {
+		return err
+	}
+	a.track(entry)
+	for follower := range a.followers {
+		select {
+		case follower <- entry:
+		default:
+			//the follower fell behind, closing its channel ends it
+			delete(a.followers, follower)
+			close(follower)
+		}
+	}
+	return nil
+}
+
+//track remembers entry as archived, a stream continues after the newest archived entry. It must be called with mux locked.
+func (a *LogcatArchive) track(entry LogEntry) {
+	if entry.Time.After(a.last) {
+		a.last = entry.Time
+		a.atLast = map[logEntryKey]int{}
+	}
+	if entry.Time.Equal(a.last) {
+		a.atLast[entry.key()]++
+	}
+}
+
+//Last returns the time of the newest archived entry, the zero time if the archive is empty.
+func (a *LogcatArchive) Last() time.Time {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return a.last
+}
+
+//Read passes the archived entries matching filter to f, oldest first, until f returns an error.
+func (a *LogcatArchive) Read(filter LogFilter, f func(LogEntry) error) error {
+	a.mux.Lock()
+	files, reader := a.snapshot()
+	a.mux.Unlock()
+	defer closeAll(files)
+	return readEntries(reader, filter, f)
+}
+
+//ReadAndFollow passes the archived entries matching filter to f like Read and returns a channel receiving every entry
+//archived after them, like Follow. No entry is passed to both.
+func (a *LogcatArchive) ReadAndFollow(filter LogFilter, f func(LogEntry) error) (<-chan LogEntry, func(), error) {
+	a.mux.Lock()
+	files, reader := a.snapshot()
+	entries, stop := a.follow()
+	a.mux.Unlock()
+	defer closeAll(files)
+	err := readEntries(reader, filter, f)
+	if err != nil {
+		stop()
+		return nil, nil, err
+	}
+	return entries, stop, nil
+}
+
+//snapshot opens the files of the archive and returns a reader of the entries archived so far, entries appended while
+//reading are left to followers. It must be called with mux locked.
+func (a *LogcatArchive) snapshot() ([]*os.File, io.Reader) {
+	files := make([]*os.File, 0, logcatArchiveBackups+1)
+	readers := make([]io.Reader, 0, logcatArchiveBackups+1)
+	for _, path := range a.paths() {
+		file, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		files = append(files, file)
+		info, err := file.Stat()
+		if err != nil {
+			continue
+		}
+		readers = append(readers, io.LimitReader(file, info.Size()))
+	}
+	return files, io.MultiReader(readers...)
+}
+
+func closeAll(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+//readEntries passes the JSON lines of reader matching filter to f until f returns an error.
+func readEntries(reader io.Reader, filter LogFilter, f func(LogEntry) error) error {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), sessionMaxData)
+	for scanner.Scan() {
+		var entry LogEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil || !filter.Matches(entry) {
+			continue
+		}
+		err := f(entry)
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+//Follow returns a channel receiving every entry archived from now on and a function to stop following.
+//The channel is closed if the follower falls behind by too many entries or the archive is closed.
+func (a *LogcatArchive) Follow() (<-chan LogEntry, func()) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return a.follow()
+}
+
+//follow adds a follower, it must be called with mux locked.
+func (a *LogcatArchive) follow() (<-chan LogEntry, func()) {
+	follower := make(chan LogEntry, logcatFollowBuffer)
+	a.followers[follower] = struct{}{}
+	return follower, func() {
+		a.mux.Lock()
+		defer a.mux.Unlock()
+		if _, ok := a.followers[follower]; ok {
+			delete(a.followers, follower)
+			close(follower)
+		}
+	}
+}
+
+//Close closes the archive file and ends all followers.
+func (a *LogcatArchive) Close() error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	for follower := range a.followers {
+		close(follower)
+	}
+	a.followers = map[chan LogEntry]struct{}{}
+	return a.file.close()
+}
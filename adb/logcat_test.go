@@ -0,0 +1,186 @@
+package adb_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/danielpaulus/go-adb/adb"
+	"github.com/stretchr/testify/assert"
+)
+
+//logEntry encodes an entry like logcat -B with the 28 byte logger_entry header of current devices.
+func logEntry(when time.Time, priority byte, tag string, message string) []byte {
+	payload := append([]byte{priority}, []byte(tag+"\x00"+message+"\x00")...)
+	header := make([]byte, 28)
+	binary.LittleEndian.PutUint16(header, uint16(len(payload)))
+	binary.LittleEndian.PutUint16(header[2:], 28)
+	binary.LittleEndian.PutUint32(header[4:], 1234)
+	binary.LittleEndian.PutUint32(header[8:], 1240)
+	binary.LittleEndian.PutUint32(header[12:], uint32(when.Unix()))
+	binary.LittleEndian.PutUint32(header[16:], uint32(when.Nanosecond()))
+	return append(header, payload...)
+}
+
+func logcatService(entries ...[]byte) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		for _, entry := range entries {
+			conn.Write(entry)
+		}
+		//logcat keeps following until go-adb closes the stream
+		io.Copy(ioutil.Discard, conn)
+		conn.Close()
+	}
+}
+
+func readArchive(archive *adb.LogcatArchive, filter adb.LogFilter) []adb.LogEntry {
+	entries := make([]adb.LogEntry, 0)
+	archive.Read(filter, func(entry adb.LogEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries
+}
+
+func TestLogcatArchivesAcrossReboots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logcat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	device := startFakeDevice(t)
+	defer adb.SetKeyStore(nil)
+	first := time.Date(2024, 5, 1, 10, 0, 0, 100, time.UTC)
+	second := first.Add(time.Second)
+	third := second.Add(time.Second)
+	device.services["exec:logcat -B"] = logcatService(logEntry(first, 4, "ActivityManager", "Start proc\n"), logEntry(second, 6, "AndroidRuntime", "FATAL EXCEPTION"))
+	device.services["exec:logcat -B -d -t 1"] = func(conn net.Conn) {
+		conn.Write(logEntry(third, 3, "ActivityManager", "Boot completed"))
+		conn.Close()
+	}
+	device.services[fmt.Sprintf("exec:logcat -B -T %d.%09d", second.Unix(), second.Nanosecond())] =
+		logcatService(logEntry(second, 6, "AndroidRuntime", "FATAL EXCEPTION"), logEntry(third, 3, "ActivityManager", "Boot completed"))
+
+	archive, err := adb.OpenLogcatArchive(dir, "1-7", 1024*1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	logcat := adb.StartLogcat(device.session, archive)
+	assert.Eventually(t, func() bool { return archive.Last().Equal(second) }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []adb.LogEntry{
+		{Time: first, Pid: 1234, Tid: 1240, Priority: "I", Tag: "ActivityManager", Message: "Start proc"},
+		{Time: second, Pid: 1234, Tid: 1240, Priority: "E", Tag: "AndroidRuntime", Message: "FATAL EXCEPTION"},
+	}, readArchive(archive, adb.LogFilter{}))
+	assert.Equal(t, 1, len(readArchive(archive, adb.LogFilter{Tag: "AndroidRuntime"})))
+
+	entries, stop := archive.Follow()
+	defer stop()
+	device.reboot()
+	logcat.Connect()
+	select {
+	case entry := <-entries:
+		assert.Equal(t, "Boot completed", entry.Message)
+	case <-time.After(time.Second):
+		t.Error("logcat was not continued after the reboot")
+	}
+	assert.Equal(t, 3, len(readArchive(archive, adb.LogFilter{})))
+	assert.Equal(t, []string{"Boot completed"}, messages(readArchive(archive, adb.LogFilter{Since: second})))
+	assert.NoError(t, logcat.Close())
+
+	reopened, err := adb.OpenLogcatArchive(dir, "1-7", 1024*1024)
+	if assert.NoError(t, err) {
+		assert.True(t, reopened.Last().Equal(third))
+		reopened.Close()
+	}
+}
+
+func messages(entries []adb.LogEntry) []string {
+	result := make([]string, len(entries))
+	for i, entry := range entries {
+		result[i] = entry.Message
+	}
+	return result
+}
+
+func TestLogcatArchiveKeepsNewestEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logcat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archive, err := adb.OpenLogcatArchive(dir, "phone1", 10*1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer archive.Close()
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 1000; i++ {
+		assert.NoError(t, archive.Append(adb.LogEntry{Time: start.Add(time.Duration(i) * time.Millisecond), Tag: "test", Message: fmt.Sprint(i)}))
+	}
+	//entries older than the archive are kept, f.ex. after the clock of the device went back
+	assert.NoError(t, archive.Append(adb.LogEntry{Time: start, Tag: "test", Message: "again"}))
+	assert.True(t, archive.Last().Equal(start.Add(999*time.Millisecond)))
+
+	files, err := filepath.Glob(filepath.Join(dir, "phone1.logcat*"))
+	assert.NoError(t, err)
+	size := int64(0)
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if assert.NoError(t, err) {
+			size += info.Size()
+		}
+	}
+	assert.LessOrEqual(t, size, int64(10*1024))
+	archived := messages(readArchive(archive, adb.LogFilter{}))
+	if assert.NotEmpty(t, archived) {
+		assert.NotEqual(t, "0", archived[0])
+		assert.Equal(t, []string{"999", "again"}, archived[len(archived)-2:])
+	}
+}
+
+func TestLogcatArchiveDropsOnlyTheOverlapOfResumedStreams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logcat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archive, err := adb.OpenLogcatArchive(dir, "phone1", 1024*1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer archive.Close()
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	later := start.Add(time.Millisecond)
+	//entries logged at the same time are all archived
+	assert.NoError(t, archive.Append(adb.LogEntry{Time: start, Pid: 1, Tag: "test", Message: "a"}))
+	assert.NoError(t, archive.Append(adb.LogEntry{Time: later, Pid: 1, Tag: "test", Message: "b"}))
+	assert.NoError(t, archive.Append(adb.LogEntry{Time: later, Pid: 2, Tag: "test", Message: "b"}))
+	assert.Equal(t, []string{"a", "b", "b"}, messages(readArchive(archive, adb.LogFilter{})))
+
+	//the stream continues at the newest entry, logcat -T sends the entries at that time again
+	reopened, err := adb.OpenLogcatArchive(dir, "phone1", 1024*1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer reopened.Close()
+	assert.True(t, reopened.Resume(later).Equal(later))
+	assert.NoError(t, reopened.Append(adb.LogEntry{Time: later, Pid: 2, Tag: "test", Message: "b"}))
+	assert.NoError(t, reopened.Append(adb.LogEntry{Time: later, Pid: 1, Tag: "test", Message: "c"}))
+	assert.NoError(t, reopened.Append(adb.LogEntry{Time: later, Pid: 1, Tag: "test", Message: "b"}))
+	assert.NoError(t, reopened.Append(adb.LogEntry{Time: later.Add(time.Millisecond), Pid: 1, Tag: "test", Message: "d"}))
+	assert.NoError(t, reopened.Append(adb.LogEntry{Time: later.Add(time.Millisecond), Pid: 1, Tag: "test", Message: "d"}))
+	assert.Equal(t, []string{"a", "b", "b", "c", "d", "d"}, messages(readArchive(reopened, adb.LogFilter{})))
+
+	//after a reboot the clock of the device is behind the archive, its whole log is read
+	rebooted := start.Add(-time.Hour)
+	assert.True(t, reopened.Resume(rebooted).IsZero())
+	assert.NoError(t, reopened.Append(adb.LogEntry{Time: rebooted, Pid: 1, Tag: "test", Message: "boot"}))
+	assert.True(t, reopened.Last().Equal(rebooted))
+	assert.Equal(t, "boot", messages(readArchive(reopened, adb.LogFilter{}))[6])
+}
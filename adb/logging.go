@@ -0,0 +1,218 @@
+package adb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	//LogFormatText is the default human readable logrus format.
+	LogFormatText = "text"
+	//LogFormatJSON makes logrus print one JSON object per line.
+	LogFormatJSON = "json"
+)
+
+var logFormat = LogFormatText
+
+var logFiles = struct {
+	dir     string
+	maxSize int64
+	backups int
+}{}
+
+//SetLogFormat configures the global logrus formatter. format must be one of LogFormatText or LogFormatJSON.
+//Bridge sub processes are started with the same format.
+func SetLogFormat(format string) error {
+	switch format {
+	case LogFormatText:
+		log.SetFormatter(&log.TextFormatter{})
+	case LogFormatJSON:
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format '%s', use '%s' or '%s'", format, LogFormatText, LogFormatJSON)
+	}
+	logFormat = format
+	return nil
+}
+
+//EnableLogFiles makes every bridge additionally write its log lines to its own file in dir.
+//Files are rotated once they grow beyond maxSize bytes, keeping the given number of backups.
+//Must be called before any bridge is created. An empty dir disables log files.
+func EnableLogFiles(dir string, maxSize int64, backups int) error {
+	if dir != "" {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	logFiles.dir = dir
+	logFiles.maxSize = maxSize
+	logFiles.backups = backups
+	return nil
+}
+
+//deviceLog receives all log lines of one bridge and keeps them in a LogBuffer
+//and, if log files are enabled, in a rotating per-device log file.
+type deviceLog struct {
+	buffer *LogBuffer
+	file   *rotatingFile
+	//bridges is the number of bridges using the deviceLog, it is protected by the mutex of the log hook
+	bridges int
+}
+
+func newDeviceLog(port int, serial string) *deviceLog {
+	deviceLog := &deviceLog{buffer: NewLogBuffer(logBufferSize)}
+	if logFiles.dir == "" {
+		return deviceLog
+	}
+	path := filepath.Join(logFiles.dir, fmt.Sprintf("%d-%s.log", port, safeFileName(serial)))
+	file, err := openRotatingFile(path, logFiles.maxSize, logFiles.backups)
+	if err != nil {
+		log.Warnf("failed opening device log file %s, logging to memory only: %v", path, err)
+		return deviceLog
+	}
+	deviceLog.file = file
+	return deviceLog
+}
+
+func (d *deviceLog) writeLine(line string) {
+	d.buffer.Append(line)
+	if d.file == nil {
+		return
+	}
+	err := d.file.writeLine(line)
+	if err != nil && err != os.ErrClosed {
+		//do not log here, it would end up in this deviceLog again
+		fmt.Fprintf(os.Stderr, "failed writing device log file %s: %v\n", d.file.path, err)
+	}
+}
+
+func (d *deviceLog) close() {
+	if d.file == nil {
+		return
+	}
+	err := d.file.close()
+	if err != nil {
+		log.Warnf("failed closing device log file %s: %v", d.file.path, err)
+	}
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+func safeFileName(name string) string {
+	if name == "" {
+		return "noserial"
+	}
+	return unsafeFileChars.ReplaceAllString(name, "_")
+}
+
+//rotatingFile is an append only log file that is renamed to path.1, path.2.. once it grows beyond maxSize.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+	mux     sync.Mutex
+}
+
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	err := r.open()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) writeLine(line string) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.file == nil {
+		return os.ErrClosed
+	}
+	if r.maxSize > 0 && r.size+int64(len(line))+1 > r.maxSize {
+		err := r.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := io.WriteString(r.file, line+"\n")
+	r.size += int64(n)
+	return err
+}
+
+func (r *rotatingFile) rotate() error {
+	err := r.file.Close()
+	if err != nil {
+		return err
+	}
+	if r.backups > 0 {
+		for i := r.backups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		err = os.Rename(r.path, r.path+".1")
+	} else {
+		err = os.Remove(r.path)
+	}
+	if err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) close() error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+//lineWriter is an io.Writer that splits everything written to it into lines,
+//passes them to a deviceLog and also forwards the raw data to out.
+//It is used to capture the output of bridge sub processes.
+type lineWriter struct {
+	deviceLog *deviceLog
+	out       io.Writer
+	partial   []byte
+}
+
+func (l *lineWriter) Write(data []byte) (int, error) {
+	l.out.Write(data)
+	l.partial = append(l.partial, data...)
+	for {
+		index := bytes.IndexByte(l.partial, '\n')
+		if index == -1 {
+			break
+		}
+		l.deviceLog.writeLine(string(l.partial[:index]))
+		l.partial = l.partial[index+1:]
+	}
+	return len(data), nil
+}
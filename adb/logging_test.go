@@ -0,0 +1,45 @@
+package adb_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/danielpaulus/go-adb/adb"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBridgeLogsAreRoutedPerDevice(t *testing.T) {
+	dir := t.TempDir()
+	err := adb.EnableLogFiles(dir, 200, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const port = 61000
+	bridge := adb.NewUsbTcpBridge(adb.DeviceInfo{SerialNumber: "log/test"}, port)
+	otherBridge := adb.NewUsbTcpBridge(adb.DeviceInfo{SerialNumber: "other"}, port+1)
+
+	for i := 0; i < 5; i++ {
+		log.WithFields(log.Fields{"port": port}).Infof("message for the device number %d", i)
+	}
+	log.Info("message without port")
+
+	lines := bridge.Logs(0)
+	if assert.Equal(t, 5, len(lines)) {
+		assert.Contains(t, lines[4], "message for the device number 4")
+	}
+	assert.Equal(t, 0, len(otherBridge.Logs(0)))
+
+	current, err := ioutil.ReadFile(filepath.Join(dir, "61000-log_test.log"))
+	if assert.NoError(t, err) {
+		currentLines := strings.Split(strings.TrimSpace(string(current)), "\n")
+		assert.Contains(t, currentLines[len(currentLines)-1], "number 4")
+	}
+	rotated, err := ioutil.ReadFile(filepath.Join(dir, "61000-log_test.log.1"))
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(rotated), "message for the device")
+	}
+	assert.NoError(t, adb.EnableLogFiles("", 0, 0))
+}
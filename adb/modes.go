@@ -0,0 +1,128 @@
+package adb
+
+import (
+	"fmt"
+
+	"github.com/google/gousb"
+)
+
+//USB modes an Android device can be in. Only devices in ModeADB can be bridged,
+//the others are reported so operators can see why a device is not available.
+const (
+	ModeADB = "adb"
+	//ModeFastboot is the bootloader, f.ex. after adb reboot bootloader
+	ModeFastboot = "fastboot"
+	//ModeMTP means the device exposes only MTP or PTP, usually because USB debugging is disabled
+	ModeMTP = "mtp"
+	//ModeEDL is the Qualcomm emergency download mode
+	ModeEDL = "edl"
+	//ModeMediatekBootROM is the MediaTek boot ROM or preloader download mode
+	ModeMediatekBootROM = "mtk-bootrom"
+	//ModeSamsungDownload is the Odin download mode of Samsung devices
+	ModeSamsungDownload = "samsung-download"
+	//ModeNoInterface is a device of a known Android vendor without any interface, f.ex. charging only
+	ModeNoInterface = "charging"
+	//ModeDisconnected is a known device that is currently not plugged in, f.ex. while it reboots
+	ModeDisconnected = "disconnected"
+)
+
+const fastbootInterfaceProtocol gousb.Protocol = 0x3
+
+var modeHints = map[string]string{
+	ModeADB:             "",
+	ModeFastboot:        "device is in the bootloader, reboot it or use fastboot",
+	ModeMTP:             "USB debugging disabled",
+	ModeEDL:             "device is in Qualcomm emergency download mode",
+	ModeMediatekBootROM: "device is in MediaTek boot ROM download mode",
+	ModeSamsungDownload: "device is in Samsung download mode",
+	ModeNoInterface:     "USB debugging disabled or USB set to charging only",
+	ModeDisconnected:    "device is not connected, it might be rebooting",
+}
+
+//ModeHint returns a short explanation why a device in the given mode cannot be bridged, empty for ModeADB.
+func ModeHint(mode string) string {
+	return modeHints[mode]
+}
+
+//ModeError is returned when connecting to a device that is plugged in but not in ModeADB,
+//f.ex. after adb reboot bootloader.
+type ModeError struct {
+	Mode string
+}
+
+func (e ModeError) Error() string {
+	return fmt.Sprintf("device is in %s mode", e.Mode)
+}
+
+//Special modes are only detectable by their VID and PID.
+var modesByVIDPID = map[[2]gousb.ID]string{
+	{0x05c6, 0x9008}: ModeEDL,
+	{0x0e8d, 0x0003}: ModeMediatekBootROM,
+	{0x0e8d, 0x2000}: ModeMediatekBootROM,
+	{0x04e8, 0x685d}: ModeSamsungDownload,
+}
+
+//androidVendors contains the USB vendor ids of common Android device manufacturers, devices of these vendors
+//that only offer MTP or no interface at all are very likely phones with USB debugging disabled.
+var androidVendors = map[gousb.ID]bool{
+	0x18d1: true, //Google
+	0x04e8: true, //Samsung
+	0x22b8: true, //Motorola
+	0x2717: true, //Xiaomi
+	0x2a70: true, //OnePlus
+	0x12d1: true, //Huawei
+	0x1004: true, //LG
+	0x0fce: true, //Sony
+	0x0bb4: true, //HTC
+	0x05c6: true, //Qualcomm
+	0x0e8d: true, //MediaTek
+	0x17ef: true, //Lenovo
+	0x19d2: true, //ZTE
+	0x22d9: true, //OPPO
+	0x2e04: true, //HMD Nokia
+	0x0b05: true, //Asus
+}
+
+//ClassifyMode returns the mode of an Android device or an empty string if desc does not look like an Android device.
+func ClassifyMode(desc *gousb.DeviceDesc) string {
+	if mode, ok := modesByVIDPID[[2]gousb.ID{desc.Vendor, desc.Product}]; ok {
+		return mode
+	}
+	mtp := false
+	interfaces := 0
+	for _, configDesc := range desc.Configs {
+		interfaces += len(configDesc.Interfaces)
+		for _, iface := range configDesc.Interfaces {
+			if isAdbInterface(iface) {
+				return ModeADB
+			}
+			for _, alt := range iface.AltSettings {
+				if isFastbootInterface(alt) {
+					return ModeFastboot
+				}
+				mtp = mtp || isMtpInterface(alt)
+			}
+		}
+	}
+	if !androidVendors[desc.Vendor] || desc.Class == gousb.ClassHub {
+		return ""
+	}
+	if mtp {
+		return ModeMTP
+	}
+	if interfaces == 0 {
+		return ModeNoInterface
+	}
+	return ""
+}
+
+func isFastbootInterface(alt gousb.InterfaceSetting) bool {
+	return alt.Class == gousb.ClassVendorSpec && alt.SubClass == adbInterfaceSubclass && alt.Protocol == fastbootInterfaceProtocol
+}
+
+//MTP is announced as still image class, like PTP, or as vendor specific interface with subclass 0xff
+func isMtpInterface(alt gousb.InterfaceSetting) bool {
+	stillImage := alt.Class == gousb.ClassPTP && alt.SubClass == 1 && alt.Protocol == 1
+	vendorMtp := alt.Class == gousb.ClassVendorSpec && alt.SubClass == 0xff && alt.Protocol == 0
+	return stillImage || vendorMtp
+}
@@ -0,0 +1,468 @@
+package adb
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//networkDialTimeout is how long a NetworkBridge waits for adbd of the device to accept a connection
+const networkDialTimeout = 5 * time.Second
+
+//NetworkBridge exposes a device attached over the network, f.ex. with wireless debugging, on a local TCP port.
+//Every client connection is relayed byte by byte to adbd of the device at DeviceInfo.NetworkAddress, so the adb protocol
+//including TLS passes through unchanged. Only if go-adb paired with the device, see Pair, the bridge completes the STLS upgrade
+//with its own key and the client continues without TLS. It accepts one client at a time like the UsbTcpBridge.
+//The state is online while adbd is reachable and detached after connecting to it failed.
+type NetworkBridge struct {
+	device       DeviceInfo
+	port         int
+	listener     net.Listener
+	inherited    net.Listener
+	currentState int
+	client       net.Conn
+	lastError    string
+	connects     int
+	tls          bool
+	onlineSince  time.Time
+	closed       bool
+	history      *StateHistory
+	logs         *deviceLog
+	session      *Session
+	sessionConn  net.Conn
+	sessionWrite sync.Mutex
+	forwards     *Forwards
+	reverses     *Reverses
+	recorder     *ScreenRecorder
+	logcat       *Logcat
+	mux          sync.Mutex
+}
+
+//NewNetworkBridge creates a notInitialized NetworkBridge for device that will listen on port.
+func NewNetworkBridge(device DeviceInfo, port int) *NetworkBridge {
+	bridge := &NetworkBridge{
+		device:       device,
+		port:         port,
+		currentState: notInitialized,
+		history:      NewStateHistory(stateHistorySize),
+		logs:         deviceLogForPort(port, device.SerialNumber),
+	}
+	bridge.session = NewSession(port, device.SerialNumber, bridge.writeSessionPacket)
+	bridge.session.dial = bridge.dialSession
+	bridge.forwards = NewForwards(bridge.session)
+	bridge.reverses = NewReverses(bridge.session)
+	bridge.recorder = NewScreenRecorder(bridge.session)
+	return bridge
+}
+
+//NewNetworkBridgeFromHandover creates a notInitialized NetworkBridge that will accept connections
+//on the TCP listener it inherited from the previous go-adb process.
+func NewNetworkBridgeFromHandover(handover BridgeHandover) (*NetworkBridge, error) {
+	bridge := NewNetworkBridge(handover.Device, handover.Port)
+	listener, err := inheritedListener(handover)
+	bridge.inherited = listener
+	return bridge, err
+}
+
+func (n *NetworkBridge) log() *log.Entry {
+	return log.WithFields(log.Fields{"port": n.port, "serial": n.device.SerialNumber, "address": n.device.NetworkAddress})
+}
+
+//GetSerialNumber returns the serial of the device this bridge is responsible for.
+func (n *NetworkBridge) GetSerialNumber() string {
+	return n.device.SerialNumber
+}
+
+//GetStateName returns the name of the current state of the bridge.
+func (n *NetworkBridge) GetStateName() string {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	_, name := GetState(n.currentState)
+	return name
+}
+
+//Details returns a map[string]interface{} that can be converted to JSON easily containing
+//the device info, state, network address, port, uptime, last error, connected client, the number of connections
+//relayed to the device, whether the bridge terminated TLS for the current connection and the forwards and reverse forwards of the device.
+func (n *NetworkBridge) Details() map[string]interface{} {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	_, state := GetState(n.currentState)
+	uptime := time.Duration(0)
+	if n.currentState == online {
+		uptime = time.Since(n.onlineSince).Round(time.Second)
+	}
+	client := ""
+	if n.client != nil {
+		client = n.client.RemoteAddr().String()
+	}
+	return map[string]interface{}{
+		"serial":    n.device.SerialNumber,
+		"port":      n.port,
+		"state":     state,
+		"mode":      ModeADB,
+		"address":   n.device.NetworkAddress,
+		"device":    n.device,
+		"uptime":    uptime.String(),
+		"lastError": n.lastError,
+		"client":    client,
+		"connects":  n.connects,
+		"tls":       n.tls,
+		"forwards":  n.forwards.List(),
+		"reverses":  n.reverses.List(),
+	}
+}
+
+//History returns the last count state transitions of this bridge, oldest first.
+//If count is zero or negative, all recorded transitions are returned.
+func (n *NetworkBridge) History(count int) []StateTransition {
+	return n.history.Last(count)
+}
+
+//Logs returns the last count log lines of this bridge, oldest first.
+//If count is zero or negative, all buffered lines are returned.
+func (n *NetworkBridge) Logs(count int) []string {
+	return n.logs.buffer.Lines(count)
+}
+
+func (n *NetworkBridge) setState(newState int) {
+	n.mux.Lock()
+	oldState := n.currentState
+	n.currentState = newState
+	if newState == online && oldState != online {
+		n.onlineSince = time.Now()
+	}
+	n.mux.Unlock()
+	if oldState == newState {
+		return
+	}
+	_, from := GetState(oldState)
+	_, to := GetState(newState)
+	n.history.Add(StateTransition{From: from, To: to, Time: time.Now()})
+}
+
+func (n *NetworkBridge) setLastError(err error) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.lastError = err.Error()
+}
+
+//Start opens the TCP port, or takes over the inherited listener, and starts relaying clients to the device.
+func (n *NetworkBridge) Start() error {
+	listener := n.inherited
+	n.inherited = nil
+	if listener == nil {
+		var err error
+		listener, err = startTcp(n.port)
+		if err != nil {
+			n.log().Errorf("failed starting tcp server, this device is unusable now: %v", err)
+			n.setLastError(err)
+			n.setState(errorTCP)
+			return err
+		}
+	}
+	n.mux.Lock()
+	if n.closed {
+		n.mux.Unlock()
+		return listener.Close()
+	}
+	n.listener = listener
+	n.mux.Unlock()
+	n.log().Infof("relaying port %d to %s", n.port, n.device.NetworkAddress)
+	n.setState(online)
+	go n.acceptClients(listener)
+	go n.reverses.Connect()
+	if n.logcat != nil {
+		n.logcat.Connect()
+	}
+	return nil
+}
+
+func (n *NetworkBridge) acceptClients(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		if !n.setClient(conn) {
+			n.log().Warn("refusing connection")
+			conn.Close()
+			continue
+		}
+		go n.relay(conn)
+	}
+}
+
+//setClient makes conn the connected client, it returns false if there already is one.
+func (n *NetworkBridge) setClient(conn net.Conn) bool {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if n.client != nil || n.closed {
+		return false
+	}
+	n.client = conn
+	return true
+}
+
+//relay copies data between the client and adbd of the device until one side closes the connection.
+func (n *NetworkBridge) relay(client net.Conn) {
+	defer func() {
+		client.Close()
+		n.mux.Lock()
+		n.client = nil
+		n.mux.Unlock()
+	}()
+	n.log().WithFields(log.Fields{"remote": client.RemoteAddr().String()}).Info("tcp connection active")
+	device, err := net.DialTimeout("tcp", n.device.NetworkAddress, networkDialTimeout)
+	if err != nil {
+		n.log().Warnf("failed connecting to device: %v", err)
+		n.setLastError(err)
+		n.setState(detached)
+		return
+	}
+	defer device.Close()
+	n.mux.Lock()
+	n.connects++
+	n.tls = false
+	n.mux.Unlock()
+	n.setState(online)
+	if store, paired := pairedKeyStore(n.device.NetworkAddress); paired {
+		device, err = n.terminateTLS(client, device, store)
+		if err != nil {
+			n.log().Warnf("failed upgrading the connection to TLS: %v", err)
+			n.setLastError(err)
+			return
+		}
+		defer device.Close()
+	}
+
+	deviceDone := make(chan struct{})
+	go func() {
+		defer close(deviceDone)
+		_, err := io.Copy(client, device)
+		if err != nil {
+			n.log().Debugf("stopped reading from device: %v", err)
+		}
+		//unblocks reading from the client
+		client.Close()
+	}()
+	_, err = io.Copy(device, client)
+	if err != nil {
+		n.log().Debugf("stopped reading from client: %v", err)
+	}
+	//unblocks reading from the device
+	device.Close()
+	<-deviceDone
+	n.log().Info("tcp connection closed")
+}
+
+//terminateTLS forwards the first packet of the client, usually Cnxn, and answers an Stls reply of the device by upgrading
+//the device connection to TLS with the key go-adb paired with. It returns the connection to relay to the device,
+//other replies are passed to the client and the connection stays unencrypted.
+func (n *NetworkBridge) terminateTLS(client net.Conn, device net.Conn, store *KeyStore) (net.Conn, error) {
+	packet, err := ReadPacketFromTCP(client)
+	if err != nil {
+		return nil, err
+	}
+	err = WritePacketToTCP(packet, device)
+	packet.Release()
+	if err != nil {
+		return nil, err
+	}
+	device.SetDeadline(time.Now().Add(networkDialTimeout))
+	defer device.SetDeadline(time.Time{})
+	reply, err := ReadPacketFromTCP(device)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Header.CommandType != Stls {
+		err = WritePacketToTCP(reply, client)
+		reply.Release()
+		return device, err
+	}
+	reply.Release()
+	stls := PacketHeader{CommandType: Stls, Arg0: stlsVersion, Magic: Stls ^ 0xffffffff}
+	err = WritePacketToTCP(Packet{Header: stls}, device)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(device, store.TLSConfig())
+	err = tlsConn.Handshake()
+	if err != nil {
+		return nil, err
+	}
+	n.log().Info("upgraded the device connection to TLS")
+	n.mux.Lock()
+	n.tls = true
+	n.mux.Unlock()
+	return tlsConn, nil
+}
+
+//Session returns go-adb's own adb connection to the device.
+func (n *NetworkBridge) Session() *Session {
+	return n.session
+}
+
+//Forwards returns the host sockets forwarded to services of the device.
+func (n *NetworkBridge) Forwards() *Forwards {
+	return n.forwards
+}
+
+//Reverses returns the sockets of the device forwarded to the host.
+func (n *NetworkBridge) Reverses() *Reverses {
+	return n.reverses
+}
+
+//ScreenRecorder records the screen of the device.
+func (n *NetworkBridge) ScreenRecorder() *ScreenRecorder {
+	return n.recorder
+}
+
+//ArchiveLogcat keeps archiving the log of the device to archive while the bridge runs, it must be called before Start.
+func (n *NetworkBridge) ArchiveLogcat(archive *LogcatArchive) {
+	n.logcat = StartLogcat(n.session, archive)
+}
+
+//LogcatArchive returns the archived log of the device, nil if it is not archived.
+func (n *NetworkBridge) LogcatArchive() *LogcatArchive {
+	if n.logcat == nil {
+		return nil
+	}
+	return n.logcat.Archive()
+}
+
+//dialSession connects the Session to adbd. Every TCP connection to adbd is a connection of its own,
+//so unlike on USB the Session does not share the connection of the client.
+func (n *NetworkBridge) dialSession() error {
+	conn, err := net.DialTimeout("tcp", n.device.NetworkAddress, networkDialTimeout)
+	if err != nil {
+		return err
+	}
+	n.mux.Lock()
+	previous := n.sessionConn
+	n.sessionConn = conn
+	n.mux.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+	go n.readSession(conn)
+	return nil
+}
+
+func (n *NetworkBridge) writeSessionPacket(packet Packet) error {
+	n.mux.Lock()
+	conn := n.sessionConn
+	n.mux.Unlock()
+	if conn == nil {
+		return ErrDeviceOffline
+	}
+	n.sessionWrite.Lock()
+	defer n.sessionWrite.Unlock()
+	return WritePacketToTCP(packet, conn)
+}
+
+//readSession passes the packets of adbd to the Session until the connection closes. If the device asks for TLS,
+//the connection is upgraded with the key go-adb paired with.
+func (n *NetworkBridge) readSession(conn net.Conn) {
+	for {
+		packet, err := ReadPacketFromTCP(conn)
+		if err == nil && packet.Header.CommandType == Stls {
+			packet.Release()
+			conn, err = n.upgradeSession(conn)
+			if err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			n.mux.Lock()
+			current := n.sessionConn == conn
+			if current {
+				n.sessionConn = nil
+			}
+			n.mux.Unlock()
+			conn.Close()
+			if current {
+				n.log().Debugf("adb connection of go-adb closed: %v", err)
+				n.session.Reset(err)
+			}
+			return
+		}
+		n.session.Handle(packet)
+		packet.Release()
+	}
+}
+
+func (n *NetworkBridge) upgradeSession(conn net.Conn) (net.Conn, error) {
+	store, paired := pairedKeyStore(n.device.NetworkAddress)
+	if !paired {
+		return conn, fmt.Errorf("device %s requires TLS, pair with it first", n.device.NetworkAddress)
+	}
+	n.sessionWrite.Lock()
+	defer n.sessionWrite.Unlock()
+	stls := PacketHeader{CommandType: Stls, Arg0: stlsVersion, Magic: Stls ^ 0xffffffff}
+	err := WritePacketToTCP(Packet{Header: stls}, conn)
+	if err != nil {
+		return conn, err
+	}
+	tlsConn := tls.Client(conn, store.TLSConfig())
+	tlsConn.SetDeadline(time.Now().Add(networkDialTimeout))
+	err = tlsConn.Handshake()
+	tlsConn.SetDeadline(time.Time{})
+	if err != nil {
+		return conn, err
+	}
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if n.sessionConn != conn {
+		tlsConn.Close()
+		return conn, ErrSessionReset
+	}
+	n.sessionConn = tlsConn
+	return tlsConn, nil
+}
+
+//Close stops accepting clients, a connected client is disconnected.
+func (n *NetworkBridge) Close() error {
+	n.log().Info("closing bridge")
+	n.forwards.Close()
+	n.reverses.Close()
+	n.recorder.Close()
+	if n.logcat != nil {
+		n.logcat.Close()
+	}
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if !n.closed {
+		releaseDeviceLog(n.port)
+	}
+	n.closed = true
+	if n.client != nil {
+		n.client.Close()
+	}
+	if n.sessionConn != nil {
+		n.sessionConn.Close()
+	}
+	if n.inherited != nil {
+		n.inherited.Close()
+	}
+	if n.listener == nil {
+		return nil
+	}
+	return n.listener.Close()
+}
+
+//Handover returns the state of the bridge and a copy of its TCP listener that survives exec.
+//The caller has to keep the returned files open until exec.
+func (n *NetworkBridge) Handover() (BridgeHandover, []*os.File, error) {
+	handover := BridgeHandover{Device: n.device, Port: n.port, State: n.GetStateName()}
+	n.mux.Lock()
+	listener := n.listener
+	n.mux.Unlock()
+	return handoverListener(handover, listener)
+}
@@ -0,0 +1,74 @@
+package adb_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/danielpaulus/go-adb/adb"
+	"github.com/stretchr/testify/assert"
+)
+
+//startFakeAdbd accepts connections and echoes everything back, like a very simple adbd.
+func startFakeAdbd(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestNetworkBridgeRelaysToDevice(t *testing.T) {
+	const port = 62200
+	adbd := startFakeAdbd(t)
+	info := adb.DeviceInfo{SerialNumber: "wifi-serial", Mode: adb.ModeADB, NetworkAddress: adbd.Addr().String()}
+	bridge := adb.NewNetworkBridge(info, port)
+	if !assert.NoError(t, bridge.Start()) {
+		return
+	}
+	defer bridge.Close()
+	assert.Equal(t, "online", bridge.GetStateName())
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if !assert.NoError(t, err) {
+		return
+	}
+	message := []byte("CNXN relayed to the device")
+	_, err = conn.Write(message)
+	assert.NoError(t, err)
+	echo := make([]byte, len(message))
+	_, err = io.ReadFull(conn, echo)
+	assert.NoError(t, err)
+	assert.Equal(t, message, echo)
+	details := bridge.Details()
+	assert.Equal(t, 1, details["connects"])
+	assert.Equal(t, adbd.Addr().String(), details["address"])
+	assert.NotEqual(t, "", details["client"])
+	conn.Close()
+
+	adbd.Close()
+	assert.Eventually(t, func() bool { return bridge.Details()["client"] == "" }, time.Second, 10*time.Millisecond)
+	conn, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err, "the client should be disconnected if the device is unreachable")
+	assert.Equal(t, "detached", bridge.GetStateName())
+	assert.NotEqual(t, "", bridge.Details()["lastError"])
+}
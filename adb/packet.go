@@ -1,6 +1,11 @@
 package adb
 
-//the 7 different adb packet/command types
+import "encoding/binary"
+
+//PacketHeaderSize is the size of an encoded PacketHeader
+const PacketHeaderSize = 24
+
+//the adb packet/command types
 const (
 	Auth uint32 = 0x48545541
 	Cnxn uint32 = 0x4e584e43
@@ -9,8 +14,13 @@ const (
 	Open uint32 = 0x4e45504f
 	Sync uint32 = 0x434e5953
 	Wrte uint32 = 0x45545257
+	//Stls asks the other side to continue with TLS, devices with wireless debugging send it in reply to Cnxn
+	Stls uint32 = 0x534c5453
 )
 
+//stlsVersion is the only version of the STLS packet
+const stlsVersion uint32 = 0x01000000
+
 //PacketHeader contains the 24 bytes header for a Packet
 //The first 4 bytes must be one of the commands above
 // DataLength indicates how long the payload of the packet will be
@@ -31,7 +41,8 @@ func IsValid(commandType uint32) bool {
 		commandType == Okay ||
 		commandType == Open ||
 		commandType == Sync ||
-		commandType == Wrte
+		commandType == Wrte ||
+		commandType == Stls
 }
 
 //Packet is one adb data packet that will be sent over
@@ -39,4 +50,46 @@ func IsValid(commandType uint32) bool {
 type Packet struct {
 	Header  PacketHeader
 	Payload []byte
+	//Raw packets carry TLS data after an Stls exchange, they have no header and only Payload is sent
+	Raw bool
+	//buffer is the pooled buffer of Payload, see Release
+	buffer *[]byte
+}
+
+//startsTLS is true for the Stls packet, everything following it in the same direction is TLS data.
+func (p Packet) startsTLS() bool {
+	return !p.Raw && p.Header.CommandType == Stls
+}
+
+//decodeHeader reads a little endian PacketHeader from the first PacketHeaderSize bytes of data.
+func decodeHeader(data []byte) PacketHeader {
+	return PacketHeader{
+		CommandType: binary.LittleEndian.Uint32(data),
+		Arg0:        binary.LittleEndian.Uint32(data[4:]),
+		Arg1:        binary.LittleEndian.Uint32(data[8:]),
+		DataLength:  binary.LittleEndian.Uint32(data[12:]),
+		Crc32:       binary.LittleEndian.Uint32(data[16:]),
+		Magic:       binary.LittleEndian.Uint32(data[20:]),
+	}
+}
+
+//encodeHeader writes header little endian into the first PacketHeaderSize bytes of data.
+func encodeHeader(header PacketHeader, data []byte) {
+	binary.LittleEndian.PutUint32(data, header.CommandType)
+	binary.LittleEndian.PutUint32(data[4:], header.Arg0)
+	binary.LittleEndian.PutUint32(data[8:], header.Arg1)
+	binary.LittleEndian.PutUint32(data[12:], header.DataLength)
+	binary.LittleEndian.PutUint32(data[16:], header.Crc32)
+	binary.LittleEndian.PutUint32(data[20:], header.Magic)
+}
+
+//newPacket creates a packet with checksum and magic set. Devices check the checksum until the connection
+//negotiated a version that skips it, so packets created by go-adb always carry one.
+func newPacket(command uint32, arg0 uint32, arg1 uint32, payload []byte) Packet {
+	var checksum uint32
+	for _, b := range payload {
+		checksum += uint32(b)
+	}
+	header := PacketHeader{CommandType: command, Arg0: arg0, Arg1: arg1, DataLength: uint32(len(payload)), Crc32: checksum, Magic: command ^ 0xffffffff}
+	return Packet{Header: header, Payload: payload}
 }
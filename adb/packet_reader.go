@@ -1,73 +1,59 @@
 package adb
 
 import (
-	"encoding/binary"
 	"fmt"
 	"io"
 
 	log "github.com/sirupsen/logrus"
 )
 
+//StartUSBWriteLoop starts writing the packets passed to EnqueueWrite to the device in order.
 func (u *UsbAdapter) StartUSBWriteLoop() {
-	u.writeChannel = make(chan Packet)
-	u.writeErrorChannel = make(chan error)
-	u.writeDone = make(chan interface{})
-
-	go func() {
-		u.log().Info("starting writeloop")
-		for {
-			select {
-			case packet, ok := <-u.writeChannel:
-				if !ok {
-					continue
-				}
-				WritePacketToUSB(packet, u)
-			case <-u.stopSignal:
-				close(u.writeErrorChannel)
-				u.writeDone <- struct{}{}
-				return
-			}
-		}
-	}()
+	u.log().Info("starting writeloop")
+	u.writeQueue = NewWriteQueue(writeQueueSize, func(packet Packet) error {
+		err := WritePacketToUSB(packet, u, u.outPacketSize)
+		packet.Release()
+		return err
+	})
 }
 
+//EnqueueWrite queues packet for the device, it blocks while the write queue is full.
+//If writing to the device failed, the error is returned and the packet is dropped.
 func (u *UsbAdapter) EnqueueWrite(packet Packet) error {
-	select {
-	case err, ok := <-u.writeErrorChannel:
-		if !ok {
-			return io.EOF
-		}
-		return err
-	default:
-		go func() { u.writeChannel <- packet }()
-	}
-	return nil
+	return u.writeQueue.Enqueue(packet)
 }
 
-func WritePacketToUSB(packet Packet, writer io.Writer) error {
-	header := make([]byte, 24)
-	binary.LittleEndian.PutUint32(header, packet.Header.CommandType)
-	binary.LittleEndian.PutUint32(header[4:], packet.Header.Arg0)
-	binary.LittleEndian.PutUint32(header[8:], packet.Header.Arg1)
-	binary.LittleEndian.PutUint32(header[12:], packet.Header.DataLength)
-	binary.LittleEndian.PutUint32(header[16:], packet.Header.Crc32)
-	binary.LittleEndian.PutUint32(header[20:], packet.Header.Magic)
-	_, err := writer.Write(header)
-	if err != nil {
-		log.Debug("failed usb sending header")
-		return fmt.Errorf("Failed sending AdbPacket Header %+v to USB: %w", packet.Header, err)
+//WriteQueueDepth returns the number of packets waiting to be written to the device.
+func (u *UsbAdapter) WriteQueueDepth() int {
+	return u.writeQueue.Depth()
+}
+
+//WritePacketToUSB sends header and payload of packet as separate bulk transfers to writer. If the payload is
+//a multiple of maxPacketSize, a zero length packet follows, otherwise the device would wait for more data.
+//Raw packets are sent without header.
+func WritePacketToUSB(packet Packet, writer io.Writer, maxPacketSize int) error {
+	payloadLength := len(packet.Payload)
+	if !packet.Raw {
+		header := headerPool.Get().(*[PacketHeaderSize]byte)
+		defer headerPool.Put(header)
+		encodeHeader(packet.Header, header[:])
+		_, err := writer.Write(header[:])
+		if err != nil {
+			log.Debug("failed usb sending header")
+			return fmt.Errorf("Failed sending AdbPacket Header %+v to USB: %w", packet.Header, err)
+		}
+		payloadLength = int(packet.Header.DataLength)
 	}
-	payloadLength := packet.Header.DataLength
 	if payloadLength == 0 {
 		return nil
 	}
-	_, err = writer.Write(packet.Payload)
+	_, err := writer.Write(packet.Payload)
 	if err != nil {
 		log.Debug("failed usb sending paylod")
 		return fmt.Errorf("Failed sending AdbPacket Payload %+v to USB: %w", packet.Header, err)
 	}
 
-	if payloadLength%512 == 0 {
+	if payloadLength%packetSize(maxPacketSize) == 0 {
 		_, err = writer.Write(make([]byte, 0))
 		if err != nil {
 
@@ -77,8 +63,16 @@ func WritePacketToUSB(packet Packet, writer io.Writer) error {
 	return nil
 }
 
+//WritePacketToTCP writes header and payload of packet to writer, raw packets are written without header.
 func WritePacketToTCP(packet Packet, writer io.Writer) error {
-	err := binary.Write(writer, binary.LittleEndian, packet.Header)
+	if packet.Raw {
+		_, err := writer.Write(packet.Payload)
+		return err
+	}
+	header := headerPool.Get().(*[PacketHeaderSize]byte)
+	defer headerPool.Put(header)
+	encodeHeader(packet.Header, header[:])
+	_, err := writer.Write(header[:])
 	if err != nil {
 		return err
 	}
@@ -87,18 +81,62 @@ func WritePacketToTCP(packet Packet, writer io.Writer) error {
 	return err
 }
 
+//ReadPacketFromTCP reads the next packet from reader, its payload is taken from a pool and should be released
+//with Packet.Release once it was written.
 func ReadPacketFromTCP(reader io.Reader) (Packet, error) {
-	var header PacketHeader
-	err := binary.Read(reader, binary.LittleEndian, &header)
+	headerBytes := headerPool.Get().(*[PacketHeaderSize]byte)
+	_, err := io.ReadFull(reader, headerBytes[:])
+	header := decodeHeader(headerBytes[:])
+	headerPool.Put(headerBytes)
 	if err != nil {
 		return Packet{}, err
 	}
-	payload := make([]byte, header.DataLength)
-	_, err = io.ReadFull(reader, payload)
+	packet := newPooledPacket(header)
+	_, err = io.ReadFull(reader, packet.Payload)
 	if err != nil {
+		packet.Release()
 		return Packet{}, err
 	}
-	return Packet{Header: header, Payload: payload}, err
+	return packet, err
+}
+
+//TCPPacketReader reads adb packets from a TCP connection. After an Stls packet, the client continues with TLS,
+//which is returned as Raw packets.
+type TCPPacketReader struct {
+	reader io.Reader
+	raw    bool
+}
+
+//NewTCPPacketReader creates a TCPPacketReader reading from reader.
+func NewTCPPacketReader(reader io.Reader) *TCPPacketReader {
+	return &TCPPacketReader{reader: reader}
+}
+
+//ReadPacket returns the next packet, its payload is taken from a pool and should be released with Packet.Release
+//once it was written.
+func (r *TCPPacketReader) ReadPacket() (Packet, error) {
+	if r.raw {
+		packet := newPooledPacket(PacketHeader{DataLength: rawReadSize})
+		n, err := r.reader.Read(packet.Payload)
+		if err != nil {
+			packet.Release()
+			return Packet{}, err
+		}
+		return rawPacket(packet, n), nil
+	}
+	packet, err := ReadPacketFromTCP(r.reader)
+	if err == nil && packet.startsTLS() {
+		r.raw = true
+	}
+	return packet, err
+}
+
+//rawPacket turns the first n bytes of the payload of packet into a Raw packet.
+func rawPacket(packet Packet, n int) Packet {
+	packet.Header = PacketHeader{}
+	packet.Payload = packet.Payload[:n]
+	packet.Raw = true
+	return packet
 }
 
 func (u *UsbAdapter) StartUSBReadLoop() {
@@ -107,42 +145,158 @@ func (u *UsbAdapter) StartUSBReadLoop() {
 
 	go func() {
 		u.log().Info("starting readloop")
+		defer u.releaseReadStream()
+		reader := NewUSBPacketReader(u, u.inPacketSize)
 		for {
-			headerBytes := make([]byte, 512)
-			n, err := u.Read(headerBytes)
+			packet, err := reader.ReadPacket()
 			if err != nil {
 				u.errorChannel <- err
 				break
 			}
-			if n != 24 {
-				u.log().Warn("discarding non adb header bytes")
-				continue
+			select {
+			case u.packetChannel <- packet:
+			case <-u.transfers.Done():
 			}
-			header := PacketHeader{
-				CommandType: binary.LittleEndian.Uint32(headerBytes),
-				Arg0:        binary.LittleEndian.Uint32(headerBytes[4:]),
-				Arg1:        binary.LittleEndian.Uint32(headerBytes[8:]),
-				DataLength:  binary.LittleEndian.Uint32(headerBytes[12:]),
-				Crc32:       binary.LittleEndian.Uint32(headerBytes[16:]),
-				Magic:       binary.LittleEndian.Uint32(headerBytes[20:]),
+		}
+		u.log().Debug("finished usb read loop")
+	}()
+}
+
+const (
+	//defaultMaxPacketSize is the max packet size of high speed bulk endpoints, it is used if the endpoint reports none
+	defaultMaxPacketSize = 512
+	//usbReadSize is the size of bulk IN transfers for headers and the end of payloads
+	usbReadSize = 16 * 1024
+	//rawReadSize is the most TLS data read at once, a TLS record is at most 16KiB plus a few bytes overhead
+	rawReadSize = 17 * 1024
+)
+
+func packetSize(maxPacketSize int) int {
+	if maxPacketSize <= 0 {
+		return defaultMaxPacketSize
+	}
+	return maxPacketSize
+}
+
+//USBPacketReader reads adb packets from a bulk IN endpoint where every Read is one USB transfer.
+//Devices can send a header merged with the start of its payload or the next header, and split headers across transfers,
+//so bytes left over from a transfer are kept for the next packet. Every transfer is a multiple of the max packet size,
+//because the device might send more than requested otherwise, which fails with an overflow.
+//After an Stls packet, the device continues with TLS, which is returned as Raw packets until the device starts over with Cnxn.
+type USBPacketReader struct {
+	reader        io.Reader
+	maxPacketSize int
+	transferSize  int
+	buffer        []byte
+	pending       []byte
+	raw           bool
+}
+
+//NewUSBPacketReader creates a USBPacketReader reading transfers from reader, maxPacketSize is the
+//max packet size of the endpoint.
+func NewUSBPacketReader(reader io.Reader, maxPacketSize int) *USBPacketReader {
+	maxPacketSize = packetSize(maxPacketSize)
+	transferSize := (usbReadSize + maxPacketSize - 1) / maxPacketSize * maxPacketSize
+	return &USBPacketReader{
+		reader:        reader,
+		maxPacketSize: maxPacketSize,
+		transferSize:  transferSize,
+		buffer:        make([]byte, PacketHeaderSize+transferSize),
+	}
+}
+
+//ReadPacket returns the next packet. Data that does not start with a valid header is discarded until
+//the next transfer. The payload is taken from a pool and should be released with Packet.Release once it was written.
+func (r *USBPacketReader) ReadPacket() (Packet, error) {
+	for {
+		if r.raw {
+			packet, err := r.readRaw()
+			if err != nil || packet.Raw {
+				return packet, err
 			}
-			if !IsValid(header.CommandType) {
-				u.log().Warnf("read invalid header from USB: %x", headerBytes)
-				continue
+		}
+		for len(r.pending) < PacketHeaderSize {
+			err := r.readTransfer()
+			if err != nil {
+				return Packet{}, err
 			}
+		}
+		header := decodeHeader(r.pending)
+		if !IsValid(header.CommandType) {
+			log.Warnf("discarding %d bytes with invalid header from USB: %x", len(r.pending), r.pending[:PacketHeaderSize])
+			r.pending = r.pending[:0]
+			continue
+		}
+		r.pending = r.pending[PacketHeaderSize:]
+		packet := newPooledPacket(header)
+		err := r.readPayload(packet.Payload)
+		if err != nil {
+			packet.Release()
+			return Packet{}, err
+		}
+		r.raw = packet.startsTLS()
+		return packet, nil
+	}
+}
 
-			payload := make([]byte, header.DataLength)
-			if header.DataLength == 0 {
-				u.packetChannel <- Packet{Header: header, Payload: payload}
-				continue
-			}
-			_, err = io.ReadFull(u, payload)
+//readRaw returns the pending bytes or the next transfer as a Raw packet. If the device starts over with a Cnxn packet,
+//f.ex. after the client went away, it leaves TLS mode and returns no packet.
+func (r *USBPacketReader) readRaw() (Packet, error) {
+	for len(r.pending) == 0 {
+		err := r.readTransfer()
+		if err != nil {
+			return Packet{}, err
+		}
+	}
+	if len(r.pending) >= PacketHeaderSize {
+		header := decodeHeader(r.pending)
+		if header.CommandType == Cnxn && header.Magic == Cnxn^0xffffffff {
+			log.Debug("device started over, leaving TLS mode")
+			r.raw = false
+			return Packet{}, nil
+		}
+	}
+	packet := newPooledPacket(PacketHeader{DataLength: uint32(len(r.pending))})
+	n := copy(packet.Payload, r.pending)
+	r.pending = r.pending[:0]
+	return rawPacket(packet, n), nil
+}
+
+//readPayload fills payload with pending bytes first. Whole max packet sizes are read directly into payload,
+//the rest is read into the buffer because the transfer might contain the next header too.
+func (r *USBPacketReader) readPayload(payload []byte) error {
+	n := copy(payload, r.pending)
+	r.pending = r.pending[n:]
+	for n < len(payload) {
+		remaining := len(payload) - n
+		if direct := remaining - remaining%r.maxPacketSize; direct > 0 {
+			read, err := r.reader.Read(payload[n : n+direct])
 			if err != nil {
-				u.errorChannel <- err
-				break
+				return err
 			}
-			u.packetChannel <- Packet{Header: header, Payload: payload}
+			n += read
+			continue
 		}
-		u.log().Debug("finished usb read loop")
-	}()
+		err := r.readTransfer()
+		if err != nil {
+			return err
+		}
+		copied := copy(payload[n:], r.pending)
+		r.pending = r.pending[copied:]
+		n += copied
+	}
+	return nil
+}
+
+//readTransfer appends one transfer to the pending bytes, zero length packets add nothing.
+//It is only called with less than a header pending, which is moved to the front of the buffer.
+func (r *USBPacketReader) readTransfer() error {
+	leftover := copy(r.buffer, r.pending)
+	r.pending = r.buffer[:leftover]
+	n, err := r.reader.Read(r.buffer[leftover : leftover+r.transferSize])
+	if err != nil {
+		return err
+	}
+	r.pending = r.buffer[:leftover+n]
+	return nil
 }
@@ -0,0 +1,331 @@
+package adb_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/danielpaulus/go-adb/adb"
+	"github.com/stretchr/testify/assert"
+)
+
+//fakeEndpoint behaves like a bulk endpoint: every Read returns the rest of the current transfer the device sent,
+//split at max packet size boundaries if it does not fit. Reads that are not a multiple of the max packet
+//size fail, libusb fails with an overflow if the device sends more than requested then.
+type fakeEndpoint struct {
+	maxPacketSize int
+	transfers     [][]byte
+	writes        [][]byte
+}
+
+func (f *fakeEndpoint) Read(p []byte) (int, error) {
+	if len(p)%f.maxPacketSize != 0 {
+		return 0, fmt.Errorf("read of %d bytes is not a multiple of %d", len(p), f.maxPacketSize)
+	}
+	if len(f.transfers) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, f.transfers[0])
+	f.transfers[0] = f.transfers[0][n:]
+	if len(f.transfers[0]) == 0 {
+		f.transfers = f.transfers[1:]
+	}
+	return n, nil
+}
+
+func (f *fakeEndpoint) Write(p []byte) (int, error) {
+	f.writes = append(f.writes, append([]byte{}, p...))
+	return len(p), nil
+}
+
+func encode(packet adb.Packet) []byte {
+	buffer := &bytes.Buffer{}
+	binary.Write(buffer, binary.LittleEndian, packet.Header)
+	buffer.Write(packet.Payload)
+	return buffer.Bytes()
+}
+
+func wrte(size int) adb.Packet {
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	return adb.Packet{Header: adb.PacketHeader{CommandType: adb.Wrte, Arg0: 1, Arg1: 2, DataLength: uint32(size), Magic: adb.Wrte ^ 0xffffffff}, Payload: payload}
+}
+
+func okay() adb.Packet {
+	return adb.Packet{Header: adb.PacketHeader{CommandType: adb.Okay, Arg0: 2, Arg1: 1, Magic: adb.Okay ^ 0xffffffff}, Payload: []byte{}}
+}
+
+func assertPacket(t *testing.T, expected adb.Packet, actual adb.Packet) {
+	assert.Equal(t, expected.Header, actual.Header)
+	assert.Equal(t, expected.Payload, actual.Payload)
+}
+
+func TestUSBPacketReaderFraming(t *testing.T) {
+	big := wrte(3000)
+	bigBytes := encode(big)
+	header, payload := bigBytes[:adb.PacketHeaderSize], bigBytes[adb.PacketHeaderSize:]
+	okayBytes := encode(okay())
+
+	testCases := map[string][][]byte{
+		"separate transfers":         {header, payload[:2048], payload[2048:], okayBytes},
+		"header merged with payload": {bigBytes[:1024], bigBytes[1024:], okayBytes},
+		"header split":               {header[:10], header[10:], payload[:2048], payload[2048:], okayBytes},
+		"next header merged":         {header, payload[:2048], append(append([]byte{}, payload[2048:]...), okayBytes...)},
+		"zero length packets":        {{}, header, payload[:2048], payload[2048:], {}, okayBytes},
+		"garbage before header":      {[]byte("garbage that is no header at all"), bigBytes[:1024], bigBytes[1024:], okayBytes},
+		"everything in one transfer": {append(append([]byte{}, bigBytes...), okayBytes...)},
+	}
+	for name, transfers := range testCases {
+		t.Run(name, func(t *testing.T) {
+			reader := adb.NewUSBPacketReader(&fakeEndpoint{maxPacketSize: 1024, transfers: transfers}, 1024)
+			packet, err := reader.ReadPacket()
+			if assert.NoError(t, err) {
+				assertPacket(t, big, packet)
+			}
+			packet, err = reader.ReadPacket()
+			if assert.NoError(t, err) {
+				assertPacket(t, okay(), packet)
+			}
+			_, err = reader.ReadPacket()
+			assert.Equal(t, io.EOF, err)
+		})
+	}
+}
+
+func TestWritePacketToUSBSendsZeroLengthPackets(t *testing.T) {
+	testCases := []struct {
+		maxPacketSize int
+		payload       int
+		zlp           bool
+	}{
+		{512, 512, true},
+		{512, 1024, true},
+		{512, 1000, false},
+		{1024, 512, false},
+		{1024, 2048, true},
+		{1024, 0, false},
+	}
+	for _, tc := range testCases {
+		endpoint := &fakeEndpoint{maxPacketSize: tc.maxPacketSize}
+		packet := wrte(tc.payload)
+		err := adb.WritePacketToUSB(packet, endpoint, tc.maxPacketSize)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		expected := [][]byte{encode(adb.Packet{Header: packet.Header})}
+		if tc.payload > 0 {
+			expected = append(expected, packet.Payload)
+		}
+		if tc.zlp {
+			expected = append(expected, []byte{})
+		}
+		assert.Equal(t, expected, endpoint.writes, "max packet size %d payload %d", tc.maxPacketSize, tc.payload)
+	}
+}
+
+//benchmarkEndpoint is an endless bulk endpoint for benchmarks, every transfer carries at most transferSize bytes.
+type benchmarkEndpoint struct {
+	data         []byte
+	offset       int
+	transferSize int
+}
+
+func (f *benchmarkEndpoint) transfer(n int) int {
+	if n > f.transferSize {
+		return f.transferSize
+	}
+	return n
+}
+
+func (f *benchmarkEndpoint) Read(p []byte) (int, error) {
+	n := copy(p[:f.transfer(len(p))], f.data[f.offset:])
+	f.offset = (f.offset + n) % len(f.data)
+	return n, nil
+}
+
+func (f *benchmarkEndpoint) Write(p []byte) (int, error) {
+	for written := 0; written < len(p); {
+		written += f.transfer(len(p) - written)
+	}
+	return len(p), nil
+}
+
+const (
+	//fakeBusRate is the throughput of bulk transfers on the bus, about what USB 2.0 high speed reaches
+	fakeBusRate = 40 * 1024 * 1024
+	//fakeCompletionDelay is the time from the end of a transfer on the bus until the adapter gets it, libusb passes
+	//completions through its event thread. The bus continues with the next transfer in flight meanwhile.
+	fakeCompletionDelay = 100 * time.Microsecond
+)
+
+//fakeStream behaves like a gousb stream of a bulk endpoint with transfers in flight. The bus moves one transfer
+//at a time and idles while no transfer is submitted, IN transfers are submitted again once the adapter read them,
+//OUT transfers once the bus sent them. With one transfer the bus waits for the adapter, more transfers hide that time.
+type fakeStream struct {
+	data         []byte
+	offset       int
+	transferSize int
+	submitted    chan []byte
+	completed    chan []byte
+	current      []byte
+	used         int
+	stop         chan struct{}
+}
+
+func newFakeStream(config adb.StreamConfig, data []byte) *fakeStream {
+	s := &fakeStream{data: data, transferSize: config.TransferSize, submitted: make(chan []byte, config.Transfers),
+		completed: make(chan []byte, config.Transfers), stop: make(chan struct{})}
+	for i := 0; i < config.Transfers; i++ {
+		buffer := make([]byte, config.TransferSize)
+		if data == nil {
+			//OUT transfers are free to be filled by the adapter
+			s.completed <- buffer
+		} else {
+			s.submitted <- buffer
+		}
+	}
+	delivered := make(chan []byte, config.Transfers)
+	go func() {
+		for {
+			select {
+			case buffer := <-s.submitted:
+				if s.data != nil {
+					buffer = buffer[:cap(buffer)]
+					for n := 0; n < len(buffer); {
+						copied := copy(buffer[n:], s.data[s.offset:])
+						s.offset = (s.offset + copied) % len(s.data)
+						n += copied
+					}
+				}
+				time.Sleep(time.Duration(len(buffer)) * time.Second / fakeBusRate)
+				delivered <- buffer
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case buffer := <-delivered:
+				time.Sleep(fakeCompletionDelay)
+				s.completed <- buffer
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+	return s
+}
+
+func (s *fakeStream) ReadContext(ctx context.Context, p []byte) (int, error) {
+	if s.current == nil {
+		s.current = <-s.completed
+		s.used = 0
+	}
+	n := copy(p, s.current[s.used:])
+	s.used += n
+	if s.used == len(s.current) {
+		s.submitted <- s.current
+		s.current = nil
+	}
+	return n, nil
+}
+
+func (s *fakeStream) WriteContext(ctx context.Context, p []byte) (int, error) {
+	for written := 0; written < len(p); {
+		buffer := <-s.completed
+		n := copy(buffer[:cap(buffer)], p[written:])
+		s.submitted <- buffer[:n]
+		written += n
+	}
+	return len(p), nil
+}
+
+func (s *fakeStream) Close() {
+	close(s.stop)
+}
+
+var benchmarkConfigs = []adb.StreamConfig{{TransferSize: 16 * 1024, Transfers: 1}, {TransferSize: 64 * 1024, Transfers: 1}, adb.DefaultStreamConfig}
+
+//BenchmarkUSBThroughput reports the MB/s the UsbAdapter reads and writes 64KiB WRTE packets with, the packet size
+//of adb push and pull, for different sizes and numbers of transfers in flight on a simulated bus.
+func BenchmarkUSBThroughput(b *testing.B) {
+	packet := wrte(64 * 1024)
+	for _, config := range benchmarkConfigs {
+		name := fmt.Sprintf("transfer=%dK,inflight=%d", config.TransferSize/1024, config.Transfers)
+		b.Run("read/"+name, func(b *testing.B) {
+			stream := newFakeStream(config, encode(packet))
+			defer stream.Close()
+			reader := adb.NewUSBPacketReader(adb.TransferAdapter(stream, nil, 512), 512)
+			b.SetBytes(int64(len(packet.Payload)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				read, err := reader.ReadPacket()
+				if err != nil {
+					b.Fatal(err)
+				}
+				read.Release()
+			}
+		})
+		b.Run("write/"+name, func(b *testing.B) {
+			stream := newFakeStream(config, nil)
+			defer stream.Close()
+			adapter := adb.TransferAdapter(nil, stream, 512)
+			b.SetBytes(int64(len(packet.Payload)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err := adb.WritePacketToUSB(packet, adapter, 512)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+//BenchmarkPacketAllocations reports the allocations for reading and writing one 64KiB packet, payloads are
+//released like the bridge does once they are written.
+func BenchmarkPacketAllocations(b *testing.B) {
+	packet := wrte(64 * 1024)
+	b.Run("tcp", func(b *testing.B) {
+		buffer := &bytes.Buffer{}
+		b.ReportAllocs()
+		b.SetBytes(int64(len(packet.Payload)))
+		for i := 0; i < b.N; i++ {
+			buffer.Reset()
+			err := adb.WritePacketToTCP(packet, buffer)
+			if err != nil {
+				b.Fatal(err)
+			}
+			read, err := adb.ReadPacketFromTCP(buffer)
+			if err != nil {
+				b.Fatal(err)
+			}
+			read.Release()
+		}
+	})
+	b.Run("usb", func(b *testing.B) {
+		endpoint := &benchmarkEndpoint{data: encode(packet), transferSize: 64 * 1024}
+		reader := adb.NewUSBPacketReader(endpoint, 512)
+		b.ReportAllocs()
+		b.SetBytes(int64(len(packet.Payload)))
+		for i := 0; i < b.N; i++ {
+			read, err := reader.ReadPacket()
+			if err != nil {
+				b.Fatal(err)
+			}
+			err = adb.WritePacketToUSB(read, endpoint, 512)
+			if err != nil {
+				b.Fatal(err)
+			}
+			read.Release()
+		}
+	})
+}
@@ -1,6 +1,7 @@
 package adb_test
 
 import (
+	"bytes"
 	"testing"
 
 	"github.com/danielpaulus/go-adb/adb"
@@ -15,6 +16,29 @@ func TestIsValid(t *testing.T) {
 	assert.True(t, adb.IsValid(adb.Open))
 	assert.True(t, adb.IsValid(adb.Sync))
 	assert.True(t, adb.IsValid(adb.Wrte))
+	assert.True(t, adb.IsValid(adb.Stls))
 
 	assert.False(t, adb.IsValid(0x987))
 }
+
+func TestTCPPacketRoundTrip(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	packets := []adb.Packet{
+		{Header: adb.PacketHeader{CommandType: adb.Okay, Arg0: 1, Arg1: 2, Magic: adb.Okay ^ 0xffffffff}, Payload: []byte{}},
+		{Header: adb.PacketHeader{CommandType: adb.Wrte, Arg0: 1, Arg1: 2, DataLength: 5, Magic: adb.Wrte ^ 0xffffffff}, Payload: []byte("hello")},
+		{Header: adb.PacketHeader{CommandType: adb.Wrte, Arg0: 3, Arg1: 4, DataLength: 2 * 1024 * 1024}, Payload: bytes.Repeat([]byte{7}, 2*1024*1024)},
+	}
+	for _, packet := range packets {
+		assert.NoError(t, adb.WritePacketToTCP(packet, buffer))
+	}
+	for _, packet := range packets {
+		read, err := adb.ReadPacketFromTCP(buffer)
+		if assert.NoError(t, err) {
+			assert.Equal(t, packet.Header, read.Header)
+			assert.Equal(t, packet.Payload, read.Payload)
+			read.Release()
+		}
+	}
+	_, err := adb.ReadPacketFromTCP(buffer)
+	assert.Error(t, err)
+}
@@ -0,0 +1,204 @@
+package adb
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//The pairing protocol of wireless debugging: both sides do a TLS handshake, then a SPAKE2 exchange with the pairing code
+//and keying material exported from TLS as password, and finally exchange their PeerInfo encrypted with a key derived
+//from SPAKE2. Decrypting only works if both sides used the same code.
+const (
+	pairingVersion       = 1
+	pairingTypeSpake2    = 0
+	pairingTypePeerInfo  = 1
+	pairingHeaderSize    = 6
+	peerInfoSize         = 8192
+	maxPairingPayload    = 2 * peerInfoSize
+	peerInfoRSAPublicKey = 0
+	peerInfoDeviceGUID   = 1
+	//the label is a C string literal with an explicit NUL, adb passes its size including both NULs
+	pairingExportLabel = "adb-label\x00\x00"
+	pairingExportSize  = 64
+	pairingCipherInfo  = "adb pairing_auth aes-128-gcm key"
+	pairingTimeout     = 30 * time.Second
+)
+
+var (
+	pairingClientName = []byte("adb pair client\x00")
+	pairingServerName = []byte("adb pair server\x00")
+	//ErrWrongPairingCode is returned if the other side could not decrypt the PeerInfo, usually because of a wrong code
+	ErrWrongPairingCode = errors.New("pairing failed, wrong pairing code")
+)
+
+//Pair pairs go-adb with the device at address, the host:port shown in the wireless debugging settings when pairing
+//with a code. The device stores the public key of store, which then authenticates the STLS upgrade of network bridges.
+func Pair(store *KeyStore, address string, code string) (PairedDevice, error) {
+	log.WithFields(log.Fields{"address": address}).Info("pairing with device")
+	conn, err := net.DialTimeout("tcp", address, networkDialTimeout)
+	if err != nil {
+		return PairedDevice{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(pairingTimeout))
+	tlsConn := tls.Client(conn, store.TLSConfig())
+	err = tlsConn.Handshake()
+	if err != nil {
+		return PairedDevice{}, fmt.Errorf("pairing TLS handshake failed: %w", err)
+	}
+	peerInfo := encodePeerInfo(peerInfoRSAPublicKey, store.PublicKey())
+	theirType, guid, err := exchangePeerInfo(tlsConn, true, code, peerInfo)
+	if err != nil {
+		return PairedDevice{}, err
+	}
+	if theirType != peerInfoDeviceGUID {
+		return PairedDevice{}, fmt.Errorf("device sent PeerInfo of unknown type %d", theirType)
+	}
+	device := PairedDevice{GUID: guid, Address: address, Paired: time.Now()}
+	err = store.AddPaired(device)
+	if err != nil {
+		return device, fmt.Errorf("paired, but failed saving the pairing: %w", err)
+	}
+	log.WithFields(log.Fields{"address": address, "guid": guid}).Info("paired with device")
+	return device, nil
+}
+
+//ServePairing is the device side of pairing on conn, it returns the public key the client sent.
+//It behaves like adbd and is used to test pairing clients.
+func ServePairing(conn net.Conn, code string, guid string, certificate tls.Certificate) (string, error) {
+	conn.SetDeadline(time.Now().Add(pairingTimeout))
+	tlsConn := tls.Server(conn, &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientAuth:   tls.RequireAnyClientCert,
+		MinVersion:   tls.VersionTLS13,
+	})
+	err := tlsConn.Handshake()
+	if err != nil {
+		return "", fmt.Errorf("pairing TLS handshake failed: %w", err)
+	}
+	theirType, publicKey, err := exchangePeerInfo(tlsConn, false, code, encodePeerInfo(peerInfoDeviceGUID, guid))
+	if err != nil {
+		return "", err
+	}
+	if theirType != peerInfoRSAPublicKey {
+		return "", fmt.Errorf("client sent PeerInfo of unknown type %d", theirType)
+	}
+	return publicKey, nil
+}
+
+//exchangePeerInfo does the SPAKE2 exchange on the TLS connection and sends peerInfo encrypted with the resulting key.
+//It returns type and data of the PeerInfo of the other side.
+func exchangePeerInfo(conn *tls.Conn, client bool, code string, peerInfo []byte) (byte, string, error) {
+	state := conn.ConnectionState()
+	exported, err := state.ExportKeyingMaterial(pairingExportLabel, nil, pairingExportSize)
+	if err != nil {
+		return 0, "", err
+	}
+	password := append([]byte(code), exported...)
+	myName, theirName := pairingServerName, pairingClientName
+	if client {
+		myName, theirName = pairingClientName, pairingServerName
+	}
+	exchange, err := newSpake2(client, myName, theirName, password, rand.Reader)
+	if err != nil {
+		return 0, "", err
+	}
+	err = writePairingPacket(conn, pairingTypeSpake2, exchange.myMessage)
+	if err != nil {
+		return 0, "", err
+	}
+	theirMessage, err := readPairingPacket(conn, pairingTypeSpake2)
+	if err != nil {
+		return 0, "", err
+	}
+	key, err := exchange.processMessage(theirMessage)
+	if err != nil {
+		return 0, "", err
+	}
+	aead, err := pairingCipher(key)
+	if err != nil {
+		return 0, "", err
+	}
+	err = writePairingPacket(conn, pairingTypePeerInfo, aead.Seal(nil, pairingNonce(), peerInfo, nil))
+	if err != nil {
+		return 0, "", err
+	}
+	encrypted, err := readPairingPacket(conn, pairingTypePeerInfo)
+	if err != nil {
+		return 0, "", err
+	}
+	theirInfo, err := aead.Open(nil, pairingNonce(), encrypted, nil)
+	if err != nil || len(theirInfo) != peerInfoSize {
+		return 0, "", ErrWrongPairingCode
+	}
+	data := theirInfo[1:]
+	if end := bytes.IndexByte(data, 0); end != -1 {
+		data = data[:end]
+	}
+	return theirInfo[0], string(data), nil
+}
+
+//pairingCipher derives the AES-128-GCM key from the SPAKE2 key with HKDF-SHA256 without salt.
+func pairingCipher(key []byte) (cipher.AEAD, error) {
+	extract := hmac.New(sha256.New, make([]byte, sha256.Size))
+	extract.Write(key)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(pairingCipherInfo))
+	expand.Write([]byte{1})
+	block, err := aes.NewCipher(expand.Sum(nil)[:16])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//pairingNonce is the nonce of the first message in each direction, adb uses a sequence number starting at 0
+//and both sides only send one encrypted message.
+func pairingNonce() []byte {
+	return make([]byte, 12)
+}
+
+//encodePeerInfo returns a PeerInfo, one type byte followed by the NUL terminated data padded to peerInfoSize.
+func encodePeerInfo(infoType byte, data string) []byte {
+	info := make([]byte, peerInfoSize)
+	info[0] = infoType
+	copy(info[1:peerInfoSize-1], data)
+	return info
+}
+
+func writePairingPacket(writer io.Writer, packetType byte, payload []byte) error {
+	header := make([]byte, pairingHeaderSize)
+	header[0] = pairingVersion
+	header[1] = packetType
+	binary.BigEndian.PutUint32(header[2:], uint32(len(payload)))
+	_, err := writer.Write(append(header, payload...))
+	return err
+}
+
+func readPairingPacket(reader io.Reader, packetType byte) ([]byte, error) {
+	header := make([]byte, pairingHeaderSize)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[2:])
+	if header[0] != pairingVersion || header[1] != packetType || size == 0 || size > maxPairingPayload {
+		return nil, fmt.Errorf("invalid pairing packet header %x", header)
+	}
+	payload := make([]byte, size)
+	_, err = io.ReadFull(reader, payload)
+	return payload, err
+}
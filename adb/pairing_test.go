@@ -0,0 +1,202 @@
+package adb_test
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/danielpaulus/go-adb/adb"
+	"github.com/stretchr/testify/assert"
+)
+
+const pairingGUID = "adb-R58M123ABC-vWgJpq"
+
+type pairingResult struct {
+	publicKey string
+	err       error
+}
+
+//startPairingServer stands in for the pairing service of a device with wireless debugging.
+func startPairingServer(t *testing.T, code string, certificate tls.Certificate) (net.Listener, chan pairingResult) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	results := make(chan pairingResult, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		publicKey, err := adb.ServePairing(conn, code, pairingGUID, certificate)
+		results <- pairingResult{publicKey: publicKey, err: err}
+	}()
+	return listener, results
+}
+
+func TestPairing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	store, err := adb.OpenKeyStore(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	device, err := adb.OpenKeyStore("")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	listener, results := startPairingServer(t, "482913", device.Certificate())
+	defer listener.Close()
+	paired, err := adb.Pair(store, listener.Addr().String(), "482913")
+	if assert.NoError(t, err) {
+		assert.Equal(t, pairingGUID, paired.GUID)
+	}
+	result := <-results
+	assert.NoError(t, result.err)
+	assert.Equal(t, store.PublicKey(), result.publicKey)
+
+	reopened, err := adb.OpenKeyStore(dir)
+	if assert.NoError(t, err) {
+		assert.Equal(t, store.PublicKey(), reopened.PublicKey())
+		assert.Equal(t, 1, len(reopened.Paired()))
+		assert.True(t, reopened.PairedWith(fmt.Sprintf("127.0.0.1:%d", 5555)))
+	}
+
+	listener, results = startPairingServer(t, "482913", device.Certificate())
+	defer listener.Close()
+	_, err = adb.Pair(store, listener.Addr().String(), "111111")
+	assert.Equal(t, adb.ErrWrongPairingCode, err)
+	assert.Equal(t, adb.ErrWrongPairingCode, (<-results).err)
+}
+
+//startTLSDevice stands in for adbd with wireless debugging, it answers Cnxn with Stls and sends its Cnxn over TLS.
+//It reports the public key the client authenticated with.
+func startTLSDevice(t *testing.T, certificate tls.Certificate) (net.Listener, chan interface{}) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	clientKeys := make(chan interface{}, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		packet, err := adb.ReadPacketFromTCP(conn)
+		if err != nil || packet.Header.CommandType != adb.Cnxn {
+			clientKeys <- nil
+			return
+		}
+		adb.WritePacketToTCP(adb.Packet{Header: adb.PacketHeader{CommandType: adb.Stls, Arg0: 0x01000000}}, conn)
+		packet, err = adb.ReadPacketFromTCP(conn)
+		if err != nil || packet.Header.CommandType != adb.Stls {
+			clientKeys <- nil
+			return
+		}
+		tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{certificate}, ClientAuth: tls.RequireAnyClientCert})
+		err = tlsConn.Handshake()
+		if err != nil {
+			clientKeys <- nil
+			return
+		}
+		clientKeys <- tlsConn.ConnectionState().PeerCertificates[0].PublicKey
+		banner := []byte("device::")
+		adb.WritePacketToTCP(adb.Packet{Header: adb.PacketHeader{CommandType: adb.Cnxn, DataLength: uint32(len(banner))}, Payload: banner}, tlsConn)
+		io.Copy(ioutil.Discard, tlsConn)
+	}()
+	return listener, clientKeys
+}
+
+func TestNetworkBridgeCompletesSTLSUpgrade(t *testing.T) {
+	const port = 62201
+	store, err := adb.OpenKeyStore("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	device, err := adb.OpenKeyStore("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	adb.SetKeyStore(store)
+	defer adb.SetKeyStore(nil)
+	listener, results := startPairingServer(t, "482913", device.Certificate())
+	defer listener.Close()
+	_, err = adb.Pair(store, listener.Addr().String(), "482913")
+	if !assert.NoError(t, err) {
+		return
+	}
+	<-results
+
+	adbd, clientKeys := startTLSDevice(t, device.Certificate())
+	defer adbd.Close()
+	bridge := adb.NewNetworkBridge(adb.DeviceInfo{SerialNumber: "R58M123ABC", Mode: adb.ModeADB, NetworkAddress: adbd.Addr().String()}, port)
+	if !assert.NoError(t, bridge.Start()) {
+		return
+	}
+	defer bridge.Close()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	banner := []byte("host::")
+	err = adb.WritePacketToTCP(adb.Packet{Header: adb.PacketHeader{CommandType: adb.Cnxn, DataLength: uint32(len(banner))}, Payload: banner}, conn)
+	assert.NoError(t, err)
+	packet, err := adb.ReadPacketFromTCP(conn)
+	if assert.NoError(t, err) {
+		assert.Equal(t, adb.Cnxn, packet.Header.CommandType)
+		assert.Equal(t, "device::", string(packet.Payload))
+	}
+	assert.Equal(t, store.Certificate().PrivateKey.(*rsa.PrivateKey).Public(), <-clientKeys)
+	assert.Equal(t, true, bridge.Details()["tls"])
+}
+
+//TestSpake2KnownAnswer checks the SPAKE2 exchange against values computed with a transcription of SPAKE2_generate_msg
+//and SPAKE2_process_msg of BoringSSL's spake25519.c on top of the reference ed25519.py, for private keys made from the
+//bytes 0..63 (alice) and 64..127 (bob). BoringSSL itself publishes no vectors for it.
+func TestSpake2KnownAnswer(t *testing.T) {
+	aliceRandom := make([]byte, 64)
+	bobRandom := make([]byte, 64)
+	for i := range aliceRandom {
+		aliceRandom[i] = byte(i)
+		bobRandom[i] = byte(64 + i)
+	}
+	client, server := []byte("adb pair client\x00"), []byte("adb pair server\x00")
+	password := []byte("482913")
+
+	aliceMessage, aliceKey, err := adb.Spake2Exchange(true, client, server, password, bytes.NewReader(aliceRandom))
+	if !assert.NoError(t, err) {
+		return
+	}
+	bobMessage, bobKey, err := adb.Spake2Exchange(false, server, client, password, bytes.NewReader(bobRandom))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "b60333e23cf9dc71f585856d0dab667906dce1d377ae10cc14ada4f1e55b883b", hex.EncodeToString(aliceMessage))
+	assert.Equal(t, "ab8c650cc579a8d0d7dc7b4dd04f489f713679ecf1fe31e267d0343c9c75b2b7", hex.EncodeToString(bobMessage))
+
+	expectedKey := "aed521ef63f8faaff84f999c6b7937b08ae997c64c3ba01309040b37b3e0beb6" +
+		"64f1bf25a4a0b5bc7fca47573e65258ab429ed09bcfa5aa630218c3bd08b74d4"
+	key, err := aliceKey(bobMessage)
+	if assert.NoError(t, err) {
+		assert.Equal(t, expectedKey, hex.EncodeToString(key))
+	}
+	key, err = bobKey(aliceMessage)
+	if assert.NoError(t, err) {
+		assert.Equal(t, expectedKey, hex.EncodeToString(key))
+	}
+}
@@ -0,0 +1,203 @@
+package adb
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gousb"
+	log "github.com/sirupsen/logrus"
+)
+
+//USB 2.0 spec chapter 11.24 hub class requests, the same uhubctl uses
+const (
+	hubPortRequestType       = uint8(gousb.ControlOut | gousb.ControlClass | gousb.ControlOther)
+	hubDescriptorRequestType = uint8(gousb.ControlIn | gousb.ControlClass | gousb.ControlDevice)
+	hubRequestClearFeature   = 0x01
+	hubRequestSetFeature     = 0x03
+	hubRequestGetDescriptor  = 0x06
+	hubFeaturePortPower      = 8
+	hubDescriptorType        = 0x29
+	superSpeedHubDescriptor  = 0x2a
+	//bits 0-1 of wHubCharacteristics, 01 means individual port power switching
+	hubPowerSwitchingMask = 0x03
+	hubPerPortPower       = 0x01
+)
+
+//PortPowerOffTime is how long a port stays switched off during a power cycle.
+const PortPowerOffTime = 3 * time.Second
+
+//sysfsUsbDevices contains one directory per USB device named after its port path, f.ex. 1-2.3
+var sysfsUsbDevices = "/sys/bus/usb/devices"
+
+//HubControl sends control requests to a USB hub. It is implemented by *gousb.Device and exists so hubs can be faked in tests.
+type HubControl interface {
+	Control(rType, request uint8, val, idx uint16, data []byte) (int, error)
+}
+
+//PortLocation is the hub port a device is plugged into.
+type PortLocation struct {
+	//Path is the port path of the device as used by sysfs, f.ex. 1-2.3 is port 3 of the hub on port 2 of the root hub of bus 1
+	Path       string
+	Bus        int
+	HubAddress int
+	Port       int
+}
+
+//LocatePort looks up the device with the given bus number and address in the sysfs USB device tree below
+//sysfsRoot and returns the hub and port it is connected to.
+func LocatePort(sysfsRoot string, bus int, address int) (PortLocation, error) {
+	path, err := findSysfsPath(sysfsRoot, bus, address)
+	if err != nil {
+		return PortLocation{}, err
+	}
+	return portOfPath(sysfsRoot, path, bus)
+}
+
+//LocateDevicePort returns the hub and port of the USB port path of device, f.ex. 1-2.3, without opening the device.
+//Devices that need a power cycle often cannot be opened anymore or left the bus.
+func LocateDevicePort(sysfsRoot string, device DeviceInfo) (PortLocation, error) {
+	path := device.PortPath()
+	if path == "" {
+		return PortLocation{}, fmt.Errorf("USB port of device %s is unknown", device.SerialNumber)
+	}
+	return portOfPath(sysfsRoot, path, device.Bus)
+}
+
+func portOfPath(sysfsRoot string, path string, bus int) (PortLocation, error) {
+	hubPath := fmt.Sprintf("usb%d", bus)
+	portIndex := strings.LastIndex(path, ".")
+	if portIndex == -1 {
+		portIndex = strings.LastIndex(path, "-")
+	} else {
+		hubPath = path[:portIndex]
+	}
+	port, err := strconv.Atoi(path[portIndex+1:])
+	if err != nil {
+		return PortLocation{}, fmt.Errorf("invalid USB port path %s", path)
+	}
+	hubAddress, err := readSysfsInt(sysfsRoot, hubPath, "devnum")
+	if err != nil {
+		return PortLocation{}, fmt.Errorf("could not find hub of %s: %w", path, err)
+	}
+	return PortLocation{Path: path, Bus: bus, HubAddress: hubAddress, Port: port}, nil
+}
+
+func readSysfsInt(sysfsRoot string, path string, attribute string) (int, error) {
+	value, err := ioutil.ReadFile(filepath.Join(sysfsRoot, path, attribute))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(value)))
+}
+
+//HubPorts reads the hub descriptor and returns the number of ports of the hub and whether it can switch power per port.
+//superSpeed has to be set for USB 3 hubs, they use a different descriptor type.
+func HubPorts(hub HubControl, superSpeed bool) (int, bool, error) {
+	descriptorType := hubDescriptorType
+	if superSpeed {
+		descriptorType = superSpeedHubDescriptor
+	}
+	descriptor := make([]byte, 16)
+	n, err := hub.Control(hubDescriptorRequestType, hubRequestGetDescriptor, uint16(descriptorType)<<8, 0, descriptor)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed reading hub descriptor: %w", err)
+	}
+	//bLength, bDescriptorType, bNbrPorts, wHubCharacteristics
+	if n < 5 {
+		return 0, false, errors.New("hub descriptor too short")
+	}
+	ports := int(descriptor[2])
+	characteristics := uint16(descriptor[3]) | uint16(descriptor[4])<<8
+	return ports, characteristics&hubPowerSwitchingMask == hubPerPortPower, nil
+}
+
+//SetPortPower switches the power of a hub port on or off.
+func SetPortPower(hub HubControl, port int, on bool) error {
+	request := uint8(hubRequestClearFeature)
+	if on {
+		request = hubRequestSetFeature
+	}
+	_, err := hub.Control(hubPortRequestType, request, hubFeaturePortPower, uint16(port), nil)
+	return err
+}
+
+//PowerCycleHubPort checks that the hub supports per port power switching, switches port off, waits offTime
+//and switches it on again.
+func PowerCycleHubPort(hub HubControl, superSpeed bool, port int, offTime time.Duration) error {
+	ports, perPort, err := HubPorts(hub, superSpeed)
+	if err != nil {
+		return err
+	}
+	if port < 1 || port > ports {
+		return fmt.Errorf("hub has no port %d, it has %d ports", port, ports)
+	}
+	if !perPort {
+		return errors.New("hub does not support per port power switching")
+	}
+	err = SetPortPower(hub, port, false)
+	if err != nil {
+		return fmt.Errorf("failed switching off port %d: %w", port, err)
+	}
+	time.Sleep(offTime)
+	err = SetPortPower(hub, port, true)
+	if err != nil {
+		return fmt.Errorf("failed switching on port %d: %w", port, err)
+	}
+	return nil
+}
+
+//PowerCycle switches off the hub port the device is connected to and switches it on again.
+//The port is taken from the port path of device, only devices without known port path are opened to find it.
+//It can be used as recovery hook with SetPowerCycleHook.
+func PowerCycle(device DeviceInfo) error {
+	ctx := gousb.NewContext()
+	defer ctx.Close()
+	if device.PortPath() != "" {
+		location, err := LocateDevicePort(sysfsUsbDevices, device)
+		if err != nil {
+			return err
+		}
+		return powerCycleLocation(ctx, location)
+	}
+	usbDevice, err := OpenDevice(ctx, device)
+	if err != nil {
+		return err
+	}
+	bus, address := usbDevice.Desc.Bus, usbDevice.Desc.Address
+	usbDevice.Close()
+	location, err := LocatePort(sysfsUsbDevices, bus, address)
+	if err != nil {
+		return err
+	}
+	return powerCycleLocation(ctx, location)
+}
+
+//PowerCycleBySerial power cycles the hub port of the Android device with the given serial.
+func PowerCycleBySerial(serial string) error {
+	ctx := gousb.NewContext()
+	device, err := findDeviceBySerial(ctx, serial)
+	ctx.Close()
+	if err != nil {
+		return err
+	}
+	return PowerCycle(device)
+}
+
+func powerCycleLocation(ctx *gousb.Context, location PortLocation) error {
+	hubs, _ := ctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
+		return desc.Bus == location.Bus && desc.Address == location.HubAddress && desc.Class == gousb.ClassHub
+	})
+	defer closeDevices(hubs)
+	if len(hubs) == 0 {
+		return fmt.Errorf("could not open hub of device %s", location.Path)
+	}
+	hub := hubs[0]
+	superSpeed := hub.Desc.Spec >= gousb.Version(3, 0)
+	log.WithFields(log.Fields{"path": location.Path, "hub": hub.String(), "port": location.Port}).Info("power cycling hub port")
+	return PowerCycleHubPort(hub, superSpeed, location.Port, PortPowerOffTime)
+}
@@ -0,0 +1,120 @@
+package adb_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/danielpaulus/go-adb/adb"
+	"github.com/stretchr/testify/assert"
+)
+
+//fakeHub answers hub class requests like a hub with the given number of ports and keeps track of their power
+type fakeHub struct {
+	ports   int
+	perPort bool
+	power   map[int]bool
+	changes []bool
+	fail    error
+}
+
+func newFakeHub(ports int, perPort bool) *fakeHub {
+	hub := &fakeHub{ports: ports, perPort: perPort, power: map[int]bool{}}
+	for port := 1; port <= ports; port++ {
+		hub.power[port] = true
+	}
+	return hub
+}
+
+func (h *fakeHub) Control(rType, request uint8, val, idx uint16, data []byte) (int, error) {
+	if h.fail != nil {
+		return 0, h.fail
+	}
+	switch {
+	case rType == 0xa0 && request == 0x06 && val>>8 == 0x29:
+		characteristics := byte(0x00)
+		if h.perPort {
+			characteristics = 0x01
+		}
+		descriptor := []byte{9, 0x29, byte(h.ports), characteristics, 0, 50, 100, 0, 0xff}
+		return copy(data, descriptor), nil
+	case rType == 0x23 && val == 8 && (request == 0x01 || request == 0x03):
+		if int(idx) < 1 || int(idx) > h.ports {
+			return 0, errors.New("pipe error")
+		}
+		h.power[int(idx)] = request == 0x03
+		h.changes = append(h.changes, request == 0x03)
+		return 0, nil
+	}
+	return 0, errors.New("unsupported request")
+}
+
+func TestPowerCycleHubPort(t *testing.T) {
+	hub := newFakeHub(4, true)
+	ports, perPort, err := adb.HubPorts(hub, false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 4, ports)
+		assert.True(t, perPort)
+	}
+
+	err = adb.PowerCycleHubPort(hub, false, 3, time.Millisecond)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []bool{false, true}, hub.changes)
+		assert.True(t, hub.power[3])
+	}
+
+	assert.Error(t, adb.PowerCycleHubPort(hub, false, 5, time.Millisecond))
+
+	ganged := newFakeHub(4, false)
+	assert.Error(t, adb.PowerCycleHubPort(ganged, false, 1, time.Millisecond))
+	assert.Equal(t, 0, len(ganged.changes))
+
+	broken := newFakeHub(4, true)
+	broken.fail = errors.New("no permission")
+	assert.Error(t, adb.PowerCycleHubPort(broken, false, 1, time.Millisecond))
+}
+
+func TestLocatePort(t *testing.T) {
+	sysfs, err := ioutil.TempDir("", "sysfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(sysfs)
+	//bus 1: root hub usb1 with a hub on port 2 and a phone on port 3 of that hub, bus 2: a phone on root hub port 4
+	devices := map[string][2]string{
+		"usb1":  {"1", "1"},
+		"1-2":   {"1", "5"},
+		"1-2.3": {"1", "9"},
+		"usb2":  {"2", "1"},
+		"2-4":   {"2", "3"},
+	}
+	for path, numbers := range devices {
+		dir := filepath.Join(sysfs, path)
+		assert.NoError(t, os.Mkdir(dir, 0755))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "busnum"), []byte(numbers[0]+"\n"), 0644))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "devnum"), []byte(numbers[1]+"\n"), 0644))
+	}
+	assert.NoError(t, os.Mkdir(filepath.Join(sysfs, "1-2.3:1.0"), 0755))
+
+	location, err := adb.LocatePort(sysfs, 1, 9)
+	if assert.NoError(t, err) {
+		assert.Equal(t, adb.PortLocation{Path: "1-2.3", Bus: 1, HubAddress: 5, Port: 3}, location)
+	}
+	location, err = adb.LocatePort(sysfs, 2, 3)
+	if assert.NoError(t, err) {
+		assert.Equal(t, adb.PortLocation{Path: "2-4", Bus: 2, HubAddress: 1, Port: 4}, location)
+	}
+	_, err = adb.LocatePort(sysfs, 1, 42)
+	assert.Error(t, err)
+
+	//the port path is enough, devices that are not on the bus anymore can be located too
+	location, err = adb.LocateDevicePort(sysfs, adb.DeviceInfo{SerialNumber: "gone", Bus: 1, Ports: []int{2, 7}})
+	if assert.NoError(t, err) {
+		assert.Equal(t, adb.PortLocation{Path: "1-2.7", Bus: 1, HubAddress: 5, Port: 7}, location)
+	}
+	_, err = adb.LocateDevicePort(sysfs, adb.DeviceInfo{SerialNumber: "unknown"})
+	assert.Error(t, err)
+}
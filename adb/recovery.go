@@ -0,0 +1,152 @@
+package adb
+
+import (
+	"time"
+)
+
+//RecoveryStep is one step of the escalation ladder a UsbTcpBridge climbs when its device keeps failing.
+type RecoveryStep int
+
+const (
+	//RecoveryReopen opens the device again with a fresh libusb context
+	RecoveryReopen RecoveryStep = iota
+	//RecoveryReclaim detaches kernel drivers and claims and releases the adb interface before reopening
+	RecoveryReclaim
+	//RecoveryReset sends a USB port reset to exactly this device
+	RecoveryReset
+	//RecoveryPowerCycle switches the hub port of the device off and on, see SetPowerCycleHook
+	RecoveryPowerCycle
+)
+
+func (s RecoveryStep) String() string {
+	switch s {
+	case RecoveryReopen:
+		return "reopen"
+	case RecoveryReclaim:
+		return "reclaim"
+	case RecoveryReset:
+		return "reset"
+	case RecoveryPowerCycle:
+		return "powercycle"
+	default:
+		return "unknown"
+	}
+}
+
+const recoveryAttemptsSize = 10
+
+//RecoveryPolicy configures when a bridge starts recovering a device and how often it tries.
+type RecoveryPolicy struct {
+	//FailureThreshold is the number of consecutive connect or read failures before the first recovery step is taken
+	FailureThreshold int
+	//MinInterval is the minimum time between two recovery attempts
+	MinInterval time.Duration
+	//MaxInterval caps the interval, which doubles with every attempt once the last step of the ladder is reached
+	MaxInterval time.Duration
+	//StableTime is how long a bridge has to stay online until the device counts as recovered
+	StableTime time.Duration
+}
+
+//DefaultRecoveryPolicy is used by all UsbTcpBridges.
+var DefaultRecoveryPolicy = RecoveryPolicy{
+	FailureThreshold: 3,
+	MinInterval:      30 * time.Second,
+	MaxInterval:      30 * time.Minute,
+	StableTime:       time.Minute,
+}
+
+//PowerCycleFunc switches off the power of the hub port the device is connected to and switches it on again.
+type PowerCycleFunc func(device DeviceInfo) error
+
+var powerCycle PowerCycleFunc
+
+//SetPowerCycleHook configures the function used for the last recovery step.
+//Without a hook, a USB reset is used instead.
+func SetPowerCycleHook(hook PowerCycleFunc) {
+	powerCycle = hook
+}
+
+//RecoveryAttempt records one recovery step taken by a bridge and its error, if it failed.
+type RecoveryAttempt struct {
+	Step  string    `json:"step"`
+	Time  time.Time `json:"time"`
+	Error string    `json:"error,omitempty"`
+}
+
+//RecoveryStatus shows how far a bridge has escalated recovering its device.
+type RecoveryStatus struct {
+	Failures int               `json:"failures"`
+	NextStep string            `json:"nextStep"`
+	Attempts []RecoveryAttempt `json:"attempts"`
+}
+
+//Recovery counts consecutive failures of a device and decides which recovery step to take next.
+//Every recovery attempt escalates to the next step, attempts are rate limited by the RecoveryPolicy.
+//It is not safe for concurrent use.
+type Recovery struct {
+	policy      RecoveryPolicy
+	failures    int
+	next        RecoveryStep
+	interval    time.Duration
+	lastAttempt time.Time
+	attempts    []RecoveryAttempt
+}
+
+//NewRecovery creates a Recovery that escalates according to policy.
+func NewRecovery(policy RecoveryPolicy) *Recovery {
+	return &Recovery{policy: policy, interval: policy.MinInterval, attempts: make([]RecoveryAttempt, 0)}
+}
+
+//Failure records a failed connect or a broken USB read loop that happened at now. It returns the recovery
+//step to take and true, or false if the bridge should just retry because the failure threshold is not reached
+//or the last attempt was too recent.
+func (r *Recovery) Failure(now time.Time) (RecoveryStep, bool) {
+	r.failures++
+	if r.failures < r.policy.FailureThreshold {
+		return 0, false
+	}
+	if !r.lastAttempt.IsZero() && now.Sub(r.lastAttempt) < r.interval {
+		return 0, false
+	}
+	step := r.next
+	if r.next < RecoveryPowerCycle {
+		r.next++
+	} else {
+		r.interval *= 2
+		if r.interval > r.policy.MaxInterval {
+			r.interval = r.policy.MaxInterval
+		}
+	}
+	r.lastAttempt = now
+	r.attempts = append(r.attempts, RecoveryAttempt{Step: step.String(), Time: now})
+	if len(r.attempts) > recoveryAttemptsSize {
+		r.attempts = r.attempts[1:]
+	}
+	return step, true
+}
+
+//Attempted records the step that was actually taken for the last attempt returned by Failure and its error.
+func (r *Recovery) Attempted(step RecoveryStep, err error) {
+	if len(r.attempts) == 0 {
+		return
+	}
+	last := &r.attempts[len(r.attempts)-1]
+	last.Step = step.String()
+	if err != nil {
+		last.Error = err.Error()
+	}
+}
+
+//Success resets the ladder after the device has been working for a while.
+func (r *Recovery) Success() {
+	r.failures = 0
+	r.next = RecoveryReopen
+	r.interval = r.policy.MinInterval
+}
+
+//Status returns the current failure count, the next step and the most recent attempts.
+func (r *Recovery) Status() RecoveryStatus {
+	attempts := make([]RecoveryAttempt, len(r.attempts))
+	copy(attempts, r.attempts)
+	return RecoveryStatus{Failures: r.failures, NextStep: r.next.String(), Attempts: attempts}
+}
@@ -0,0 +1,52 @@
+package adb_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/danielpaulus/go-adb/adb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecoveryEscalation(t *testing.T) {
+	policy := adb.RecoveryPolicy{FailureThreshold: 3, MinInterval: time.Second, MaxInterval: 4 * time.Second, StableTime: time.Minute}
+	recovery := adb.NewRecovery(policy)
+	now := time.Now()
+
+	_, recover := recovery.Failure(now)
+	assert.False(t, recover)
+	_, recover = recovery.Failure(now)
+	assert.False(t, recover)
+
+	expected := []adb.RecoveryStep{adb.RecoveryReopen, adb.RecoveryReclaim, adb.RecoveryReset, adb.RecoveryPowerCycle, adb.RecoveryPowerCycle}
+	for _, expectedStep := range expected {
+		step, recover := recovery.Failure(now)
+		if assert.True(t, recover) {
+			assert.Equal(t, expectedStep, step)
+		}
+		//attempts are rate limited
+		_, recover = recovery.Failure(now.Add(time.Millisecond))
+		assert.False(t, recover)
+		now = now.Add(2 * time.Second)
+	}
+	recovery.Attempted(adb.RecoveryReset, errors.New("no such device"))
+
+	status := recovery.Status()
+	assert.Equal(t, 12, status.Failures)
+	assert.Equal(t, "powercycle", status.NextStep)
+	if assert.Equal(t, 5, len(status.Attempts)) {
+		assert.Equal(t, "reopen", status.Attempts[0].Step)
+		assert.Equal(t, "reset", status.Attempts[4].Step)
+		assert.Equal(t, "no such device", status.Attempts[4].Error)
+	}
+
+	//once the last step is reached, the interval doubles
+	_, recover = recovery.Failure(now)
+	assert.False(t, recover)
+
+	recovery.Success()
+	_, recover = recovery.Failure(now.Add(time.Hour))
+	assert.False(t, recover)
+	assert.Equal(t, "reopen", recovery.Status().NextStep)
+}
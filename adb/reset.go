@@ -19,6 +19,18 @@ func ResetByVIDPID(vid int, pid int) error {
 	return resetDeviceVIDPID(ctx, gousb.ID(vid), gousb.ID(pid))
 }
 
+//ResetDevice sends a USB port reset to exactly the given device, other devices with the same VID and PID are not affected.
+func ResetDevice(device DeviceInfo) error {
+	ctx := gousb.NewContext()
+	defer ctx.Close()
+	usbDevice, err := OpenDevice(ctx, device)
+	if err != nil {
+		return err
+	}
+	defer usbDevice.Close()
+	return usbDevice.Reset()
+}
+
 func resetDeviceVIDPID(ctx *gousb.Context, vid gousb.ID, pid gousb.ID) error {
 	devices, _ := ctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
 		// this function is called for every device present.
@@ -35,19 +47,28 @@ func resetDeviceVIDPID(ctx *gousb.Context, vid gousb.ID, pid gousb.ID) error {
 }
 
 func resetDevice(ctx *gousb.Context, serial string) error {
-	devices, _ := ctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
-		// this function is called for every device present.
-		// Returning true means the device should be opened.
-		return isAndroidDevice(desc)
-	})
-	defer closeDevices(devices)
-	for _, dev := range devices {
-		s, err := dev.SerialNumber()
-		log.Warnf("could not get serial for device err:%v", err)
-		if serial == s {
-			return dev.Reset()
-		}
+	device, err := findDeviceBySerial(ctx, serial)
+	if err != nil {
+		return err
+	}
+	usbDevice, err := OpenDevice(ctx, device)
+	if err != nil {
+		return err
 	}
+	defer usbDevice.Close()
+	return usbDevice.Reset()
+}
 
-	return fmt.Errorf("device '%s' not found", serial)
+//findDeviceBySerial returns the connected Android device with the given serial, which can be a serial made up by go-adb.
+func findDeviceBySerial(ctx *gousb.Context, serial string) (DeviceInfo, error) {
+	devices, err := findDevices(ctx)
+	for _, device := range devices {
+		if device.SerialNumber == serial {
+			return device, nil
+		}
+	}
+	if err != nil {
+		log.Warnf("device list might be incomplete: %v", err)
+	}
+	return DeviceInfo{}, fmt.Errorf("device '%s' not found", serial)
 }
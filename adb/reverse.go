@@ -0,0 +1,290 @@
+package adb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//ErrReverseNotFound is returned when removing a reverse forward that does not exist
+var ErrReverseNotFound = errors.New("reverse forward not found")
+
+//Reverse is a socket of the device forwarded to a socket of the host, both given like adb reverse does,
+//f.ex. tcp:8080 on the device to tcp:8080 on the host.
+type Reverse struct {
+	Remote      string `json:"remote"`
+	Local       string `json:"local"`
+	Connections int    `json:"connections"`
+}
+
+//Reverses does what adb reverse does without an adb server. The device listens on the remote socket and opens
+//a stream to go-adb for every connection, which go-adb connects to the local socket of the host.
+//Devices forget reverse forwards when their adb connection is reset, f.ex. when they reboot, so Reverses
+//sets them up again every time the device comes online.
+type Reverses struct {
+	session  *Session
+	reverses []*reverseForward
+	save     func([]Reverse)
+	mux      sync.Mutex
+}
+
+type reverseForward struct {
+	remote      string
+	local       string
+	connections map[*Stream]net.Conn
+}
+
+//NewReverses creates Reverses for the device of session.
+func NewReverses(session *Session) *Reverses {
+	reverses := &Reverses{session: session, reverses: make([]*reverseForward, 0), save: func([]Reverse) {}}
+	session.mux.Lock()
+	session.accept = reverses.accept
+	session.mux.Unlock()
+	session.whenOnline(reverses.apply)
+	return reverses
+}
+
+//Restore sets the reverse forwards without contacting the device, they are set up once the device comes online.
+//save is called with all reverse forwards whenever they change.
+func (r *Reverses) Restore(reverses []Reverse, save func([]Reverse)) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.save = save
+	for _, restored := range reverses {
+		r.reverses = append(r.reverses, &reverseForward{remote: restored.Remote, local: restored.Local, connections: map[*Stream]net.Conn{}})
+	}
+}
+
+//Add makes the device forward its socket remote to the host socket local. remote is any socket adbd can listen on,
+//f.ex. tcp:8080 or localabstract:<name>, tcp:0 picks a free port. local is tcp:<port> on localhost or tcp:<host>:<port>
+//with a loopback host like 127.0.0.1. If remote is forwarded already, it is forwarded to local from now on.
+func (r *Reverses) Add(remote string, local string) (Reverse, error) {
+	if !strings.Contains(remote, ":") || strings.HasPrefix(remote, ":") {
+		return Reverse{}, fmt.Errorf("%w: %s", ErrInvalidSocket, remote)
+	}
+	if _, err := socketAddress(local); err != nil {
+		return Reverse{}, err
+	}
+	resolved, err := r.request(fmt.Sprintf("forward:%s;%s", remote, local))
+	if err != nil {
+		return Reverse{}, err
+	}
+	if resolved != "" {
+		remote = "tcp:" + resolved
+	}
+	r.mux.Lock()
+	added := r.find(remote)
+	if added == nil {
+		added = &reverseForward{remote: remote, connections: map[*Stream]net.Conn{}}
+		r.reverses = append(r.reverses, added)
+	}
+	added.local = local
+	info := added.info()
+	r.mux.Unlock()
+	r.session.log().Infof("reverse forwarding %s to %s", remote, local)
+	r.changed()
+	return info, nil
+}
+
+//Remove stops forwarding the socket remote of the device and closes its connections.
+func (r *Reverses) Remove(remote string) error {
+	r.mux.Lock()
+	index := -1
+	for i, reverse := range r.reverses {
+		if reverse.remote == remote {
+			index = i
+			reverse.close()
+		}
+	}
+	if index == -1 {
+		r.mux.Unlock()
+		return fmt.Errorf("%w: %s", ErrReverseNotFound, remote)
+	}
+	r.reverses = append(r.reverses[:index], r.reverses[index+1:]...)
+	r.mux.Unlock()
+	r.changed()
+	if !r.session.Online() {
+		return nil
+	}
+	_, err := r.request("killforward:" + remote)
+	if err != nil {
+		r.session.log().Warnf("failed removing reverse forward %s from the device: %v", remote, err)
+	}
+	r.session.log().Infof("stopped reverse forwarding %s", remote)
+	return nil
+}
+
+//List returns all reverse forwards in the order they were added.
+func (r *Reverses) List() []Reverse {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	result := make([]Reverse, len(r.reverses))
+	for i, reverse := range r.reverses {
+		result[i] = reverse.info()
+	}
+	return result
+}
+
+//Connect connects to the device if there are reverse forwards to set up, it is called when the bridge connected to the device.
+func (r *Reverses) Connect() {
+	r.mux.Lock()
+	empty := len(r.reverses) == 0
+	r.mux.Unlock()
+	if empty || r.session.Online() {
+		return
+	}
+	err := r.session.connect()
+	if err != nil {
+		r.session.log().Warnf("failed connecting to set up reverse forwards: %v", err)
+	}
+}
+
+//Close closes all connections of reverse forwards.
+func (r *Reverses) Close() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for _, reverse := range r.reverses {
+		reverse.close()
+	}
+}
+
+//apply sets up all reverse forwards on the device after it came online.
+func (r *Reverses) apply() {
+	for _, reverse := range r.List() {
+		_, err := r.request(fmt.Sprintf("forward:%s;%s", reverse.Remote, reverse.Local))
+		if err != nil {
+			r.session.log().Warnf("failed setting up reverse forward %s to %s: %v", reverse.Remote, reverse.Local, err)
+			continue
+		}
+		r.session.log().Infof("reverse forwarding %s to %s", reverse.Remote, reverse.Local)
+	}
+}
+
+func (r *Reverses) changed() {
+	reverses := r.List()
+	for i := range reverses {
+		reverses[i].Connections = 0
+	}
+	r.mux.Lock()
+	save := r.save
+	r.mux.Unlock()
+	save(reverses)
+}
+
+//find returns the reverse forward of remote, it must be called with mux locked.
+func (r *Reverses) find(remote string) *reverseForward {
+	for _, reverse := range r.reverses {
+		if reverse.remote == remote {
+			return reverse
+		}
+	}
+	return nil
+}
+
+//request sends a request to the reverse service of the device, f.ex. forward:tcp:8080;tcp:8080.
+//It returns the string the device sent after OKAY, which is the port it picked for tcp:0.
+func (r *Reverses) request(service string) (string, error) {
+	stream, err := r.session.Open("reverse:" + service)
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+	reply, err := ioutil.ReadAll(stream)
+	if err != nil {
+		return "", err
+	}
+	if bytes.HasPrefix(reply, []byte("OKAY")) {
+		return protocolString(reply[4:]), nil
+	}
+	if bytes.HasPrefix(reply, []byte("FAIL")) {
+		return "", fmt.Errorf("device refused reverse:%s: %s", service, protocolString(reply[4:]))
+	}
+	return "", fmt.Errorf("unexpected reply to reverse:%s: %q", service, reply)
+}
+
+//protocolString decodes a string prefixed with its length in 4 hex digits, which is how adb services send strings.
+func protocolString(data []byte) string {
+	if len(data) < 4 {
+		return ""
+	}
+	length, err := strconv.ParseUint(string(data[:4]), 16, 16)
+	if err != nil || int(length) > len(data)-4 {
+		return string(data)
+	}
+	return string(data[4 : 4+length])
+}
+
+//accept takes the streams the device opens for a reverse forward and connects them to its local socket.
+func (r *Reverses) accept(stream *Stream) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for _, reverse := range r.reverses {
+		if reverse.local == stream.Destination() {
+			reverse.connections[stream] = nil
+			go r.relay(reverse, stream)
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Reverses) relay(reverse *reverseForward, stream *Stream) {
+	defer func() {
+		stream.Close()
+		r.mux.Lock()
+		delete(reverse.connections, stream)
+		r.mux.Unlock()
+	}()
+	conn, err := dialSocket(reverse.local)
+	if err != nil {
+		r.session.log().WithFields(log.Fields{"remote": reverse.remote, "local": reverse.local}).Warnf("failed connecting reverse forward: %v", err)
+		return
+	}
+	defer conn.Close()
+	r.mux.Lock()
+	_, open := reverse.connections[stream]
+	if open {
+		reverse.connections[stream] = conn
+	}
+	r.mux.Unlock()
+	if !open {
+		return
+	}
+	err = stream.Accept()
+	if err != nil {
+		return
+	}
+	hostDone := make(chan struct{})
+	go func() {
+		defer close(hostDone)
+		io.Copy(stream, conn)
+		//unblocks reading from the stream
+		stream.Close()
+	}()
+	io.Copy(conn, stream)
+	//unblocks reading from the host
+	conn.Close()
+	<-hostDone
+}
+
+func (rv *reverseForward) info() Reverse {
+	return Reverse{Remote: rv.remote, Local: rv.local, Connections: len(rv.connections)}
+}
+
+//close closes the connections of the reverse forward, it must be called with the mux of Reverses locked.
+func (rv *reverseForward) close() {
+	for stream, conn := range rv.connections {
+		stream.Close()
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package adb_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/danielpaulus/go-adb/adb"
+	"github.com/stretchr/testify/assert"
+)
+
+//startEchoServer listens on a free port of localhost and echoes every connection.
+func startEchoServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go echoService(conn)
+		}
+	}()
+	return listener
+}
+
+func (d *fakeDevice) reverse(remote string) (string, bool) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	local, ok := d.reverses[remote]
+	return local, ok
+}
+
+func TestReversesConnectDeviceToHost(t *testing.T) {
+	device := startFakeDevice(t)
+	defer adb.SetKeyStore(nil)
+	listener := startEchoServer(t)
+	defer listener.Close()
+	local := "tcp:" + listener.Addr().String()
+	reverses := adb.NewReverses(device.session)
+	defer reverses.Close()
+
+	reverse, err := reverses.Add("tcp:8080", local)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, adb.Reverse{Remote: "tcp:8080", Local: local}, reverse)
+
+	conn, err := device.connectReverse("tcp:8080")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.Write([]byte("hello"))
+	assert.NoError(t, err)
+	reply := make([]byte, 5)
+	_, err = io.ReadFull(conn, reply)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(reply))
+	assert.Equal(t, []adb.Reverse{{Remote: "tcp:8080", Local: local, Connections: 1}}, reverses.List())
+
+	picked, err := reverses.Add("tcp:0", local)
+	assert.NoError(t, err)
+	assert.Equal(t, "tcp:41000", picked.Remote)
+
+	assert.NoError(t, reverses.Remove("tcp:8080"))
+	_, err = conn.Read(reply)
+	assert.Error(t, err)
+	_, ok := device.reverse("tcp:8080")
+	assert.False(t, ok)
+	assert.True(t, errors.Is(reverses.Remove("tcp:8080"), adb.ErrReverseNotFound))
+	assert.Equal(t, []adb.Reverse{{Remote: "tcp:41000", Local: local}}, reverses.List())
+}
+
+func TestReversesAreSetUpAgainAfterReboot(t *testing.T) {
+	device := startFakeDevice(t)
+	defer adb.SetKeyStore(nil)
+	reverses := adb.NewReverses(device.session)
+	defer reverses.Close()
+	saved := make(chan []adb.Reverse, 10)
+	reverses.Restore([]adb.Reverse{{Remote: "tcp:8080", Local: "tcp:9000"}}, func(list []adb.Reverse) { saved <- list })
+
+	reverses.Connect()
+	assert.Eventually(t, func() bool {
+		local, ok := device.reverse("tcp:8080")
+		return ok && local == "tcp:9000"
+	}, time.Second, 10*time.Millisecond)
+
+	_, err := reverses.Add("localabstract:app", "tcp:9001")
+	assert.NoError(t, err)
+	assert.Equal(t, []adb.Reverse{{Remote: "tcp:8080", Local: "tcp:9000"}, {Remote: "localabstract:app", Local: "tcp:9001"}}, <-saved)
+
+	device.reboot()
+	_, ok := device.reverse("tcp:8080")
+	assert.False(t, ok)
+	reverses.Connect()
+	assert.Eventually(t, func() bool {
+		_, first := device.reverse("tcp:8080")
+		_, second := device.reverse("localabstract:app")
+		return first && second
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestReversesRejectInvalidSockets(t *testing.T) {
+	reverses := adb.NewReverses(adb.NewSession(0, "fake", func(adb.Packet) error { return adb.ErrDeviceOffline }))
+	for _, local := range []string{"9000", "tcp:", "tcp:abc", "udp:9000"} {
+		_, err := reverses.Add("tcp:8080", local)
+		assert.True(t, errors.Is(err, adb.ErrInvalidSocket), local)
+	}
+	_, err := reverses.Add("8080", "tcp:9000")
+	assert.True(t, errors.Is(err, adb.ErrInvalidSocket))
+	for _, local := range []string{"tcp:192.168.1.20:9000", "tcp:example.com:9000", "localfilesystem:/run/docker.sock", "localabstract:app"} {
+		_, err := reverses.Add("tcp:8080", local)
+		assert.True(t, errors.Is(err, adb.ErrSocketNotAllowed), local)
+	}
+	_, err = reverses.Add("tcp:8080", "tcp:[::1]:9000")
+	assert.False(t, errors.Is(err, adb.ErrSocketNotAllowed))
+}
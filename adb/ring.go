@@ -0,0 +1,48 @@
+package adb
+
+import "sync"
+
+//ring is a fixed size ring buffer keeping the most recent values added to it, once it is full the oldest
+//value is overwritten. StateHistory and LogBuffer are built on it. It is safe for concurrent use.
+type ring struct {
+	values []interface{}
+	next   int
+	full   bool
+	mux    sync.Mutex
+}
+
+func newRing(size int) ring {
+	return ring{values: make([]interface{}, size)}
+}
+
+func (r *ring) add(value interface{}) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.values[r.next] = value
+	r.next = (r.next + 1) % len(r.values)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+//last returns up to n of the most recent values, oldest first. If n is zero or negative, all stored values are returned.
+func (r *ring) last(n int) []interface{} {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	count := r.next
+	if r.full {
+		count = len(r.values)
+	}
+	if n <= 0 || n > count {
+		n = count
+	}
+	result := make([]interface{}, n)
+	start := r.next - n
+	if start < 0 {
+		start += len(r.values)
+	}
+	for i := 0; i < n; i++ {
+		result[i] = r.values[(start+i)%len(r.values)]
+	}
+	return result
+}
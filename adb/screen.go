@@ -0,0 +1,188 @@
+package adb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	//ErrRecording is returned when starting a screen recording while the screen is recorded already
+	ErrRecording = errors.New("the screen of the device is recorded already")
+	//ErrNotRecording is returned when stopping a screen recording that is not running
+	ErrNotRecording = errors.New("the screen of the device is not recorded")
+	//ErrInvalidRecordOptions is returned for RecordOptions screenrecord would not accept
+	ErrInvalidRecordOptions = errors.New("invalid screen record options")
+)
+
+var (
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+	videoSize    = regexp.MustCompile(`^[0-9]+x[0-9]+$`)
+)
+
+//Screenshot returns a PNG of the screen of the device taken with screencap.
+func (s *Session) Screenshot() ([]byte, error) {
+	stream, err := s.Open("exec:screencap -p")
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	data, err := ioutil.ReadAll(stream)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, pngSignature) {
+		//screencap prints its errors instead of the image
+		message := strings.TrimSpace(string(data))
+		if len(message) > 200 {
+			message = message[:200]
+		}
+		return nil, fmt.Errorf("screencap did not return a PNG: %q", message)
+	}
+	return data, nil
+}
+
+//RecordOptions are the options of screenrecord, zero values keep the defaults of the device.
+type RecordOptions struct {
+	//Size is the video size like 1280x720, the default is the size of the screen
+	Size string `json:"size"`
+	//BitRate is the bit rate of the video in bits per second
+	BitRate int `json:"bitRate"`
+	//TimeLimit is the maximum length of the recording in seconds, screenrecord stops after 180 seconds by default
+	TimeLimit int `json:"timeLimit"`
+}
+
+//command returns the screenrecord command writing a raw H.264 stream to stdout.
+func (o RecordOptions) command() (string, error) {
+	command := "screenrecord --output-format=h264"
+	if o.Size != "" {
+		if !videoSize.MatchString(o.Size) {
+			return "", fmt.Errorf("%w: size %s", ErrInvalidRecordOptions, o.Size)
+		}
+		command += " --size " + o.Size
+	}
+	if o.BitRate < 0 || o.TimeLimit < 0 {
+		return "", fmt.Errorf("%w: bit rate and time limit must not be negative", ErrInvalidRecordOptions)
+	}
+	if o.BitRate > 0 {
+		command += fmt.Sprintf(" --bit-rate %d", o.BitRate)
+	}
+	if o.TimeLimit > 0 {
+		command += fmt.Sprintf(" --time-limit %d", o.TimeLimit)
+	}
+	return command + " -", nil
+}
+
+//RecordingInfo describes a screen recording.
+type RecordingInfo struct {
+	Output  string    `json:"output"`
+	Started time.Time `json:"started"`
+	Bytes   int64     `json:"bytes"`
+}
+
+//Recording is a running screen recording, see ScreenRecorder.
+type Recording struct {
+	output  string
+	started time.Time
+	bytes   int64
+	stream  *Stream
+	done    chan struct{}
+	err     error
+}
+
+//Info returns the output, start and size of the recording so far.
+func (rec *Recording) Info() RecordingInfo {
+	return RecordingInfo{Output: rec.output, Started: rec.started, Bytes: atomic.LoadInt64(&rec.bytes)}
+}
+
+//Wait waits until the recording ended, it returns the error that ended it, nil if it was stopped or reached its time limit.
+func (rec *Recording) Wait() error {
+	<-rec.done
+	return rec.err
+}
+
+func (rec *Recording) Write(p []byte) (int, error) {
+	atomic.AddInt64(&rec.bytes, int64(len(p)))
+	return len(p), nil
+}
+
+//ScreenRecorder records the screen of the device with screenrecord, one recording at a time like the device allows.
+type ScreenRecorder struct {
+	session   *Session
+	recording *Recording
+	mux       sync.Mutex
+}
+
+//NewScreenRecorder creates a ScreenRecorder for the device of session.
+func NewScreenRecorder(session *Session) *ScreenRecorder {
+	return &ScreenRecorder{session: session}
+}
+
+//Start starts recording the screen and copies the raw H.264 stream to output until the recording is stopped,
+//reaches its time limit or the device disconnects. name describes output in RecordingInfo, f.ex. the path of a file.
+func (r *ScreenRecorder) Start(options RecordOptions, output io.Writer, name string) (*Recording, error) {
+	command, err := options.command()
+	if err != nil {
+		return nil, err
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.recording != nil {
+		return nil, ErrRecording
+	}
+	stream, err := r.session.Open("exec:" + command)
+	if err != nil {
+		return nil, err
+	}
+	recording := &Recording{output: name, started: time.Now(), stream: stream, done: make(chan struct{})}
+	r.recording = recording
+	go r.record(recording, output)
+	r.session.log().Infof("recording the screen to %s", name)
+	return recording, nil
+}
+
+func (r *ScreenRecorder) record(recording *Recording, output io.Writer) {
+	_, err := io.Copy(io.MultiWriter(output, recording), recording.stream)
+	recording.stream.Close()
+	r.mux.Lock()
+	if r.recording == recording {
+		r.recording = nil
+	}
+	r.mux.Unlock()
+	recording.err = err
+	close(recording.done)
+	info := recording.Info()
+	r.session.log().Infof("recorded %d bytes of the screen to %s", info.Bytes, info.Output)
+}
+
+//Stop stops the running recording and waits until its output was written.
+func (r *ScreenRecorder) Stop() (RecordingInfo, error) {
+	r.mux.Lock()
+	recording := r.recording
+	r.mux.Unlock()
+	if recording == nil {
+		return RecordingInfo{}, ErrNotRecording
+	}
+	recording.stream.Close()
+	recording.Wait()
+	return recording.Info(), nil
+}
+
+//Running returns the running recording, nil if the screen is not recorded.
+func (r *ScreenRecorder) Running() *Recording {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.recording
+}
+
+//Close stops the running recording.
+func (r *ScreenRecorder) Close() {
+	r.Stop()
+}
@@ -0,0 +1,76 @@
+package adb_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/danielpaulus/go-adb/adb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScreenshot(t *testing.T) {
+	device := startFakeDevice(t)
+	defer adb.SetKeyStore(nil)
+	png := []byte("\x89PNG\r\n\x1a\nimage data")
+	device.services["exec:screencap -p"] = func(conn net.Conn) {
+		conn.Write(png)
+		conn.Close()
+	}
+
+	screenshot, err := device.session.Screenshot()
+	assert.NoError(t, err)
+	assert.Equal(t, png, screenshot)
+
+	device.services["exec:screencap -p"] = func(conn net.Conn) {
+		conn.Write([]byte("Error: no display\n"))
+		conn.Close()
+	}
+	_, err = device.session.Screenshot()
+	assert.EqualError(t, err, `screencap did not return a PNG: "Error: no display"`)
+}
+
+func TestScreenRecorderStreamsUntilStopped(t *testing.T) {
+	device := startFakeDevice(t)
+	defer adb.SetKeyStore(nil)
+	video := []byte("\x00\x00\x00\x01h264 frames")
+	device.services["exec:screenrecord --output-format=h264 --size 1280x720 --time-limit 30 -"] = func(conn net.Conn) {
+		conn.Write(video)
+		io.Copy(ioutil.Discard, conn)
+		conn.Close()
+	}
+	recorder := adb.NewScreenRecorder(device.session)
+	options := adb.RecordOptions{Size: "1280x720", TimeLimit: 30}
+
+	output := &bytes.Buffer{}
+	recording, err := recorder.Start(options, output, "buffer")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = recorder.Start(options, &bytes.Buffer{}, "buffer")
+	assert.True(t, errors.Is(err, adb.ErrRecording))
+	assert.Equal(t, recording, recorder.Running())
+
+	assert.Eventually(t, func() bool { return recording.Info().Bytes == int64(len(video)) }, time.Second, 10*time.Millisecond)
+	info, err := recorder.Stop()
+	assert.NoError(t, err)
+	assert.Equal(t, "buffer", info.Output)
+	assert.Equal(t, int64(len(video)), info.Bytes)
+	assert.Equal(t, video, output.Bytes())
+	assert.NoError(t, recording.Wait())
+	assert.Nil(t, recorder.Running())
+	_, err = recorder.Stop()
+	assert.True(t, errors.Is(err, adb.ErrNotRecording))
+}
+
+func TestScreenRecorderRejectsInvalidOptions(t *testing.T) {
+	recorder := adb.NewScreenRecorder(adb.NewSession(0, "fake", func(adb.Packet) error { return adb.ErrDeviceOffline }))
+	for _, options := range []adb.RecordOptions{{Size: "1280x720; reboot"}, {BitRate: -1}, {TimeLimit: -1}} {
+		_, err := recorder.Start(options, &bytes.Buffer{}, "buffer")
+		assert.True(t, errors.Is(err, adb.ErrInvalidRecordOptions), options)
+	}
+}
@@ -0,0 +1,474 @@
+package adb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	//sessionStreamBase is the first local id of streams opened by go-adb. Clients connected to the bridge count their ids
+	//up from 1, so both can open streams on the same connection to the device.
+	sessionStreamBase uint32 = 0x40000000
+	//adbVersion is the protocol version that lets devices skip checksums
+	adbVersion     uint32 = 0x01000001
+	sessionMaxData        = 256 * 1024
+	sessionBanner         = "host::features=shell_v2,cmd,stat_v2,ls_v2,fixed_push_mkdir,abb,abb_exec"
+	sessionTimeout        = 10 * time.Second
+)
+
+//the types of Auth packets
+const (
+	authToken        = 1
+	authSignature    = 2
+	authRSAPublicKey = 3
+)
+
+var (
+	//ErrSessionReset is returned by streams of a Session whose connection to the device was reset
+	ErrSessionReset = errors.New("the adb connection to the device was reset")
+	//ErrDeviceOffline is returned when opening a stream while the bridge is not connected to the device
+	ErrDeviceOffline = errors.New("device is offline")
+	//ErrKeyNotAccepted is returned when opening a stream after the device asked the user to allow USB debugging for
+	//go-adb and nobody did. go-adb does not ask again until a client connected to the bridge.
+	ErrKeyNotAccepted = errors.New("device does not allow USB debugging for the key of go-adb, connect an adb client to the bridge or allow it on the device")
+	errSessionTimeout = errors.New("device did not accept the adb connection, confirm the USB debugging prompt on the device")
+)
+
+//Session is go-adb's own adb connection to a device. It opens streams to services of the device, like an adb server does,
+//next to the streams of the client connected to the bridge. If no client connected yet, the Session connects and
+//authenticates with the key of the KeyStore itself, otherwise it uses the connection the client established.
+//Packets from the device are passed to Handle, packets to the device are written with send.
+type Session struct {
+	port    int
+	serial  string
+	send    func(Packet) error
+	dial    func() error
+	ready   chan struct{}
+	online  bool
+	err     error
+	banner  string
+	maxData int
+	//connecting is true while the Session connects itself, then it consumes Cnxn and Auth of the device
+	connecting bool
+	signed     bool
+	//keyOffered is true after the Session sent its public key and the device did not come online since, so the user
+	//is not asked again and again
+	keyOffered bool
+	streams    map[uint32]*Stream
+	nextID     uint32
+	//accept is offered the streams the device opens, it returns false for streams of the client
+	accept func(stream *Stream) bool
+	//onOnline are called in their own goroutine whenever the device comes online, also after a client reset the connection
+	onOnline []func()
+	mux      sync.Mutex
+}
+
+//NewSession creates an offline Session for the device bridged on port that writes its packets with send.
+func NewSession(port int, serial string, send func(Packet) error) *Session {
+	return &Session{
+		port:    port,
+		serial:  serial,
+		send:    send,
+		ready:   make(chan struct{}),
+		err:     ErrSessionReset,
+		streams: map[uint32]*Stream{},
+		nextID:  sessionStreamBase,
+	}
+}
+
+func (s *Session) log() *log.Entry {
+	return log.WithFields(log.Fields{"port": s.port, "serial": s.serial})
+}
+
+//Banner returns the banner the device sent with its Cnxn, f.ex. "device::ro.product.name=...;features=shell_v2,...".
+func (s *Session) Banner() string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.banner
+}
+
+//Online is true while the device is connected.
+func (s *Session) Online() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.online
+}
+
+//Open opens a stream to the service at destination on the device, f.ex. tcp:8080 or localabstract:chrome_devtools_remote.
+//The Session connects to the device first if needed.
+func (s *Session) Open(destination string) (*Stream, error) {
+	err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	s.mux.Lock()
+	stream := newStream(s, s.nextID, destination)
+	s.streams[stream.localID] = stream
+	s.nextID++
+	s.mux.Unlock()
+	err = s.send(newPacket(Open, stream.localID, 0, append([]byte(destination), 0)))
+	if err != nil {
+		stream.closeLocal()
+		return nil, err
+	}
+	select {
+	case <-stream.okay:
+		return stream, nil
+	case <-stream.closed:
+		return nil, fmt.Errorf("device refused to open %s", destination)
+	case <-time.After(sessionTimeout):
+		stream.Close()
+		return nil, fmt.Errorf("timed out opening %s", destination)
+	}
+}
+
+//connect waits until the device is online, sending a Cnxn if nobody did yet. It fails right away if the device did
+//not accept the key of go-adb before.
+func (s *Session) connect() error {
+	s.mux.Lock()
+	if s.online {
+		s.mux.Unlock()
+		return nil
+	}
+	if s.keyOffered && !s.connecting {
+		s.mux.Unlock()
+		return ErrKeyNotAccepted
+	}
+	ready := s.ready
+	start := !s.connecting
+	s.connecting = true
+	s.mux.Unlock()
+	if start {
+		s.log().Info("connecting to adb of the device")
+		err := s.handshake()
+		if err != nil {
+			s.Reset(err)
+			return err
+		}
+	}
+	select {
+	case <-ready:
+	case <-time.After(sessionTimeout):
+		s.mux.Lock()
+		s.connecting = false
+		s.mux.Unlock()
+		return errSessionTimeout
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.online {
+		return nil
+	}
+	return s.err
+}
+
+func (s *Session) handshake() error {
+	if s.dial != nil {
+		err := s.dial()
+		if err != nil {
+			return err
+		}
+	}
+	s.mux.Lock()
+	s.signed = false
+	s.mux.Unlock()
+	return s.send(newPacket(Cnxn, adbVersion, sessionMaxData, []byte(sessionBanner)))
+}
+
+//Handle processes a packet of the device, it returns true if the packet belonged to the Session
+//and must not be passed on to the client.
+func (s *Session) Handle(packet Packet) bool {
+	if packet.Raw {
+		return false
+	}
+	header := packet.Header
+	switch header.CommandType {
+	case Cnxn:
+		return s.connected(header.Arg1, string(packet.Payload))
+	case Auth:
+		s.mux.Lock()
+		connecting := s.connecting
+		s.mux.Unlock()
+		if connecting && header.Arg0 == authToken {
+			err := s.authenticate(packet.Payload)
+			if err != nil {
+				s.log().Warnf("failed authenticating to the device: %v", err)
+			}
+		}
+		return connecting
+	case Open:
+		return s.opened(header.Arg0, strings.TrimSuffix(string(packet.Payload), "\x00"))
+	case Okay, Wrte, Clse:
+		if header.Arg1 < sessionStreamBase {
+			return false
+		}
+		s.mux.Lock()
+		stream, ok := s.streams[header.Arg1]
+		if ok && header.CommandType == Okay && stream.remoteID == 0 {
+			stream.remoteID = header.Arg0
+		}
+		s.mux.Unlock()
+		if ok {
+			stream.handle(packet)
+		}
+		return true
+	}
+	return false
+}
+
+//opened offers a stream the device opened to accept, which is how reverse forwards connect to the host.
+//It returns false if the stream is not accepted, then it belongs to the client.
+func (s *Session) opened(remoteID uint32, destination string) bool {
+	s.mux.Lock()
+	accept := s.accept
+	if accept == nil {
+		s.mux.Unlock()
+		return false
+	}
+	stream := newStream(s, s.nextID, destination)
+	stream.remoteID = remoteID
+	s.streams[stream.localID] = stream
+	s.nextID++
+	s.mux.Unlock()
+	if accept(stream) {
+		return true
+	}
+	s.mux.Lock()
+	delete(s.streams, stream.localID)
+	s.mux.Unlock()
+	return false
+}
+
+//connected marks the Session online after the device sent its Cnxn, it returns true if the Session sent the Cnxn.
+func (s *Session) connected(maxData uint32, banner string) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	consumed := s.connecting
+	s.connecting = false
+	//go-adb's key was accepted or a client authorized, the device may ask for go-adb's key again after a reset
+	s.keyOffered = false
+	s.banner = banner
+	s.maxData = int(maxData)
+	if s.maxData > sessionMaxData || s.maxData <= 0 {
+		s.maxData = sessionMaxData
+	}
+	if !s.online {
+		s.online = true
+		close(s.ready)
+		s.log().WithFields(log.Fields{"banner": banner}).Info("device is online")
+		for _, f := range s.onOnline {
+			go f()
+		}
+	}
+	return consumed
+}
+
+//whenOnline makes the Session call f whenever the device comes online.
+func (s *Session) whenOnline(f func()) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.onOnline = append(s.onOnline, f)
+}
+
+//authenticate answers the first token of the device with a signature and the next one with the public key,
+//which makes the device ask the user to allow USB debugging.
+func (s *Session) authenticate(token []byte) error {
+	store, err := GetKeyStore()
+	if err != nil {
+		return err
+	}
+	s.mux.Lock()
+	signed := s.signed
+	s.signed = true
+	if signed {
+		s.keyOffered = true
+	}
+	s.mux.Unlock()
+	if !signed {
+		signature, err := store.sign(token)
+		if err != nil {
+			return err
+		}
+		return s.send(newPacket(Auth, authSignature, 0, signature))
+	}
+	s.log().Warn("device does not know the key of go-adb, confirm the USB debugging prompt on the device")
+	return s.send(newPacket(Auth, authRSAPublicKey, 0, append([]byte(store.PublicKey()), 0)))
+}
+
+//Reset marks the Session offline and closes all its streams, f.ex. after the device was disconnected or
+//a client reset the connection of the device with a new Cnxn.
+func (s *Session) Reset(err error) {
+	s.mux.Lock()
+	streams := s.streams
+	s.streams = map[uint32]*Stream{}
+	s.err = err
+	s.connecting = false
+	if !s.online {
+		//wakes up Open waiting for the device
+		close(s.ready)
+	}
+	s.online = false
+	s.ready = make(chan struct{})
+	s.mux.Unlock()
+	for _, stream := range streams {
+		stream.closeLocal()
+	}
+}
+
+func (s *Session) payloadSize() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.maxData
+}
+
+func (s *Session) remoteID(stream *Stream) uint32 {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return stream.remoteID
+}
+
+//Stream is one adb stream of a Session to a service of the device. Writes wait for the device to acknowledge
+//each packet, reads acknowledge the data of the device once it is consumed.
+type Stream struct {
+	session     *Session
+	localID     uint32
+	remoteID    uint32
+	destination string
+	incoming    chan []byte
+	pending     []byte
+	okay        chan struct{}
+	closed      chan struct{}
+	closeOnce   sync.Once
+	writeMux    sync.Mutex
+}
+
+func newStream(session *Session, localID uint32, destination string) *Stream {
+	return &Stream{
+		session:     session,
+		localID:     localID,
+		destination: destination,
+		incoming:    make(chan []byte, 1),
+		okay:        make(chan struct{}, 1),
+		closed:      make(chan struct{}),
+	}
+}
+
+//Destination returns the service the stream was opened to.
+func (st *Stream) Destination() string {
+	return st.destination
+}
+
+func (st *Stream) handle(packet Packet) {
+	switch packet.Header.CommandType {
+	case Okay:
+		select {
+		case st.okay <- struct{}{}:
+		default:
+		}
+	case Wrte:
+		select {
+		case st.incoming <- append([]byte{}, packet.Payload...):
+		default:
+			st.session.log().Warnf("dropping data the device sent to %s without waiting for okay", st.destination)
+		}
+	case Clse:
+		st.closeLocal()
+	}
+}
+
+//Read reads data the device sent, it returns io.EOF once the device closed the stream.
+func (st *Stream) Read(p []byte) (int, error) {
+	if len(st.pending) == 0 {
+		select {
+		case data := <-st.incoming:
+			st.pending = data
+			st.acknowledge()
+		case <-st.closed:
+			select {
+			case data := <-st.incoming:
+				st.pending = data
+			default:
+				return 0, io.EOF
+			}
+		}
+	}
+	n := copy(p, st.pending)
+	st.pending = st.pending[n:]
+	return n, nil
+}
+
+func (st *Stream) acknowledge() {
+	select {
+	case <-st.closed:
+		return
+	default:
+	}
+	err := st.session.send(newPacket(Okay, st.localID, st.session.remoteID(st), []byte{}))
+	if err != nil {
+		st.session.log().Debugf("failed acknowledging data of %s: %v", st.destination, err)
+	}
+}
+
+//Write sends p to the device in packets of at most the size the device accepts.
+func (st *Stream) Write(p []byte) (int, error) {
+	st.writeMux.Lock()
+	defer st.writeMux.Unlock()
+	written := 0
+	for written < len(p) {
+		size := len(p) - written
+		if maxData := st.session.payloadSize(); size > maxData {
+			size = maxData
+		}
+		//the packet is queued, so p may not be referenced after Write returned
+		payload := append([]byte{}, p[written:written+size]...)
+		err := st.session.send(newPacket(Wrte, st.localID, st.session.remoteID(st), payload))
+		if err != nil {
+			return written, err
+		}
+		select {
+		case <-st.okay:
+		case <-st.closed:
+			return written, io.ErrClosedPipe
+		}
+		written += size
+	}
+	return written, nil
+}
+
+//Accept tells the device that a stream it opened is connected, the device starts sending data afterwards.
+func (st *Stream) Accept() error {
+	return st.session.send(newPacket(Okay, st.localID, st.session.remoteID(st), []byte{}))
+}
+
+//Close closes the stream on the device.
+func (st *Stream) Close() error {
+	if !st.closeLocal() {
+		return nil
+	}
+	remoteID := st.session.remoteID(st)
+	if remoteID == 0 || !st.session.Online() {
+		return nil
+	}
+	return st.session.send(newPacket(Clse, st.localID, remoteID, []byte{}))
+}
+
+//closeLocal forgets the stream and wakes up readers and writers, it returns false if it was closed already.
+func (st *Stream) closeLocal() bool {
+	closed := false
+	st.closeOnce.Do(func() {
+		closed = true
+		st.session.mux.Lock()
+		if st.session.streams[st.localID] == st {
+			delete(st.session.streams, st.localID)
+		}
+		st.session.mux.Unlock()
+		close(st.closed)
+	})
+	return closed
+}
@@ -0,0 +1,330 @@
+package adb_test
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/danielpaulus/go-adb/adb"
+	"github.com/stretchr/testify/assert"
+)
+
+//fakeDevice stands in for adbd on the other side of a Session. It asks for authentication with publicKey
+//and serves every opened stream with the service of the same name through a net.Pipe. It keeps reverse forwards
+//like adbd and forgets them when it reboots. With unknownKey it asks for another signature instead of accepting
+//the key and counts the public keys it was offered, which nobody confirms.
+type fakeDevice struct {
+	t         *testing.T
+	session   *adb.Session
+	publicKey crypto.PublicKey
+	token     []byte
+	banner    string
+	services  map[string]func(conn net.Conn)
+	packets   chan adb.Packet
+	streams   map[uint32]*fakeDeviceStream
+	reverses  map[string]string
+	nextID    uint32
+	//unknownKey makes the device reject the signature of the Session
+	unknownKey bool
+	offered    int
+	mux        sync.Mutex
+}
+
+type fakeDeviceStream struct {
+	hostID uint32
+	conn   net.Conn
+	in     chan []byte
+	okay   chan struct{}
+}
+
+func newFakeDevice(t *testing.T, publicKey crypto.PublicKey) *fakeDevice {
+	device := &fakeDevice{
+		t:         t,
+		publicKey: publicKey,
+		services:  map[string]func(conn net.Conn){},
+		packets:   make(chan adb.Packet, 100),
+		streams:   map[uint32]*fakeDeviceStream{},
+		reverses:  map[string]string{},
+		banner:    "device::ro.product.name=fake;features=shell_v2",
+		nextID:    1,
+	}
+	device.session = adb.NewSession(0, "fake", device.receive)
+	go device.serve()
+	return device
+}
+
+func devicePacket(command uint32, arg0 uint32, arg1 uint32, payload []byte) adb.Packet {
+	header := adb.PacketHeader{CommandType: command, Arg0: arg0, Arg1: arg1, DataLength: uint32(len(payload)), Magic: command ^ 0xffffffff}
+	return adb.Packet{Header: header, Payload: payload}
+}
+
+func (d *fakeDevice) receive(packet adb.Packet) error {
+	d.packets <- adb.Packet{Header: packet.Header, Payload: append([]byte{}, packet.Payload...)}
+	return nil
+}
+
+func (d *fakeDevice) serve() {
+	for packet := range d.packets {
+		header := packet.Header
+		switch header.CommandType {
+		case adb.Cnxn:
+			d.token = make([]byte, 20)
+			rand.Read(d.token)
+			d.session.Handle(devicePacket(adb.Auth, 1, 0, d.token))
+		case adb.Auth:
+			d.mux.Lock()
+			unknownKey := d.unknownKey
+			if header.Arg0 == 3 {
+				d.offered++
+			}
+			d.mux.Unlock()
+			if unknownKey {
+				if header.Arg0 != 3 {
+					d.session.Handle(devicePacket(adb.Auth, 1, 0, d.token))
+				}
+				continue
+			}
+			err := rsa.VerifyPKCS1v15(d.publicKey.(*rsa.PublicKey), crypto.SHA1, d.token, packet.Payload)
+			if assert.NoError(d.t, err, "wrong signature") {
+				d.session.Handle(devicePacket(adb.Cnxn, 0x01000001, 4096, []byte(d.banner)))
+			}
+		case adb.Open:
+			d.open(header.Arg0, strings.TrimSuffix(string(packet.Payload), "\x00"))
+		case adb.Wrte:
+			if stream, ok := d.stream(header.Arg1); ok {
+				stream.in <- packet.Payload
+			}
+		case adb.Okay:
+			if stream, ok := d.stream(header.Arg1); ok {
+				d.mux.Lock()
+				if stream.hostID == 0 {
+					stream.hostID = header.Arg0
+				}
+				d.mux.Unlock()
+				select {
+				case stream.okay <- struct{}{}:
+				default:
+				}
+			}
+		case adb.Clse:
+			if stream, ok := d.stream(header.Arg1); ok {
+				stream.conn.Close()
+			}
+		}
+	}
+}
+
+func (d *fakeDevice) stream(id uint32) (*fakeDeviceStream, bool) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	stream, ok := d.streams[id]
+	return stream, ok
+}
+
+//open starts the service destination and relays between its end of the pipe and the stream.
+func (d *fakeDevice) open(hostID uint32, destination string) {
+	service, ok := d.services[destination]
+	if strings.HasPrefix(destination, "reverse:") {
+		service, ok = d.reverseService(destination), true
+	}
+	if !ok {
+		d.session.Handle(devicePacket(adb.Clse, 0, hostID, []byte{}))
+		return
+	}
+	serviceEnd, deviceEnd := net.Pipe()
+	id, stream := d.addStream(hostID, deviceEnd)
+	d.session.Handle(devicePacket(adb.Okay, id, hostID, []byte{}))
+	go service(serviceEnd)
+	d.relay(id, stream)
+}
+
+func (d *fakeDevice) addStream(hostID uint32, conn net.Conn) (uint32, *fakeDeviceStream) {
+	stream := &fakeDeviceStream{hostID: hostID, conn: conn, in: make(chan []byte, 1), okay: make(chan struct{}, 1)}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	id := d.nextID
+	d.nextID++
+	d.streams[id] = stream
+	return id, stream
+}
+
+//relay copies between the device end of the pipe of a stream and the Session with flow control.
+func (d *fakeDevice) relay(id uint32, stream *fakeDeviceStream) {
+	hostID, deviceEnd := stream.hostID, stream.conn
+	go func() {
+		for data := range stream.in {
+			deviceEnd.Write(data)
+			d.session.Handle(devicePacket(adb.Okay, id, hostID, []byte{}))
+		}
+	}()
+	go func() {
+		buffer := make([]byte, 4096)
+		for {
+			n, err := deviceEnd.Read(buffer)
+			if err != nil {
+				d.session.Handle(devicePacket(adb.Clse, id, hostID, []byte{}))
+				return
+			}
+			d.session.Handle(devicePacket(adb.Wrte, id, hostID, append([]byte{}, buffer[:n]...)))
+			<-stream.okay
+		}
+	}()
+}
+
+//reverseService answers requests like reverse:forward:tcp:8080;tcp:8080 like adbd does.
+func (d *fakeDevice) reverseService(destination string) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		defer conn.Close()
+		request := strings.TrimPrefix(destination, "reverse:")
+		reply := "OKAY"
+		d.mux.Lock()
+		switch {
+		case strings.HasPrefix(request, "forward:"):
+			sockets := strings.SplitN(strings.TrimPrefix(request, "forward:"), ";", 2)
+			if sockets[0] == "tcp:0" {
+				sockets[0] = "tcp:41000"
+				reply = "OKAY000541000"
+			}
+			d.reverses[sockets[0]] = sockets[1]
+		case strings.HasPrefix(request, "killforward:"):
+			delete(d.reverses, strings.TrimPrefix(request, "killforward:"))
+		default:
+			reply = "FAIL0007unknown"
+		}
+		d.mux.Unlock()
+		conn.Write([]byte(reply))
+	}
+}
+
+//connectReverse connects to the reverse forward of remote like an app on the device, it returns the end of the app.
+func (d *fakeDevice) connectReverse(remote string) (net.Conn, error) {
+	d.mux.Lock()
+	local, ok := d.reverses[remote]
+	d.mux.Unlock()
+	if !ok {
+		return nil, errors.New("connection refused")
+	}
+	appEnd, deviceEnd := net.Pipe()
+	id, stream := d.addStream(0, deviceEnd)
+	d.session.Handle(devicePacket(adb.Open, id, 0, append([]byte(local), 0)))
+	select {
+	case <-stream.okay:
+	case <-time.After(time.Second):
+		return nil, errors.New("host did not accept the connection")
+	}
+	d.relay(id, stream)
+	return appEnd, nil
+}
+
+//reboot makes the device forget its reverse forwards and resets the Session.
+func (d *fakeDevice) reboot() {
+	d.mux.Lock()
+	d.reverses = map[string]string{}
+	d.mux.Unlock()
+	d.session.Reset(adb.ErrDeviceOffline)
+}
+
+func echoService(conn net.Conn) {
+	io.Copy(conn, conn)
+	conn.Close()
+}
+
+//startFakeDevice creates a fakeDevice that knows the key of a new KeyStore used by go-adb.
+func startFakeDevice(t *testing.T) *fakeDevice {
+	store, err := adb.OpenKeyStore("")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	adb.SetKeyStore(store)
+	return newFakeDevice(t, store.Certificate().PrivateKey.(*rsa.PrivateKey).Public())
+}
+
+func TestSessionAuthenticatesAndOpensStreams(t *testing.T) {
+	device := startFakeDevice(t)
+	defer adb.SetKeyStore(nil)
+	device.services["tcp:7000"] = echoService
+	device.services["shell:echo hello"] = func(conn net.Conn) {
+		conn.Write([]byte("hello\n"))
+		conn.Close()
+	}
+
+	stream, err := device.session.Open("tcp:7000")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "device::ro.product.name=fake;features=shell_v2", device.session.Banner())
+	//bigger than the max payload of the device
+	data := []byte(strings.Repeat("0123456789", 1000))
+	go stream.Write(data)
+	echoed := make([]byte, len(data))
+	_, err = io.ReadFull(stream, echoed)
+	assert.NoError(t, err)
+	assert.Equal(t, data, echoed)
+	assert.NoError(t, stream.Close())
+
+	shell, err := device.session.Open("shell:echo hello")
+	if assert.NoError(t, err) {
+		output, err := ioutil.ReadAll(shell)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello\n", string(output))
+	}
+
+	_, err = device.session.Open("localabstract:missing")
+	assert.Error(t, err)
+}
+
+func TestSessionOffersKeyOnlyOnce(t *testing.T) {
+	device := startFakeDevice(t)
+	defer adb.SetKeyStore(nil)
+	device.unknownKey = true
+	device.services["tcp:7000"] = echoService
+	opened := make(chan error, 1)
+	go func() {
+		_, err := device.session.Open("tcp:7000")
+		opened <- err
+	}()
+	offered := func() int {
+		device.mux.Lock()
+		defer device.mux.Unlock()
+		return device.offered
+	}
+	assert.Eventually(t, func() bool { return offered() == 1 }, 5*time.Second, 10*time.Millisecond)
+	//the device was unplugged before anybody allowed USB debugging
+	device.session.Reset(adb.ErrDeviceOffline)
+	assert.Error(t, <-opened)
+
+	_, err := device.session.Open("tcp:7000")
+	assert.True(t, errors.Is(err, adb.ErrKeyNotAccepted))
+	assert.Equal(t, 1, offered())
+
+	//a client connected and the device answered it
+	device.session.Handle(devicePacket(adb.Cnxn, 0x01000001, 4096, []byte(device.banner)))
+	stream, err := device.session.Open("tcp:7000")
+	if assert.NoError(t, err) {
+		stream.Close()
+	}
+}
+
+func TestSessionResetClosesStreams(t *testing.T) {
+	device := startFakeDevice(t)
+	defer adb.SetKeyStore(nil)
+	device.services["tcp:7000"] = echoService
+	stream, err := device.session.Open("tcp:7000")
+	if !assert.NoError(t, err) {
+		return
+	}
+	device.session.Reset(adb.ErrDeviceOffline)
+	_, err = stream.Read(make([]byte, 10))
+	assert.Equal(t, io.EOF, err)
+	_, err = stream.Write([]byte("hello"))
+	assert.Error(t, err)
+	assert.False(t, device.session.Online())
+}
@@ -0,0 +1,201 @@
+package adb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+//the ids of shell v2 packets, see shell_protocol.h of adbd
+const (
+	ShellStdin      byte = 0
+	ShellStdout     byte = 1
+	ShellStderr     byte = 2
+	ShellExit       byte = 3
+	ShellCloseStdin byte = 4
+	ShellWindowSize byte = 5
+)
+
+//shellHeaderLength is the id byte and the little endian uint32 length in front of every shell v2 packet
+const shellHeaderLength = 5
+
+//ErrShellV2NotSupported is returned for devices that do not announce the shell_v2 feature, f.ex. Android 6 and older
+var ErrShellV2NotSupported = errors.New("device does not support the shell v2 protocol")
+
+//Shell is a command running on the device with the shell v2 protocol, which keeps stdout and stderr apart
+//and reports the exit status of the command, unlike the plain shell service. Terminals of devices without
+//shell v2 use the plain shell service, see OpenTerminal.
+type Shell struct {
+	stream   *Stream
+	legacy   bool
+	header   [shellHeaderLength]byte
+	buffer   []byte
+	writeMux sync.Mutex
+}
+
+//Supports is true if the device announced feature in the banner of its Cnxn, f.ex. shell_v2.
+func (s *Session) Supports(feature string) bool {
+	banner := s.Banner()
+	index := strings.Index(banner, "features=")
+	if index == -1 {
+		return false
+	}
+	features := banner[index+len("features="):]
+	if end := strings.Index(features, ";"); end != -1 {
+		features = features[:end]
+	}
+	for _, supported := range strings.Split(features, ",") {
+		if supported == feature {
+			return true
+		}
+	}
+	return false
+}
+
+//OpenShell runs command on the device, an empty command starts an interactive shell. If term is empty, stdin and output are
+//passed through raw like adb shell -T does. Otherwise the command runs in a pseudo terminal of type term, f.ex. xterm-256color.
+func (s *Session) OpenShell(command string, term string) (*Shell, error) {
+	err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	if !s.Supports("shell_v2") {
+		return nil, ErrShellV2NotSupported
+	}
+	destination := "shell,v2,raw:" + command
+	if term != "" {
+		destination = fmt.Sprintf("shell,v2,TERM=%s,pty:%s", term, command)
+	}
+	stream, err := s.Open(destination)
+	if err != nil {
+		return nil, err
+	}
+	return &Shell{stream: stream}, nil
+}
+
+//OpenTerminal starts an interactive shell in a pseudo terminal of type term with rows and cols, like adb shell does
+//for terminals. Devices without shell v2 get the plain shell service, it has no exit status and its window size is fixed.
+func (s *Session) OpenTerminal(term string, rows int, cols int) (*Shell, error) {
+	shell, err := s.OpenShell("", term)
+	if err == ErrShellV2NotSupported {
+		stream, err := s.Open("shell:")
+		if err != nil {
+			return nil, err
+		}
+		return &Shell{stream: stream, legacy: true, buffer: make([]byte, sessionMaxData)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rows > 0 && cols > 0 {
+		err = shell.Resize(rows, cols)
+		if err != nil {
+			shell.Close()
+			return nil, err
+		}
+	}
+	return shell, nil
+}
+
+//ReadPacket returns the next packet of the command, its id is ShellStdout, ShellStderr or ShellExit. The data of
+//ShellExit is the exit status in one byte. ReadPacket returns io.EOF once the stream is closed.
+func (sh *Shell) ReadPacket() (byte, []byte, error) {
+	if sh.legacy {
+		n, err := sh.stream.Read(sh.buffer)
+		return ShellStdout, append([]byte{}, sh.buffer[:n]...), err
+	}
+	_, err := io.ReadFull(sh.stream, sh.header[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	length := binary.LittleEndian.Uint32(sh.header[1:])
+	if length > sessionMaxData {
+		return 0, nil, fmt.Errorf("shell packet of %d bytes is too big", length)
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(sh.stream, data)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return sh.header[0], data, err
+}
+
+//Write sends p to stdin of the command.
+func (sh *Shell) Write(p []byte) (int, error) {
+	if sh.legacy {
+		return sh.stream.Write(p)
+	}
+	err := sh.writePacket(ShellStdin, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+//CloseStdin closes stdin of the command, commands reading stdin get EOF. The plain shell service cannot close stdin.
+func (sh *Shell) CloseStdin() error {
+	if sh.legacy {
+		return nil
+	}
+	return sh.writePacket(ShellCloseStdin, []byte{})
+}
+
+//Resize changes the window size of the pseudo terminal of the command, the plain shell service ignores it.
+func (sh *Shell) Resize(rows int, cols int) error {
+	if sh.legacy {
+		return nil
+	}
+	return sh.writePacket(ShellWindowSize, []byte(fmt.Sprintf("%dx%d,0x0", rows, cols)))
+}
+
+//Close closes the stream of the command, which makes adbd kill it.
+func (sh *Shell) Close() error {
+	return sh.stream.Close()
+}
+
+//TextChunker splits the output of a command into chunks of UTF-8 text. A character split across packets is kept
+//until the packet with its remaining bytes arrives, so every chunk can be passed on as a string by itself.
+type TextChunker struct {
+	pending []byte
+}
+
+//Next returns the output up to the last complete character of data, together with what was kept from the previous
+//packet. text is false if the chunk is not valid UTF-8, f.ex. binary output, which then has to be passed on as bytes.
+func (c *TextChunker) Next(data []byte) (chunk []byte, text bool) {
+	chunk = append(c.pending, data...)
+	c.pending = nil
+	//a character has at most utf8.UTFMax bytes, an incomplete one at the end starts in the last UTFMax-1 bytes
+	for i := len(chunk) - 1; i >= 0 && i >= len(chunk)-(utf8.UTFMax-1); i-- {
+		if !utf8.RuneStart(chunk[i]) {
+			continue
+		}
+		if !utf8.FullRune(chunk[i:]) {
+			c.pending = append([]byte{}, chunk[i:]...)
+			chunk = chunk[:i]
+		}
+		break
+	}
+	return chunk, utf8.Valid(chunk)
+}
+
+//Rest returns the bytes of an incomplete character at the end of the output, once the command ended.
+func (c *TextChunker) Rest() []byte {
+	rest := c.pending
+	c.pending = nil
+	return rest
+}
+
+func (sh *Shell) writePacket(id byte, data []byte) error {
+	packet := make([]byte, shellHeaderLength+len(data))
+	packet[0] = id
+	binary.LittleEndian.PutUint32(packet[1:], uint32(len(data)))
+	copy(packet[shellHeaderLength:], data)
+	sh.writeMux.Lock()
+	defer sh.writeMux.Unlock()
+	_, err := sh.stream.Write(packet)
+	return err
+}
@@ -0,0 +1,173 @@
+package adb_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/danielpaulus/go-adb/adb"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeShellPacket(conn net.Conn, id byte, data []byte) {
+	header := make([]byte, 5)
+	header[0] = id
+	binary.LittleEndian.PutUint32(header[1:], uint32(len(data)))
+	conn.Write(append(header, data...))
+}
+
+func readShellPacket(conn net.Conn) (byte, string, error) {
+	header := make([]byte, 5)
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return 0, "", err
+	}
+	data := make([]byte, binary.LittleEndian.Uint32(header[1:]))
+	_, err = io.ReadFull(conn, data)
+	return header[0], string(data), err
+}
+
+func TestShellSeparatesOutputAndExitStatus(t *testing.T) {
+	device := startFakeDevice(t)
+	defer adb.SetKeyStore(nil)
+	device.services["shell,v2,raw:ls /missing"] = func(conn net.Conn) {
+		writeShellPacket(conn, adb.ShellStdout, []byte("/sdcard\n"))
+		writeShellPacket(conn, adb.ShellStderr, []byte("ls: /missing: No such file or directory\n"))
+		writeShellPacket(conn, adb.ShellExit, []byte{1})
+		conn.Close()
+	}
+
+	shell, err := device.session.OpenShell("ls /missing", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	id, data, err := shell.ReadPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, adb.ShellStdout, id)
+	assert.Equal(t, "/sdcard\n", string(data))
+	id, data, err = shell.ReadPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, adb.ShellStderr, id)
+	assert.Equal(t, "ls: /missing: No such file or directory\n", string(data))
+	id, data, err = shell.ReadPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, adb.ShellExit, id)
+	assert.Equal(t, []byte{1}, data)
+	_, _, err = shell.ReadPacket()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestShellSendsInputAndWindowSize(t *testing.T) {
+	device := startFakeDevice(t)
+	defer adb.SetKeyStore(nil)
+	received := make(chan string, 3)
+	device.services["shell,v2,TERM=xterm-256color,pty:"] = func(conn net.Conn) {
+		defer conn.Close()
+		for {
+			id, data, err := readShellPacket(conn)
+			if err != nil {
+				return
+			}
+			switch id {
+			case adb.ShellWindowSize:
+				received <- data
+			case adb.ShellStdin:
+				writeShellPacket(conn, adb.ShellStdout, []byte(data))
+			case adb.ShellCloseStdin:
+				writeShellPacket(conn, adb.ShellExit, []byte{0})
+				return
+			}
+		}
+	}
+
+	shell, err := device.session.OpenShell("", "xterm-256color")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, shell.Resize(24, 80))
+	assert.Equal(t, "24x80,0x0", <-received)
+	_, err = shell.Write([]byte("echo hello\n"))
+	assert.NoError(t, err)
+	id, data, err := shell.ReadPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, adb.ShellStdout, id)
+	assert.Equal(t, "echo hello\n", string(data))
+	assert.NoError(t, shell.CloseStdin())
+	id, _, err = shell.ReadPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, adb.ShellExit, id)
+}
+
+func TestShellNeedsShellV2(t *testing.T) {
+	device := startFakeDevice(t)
+	defer adb.SetKeyStore(nil)
+	device.banner = "device::ro.product.name=fake;features=cmd"
+	_, err := device.session.OpenShell("ls", "")
+	assert.True(t, errors.Is(err, adb.ErrShellV2NotSupported))
+}
+
+func TestTerminalSetsWindowSize(t *testing.T) {
+	device := startFakeDevice(t)
+	defer adb.SetKeyStore(nil)
+	received := make(chan string, 1)
+	device.services["shell,v2,TERM=xterm-256color,pty:"] = func(conn net.Conn) {
+		defer conn.Close()
+		id, data, err := readShellPacket(conn)
+		if err == nil && id == adb.ShellWindowSize {
+			received <- data
+		}
+		io.Copy(ioutil.Discard, conn)
+	}
+
+	shell, err := device.session.OpenTerminal("xterm-256color", 40, 120)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "40x120,0x0", <-received)
+		shell.Close()
+	}
+}
+
+func TestTerminalFallsBackToPlainShell(t *testing.T) {
+	device := startFakeDevice(t)
+	defer adb.SetKeyStore(nil)
+	device.banner = "device::ro.product.name=fake;features=cmd"
+	device.services["shell:"] = echoService
+
+	shell, err := device.session.OpenTerminal("xterm-256color", 40, 120)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer shell.Close()
+	assert.NoError(t, shell.Resize(50, 100))
+	_, err = shell.Write([]byte("ls\n"))
+	assert.NoError(t, err)
+	id, data, err := shell.ReadPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, adb.ShellStdout, id)
+	assert.Equal(t, "ls\n", string(data))
+}
+
+func TestTextChunkerKeepsCharactersSplitAcrossPackets(t *testing.T) {
+	var chunker adb.TextChunker
+	output := []byte("grüße 👋")
+	//the packets end within ü and within the 4 bytes of the emoji
+	chunk, text := chunker.Next(output[:3])
+	assert.True(t, text)
+	assert.Equal(t, "gr", string(chunk))
+	chunk, text = chunker.Next(output[3:9])
+	assert.True(t, text)
+	assert.Equal(t, "üße ", string(chunk))
+	chunk, _ = chunker.Next(output[9:11])
+	assert.Empty(t, chunk)
+	chunk, text = chunker.Next(output[11:])
+	assert.True(t, text)
+	assert.Equal(t, "👋", string(chunk))
+	assert.Empty(t, chunker.Rest())
+
+	chunk, text = chunker.Next([]byte{0xff, 'a', 0xe2, 0x82})
+	assert.False(t, text)
+	assert.Equal(t, []byte{0xff, 'a'}, chunk)
+	assert.Equal(t, []byte{0xe2, 0x82}, chunker.Rest())
+}
@@ -0,0 +1,129 @@
+package adb
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+
+	"filippo.io/edwards25519"
+)
+
+var (
+	//spakeM and spakeN are the SPAKE2 points of BoringSSL, which adb uses. They are the first SHA-256 hash chain values
+	//of "edwards25519 point generation seed (M)" and "(N)" that decode to a point.
+	spakeM = mustDecodePoint("5ada7e4bf6ddd9adb6626d32131c6b5c51a1e347a3478f53cfcf441b88eed12e")
+	spakeN = mustDecodePoint("10e3df0ae37d8e7a99b5fe74b44672103dbddcbd06af680d71329a11693bc778")
+	//spakeCofactor is the cofactor 8 of edwards25519 as a scalar
+	spakeCofactor = mustScalar(8)
+)
+
+func mustDecodePoint(encoded string) *edwards25519.Point {
+	data, err := hex.DecodeString(encoded)
+	if err != nil {
+		panic(err)
+	}
+	point, err := new(edwards25519.Point).SetBytes(data)
+	if err != nil {
+		panic(err)
+	}
+	return point
+}
+
+func mustScalar(value byte) *edwards25519.Scalar {
+	encoded := make([]byte, 32)
+	encoded[0] = value
+	scalar, err := edwards25519.NewScalar().SetCanonicalBytes(encoded)
+	if err != nil {
+		panic(err)
+	}
+	return scalar
+}
+
+//spake2 is the SPAKE2 key exchange of BoringSSL over edwards25519 that adb uses for pairing.
+//alice is the pairing client, bob the device. The group operations are the constant time ones of
+//filippo.io/edwards25519, the password scalar never goes through a variable time multiplication.
+type spake2 struct {
+	alice          bool
+	myName         []byte
+	theirName      []byte
+	privateKey     *edwards25519.Scalar
+	passwordScalar *edwards25519.Scalar
+	passwordHash   []byte
+	myMessage      []byte
+}
+
+//newSpake2 generates the message that has to be sent to the other side. myName and theirName
+//have to be the same on both sides. The private key is made from 64 bytes of randomSource, crypto/rand.Reader
+//outside of tests.
+func newSpake2(alice bool, myName []byte, theirName []byte, password []byte, randomSource io.Reader) (*spake2, error) {
+	random := make([]byte, 64)
+	_, err := io.ReadFull(randomSource, random)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := edwards25519.NewScalar().SetUniformBytes(random)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha512.Sum512(password)
+	//BoringSSL adds multiples of the order until the password scalar is a multiple of eight. M and N have prime
+	//order, so the reduced hash gives the same points.
+	passwordScalar, err := edwards25519.NewScalar().SetUniformBytes(hash[:])
+	if err != nil {
+		return nil, err
+	}
+	mask := spakeN
+	if alice {
+		mask = spakeM
+	}
+	//BoringSSL multiplies the private key by the cofactor, the base point has prime order so 8*r mod l is the same
+	message := new(edwards25519.Point).ScalarBaseMult(edwards25519.NewScalar().Multiply(privateKey, spakeCofactor))
+	message.Add(message, new(edwards25519.Point).ScalarMult(passwordScalar, mask))
+	return &spake2{
+		alice:          alice,
+		myName:         myName,
+		theirName:      theirName,
+		privateKey:     privateKey,
+		passwordScalar: passwordScalar,
+		passwordHash:   hash[:],
+		myMessage:      message.Bytes(),
+	}, nil
+}
+
+//processMessage returns the 64 byte key derived from the message of the other side. Both sides only get the same key
+//if they used the same password.
+func (s *spake2) processMessage(theirMessage []byte) ([]byte, error) {
+	theirPoint, err := new(edwards25519.Point).SetBytes(theirMessage)
+	if err != nil {
+		return nil, err
+	}
+	mask := spakeM
+	if s.alice {
+		mask = spakeN
+	}
+	shared := new(edwards25519.Point).Subtract(theirPoint, new(edwards25519.Point).ScalarMult(s.passwordScalar, mask))
+	//multiplying by the cofactor before the private key is the same as BoringSSL's unreduced 8*r and
+	//clears small order components of the point of the other side
+	shared.MultByCofactor(shared)
+	shared.ScalarMult(s.privateKey, shared)
+
+	hash := sha512.New()
+	if s.alice {
+		writeLengthPrefixed(hash, s.myName, s.theirName, s.myMessage, theirMessage)
+	} else {
+		writeLengthPrefixed(hash, s.theirName, s.myName, theirMessage, s.myMessage)
+	}
+	writeLengthPrefixed(hash, shared.Bytes(), s.passwordHash)
+	return hash.Sum(nil), nil
+}
+
+//writeLengthPrefixed writes each value with its length as 8 byte little endian in front.
+func writeLengthPrefixed(hash io.Writer, values ...[]byte) {
+	length := make([]byte, 8)
+	for _, value := range values {
+		binary.LittleEndian.PutUint64(length, uint64(len(value)))
+		hash.Write(length)
+		hash.Write(value)
+	}
+}
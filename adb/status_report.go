@@ -0,0 +1,118 @@
+package adb
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+//StatusReportInterval is how often a bridge process reports its status to the parent
+//even if nothing changed. The parent uses these reports as heartbeat.
+const StatusReportInterval = 5 * time.Second
+
+//ChildStatus is sent as one JSON line by a go-adb single process to its parent
+//over the status pipe. It contains the real state of the UsbTcpBridge in the child
+//and the resources used by the child process.
+type ChildStatus struct {
+	State      string         `json:"state"`
+	Mode       string         `json:"mode"`
+	LastError  string         `json:"lastError"`
+	Client     string         `json:"client"`
+	Reconnects int            `json:"reconnects"`
+	WriteQueue int            `json:"writeQueue"`
+	Recovery   RecoveryStatus `json:"recovery"`
+	CPUSeconds float64        `json:"cpuSeconds"`
+	RSS        int64          `json:"rss"`
+	Time       time.Time      `json:"time"`
+	//Reverses are all reverse forwards of the bridge if they changed since the last ChildStatus, nil otherwise
+	Reverses *[]Reverse `json:"reverses,omitempty"`
+}
+
+func (u *UsbTcpBridge) status() ChildStatus {
+	cpu, rss := resourceUsage()
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	_, state := GetState(u.currentState)
+	reverses := u.changedReverses
+	u.changedReverses = nil
+	return ChildStatus{
+		State:      state,
+		Mode:       u.mode,
+		LastError:  u.lastError,
+		Client:     u.client,
+		Reconnects: u.reconnects,
+		WriteQueue: u.writeQueueDepth(),
+		Recovery:   u.recovery.Status(),
+		CPUSeconds: cpu,
+		RSS:        rss,
+		Time:       time.Now(),
+		Reverses:   reverses,
+	}
+}
+
+//ReportReverses restores the reverse forwards of the bridge, they are sent with the next ChildStatus whenever they change,
+//so the parent go-adb process can save them. It must be called before Start.
+func (u *UsbTcpBridge) ReportReverses(reverses []Reverse) {
+	u.reverses.Restore(reverses, func(changed []Reverse) {
+		u.mux.Lock()
+		u.changedReverses = &changed
+		u.mux.Unlock()
+		u.notifyStatus()
+	})
+}
+
+//ReportStatus writes a ChildStatus of the bridge as JSON line to w whenever the bridge changes its state
+//and at least every interval. It returns when done is closed or writing fails, f.ex. because the parent died.
+func ReportStatus(bridge *UsbTcpBridge, w io.Writer, interval time.Duration, done <-chan struct{}) error {
+	encoder := json.NewEncoder(w)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := encoder.Encode(bridge.status())
+		if err != nil {
+			return err
+		}
+		select {
+		case <-done:
+			return nil
+		case <-bridge.stateChanged:
+		case <-ticker.C:
+		}
+	}
+}
+
+//ChildControl is sent as one JSON line by go-adb to its single processes over the control pipe,
+//f.ex. when the log level is changed at runtime.
+type ChildControl struct {
+	LogLevel string `json:"logLevel,omitempty"`
+}
+
+//ReadChildControl decodes ChildControl lines from r and passes them to onControl until r is closed.
+//It is used by go-adb single processes to receive messages of their parent.
+func ReadChildControl(r io.Reader, onControl func(ChildControl)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var control ChildControl
+		err := json.Unmarshal(scanner.Bytes(), &control)
+		if err != nil {
+			return err
+		}
+		onControl(control)
+	}
+	return scanner.Err()
+}
+
+//readStatusReports decodes ChildStatus lines from r and passes them to onStatus until r is closed.
+func readStatusReports(r io.Reader, onStatus func(ChildStatus)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var status ChildStatus
+		err := json.Unmarshal(scanner.Bytes(), &status)
+		if err != nil {
+			return err
+		}
+		onStatus(status)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,170 @@
+package adb_test
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/danielpaulus/go-adb/adb"
+	"github.com/stretchr/testify/assert"
+)
+
+//usbLink is one direction of a bulk endpoint pair, every Write is one transfer that Read returns
+//in pieces of at most the requested size.
+type usbLink struct {
+	transfers chan []byte
+	current   []byte
+}
+
+func newUSBLink() *usbLink {
+	return &usbLink{transfers: make(chan []byte, 100)}
+}
+
+func (l *usbLink) Write(p []byte) (int, error) {
+	l.transfers <- append([]byte{}, p...)
+	return len(p), nil
+}
+
+func (l *usbLink) Read(p []byte) (int, error) {
+	if len(l.current) == 0 {
+		transfer, ok := <-l.transfers
+		if !ok {
+			return 0, io.EOF
+		}
+		l.current = transfer
+	}
+	n := copy(p, l.current)
+	l.current = l.current[n:]
+	return n, nil
+}
+
+//packetConn runs TLS on top of the Raw packets of an adb stream, only Read and Write are used by the handshake.
+type packetConn struct {
+	net.Conn
+	read    func() (adb.Packet, error)
+	write   func(adb.Packet) error
+	pending []byte
+}
+
+func (c *packetConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		packet, err := c.read()
+		if err != nil {
+			return 0, err
+		}
+		if !packet.Raw {
+			return 0, io.ErrUnexpectedEOF
+		}
+		c.pending = append([]byte{}, packet.Payload...)
+		packet.Release()
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *packetConn) Write(p []byte) (int, error) {
+	err := c.write(adb.Packet{Payload: append([]byte{}, p...), Raw: true})
+	return len(p), err
+}
+
+func cnxn(banner string) adb.Packet {
+	return adb.Packet{Header: adb.PacketHeader{CommandType: adb.Cnxn, DataLength: uint32(len(banner)), Magic: adb.Cnxn ^ 0xffffffff}, Payload: []byte(banner)}
+}
+
+//runTLSDevice stands in for a device answering Cnxn with Stls over USB and sending its Cnxn over TLS afterwards.
+func runTLSDevice(t *testing.T, fromHost *usbLink, toHost *usbLink, certificate tls.Certificate) {
+	const maxPacketSize = 512
+	reader := adb.NewUSBPacketReader(fromHost, maxPacketSize)
+	packet, err := reader.ReadPacket()
+	if !assert.NoError(t, err) || !assert.Equal(t, adb.Cnxn, packet.Header.CommandType) {
+		return
+	}
+	stls := adb.Packet{Header: adb.PacketHeader{CommandType: adb.Stls, Arg0: 0x01000000, Magic: adb.Stls ^ 0xffffffff}, Payload: []byte{}}
+	assert.NoError(t, adb.WritePacketToUSB(stls, toHost, maxPacketSize))
+	packet, err = reader.ReadPacket()
+	if !assert.NoError(t, err) || !assert.Equal(t, adb.Stls, packet.Header.CommandType) {
+		return
+	}
+	conn := &packetConn{
+		read:  reader.ReadPacket,
+		write: func(packet adb.Packet) error { return adb.WritePacketToUSB(packet, toHost, maxPacketSize) },
+	}
+	tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{certificate}, ClientAuth: tls.RequireAnyClientCert})
+	if !assert.NoError(t, tlsConn.Handshake()) {
+		return
+	}
+	assert.NoError(t, adb.WritePacketToTCP(cnxn("device::"), tlsConn))
+}
+
+//TestTLSPassesThroughUSBBridge relays like the UsbTcpBridge does between a client and a device that upgrade to TLS.
+func TestTLSPassesThroughUSBBridge(t *testing.T) {
+	const maxPacketSize = 512
+	keys, err := adb.OpenKeyStore("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	hostToDevice, deviceToHost := newUSBLink(), newUSBLink()
+	go runTLSDevice(t, hostToDevice, deviceToHost, keys.Certificate())
+
+	client, bridge := net.Pipe()
+	defer client.Close()
+	go func() {
+		reader := adb.NewTCPPacketReader(bridge)
+		for {
+			packet, err := reader.ReadPacket()
+			if err != nil {
+				return
+			}
+			adb.WritePacketToUSB(packet, hostToDevice, maxPacketSize)
+			packet.Release()
+		}
+	}()
+	go func() {
+		reader := adb.NewUSBPacketReader(deviceToHost, maxPacketSize)
+		for {
+			packet, err := reader.ReadPacket()
+			if err != nil {
+				return
+			}
+			adb.WritePacketToTCP(packet, bridge)
+			packet.Release()
+		}
+	}()
+
+	assert.NoError(t, adb.WritePacketToTCP(cnxn("host::"), client))
+	packet, err := adb.ReadPacketFromTCP(client)
+	if !assert.NoError(t, err) || !assert.Equal(t, adb.Stls, packet.Header.CommandType) {
+		return
+	}
+	stls := adb.Packet{Header: adb.PacketHeader{CommandType: adb.Stls, Arg0: 0x01000000, Magic: adb.Stls ^ 0xffffffff}, Payload: []byte{}}
+	assert.NoError(t, adb.WritePacketToTCP(stls, client))
+	tlsConn := tls.Client(client, keys.TLSConfig())
+	if !assert.NoError(t, tlsConn.Handshake()) {
+		return
+	}
+	packet, err = adb.ReadPacketFromTCP(tlsConn)
+	if assert.NoError(t, err) {
+		assertPacket(t, cnxn("device::"), packet)
+	}
+}
+
+func TestUSBPacketReaderLeavesTLSOnCnxn(t *testing.T) {
+	stls := adb.Packet{Header: adb.PacketHeader{CommandType: adb.Stls, Arg0: 0x01000000, Magic: adb.Stls ^ 0xffffffff}, Payload: []byte{}}
+	tlsRecord := []byte{0x16, 0x03, 0x03, 0x00, 0x02, 0x01, 0x00}
+	endpoint := &fakeEndpoint{maxPacketSize: 512, transfers: [][]byte{encode(stls), tlsRecord, encode(cnxn("device::"))}}
+	reader := adb.NewUSBPacketReader(endpoint, 512)
+
+	packet, err := reader.ReadPacket()
+	assert.NoError(t, err)
+	assertPacket(t, stls, packet)
+	packet, err = reader.ReadPacket()
+	assert.NoError(t, err)
+	assert.True(t, packet.Raw)
+	assert.Equal(t, tlsRecord, packet.Payload)
+	packet, err = reader.ReadPacket()
+	assert.NoError(t, err)
+	assert.False(t, packet.Raw)
+	assertPacket(t, cnxn("device::"), packet)
+}
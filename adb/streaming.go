@@ -0,0 +1,112 @@
+package adb
+
+import (
+	"context"
+	"fmt"
+)
+
+//transferReader and transferWriter are the bulk transfers of a UsbAdapter, implemented by the endpoints and streams of gousb.
+type transferReader interface {
+	ReadContext(ctx context.Context, p []byte) (int, error)
+}
+
+type transferWriter interface {
+	WriteContext(ctx context.Context, p []byte) (int, error)
+}
+
+//StreamConfig configures the bulk transfers of the UsbAdapter. Keeping several transfers in flight
+//avoids idle time on the bus between two transfers, which limits the throughput of adb push and pull otherwise.
+type StreamConfig struct {
+	//TransferSize is the size of one bulk transfer in bytes, it is rounded up to a multiple of the max packet size
+	TransferSize int
+	//Transfers is the number of transfers in flight per direction, 0 uses one synchronous transfer at a time
+	Transfers int
+}
+
+//DefaultStreamConfig keeps 8 transfers of 64KiB in flight per direction.
+var DefaultStreamConfig = StreamConfig{TransferSize: 64 * 1024, Transfers: 8}
+
+var streamConfig = DefaultStreamConfig
+
+//SetStreamConfig configures the transfers of all UsbAdapters connected afterwards.
+func SetStreamConfig(config StreamConfig) error {
+	if config.TransferSize <= 0 {
+		return fmt.Errorf("invalid transfer size %d", config.TransferSize)
+	}
+	if config.Transfers < 0 {
+		return fmt.Errorf("invalid number of transfers %d", config.Transfers)
+	}
+	streamConfig = config
+	return nil
+}
+
+//GetStreamConfig returns the configuration set with SetStreamConfig.
+func GetStreamConfig() StreamConfig {
+	return streamConfig
+}
+
+//childArgs returns the go-adb single arguments that make the child use the same configuration.
+func (c StreamConfig) childArgs() []string {
+	return []string{fmt.Sprintf("--transfersize=%d", c.TransferSize), fmt.Sprintf("--transfers=%d", c.Transfers)}
+}
+
+//roundTransferSize rounds size up to a multiple of maxPacketSize, otherwise the device might send
+//more than fits into a transfer, which fails with an overflow.
+func roundTransferSize(size int, maxPacketSize int) int {
+	maxPacketSize = packetSize(maxPacketSize)
+	return (size + maxPacketSize - 1) / maxPacketSize * maxPacketSize
+}
+
+//openStreams starts the read and write streams of the adapter if streaming is enabled.
+func (usbAdapter *UsbAdapter) openStreams(config StreamConfig) error {
+	if config.Transfers == 0 {
+		return nil
+	}
+	readStream, err := usbAdapter.inEndpoint.NewStream(roundTransferSize(config.TransferSize, usbAdapter.inPacketSize), config.Transfers)
+	if err != nil {
+		return fmt.Errorf("failed creating read stream: %w", err)
+	}
+	usbAdapter.readStream = readStream
+	usbAdapter.in = readStream
+	writeStream, err := usbAdapter.outEndpoint.NewStream(roundTransferSize(config.TransferSize, usbAdapter.outPacketSize), config.Transfers)
+	if err != nil {
+		usbAdapter.cancelTransfers()
+		usbAdapter.releaseReadStream()
+		usbAdapter.readStream = nil
+		usbAdapter.in = usbAdapter.inEndpoint
+		return fmt.Errorf("failed creating write stream: %w", err)
+	}
+	usbAdapter.writeStream = writeStream
+	usbAdapter.out = writeStream
+	usbAdapter.log().Debugf("streaming with %d transfers of %d bytes", config.Transfers, config.TransferSize)
+	return nil
+}
+
+//releaseReadStream frees the transfers of the read stream after the adapter was closed. It must not be called
+//while the read loop is reading, the read loop calls it when it stops.
+func (usbAdapter *UsbAdapter) releaseReadStream() {
+	stream := usbAdapter.readStream
+	if stream == nil {
+		return
+	}
+	stream.Close()
+	//reads return the remaining transfers until they fail, the failing read frees everything
+	drain := make([]byte, streamConfig.TransferSize)
+	for {
+		_, err := stream.ReadContext(usbAdapter.transfers, drain)
+		if err != nil {
+			return
+		}
+	}
+}
+
+//closeWriteStream frees the transfers of the write stream after the adapter was closed and the write loop stopped.
+func (usbAdapter *UsbAdapter) closeWriteStream() {
+	if usbAdapter.writeStream == nil {
+		return
+	}
+	err := usbAdapter.writeStream.CloseContext(usbAdapter.transfers)
+	if err != nil {
+		usbAdapter.log().Debugf("write stream closed with %v", err)
+	}
+}
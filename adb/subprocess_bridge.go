@@ -1,31 +1,75 @@
 package adb
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sync"
 	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	minRestartBackoff = time.Second
+	maxRestartBackoff = time.Minute
+	//a process that ran at least this long is considered stable and resets the backoff
+	stableRunTime = 2 * time.Minute
+	//how long Close waits after SIGTERM before it sends a SIGKILL
+	killTimeout = 20 * time.Second
+	//the fd number of the status pipe in the child, 0-2 are stdin, stdout and stderr
+	statusFd = 3
+	//the fd number of the control pipe in the child, it receives ChildControl messages
+	controlFd = 4
+	//the fd number of the start pipe in the child, it waits until the parent closes it before it opens the device
+	startFd = 5
+)
+
 type subProcessBridge struct {
-	device       DeviceInfo
-	port         int
-	done         chan struct{}
-	finished     chan struct{}
-	cmd          *exec.Cmd
-	goadbPath    string
-	currentState int
+	device        DeviceInfo
+	port          int
+	done          chan struct{}
+	finished      chan struct{}
+	child         *childProcess
+	adopted       *childProcess
+	goadbPath     string
+	currentState  int
+	history       *StateHistory
+	logs          *deviceLog
+	startedAt     time.Time
+	lastError     string
+	restarts      int
+	crashes       int
+	backoff       time.Duration
+	childStatus   ChildStatus
+	cpuPercent    float64
+	lastHeartbeat time.Time
+	limits        ProcessLimits
+	reverses      []Reverse
+	saveReverses  func([]Reverse)
+	logcatDir     string
+	logcatSize    int64
+	recordDir     string
+	closeOnce     sync.Once
+	mux           sync.Mutex
 }
 
 //NewSubProcessBridge creates a Bridge that will start the device usb-tcp bridge
 //in a separate go-adb process using the go-adb single command.
-//the process will be automatically restarted should it crash or shutdown.
-//On Close we send a SIGTERM to the childprocess.
+//the process will be automatically restarted with an exponential backoff should it crash or shutdown.
+//The child reports the real state of its UsbTcpBridge over a pipe, which is used as the state of this bridge.
+//On Close we send a SIGTERM to the childprocess, followed by a SIGKILL if it does not exit in time.
 //device is the DeviceInfo for the device we need to bridge, port is the TCP port on which
-//the device will be available and goadbpath is the go-adb binary to start.
-func NewSubProcessBridge(device DeviceInfo, port int, goadbPath string) *subProcessBridge {
+//the device will be available and goadbpath is the go-adb binary to start. limits restrict
+//the resources and privileges of the process.
+func NewSubProcessBridge(device DeviceInfo, port int, goadbPath string, limits ProcessLimits) *subProcessBridge {
 	return &subProcessBridge{
 		device:       device,
 		port:         port,
@@ -33,63 +77,558 @@ func NewSubProcessBridge(device DeviceInfo, port int, goadbPath string) *subProc
 		finished:     make(chan struct{}),
 		goadbPath:    goadbPath,
 		currentState: detached,
+		history:      NewStateHistory(stateHistorySize),
+		logs:         deviceLogForPort(port, device.SerialNumber),
+		backoff:      minRestartBackoff,
+		limits:       limits,
 	}
 }
 
+//RestoreReverses passes reverses to the bridge process, which sets them up once the device is online. save is called
+//with all reverse forwards whenever the process reports that they changed. It must be called before Start.
+func (s *subProcessBridge) RestoreReverses(reverses []Reverse, save func([]Reverse)) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.reverses = reverses
+	s.saveReverses = save
+}
+
+//ArchiveLogcatIn makes the bridge process archive the log of the device in dir, see OpenLogcatArchive.
+//It must be called before Start.
+func (s *subProcessBridge) ArchiveLogcatIn(dir string, maxSize int64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.logcatDir = dir
+	s.logcatSize = maxSize
+}
+
+//RecordIn makes the bridge process write screen recordings requested with a file name into dir.
+//It must be called before Start.
+func (s *subProcessBridge) RecordIn(dir string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.recordDir = dir
+}
+
+//APISocket returns the unix socket the bridge process serves the device features of the REST api on,
+//like forwards, shell or logcat.
+func (s *subProcessBridge) APISocket() string {
+	return BridgeAPISocket(s.port)
+}
+
+//BridgeAPISocket returns the unix socket of the REST api of the bridge process for port. It is in a directory only
+//the user of go-adb can enter, the path stays the same so a go-adb taking over running processes finds it.
+func BridgeAPISocket(port int) string {
+	return filepath.Join(apiSocketDir(), fmt.Sprintf("%d.sock", port))
+}
+
+func apiSocketDir() string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("go-adb-%d", os.Getuid()))
+}
+
+//listenAPISocket creates the socket of the REST api of the bridge process for port and returns it as file, which the
+//process gets instead of the path. The process may run as another user, who cannot create sockets in the private
+//directory, and nobody can connect before the directory has been checked.
+func listenAPISocket(port int) (*os.File, error) {
+	err := ensurePrivateDir(apiSocketDir())
+	if err != nil {
+		return nil, err
+	}
+	path := BridgeAPISocket(port)
+	//a socket left behind by a process that was killed
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	//the process keeps serving on the socket after we closed our copy
+	listener.SetUnlinkOnClose(false)
+	defer listener.Close()
+	return listener.File()
+}
+
+//ensurePrivateDir creates dir with mode 0700 and makes sure that it is a real directory owned by us that nobody else
+//can enter, because the temp directory is shared and anyone could have created it first.
+func ensurePrivateDir(dir string) error {
+	err := os.Mkdir(dir, 0700)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok || int(stat.Uid) != os.Getuid() || info.Mode().Perm() != 0700 {
+		return fmt.Errorf("%s must be a directory of user %d with mode 0700", dir, os.Getuid())
+	}
+	return nil
+}
+
+func (s *subProcessBridge) log() *log.Entry {
+	return log.WithFields(log.Fields{"port": s.port, "serial": s.device.SerialNumber})
+}
+
 //GetSerialNumber returns the serial usb number of the device this bridge is responsible for.
 func (s *subProcessBridge) GetSerialNumber() string {
 	return s.device.SerialNumber
 }
 
+//Details returns a map[string]interface{} that can be converted to JSON easily containing
+//the device info, state, port, uptime and last error of the bridge, together with the
+//supervision status of the bridge process.
+func (s *subProcessBridge) Details() map[string]interface{} {
+	details := s.SupervisionStatus()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	_, state := GetState(s.currentState)
+	uptime := time.Duration(0)
+	if s.child != nil {
+		uptime = time.Since(s.startedAt).Round(time.Second)
+	}
+	lastError := s.childStatus.LastError
+	if lastError == "" {
+		lastError = s.lastError
+	}
+	details["serial"] = s.device.SerialNumber
+	details["port"] = s.port
+	details["state"] = state
+	details["mode"] = s.childStatus.Mode
+	details["device"] = s.device
+	details["uptime"] = uptime.String()
+	details["lastError"] = lastError
+	details["client"] = s.childStatus.Client
+	details["reconnects"] = s.childStatus.Reconnects
+	details["writeQueue"] = s.childStatus.WriteQueue
+	details["recovery"] = s.childStatus.Recovery
+	return details
+}
+
+//SupervisionStatus returns the pid, restart and crash counters, the current restart backoff, the CPU
+//and memory usage and the health of the bridge process. The health is based on the status reports of the child.
+func (s *subProcessBridge) SupervisionStatus() map[string]interface{} {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	pid := 0
+	health := "stopped"
+	if s.child != nil {
+		pid = s.child.process.Pid
+		health = "healthy"
+		if time.Since(s.lastHeartbeat) > 3*StatusReportInterval {
+			health = "unresponsive"
+		}
+	}
+	return map[string]interface{}{
+		"pid":      pid,
+		"restarts": s.restarts,
+		"crashes":  s.crashes,
+		"backoff":  s.backoff.String(),
+		"health":   health,
+		"cpu":      s.cpuPercent,
+		"rss":      s.childStatus.RSS,
+	}
+}
+
+//History returns the last n state transitions of the bridge process, oldest first.
+func (s *subProcessBridge) History(n int) []StateTransition {
+	return s.history.Last(n)
+}
+
+//Logs returns the last n log lines of the bridge process, oldest first.
+func (s *subProcessBridge) Logs(n int) []string {
+	return s.logs.buffer.Lines(n)
+}
+
+func (s *subProcessBridge) setState(newState int) {
+	s.changeState(newState, "")
+}
+
+func (s *subProcessBridge) changeState(newState int, recovery string) {
+	s.mux.Lock()
+	oldState := s.currentState
+	s.currentState = newState
+	s.mux.Unlock()
+	if oldState == newState {
+		return
+	}
+	_, from := GetState(oldState)
+	_, to := GetState(newState)
+	s.history.Add(StateTransition{From: from, To: to, Time: time.Now(), Recovery: recovery})
+}
+
+func (s *subProcessBridge) setLastError(err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.lastError = err.Error()
+}
+
+func (s *subProcessBridge) setChild(child *childProcess) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.child = child
+	s.startedAt = time.Now()
+	s.lastHeartbeat = s.startedAt
+	s.childStatus = ChildStatus{}
+	s.cpuPercent = 0
+}
+
+func (s *subProcessBridge) onStatus(status ChildStatus) {
+	state, ok := stateFromName(status.State)
+	if !ok {
+		s.log().Warnf("bridge process reported unknown state '%s'", status.State)
+		return
+	}
+	s.mux.Lock()
+	previous := s.childStatus
+	if !previous.Time.IsZero() && status.Time.After(previous.Time) {
+		cpu := (status.CPUSeconds - previous.CPUSeconds) / status.Time.Sub(previous.Time).Seconds() * 100
+		s.cpuPercent = math.Round(cpu*10) / 10
+	}
+	s.childStatus = status
+	s.lastHeartbeat = time.Now()
+	save := s.saveReverses
+	if status.Reverses != nil {
+		//a restarted process sets up the reverse forwards it reported last
+		s.reverses = *status.Reverses
+	}
+	s.mux.Unlock()
+	if status.Reverses != nil && save != nil {
+		save(*status.Reverses)
+	}
+	recovery := ""
+	if attempts := status.Recovery.Attempts; state == recovering && len(attempts) > 0 {
+		recovery = attempts[len(attempts)-1].Step
+	}
+	s.changeState(state, recovery)
+}
+
 //Close sends a SIGTERM to the childprocess and waits for it to shut down.
-//Currently there is no timeout here, go-adb is expected to always shutdown.
+//If the process does not exit within killTimeout, it is killed with SIGKILL.
 func (s *subProcessBridge) Close() error {
 	//https://bigkevmcd.github.io/go/pgrp/context/2019/02/19/terminating-processes-in-go.html
-	go func() { s.done <- struct{}{} }()
-	log.Info("sending sigterm")
-	syscall.Kill(s.cmd.Process.Pid, syscall.SIGTERM)
-	<-s.finished
-	log.Info("closing bridge")
+	s.closeOnce.Do(func() { close(s.done) })
+	s.signal(syscall.SIGTERM)
+	select {
+	case <-s.finished:
+	case <-time.After(killTimeout):
+		s.log().Warnf("bridge process did not exit %s after SIGTERM, sending SIGKILL", killTimeout)
+		s.signal(syscall.SIGKILL)
+		select {
+		case <-s.finished:
+		case <-time.After(killTimeout):
+			return fmt.Errorf("bridge process for device %s did not exit after SIGKILL", s.device.SerialNumber)
+		}
+	}
+	s.log().Info("closing bridge")
+	releaseDeviceLog(s.port)
 	return nil
 }
 
+//SetLogLevel passes level to the bridge process, which logs with it from now on. New processes are started with
+//the current log level of go-adb.
+func (s *subProcessBridge) SetLogLevel(level log.Level) {
+	s.mux.Lock()
+	child := s.child
+	s.mux.Unlock()
+	if child == nil || child.control == nil {
+		return
+	}
+	//one short line is written atomically to a pipe, so concurrent calls do not mix up
+	err := json.NewEncoder(child.control).Encode(ChildControl{LogLevel: level.String()})
+	if err != nil {
+		s.log().Debugf("failed passing log level to bridge process: %v", err)
+	}
+}
+
+func (s *subProcessBridge) signal(sig syscall.Signal) {
+	s.mux.Lock()
+	child := s.child
+	s.mux.Unlock()
+	if child == nil {
+		return
+	}
+	s.log().Infof("sending %s", sig)
+	err := child.process.Signal(sig)
+	if err != nil {
+		s.log().Debugf("failed sending %s: %v", sig, err)
+	}
+}
+
 //Start launches a new go-adb process for the device, make sure to only call once.
 func (s *subProcessBridge) Start() error {
+	go s.supervise()
+	return nil
+}
+
+//supervise runs the bridge process and restarts it until Close is called.
+//Restarts are delayed with an exponential backoff that is reset once a process ran stable for a while.
+func (s *subProcessBridge) supervise() {
+	defer close(s.finished)
+	defer s.limits.removeCgroup(s.port)
+	for {
+		startedAt := time.Now()
+		err := s.runProcess()
+		if s.isClosed() {
+			return
+		}
+		s.mux.Lock()
+		if err != nil {
+			s.crashes++
+		}
+		if time.Since(startedAt) > stableRunTime {
+			s.backoff = minRestartBackoff
+		}
+		backoff := s.backoff
+		s.backoff *= 2
+		if s.backoff > maxRestartBackoff {
+			s.backoff = maxRestartBackoff
+		}
+		s.mux.Unlock()
+
+		s.log().Infof("restarting bridge process in %s", backoff)
+		select {
+		case <-s.done:
+			return
+		case <-time.After(backoff):
+		}
+		s.mux.Lock()
+		s.restarts++
+		s.mux.Unlock()
+	}
+}
+
+func (s *subProcessBridge) isClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+//childProcess is a running go-adb single process together with the read ends of its status and output pipes
+//and the write end of its control pipe, which is nil for processes adopted from go-adb versions without it.
+//start is the write end of the start pipe of a process that waits to be moved into its cgroup, nil otherwise.
+type childProcess struct {
+	process *os.Process
+	status  *os.File
+	output  *os.File
+	control *os.File
+	start   *os.File
+}
+
+//runProcess starts one go-adb single process, or waits for the adopted one, and blocks until it exits.
+func (s *subProcessBridge) runProcess() error {
+	s.mux.Lock()
+	child := s.adopted
+	s.adopted = nil
+	s.mux.Unlock()
+	if child != nil {
+		s.log().Infof("adopted bridge process %d", child.process.Pid)
+		return s.waitProcess(child)
+	}
+	child, err := s.startProcess()
+	if err != nil {
+		s.setLastError(err)
+		return err
+	}
+	s.setState(notInitialized)
+	if child.start != nil {
+		err = s.limits.joinCgroup(s.port, child.process.Pid)
+		if err != nil {
+			s.log().Warnf("failed moving bridge process into its cgroup: %v", err)
+		}
+		//the process waits for EOF, so it only allocates memory and opens the device once it is limited by its cgroup
+		child.start.Close()
+	}
+	return s.waitProcess(child)
+}
+
+func (s *subProcessBridge) startProcess() (*childProcess, error) {
+	s.log().Info("starting bridge process")
+	statusReader, statusWriter, err := os.Pipe()
+	if err != nil {
+		s.log().Errorf("failed creating status pipe: %v", err)
+		return nil, err
+	}
+	outputReader, outputWriter, err := os.Pipe()
+	if err != nil {
+		statusReader.Close()
+		statusWriter.Close()
+		s.log().Errorf("failed creating output pipe: %v", err)
+		return nil, err
+	}
+	controlReader, controlWriter, err := os.Pipe()
+	if err != nil {
+		statusReader.Close()
+		statusWriter.Close()
+		outputReader.Close()
+		outputWriter.Close()
+		s.log().Errorf("failed creating control pipe: %v", err)
+		return nil, err
+	}
+	args := []string{
+		"single", fmt.Sprintf("--serial=%s", s.device.SerialNumber), fmt.Sprintf("--port=%d", s.port),
+		fmt.Sprintf("--vid=%d", s.device.VID), fmt.Sprintf("--pid=%d", s.device.PID),
+		fmt.Sprintf("--logformat=%s", logFormat), fmt.Sprintf("--loglevel=%s", log.GetLevel()),
+		fmt.Sprintf("--statusfd=%d", statusFd), fmt.Sprintf("--controlfd=%d", controlFd),
+		fmt.Sprintf("--identity=%s", identityMode),
+	}
+	args = append(args, streamConfig.childArgs()...)
+	if path := s.device.PortPath(); path != "" {
+		args = append(args, fmt.Sprintf("--usbpath=%s", path))
+	}
+	if s.device.SerialWarning != "" {
+		args = append(args, fmt.Sprintf("--serialwarning=%s", s.device.SerialWarning))
+	}
+	featureArgs, err := s.featureArgs()
+	if err != nil {
+		statusReader.Close()
+		statusWriter.Close()
+		outputReader.Close()
+		outputWriter.Close()
+		controlReader.Close()
+		controlWriter.Close()
+		return nil, err
+	}
+	args = append(args, featureArgs...)
+	extraFiles := []*os.File{statusWriter, controlReader}
+	var startReader, startWriter *os.File
+	if s.limits.CgroupParent != "" {
+		startReader, startWriter, err = os.Pipe()
+		if err != nil {
+			statusReader.Close()
+			statusWriter.Close()
+			outputReader.Close()
+			outputWriter.Close()
+			controlReader.Close()
+			controlWriter.Close()
+			s.log().Errorf("failed creating start pipe: %v", err)
+			return nil, err
+		}
+		extraFiles = append(extraFiles, startReader)
+		args = append(args, fmt.Sprintf("--startfd=%d", startFd))
+	}
+	apiSocket, err := listenAPISocket(s.port)
+	if err != nil {
+		//the bridge works without the device features of the REST api
+		s.log().Errorf("failed creating socket of the device api: %v", err)
+	} else {
+		defer apiSocket.Close()
+		args = append(args, fmt.Sprintf("--apifd=%d", statusFd+len(extraFiles)))
+		extraFiles = append(extraFiles, apiSocket)
+	}
+	cmd := exec.Command(s.goadbPath, append(args, s.limits.childArgs()...)...)
+	if s.limits.Credential != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: s.limits.Credential}
+	}
+	//stdout and stderr share one pipe so lines of both streams do not get mixed up.
+	//We use our own pipes instead of letting exec create them, so they can be handed over on upgrades.
+	cmd.Stdout = outputWriter
+	cmd.Stderr = outputWriter
+	cmd.ExtraFiles = extraFiles
+	err = cmd.Start()
+	//the child has its own copies now, closing ours makes the readers see EOF once the child exits
+	statusWriter.Close()
+	outputWriter.Close()
+	controlReader.Close()
+	if startReader != nil {
+		startReader.Close()
+	}
+	if err != nil {
+		statusReader.Close()
+		outputReader.Close()
+		controlWriter.Close()
+		if startWriter != nil {
+			startWriter.Close()
+		}
+		s.log().Error("failed starting process:" + err.Error())
+		return nil, err
+	}
+	return &childProcess{process: cmd.Process, status: statusReader, output: outputReader, control: controlWriter, start: startWriter}, nil
+}
+
+//featureArgs returns the options of the bridge process for the device features of the REST api it serves.
+func (s *subProcessBridge) featureArgs() ([]string, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var args []string
+	if s.saveReverses != nil {
+		reverses := s.reverses
+		if reverses == nil {
+			reverses = []Reverse{}
+		}
+		encoded, err := json.Marshal(reverses)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, fmt.Sprintf("--restorereverses=%s", encoded))
+	}
+	if s.logcatDir != "" {
+		args = append(args, fmt.Sprintf("--logcat=%s", s.logcatDir), fmt.Sprintf("--logcatsize=%d", s.logcatSize))
+	}
+	if s.recordDir != "" {
+		args = append(args, fmt.Sprintf("--recorddir=%s", s.recordDir))
+	}
+	if dir := keyStoreDir(); dir != "" {
+		args = append(args, fmt.Sprintf("--keydir=%s", dir))
+	}
+	args = append(args, fmt.Sprintf("--forwardaddr=%s", forwardAddress))
+	if forwardSocketDir != "" {
+		args = append(args, fmt.Sprintf("--socketdir=%s", forwardSocketDir))
+	}
+	return args, nil
+}
+
+func (s *subProcessBridge) waitProcess(child *childProcess) error {
+	s.setChild(child)
+	if s.isClosed() {
+		//Close was called while the process was starting and had nothing to signal yet
+		s.signal(syscall.SIGTERM)
+	}
+	statusDone := make(chan struct{})
 	go func() {
-		for {
-			log.Info("starting bridge process")
-			s.cmd = exec.Command(s.goadbPath,
-				"single", fmt.Sprintf("--serial=%s", s.device.SerialNumber), fmt.Sprintf("--port=%d", s.port),
-				fmt.Sprintf("--vid=%d", s.device.VID), fmt.Sprintf("--pid=%d", s.device.PID),
-			)
-			s.cmd.Stdout = os.Stdout
-			s.cmd.Stderr = os.Stderr
-			err := s.cmd.Start()
-			if err != nil {
-				log.Error("failed starting process:" + err.Error())
-				continue
-			}
-			log.Info("waiting bridge process to complete")
-			s.currentState = online
-			err = s.cmd.Wait()
-			if err != nil {
-				log.Warnf("bridge process failed with:%+v", err)
-			}
-			s.currentState = detached
-			log.Info("bridge process done")
-			select {
-			case <-s.done:
-				s.finished <- struct{}{}
-				return
-			default:
-			}
+		defer close(statusDone)
+		err := readStatusReports(child.status, s.onStatus)
+		if err != nil {
+			s.log().Warnf("failed reading status of bridge process: %v", err)
 		}
 	}()
-	return nil
+	outputDone := make(chan struct{})
+	go func() {
+		defer close(outputDone)
+		io.Copy(&lineWriter{deviceLog: s.logs, out: os.Stderr}, child.output)
+	}()
+
+	s.log().Info("waiting bridge process to complete")
+	processState, err := child.process.Wait()
+	if err == nil && !processState.Success() {
+		err = errors.New(processState.String())
+	}
+	<-statusDone
+	<-outputDone
+	child.status.Close()
+	child.output.Close()
+	if child.control != nil {
+		child.control.Close()
+	}
+	s.setChild(nil)
+	if err != nil {
+		s.log().Warnf("bridge process failed with:%+v", err)
+		s.setLastError(err)
+	}
+	s.setState(detached)
+	s.log().Info("bridge process done")
+	return err
 }
 
 //Basic implementation
 func (s *subProcessBridge) GetStateName() string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
 	_, name := GetState(s.currentState)
 	return name
 }
@@ -0,0 +1,196 @@
+package adb_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/danielpaulus/go-adb/adb"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+//fakeGoAdb writes a shell script that is started instead of the go-adb binary
+func fakeGoAdb(t *testing.T, script string) string {
+	path := filepath.Join(t.TempDir(), "go-adb")
+	err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSubProcessBridgeReportsChildState(t *testing.T) {
+	goadb := fakeGoAdb(t, `echo '{"state":"online","client":"127.0.0.1:5555"}' >&3
+echo "hello from the child"
+exec sleep 60
+`)
+	bridge := adb.NewSubProcessBridge(adb.DeviceInfo{SerialNumber: "child"}, 61100, goadb, adb.ProcessLimits{})
+	assert.NoError(t, bridge.Start())
+
+	assert.Eventually(t, func() bool { return bridge.GetStateName() == "online" }, 5*time.Second, 10*time.Millisecond)
+	status := bridge.SupervisionStatus()
+	assert.Equal(t, "healthy", status["health"])
+	assert.NotEqual(t, 0, status["pid"])
+	assert.Equal(t, "127.0.0.1:5555", bridge.Details()["client"])
+	assert.Eventually(t, func() bool {
+		lines := bridge.Logs(0)
+		return len(lines) > 0 && lines[len(lines)-1] == "hello from the child"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	start := time.Now()
+	assert.NoError(t, bridge.Close())
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+	assert.Equal(t, "stopped", bridge.SupervisionStatus()["health"])
+}
+
+func TestSubProcessBridgeBacksOffOnCrash(t *testing.T) {
+	goadb := fakeGoAdb(t, "exit 1\n")
+	bridge := adb.NewSubProcessBridge(adb.DeviceInfo{SerialNumber: "crashing"}, 61101, goadb, adb.ProcessLimits{})
+	assert.NoError(t, bridge.Start())
+
+	assert.Eventually(t, func() bool { return bridge.SupervisionStatus()["crashes"] == 2 }, 5*time.Second, 10*time.Millisecond)
+	status := bridge.SupervisionStatus()
+	assert.Equal(t, 1, status["restarts"])
+	assert.Equal(t, "4s", status["backoff"])
+	assert.Contains(t, bridge.Details()["lastError"], "exit status 1")
+
+	assert.NoError(t, bridge.Close())
+}
+
+func TestSubProcessBridgePassesLogLevel(t *testing.T) {
+	goadb := fakeGoAdb(t, `echo '{"state":"online"}' >&3
+for arg in "$@"; do echo "arg $arg"; done
+while read line <&4; do echo "control $line"; done
+exec sleep 60
+`)
+	dir := t.TempDir()
+	assert.NoError(t, adb.EnableLogFiles(dir, 0, 0))
+	defer adb.EnableLogFiles("", 0, 0)
+	const port = 61102
+	bridge := adb.NewSubProcessBridge(adb.DeviceInfo{SerialNumber: "level"}, port, goadb, adb.ProcessLimits{})
+	assert.NoError(t, bridge.Start())
+	assert.Eventually(t, func() bool { return bridge.GetStateName() == "online" }, 5*time.Second, 10*time.Millisecond)
+	assert.Contains(t, bridge.Logs(0), "arg --loglevel="+log.GetLevel().String())
+
+	bridge.SetLogLevel(log.WarnLevel)
+	assert.Eventually(t, func() bool {
+		lines := bridge.Logs(0)
+		return len(lines) > 0 && lines[len(lines)-1] == `control {"logLevel":"warning"}`
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, bridge.Close())
+
+	//the log file is closed with the bridge, later lines are not written to it anymore
+	path := filepath.Join(dir, "61102-level.log")
+	before, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	log.WithFields(log.Fields{"port": port}).Error("after close")
+	after, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, before, after)
+}
+
+func TestSubProcessBridgeWaitsForItsCgroup(t *testing.T) {
+	//the fake process reports a state only once the start pipe is closed, which happens after joining the cgroup
+	goadb := fakeGoAdb(t, `cat <&5
+echo '{"state":"online"}' >&3
+exec sleep 60
+`)
+	cgroups := t.TempDir()
+	const port = 61103
+	bridge := adb.NewSubProcessBridge(adb.DeviceInfo{SerialNumber: "cgroup"}, port, goadb, adb.ProcessLimits{CgroupParent: cgroups})
+	assert.NoError(t, bridge.Start())
+	assert.Eventually(t, func() bool { return bridge.GetStateName() == "online" }, 5*time.Second, 10*time.Millisecond)
+
+	procs, err := ioutil.ReadFile(filepath.Join(cgroups, "go-adb-61103", "cgroup.procs"))
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprint(bridge.SupervisionStatus()["pid"]), string(procs))
+	assert.NoError(t, bridge.Close())
+}
+
+func TestSubProcessBridgeAdoptsProcess(t *testing.T) {
+	//the process of the previous go-adb, started with the same pipes subprocess bridges use
+	goadb := fakeGoAdb(t, `while true; do echo '{"state":"online"}' >&3; echo "still running"; sleep 1; done
+`)
+	statusReader, statusWriter, err := os.Pipe()
+	assert.NoError(t, err)
+	outputReader, outputWriter, err := os.Pipe()
+	assert.NoError(t, err)
+	cmd := exec.Command(goadb)
+	cmd.Stdout = outputWriter
+	cmd.ExtraFiles = []*os.File{statusWriter}
+	if !assert.NoError(t, cmd.Start()) {
+		return
+	}
+	statusWriter.Close()
+	outputWriter.Close()
+	//like exec, the adopting bridge owns the file descriptors afterwards
+	statusFd, err := syscall.Dup(int(statusReader.Fd()))
+	assert.NoError(t, err)
+	outputFd, err := syscall.Dup(int(outputReader.Fd()))
+	assert.NoError(t, err)
+	statusReader.Close()
+	outputReader.Close()
+
+	handover := adb.BridgeHandover{Device: adb.DeviceInfo{SerialNumber: "adopted"}, Port: 61104, State: "online",
+		Pid: cmd.Process.Pid, StatusFd: statusFd, OutputFd: outputFd, Restarts: 2}
+	bridge, err := adb.AdoptSubProcessBridge(handover, goadb, adb.ProcessLimits{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, bridge.Start())
+	assert.Eventually(t, func() bool {
+		lines := bridge.Logs(0)
+		return len(lines) > 0 && lines[len(lines)-1] == "still running"
+	}, 5*time.Second, 10*time.Millisecond)
+	supervision := bridge.SupervisionStatus()
+	assert.Equal(t, cmd.Process.Pid, supervision["pid"])
+	assert.Equal(t, 2, supervision["restarts"])
+	assert.Equal(t, "online", bridge.GetStateName())
+	assert.NoError(t, bridge.Close())
+}
+
+func TestSubProcessBridgeClosedWhileStarting(t *testing.T) {
+	goadb := fakeGoAdb(t, "exec sleep 60\n")
+	bridge := adb.NewSubProcessBridge(adb.DeviceInfo{SerialNumber: "starting"}, 61105, goadb, adb.ProcessLimits{})
+	assert.NoError(t, bridge.Start())
+	start := time.Now()
+	assert.NoError(t, bridge.Close())
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+}
+
+func TestSubProcessBridgeSavesReportedReverses(t *testing.T) {
+	goadb := fakeGoAdb(t, `for arg in "$@"; do echo "arg $arg"; done
+echo '{"state":"online","reverses":[{"remote":"tcp:9000","local":"tcp:9001"}]}' >&3
+exec sleep 60
+`)
+	bridge := adb.NewSubProcessBridge(adb.DeviceInfo{SerialNumber: "reverses"}, 61106, goadb, adb.ProcessLimits{})
+	saved := make(chan []adb.Reverse, 1)
+	bridge.RestoreReverses([]adb.Reverse{{Remote: "tcp:8000", Local: "tcp:8001"}}, func(reverses []adb.Reverse) { saved <- reverses })
+	assert.NoError(t, bridge.Start())
+	defer bridge.Close()
+
+	select {
+	case reverses := <-saved:
+		assert.Equal(t, []adb.Reverse{{Remote: "tcp:9000", Local: "tcp:9001"}}, reverses)
+	case <-time.After(5 * time.Second):
+		t.Fatal("reported reverse forwards were not saved")
+	}
+	assert.Eventually(t, func() bool { return len(bridge.Logs(0)) >= 2 }, 5*time.Second, 10*time.Millisecond)
+	lines := bridge.Logs(0)
+	assert.Contains(t, lines, "arg --apifd=5")
+	socket, err := os.Stat(adb.BridgeAPISocket(61106))
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.ModeSocket, socket.Mode().Type())
+	}
+	dir, err := os.Stat(filepath.Dir(adb.BridgeAPISocket(61106)))
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0700), dir.Mode().Perm())
+	}
+	assert.Contains(t, lines, `arg --restorereverses=[{"remote":"tcp:8000","local":"tcp:8001","connections":0}]`)
+}
@@ -21,6 +21,7 @@ const (
 	errorTCP       = iota
 	errorUSB       = iota
 	disconnected   = iota
+	recovering     = iota
 )
 
 type event struct {
@@ -35,11 +36,31 @@ type UsbTcpBridge struct {
 	device       DeviceInfo
 	adapter      *UsbAdapter
 	tcpServer    net.Listener
+	inheritedTCP net.Listener
 	port         int
 	currentState int
 	opQueue      chan func()
 	done         chan struct{}
 	finished     chan struct{}
+	history      *StateHistory
+	logs         *deviceLog
+	onlineSince  time.Time
+	lastError    string
+	client       string
+	reconnects   int
+	connected    bool
+	mode         string
+	writeQueue   *WriteQueue
+	recovery     *Recovery
+	stateChanged chan struct{}
+	session      *Session
+	forwards     *Forwards
+	reverses     *Reverses
+	recorder     *ScreenRecorder
+	logcat       *Logcat
+	//changedReverses are sent with the next ChildStatus, see ReportReverses
+	changedReverses *[]Reverse
+	mux             sync.Mutex
 }
 
 //NewUsbTcpBridge creates a new notInilialized UsbTcpBridge.
@@ -51,10 +72,62 @@ func NewUsbTcpBridge(device DeviceInfo, port int) *UsbTcpBridge {
 		opQueue:      make(chan func()),
 		done:         make(chan struct{}),
 		finished:     make(chan struct{}),
+		history:      NewStateHistory(stateHistorySize),
+		logs:         deviceLogForPort(port, device.SerialNumber),
+		recovery:     NewRecovery(DefaultRecoveryPolicy),
+		stateChanged: make(chan struct{}, 1),
 	}
+	bridge.session = NewSession(port, device.SerialNumber, bridge.writeSessionPacket)
+	bridge.forwards = NewForwards(bridge.session)
+	bridge.reverses = NewReverses(bridge.session)
+	bridge.recorder = NewScreenRecorder(bridge.session)
 	return bridge
 }
 
+//writeSessionPacket writes packets of the Session of the bridge to the device.
+func (u *UsbTcpBridge) writeSessionPacket(packet Packet) error {
+	u.mux.Lock()
+	state := u.currentState
+	u.mux.Unlock()
+	if state != online {
+		return ErrDeviceOffline
+	}
+	return u.adapter.EnqueueWrite(packet)
+}
+
+//Session returns go-adb's own adb connection to the device, it shares the USB connection with the client of the bridge.
+func (u *UsbTcpBridge) Session() *Session {
+	return u.session
+}
+
+//Forwards returns the host sockets forwarded to services of the device.
+func (u *UsbTcpBridge) Forwards() *Forwards {
+	return u.forwards
+}
+
+//Reverses returns the sockets of the device forwarded to the host.
+func (u *UsbTcpBridge) Reverses() *Reverses {
+	return u.reverses
+}
+
+//ScreenRecorder records the screen of the device.
+func (u *UsbTcpBridge) ScreenRecorder() *ScreenRecorder {
+	return u.recorder
+}
+
+//ArchiveLogcat keeps archiving the log of the device to archive while the bridge runs, it must be called before Start.
+func (u *UsbTcpBridge) ArchiveLogcat(archive *LogcatArchive) {
+	u.logcat = StartLogcat(u.session, archive)
+}
+
+//LogcatArchive returns the archived log of the device, nil if it is not archived.
+func (u *UsbTcpBridge) LogcatArchive() *LogcatArchive {
+	if u.logcat == nil {
+		return nil
+	}
+	return u.logcat.Archive()
+}
+
 func (u *UsbTcpBridge) log() *log.Entry {
 	return log.WithFields(log.Fields{"port": u.port, "serial": u.device.SerialNumber, "state": u.GetStateName()})
 }
@@ -64,6 +137,129 @@ func (u *UsbTcpBridge) GetSerialNumber() string {
 	return u.device.SerialNumber
 }
 
+//Details returns a map[string]interface{} that can be converted to JSON easily containing
+//the device info, state, current mode, port, uptime, last error, connected client, reconnect count, the number of packets
+//waiting to be written to the device, recovery status, forwards and reverse forwards of this bridge.
+func (u *UsbTcpBridge) Details() map[string]interface{} {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	_, state := GetState(u.currentState)
+	uptime := time.Duration(0)
+	if u.currentState == online {
+		uptime = time.Since(u.onlineSince).Round(time.Second)
+	}
+	return map[string]interface{}{
+		"serial":     u.device.SerialNumber,
+		"port":       u.port,
+		"state":      state,
+		"mode":       u.mode,
+		"device":     u.device,
+		"uptime":     uptime.String(),
+		"lastError":  u.lastError,
+		"client":     u.client,
+		"reconnects": u.reconnects,
+		"writeQueue": u.writeQueueDepth(),
+		"recovery":   u.recovery.Status(),
+		"forwards":   u.forwards.List(),
+		"reverses":   u.reverses.List(),
+	}
+}
+
+//writeQueueDepth returns the depth of the write queue of the current adapter, it must be called with mux locked.
+func (u *UsbTcpBridge) writeQueueDepth() int {
+	if u.writeQueue == nil {
+		return 0
+	}
+	return u.writeQueue.Depth()
+}
+
+//History returns the last n state transitions of this bridge, oldest first.
+//If n is zero or negative, all recorded transitions are returned.
+func (u *UsbTcpBridge) History(n int) []StateTransition {
+	return u.history.Last(n)
+}
+
+//Logs returns the last n log lines of this bridge, oldest first.
+//If n is zero or negative, all buffered lines are returned.
+func (u *UsbTcpBridge) Logs(n int) []string {
+	return u.logs.buffer.Lines(n)
+}
+
+func (u *UsbTcpBridge) setState(newState int) {
+	u.changeState(newState, "")
+}
+
+//changeState sets the new state and records the transition together with the recovery step that caused it, if any.
+func (u *UsbTcpBridge) changeState(newState int, recovery string) {
+	u.mux.Lock()
+	oldState := u.currentState
+	u.currentState = newState
+	if newState == online {
+		u.onlineSince = time.Now()
+	}
+	u.mux.Unlock()
+	if oldState == newState {
+		return
+	}
+	_, from := GetState(oldState)
+	_, to := GetState(newState)
+	u.history.Add(StateTransition{From: from, To: to, Time: time.Now(), Recovery: recovery})
+	u.notifyStatus()
+}
+
+//notifyStatus makes ReportStatus send a ChildStatus right away.
+func (u *UsbTcpBridge) notifyStatus() {
+	select {
+	case u.stateChanged <- struct{}{}:
+	default:
+	}
+}
+
+func (u *UsbTcpBridge) setLastError(err error) {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	u.lastError = err.Error()
+}
+
+func (u *UsbTcpBridge) setClient(remote string) {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	u.client = remote
+}
+
+func (u *UsbTcpBridge) countConnect() {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	if u.connected {
+		u.reconnects++
+	}
+	u.connected = true
+}
+
+//updateMode records the mode the device was found in by the last connect attempt. A device that comes back
+//in ADB mode with another PID, f.ex. in recovery, keeps its bridge, so the VID and PID are updated too.
+func (u *UsbTcpBridge) updateMode(err error) {
+	mode := currentMode(err)
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	if mode != "" {
+		u.mode = mode
+	}
+	if err == nil {
+		u.device.VID = u.adapter.usbDevice.Desc.Vendor
+		u.device.PID = u.adapter.usbDevice.Desc.Product
+		u.device.Mode = mode
+	}
+}
+
+//inOtherMode is true while the device is plugged in but not in ADB mode, f.ex. in the bootloader.
+//Failing to connect is expected then and must not trigger recovery, which would interrupt flashing.
+func (u *UsbTcpBridge) inOtherMode() (string, bool) {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	return u.mode, u.mode != "" && u.mode != ModeADB && u.mode != ModeDisconnected
+}
+
 func deviceDetached(u *UsbTcpBridge) func() {
 	return func() {
 		if u.currentState == errorTCP {
@@ -71,12 +267,63 @@ func deviceDetached(u *UsbTcpBridge) func() {
 			return
 		}
 		u.log().Debug("deviceDetached queuing connectUsbOp")
-		u.currentState = detached
+		u.setState(detached)
+		mode, other := u.inOtherMode()
+		switch {
+		case other:
+			u.log().Infof("device is in %s mode, waiting for it to return to adb", mode)
+		case mode == ModeDisconnected:
+			//recovering a device that left the bus would reset or power off whatever is plugged into its port now
+			u.log().Info("device is not plugged in, waiting for it to be enumerated again")
+		default:
+			if step, recover := u.countFailure(); recover {
+				u.recover(step)
+			}
+		}
 		time.Sleep(time.Second * 5)
 		go func() { u.opQueue <- connectUSBOp(u) }()
 	}
 }
 
+//countFailure passes a failed connect or a broken connection to the Recovery of the bridge.
+//If the bridge was online for long enough before, the device counts as recovered and the ladder starts over.
+func (u *UsbTcpBridge) countFailure() (RecoveryStep, bool) {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	if !u.onlineSince.IsZero() && time.Since(u.onlineSince) >= DefaultRecoveryPolicy.StableTime {
+		u.recovery.Success()
+	}
+	u.onlineSince = time.Time{}
+	return u.recovery.Failure(time.Now())
+}
+
+//recover executes one step of the recovery ladder, the device is connected again afterwards as usual.
+func (u *UsbTcpBridge) recover(step RecoveryStep) {
+	if step == RecoveryPowerCycle && powerCycle == nil {
+		step = RecoveryReset
+	}
+	u.log().Warnf("device keeps failing, recovering with %s", step)
+	u.changeState(recovering, step.String())
+	var err error
+	switch step {
+	case RecoveryReopen:
+		//the adapter is closed already, connectUSBOp opens the device with a new context
+	case RecoveryReclaim:
+		err = ReclaimInterface(u.device)
+	case RecoveryReset:
+		err = ResetDevice(u.device)
+	case RecoveryPowerCycle:
+		err = powerCycle(u.device)
+	}
+	if err != nil {
+		u.log().Warnf("recovery step %s failed: %v", step, err)
+		u.setLastError(err)
+	}
+	u.mux.Lock()
+	u.recovery.Attempted(step, err)
+	u.mux.Unlock()
+}
+
 func disconnectEverything(u *UsbTcpBridge) func() {
 	return func() {
 		if u.currentState != online {
@@ -84,16 +331,23 @@ func disconnectEverything(u *UsbTcpBridge) func() {
 			return
 		}
 		u.log().Debug("Disconnecting everything")
-		if u.tcpServer != nil {
-			err := u.tcpServer.Close()
+		u.mux.Lock()
+		tcpServer := u.tcpServer
+		u.tcpServer = nil
+		//the queue of the closed adapter would report its last depth until the device is back
+		u.writeQueue = nil
+		u.mux.Unlock()
+		if tcpServer != nil {
+			err := tcpServer.Close()
 			if err != nil {
 				u.log().Warnf("error closing tcp server %+v", err)
 			}
 		}
 
 		u.adapter.Close()
+		u.session.Reset(ErrDeviceOffline)
 		u.log().Debug("done disonnecting everything")
-		u.currentState = disconnected
+		u.setState(disconnected)
 		go func() { u.opQueue <- deviceDetached(u) }()
 	}
 }
@@ -105,17 +359,23 @@ func connectUSBOp(u *UsbTcpBridge) func() {
 			return
 		}
 		u.log().Debug("Connecting usb")
-		u.adapter = &UsbAdapter{Dump: false, injectedLog: u.log(), stopSignal: make(chan interface{})}
+		u.adapter = &UsbAdapter{Dump: false, injectedLog: u.log()}
 		err := u.adapter.ConnectDevice(u.device)
+		u.updateMode(err)
 		if err != nil {
 			u.log().Warnf("failed connecting usb %+v", err)
+			u.setLastError(err)
 			u.adapter.Close()
 			go func() { u.opQueue <- deviceDetached(u) }()
 			return
 		}
 		u.adapter.StartUSBReadLoop()
 		u.adapter.StartUSBWriteLoop()
-		u.currentState = connectedUSB
+		u.mux.Lock()
+		u.writeQueue = u.adapter.writeQueue
+		u.mux.Unlock()
+		u.countConnect()
+		u.setState(connectedUSB)
 		u.log().Debug("connected USB starting TCP")
 		go func() { u.opQueue <- connectTcpOp(u) }()
 	}
@@ -128,16 +388,23 @@ func connectTcpOp(u *UsbTcpBridge) func() {
 			return
 		}
 		u.log().Info("Starting TCP server")
-		l, err := startTcp(u.port)
+		l, err := u.listen()
 		if err != nil {
 			u.log().WithFields(log.Fields{"port": u.port, "device": u.device.SerialNumber, "error": err}).Error("failed starting tcp server, this device is unusable now")
-			u.currentState = errorTCP
+			u.setLastError(err)
+			u.setState(errorTCP)
 			return
 		}
+		u.mux.Lock()
 		u.tcpServer = l
+		u.mux.Unlock()
 		go startHandlingConnections(l, u)
 		u.log().Infof("started tcp server on port %d", u.port)
-		u.currentState = online
+		u.setState(online)
+		go u.reverses.Connect()
+		if u.logcat != nil {
+			u.logcat.Connect()
+		}
 
 	}
 }
@@ -186,6 +453,16 @@ func (u *UsbTcpBridge) Close() error {
 	}
 
 	disconnectEverything(u)()
+	u.forwards.Close()
+	u.reverses.Close()
+	u.recorder.Close()
+	if u.logcat != nil {
+		u.logcat.Close()
+	}
+	if u.inheritedTCP != nil {
+		u.inheritedTCP.Close()
+	}
+	releaseDeviceLog(u.port)
 	return nil
 }
 
@@ -197,7 +474,11 @@ func (u *UsbTcpBridge) Start() error {
 	u.opQueue <- connectUSBOp(u)
 	return nil
 }
+
+//GetStateName returns the name of the current state of the bridge.
 func (u *UsbTcpBridge) GetStateName() string {
+	u.mux.Lock()
+	defer u.mux.Unlock()
 	_, name := GetState(u.currentState)
 	return name
 }
@@ -223,6 +504,8 @@ func GetState(currentState int) (int, string) {
 		return currentState, "online"
 	case disconnected:
 		return currentState, "disconnected"
+	case recovering:
+		return currentState, "recovering"
 	default:
 		panic("usb bridge was set to unknown state, this is a bug")
 
@@ -230,6 +513,26 @@ func GetState(currentState int) (int, string) {
 
 }
 
+//stateFromName is the inverse of GetState, it is used to restore states reported by bridge processes.
+func stateFromName(name string) (int, bool) {
+	for state := notInitialized; state <= recovering; state++ {
+		if _, stateName := GetState(state); stateName == name {
+			return state, true
+		}
+	}
+	return 0, false
+}
+
+//listen uses the listener inherited during an upgrade once and starts a new TCP server afterwards.
+func (u *UsbTcpBridge) listen() (net.Listener, error) {
+	if u.inheritedTCP != nil {
+		l := u.inheritedTCP
+		u.inheritedTCP = nil
+		return l, nil
+	}
+	return startTcp(u.port)
+}
+
 func startTcp(port int) (net.Listener, error) {
 	l, err := net.Listen("tcp4", fmt.Sprintf("0.0.0.0:%d", port))
 
@@ -277,12 +580,17 @@ func (t *tcpSender) startSending(bridge *UsbTcpBridge) {
 		for loop {
 			select {
 			case packet := <-bridge.adapter.packetChannel:
+				if bridge.session.Handle(packet) {
+					packet.Release()
+					continue
+				}
 
 				if t.tcpConn != nil {
 					t.mux.Lock()
 					conn := t.tcpConn
 					t.mux.Unlock()
 					err := WritePacketToTCP(packet, conn)
+					packet.Release()
 					if err != nil {
 						bridge.log().Errorf("Writing to TCP failed %+v", err)
 
@@ -293,9 +601,12 @@ func (t *tcpSender) startSending(bridge *UsbTcpBridge) {
 
 				} else {
 					bridge.log().Info("dropping packet, nobody connected")
+					packet.Release()
 				}
 			case err := <-bridge.adapter.errorChannel:
 				bridge.log().Errorf("bridge failed reading from usb %+v", err)
+				bridge.setLastError(err)
+				bridge.session.Reset(err)
 
 				if t.tcpConn != nil {
 					t.tcpConn.Close()
@@ -312,20 +623,29 @@ func (t *tcpSender) startSending(bridge *UsbTcpBridge) {
 
 func handleConnection(c net.Conn, bridge *UsbTcpBridge, connectionAvailable chan struct{}) {
 	bridge.log().WithFields(log.Fields{"remote": c.RemoteAddr().String()}).Info("tcp connection active")
+	bridge.setClient(c.RemoteAddr().String())
 
 	go func() {
+		reader := NewTCPPacketReader(c)
 		for {
 
-			packet, err := ReadPacketFromTCP(c)
+			packet, err := reader.ReadPacket()
 			if err != nil {
 				bridge.log().Errorf("Reading From TCP failed %+v", err)
 				c.Close()
+				bridge.setClient("")
 				connectionAvailable <- struct{}{}
 				break
 			}
+			if !packet.Raw && packet.Header.CommandType == Cnxn {
+				//the device resets its connection and closes all streams
+				bridge.session.Reset(ErrSessionReset)
+			}
 			err = bridge.adapter.EnqueueWrite(packet)
 			if err != nil {
+				packet.Release()
 				bridge.log().Errorf("bridge failed writing to usb %+v", err)
+				bridge.setLastError(err)
 				c.Close()
 				go func() { bridge.opQueue <- disconnectEverything(bridge) }()
 				break
@@ -12,6 +12,9 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+//errDeviceNotFound is returned by OpenDevice if no device with the requested identity is plugged in.
+var errDeviceNotFound = errors.New("device not found")
+
 //UsbAdapter reads and writes from AV Quicktime USB Bulk endpoints
 type UsbAdapter struct {
 	outEndpoint   *gousb.OutEndpoint
@@ -20,7 +23,15 @@ type UsbAdapter struct {
 	usbDevice     *gousb.Device
 	usbContext    *gousb.Context
 	usbConfig     *gousb.Config
-	stopSignal    chan interface{}
+	inPacketSize  int //max packet size of the bulk endpoints, 512 on high speed and 1024 on SuperSpeed
+	outPacketSize int
+	readStream    *gousb.ReadStream
+	writeStream   *gousb.WriteStream
+	//in and out carry the bulk transfers, they are the streams if streaming is enabled and the endpoints otherwise.
+	//packetOut is the OUT endpoint, zero length packets cannot be sent through a stream.
+	in            transferReader
+	out           transferWriter
+	packetOut     transferWriter
 	Dump          bool
 	DumpOutWriter io.Writer
 	DumpInWriter  io.Writer
@@ -28,26 +39,36 @@ type UsbAdapter struct {
 	packetChannel chan Packet
 	errorChannel  chan error
 
-	writeChannel      chan Packet
-	writeErrorChannel chan error
-	writeDone         chan interface{}
-	injectedLog       *log.Entry
+	writeQueue  *WriteQueue
+	injectedLog *log.Entry
+
+	//transfers is cancelled when the adapter is closed, it aborts all pending transfers
+	transfers       context.Context
+	cancelTransfers context.CancelFunc
 }
 
 func (usbAdapter *UsbAdapter) log() *log.Entry {
 	return usbAdapter.injectedLog
 }
 
+//Read returns the data of one bulk transfer, or what fits into p of it if streaming is enabled.
 func (usbAdapter *UsbAdapter) Read(p []byte) (int, error) {
-	n, err := usbAdapter.inEndpoint.Read(p)
-	return n, err
+	return usbAdapter.in.ReadContext(usbAdapter.transfers, p)
 }
 
 //WriteDataToUsb implements the UsbWriter interface and sends the byte array to the usb bulk endpoint.
+//With streaming enabled, Write returns once the data is queued and errors show up in one of the next writes.
+//Zero length packets cannot be sent through a stream, they are submitted directly which keeps the order.
 func (usbAdapter *UsbAdapter) Write(bytes []byte) (int, error) {
-	toContext, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	toContext, cancel := context.WithTimeout(usbAdapter.transfers, time.Millisecond*500)
 	defer cancel()
-	n, err := usbAdapter.outEndpoint.WriteContext(toContext, bytes)
+	var n int
+	var err error
+	if len(bytes) > 0 {
+		n, err = usbAdapter.out.WriteContext(toContext, bytes)
+	} else {
+		n, err = usbAdapter.packetOut.WriteContext(toContext, bytes)
+	}
 	if usbAdapter.Dump {
 		_, err := usbAdapter.DumpOutWriter.Write(bytes)
 		if err != nil {
@@ -60,17 +81,20 @@ func (usbAdapter *UsbAdapter) Write(bytes []byte) (int, error) {
 func (usbAdapter *UsbAdapter) Close() {
 
 	usbAdapter.log().Info("Closing usbadapter")
+	if usbAdapter.cancelTransfers != nil {
+		usbAdapter.cancelTransfers()
+	}
 
 	if usbAdapter.adbInterface != nil {
-		log.Info("stopping write loop..")
-		go func() { usbAdapter.stopSignal <- struct{}{} }()
-
-		select {
-		case <-usbAdapter.writeDone:
-			log.Info("write loop stopped")
-		case <-time.After(time.Second * 5):
-			log.Warn("timed out waiting for write loop to finish")
+		if usbAdapter.writeQueue != nil {
+			log.Info("stopping write loop..")
+			if usbAdapter.writeQueue.Close(time.Second * 5) {
+				log.Info("write loop stopped")
+			} else {
+				log.Warn("timed out waiting for write loop to finish")
+			}
 		}
+		usbAdapter.closeWriteStream()
 
 		usbAdapter.log().Info("Closing adb interface")
 		usbAdapter.adbInterface.Close()
@@ -105,15 +129,21 @@ func (usbAdapter *UsbAdapter) Close() {
 
 }
 
+//ConnectDevice opens the device and claims its adb interface. It returns a ModeError if the device is not in ModeADB
+//and an error with cause errDeviceNotFound if it is not plugged in.
 func (usbAdapter *UsbAdapter) ConnectDevice(device DeviceInfo) error {
 	ctx := gousb.NewContext()
 	usbAdapter.usbContext = ctx
+	usbAdapter.transfers, usbAdapter.cancelTransfers = context.WithCancel(context.Background())
 	usbDevice, err := OpenDevice(ctx, device)
 	if err != nil {
 		return err
 	}
-	usbDevice.SetAutoDetach(true)
 	usbAdapter.usbDevice = usbDevice
+	if mode := ClassifyMode(usbDevice.Desc); mode != ModeADB {
+		return ModeError{Mode: mode}
+	}
+	usbDevice.SetAutoDetach(true)
 	usbAdapter.log().Debug("device open")
 	confignum, _ := usbDevice.ActiveConfigNum()
 	usbAdapter.log().Debugf("Config is active: %d", confignum)
@@ -165,11 +195,63 @@ func (usbAdapter *UsbAdapter) ConnectDevice(device DeviceInfo) error {
 	usbAdapter.log().Debug("Endpoint claimed")
 	usbAdapter.log().Infof("Device '%s' USB connection ready", device.SerialNumber)
 	usbAdapter.inEndpoint = inEndpoint
+	usbAdapter.in = inEndpoint
+	usbAdapter.out = outEndpoint
+	usbAdapter.packetOut = outEndpoint
+	usbAdapter.inPacketSize = inEndpoint.Desc.MaxPacketSize
+	usbAdapter.outPacketSize = outEndpoint.Desc.MaxPacketSize
 
+	err = usbAdapter.openStreams(streamConfig)
+	if err != nil {
+		iface.Close()
+		return err
+	}
 	usbAdapter.adbInterface = iface
 	return nil
 }
 
+//currentMode returns the mode of the device after a ConnectDevice attempt with err as result.
+func currentMode(err error) string {
+	if err == nil {
+		return ModeADB
+	}
+	if modeErr, ok := errors.Cause(err).(ModeError); ok {
+		return modeErr.Mode
+	}
+	if errors.Cause(err) == errDeviceNotFound {
+		return ModeDisconnected
+	}
+	return ""
+}
+
+//ReclaimInterface opens the device, detaches kernel drivers from its adb interface, claims the interface and releases it again.
+//It is used to recover devices whose interface is stuck in a stale claim.
+func ReclaimInterface(device DeviceInfo) error {
+	ctx := gousb.NewContext()
+	defer ctx.Close()
+	usbDevice, err := OpenDevice(ctx, device)
+	if err != nil {
+		return err
+	}
+	defer usbDevice.Close()
+	usbDevice.SetAutoDetach(true)
+	confignum, err := usbDevice.ActiveConfigNum()
+	if err != nil {
+		return err
+	}
+	config, err := usbDevice.Config(confignum)
+	if err != nil {
+		return err
+	}
+	defer config.Close()
+	iface, err := findAndClaimAdbInterface(config)
+	if err != nil {
+		return err
+	}
+	iface.Close()
+	return nil
+}
+
 func findBulkEndpoint(setting gousb.InterfaceSetting, direction gousb.EndpointDirection) (int, gousb.EndpointAddress, error) {
 	for _, v := range setting.Endpoints {
 		if v.Direction == direction {
@@ -204,31 +286,101 @@ func findInterfaceForSubclass(confDesc gousb.ConfigDesc, subClass gousb.Class) (
 	return false, -1
 }
 
-//OpenDevice finds a gousb.Device by using the provided iosDevice.SerialNumber. It returns an open device handle.
-//Opening using VID and PID is not specific enough, as different iOS devices can have identical VID/PID combinations.
+//OpenDevice finds the gousb.Device with the identity of androidDevice, see SetIdentityMode. It returns an open device handle.
+//VID and PID of androidDevice only decide which devices are tried first, they change when a device reboots into another
+//mode like the bootloader. When devices are identified by port path only, whatever Android device is plugged into that port is opened.
+//Devices without a unique serial are always opened by their port path, as are devices whose serial is shared by
+//devices plugged in after them, see SerialTracker.
+//Devices are picked by their descriptor before they are opened, opening a device disturbs its other users like fastboot.
 func OpenDevice(ctx *gousb.Context, androidDevice DeviceInfo) (*gousb.Device, error) {
+	uniqueSerial := androidDevice.SerialWarning == ""
+	path := androidDevice.PortPath()
+	if (identityMode != IdentityBySerial || !uniqueSerial) && path != "" {
+		return openMatching(ctx, androidDevice, true, func(desc *gousb.DeviceDesc) bool {
+			return descPortPath(desc) == path
+		})
+	}
+	//the serial is only known once a device is opened, the devices with the same VID and PID or in the same port are
+	//tried first, all others only if the device is not among them
+	likely := func(desc *gousb.DeviceDesc) bool {
+		return desc.Vendor == androidDevice.VID && desc.Product == androidDevice.PID || path != "" && descPortPath(desc) == path
+	}
+	usbDevice, err := openMatching(ctx, androidDevice, false, likely)
+	if errors.Cause(err) != errDeviceNotFound {
+		return usbDevice, err
+	}
+	return openMatching(ctx, androidDevice, false, func(desc *gousb.DeviceDesc) bool {
+		return !likely(desc)
+	})
+}
+
+//descPortPath returns the port path of the device with desc, empty if it is unknown.
+func descPortPath(desc *gousb.DeviceDesc) string {
+	var device DeviceInfo
+	locateDesc(&device, desc)
+	return device.PortPath()
+}
+
+//openMatching opens the Android devices accepted by filter and returns the one with the identity of androidDevice,
+//byPortPath is true if they are told apart by their port path.
+func openMatching(ctx *gousb.Context, androidDevice DeviceInfo, byPortPath bool, filter func(desc *gousb.DeviceDesc) bool) (*gousb.Device, error) {
+	uniqueSerial := androidDevice.SerialWarning == ""
 	deviceList, err := ctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
-		return desc.Product == androidDevice.PID && desc.Vendor == androidDevice.VID
+		return ClassifyMode(desc) != "" && filter(desc)
 	})
 
 	if err != nil {
 		log.Warn("Error opening usb devices", err)
 	}
-	var usbDevice *gousb.Device = nil
+	matches := make([]*gousb.Device, 0, 1)
+	matchPaths := make([]string, 0, 1)
 	for _, device := range deviceList {
 		sn, err := device.SerialNumber()
 		if err != nil {
 			log.Warn("Error retrieving Serialnumber", err)
 		}
-		if sn == androidDevice.SerialNumber {
-			usbDevice = device
+		candidate := DeviceInfo{SerialNumber: sn}
+		locate(&candidate, device)
+		var match bool
+		if uniqueSerial && !byPortPath {
+			match = sn == androidDevice.SerialNumber
+		} else if uniqueSerial {
+			match = candidate.Identity() == androidDevice.Identity()
+		} else {
+			match = sn == androidDevice.ReportedSerial() && candidate.PortPath() == androidDevice.PortPath()
+		}
+		if match {
+			matches = append(matches, device)
+			matchPaths = append(matchPaths, candidate.PortPath())
 		} else {
 			device.Close()
 		}
 	}
+	if len(matches) > 1 && androidDevice.PortPath() != "" {
+		//a device that was bridged before another one with the same serial was plugged in keeps its serial,
+		//it is the one at its port path
+		matches = atPortPath(matches, matchPaths, androidDevice.PortPath())
+	}
 
-	if usbDevice == nil {
-		return nil, fmt.Errorf("Unable to find device:%+v", androidDevice)
+	if len(matches) == 0 {
+		return nil, errors.Wrapf(errDeviceNotFound, "Unable to find device:%+v", androidDevice)
+	}
+	if len(matches) > 1 {
+		closeDevices(matches)
+		return nil, fmt.Errorf("found %d devices matching %+v, refusing to open one of them", len(matches), androidDevice)
+	}
+	return matches[0], nil
+}
+
+//atPortPath returns the devices whose port path in paths is path and closes the others.
+func atPortPath(devices []*gousb.Device, paths []string, path string) []*gousb.Device {
+	result := make([]*gousb.Device, 0, 1)
+	for i, device := range devices {
+		if paths[i] == path {
+			result = append(result, device)
+		} else {
+			device.Close()
+		}
 	}
-	return usbDevice, nil
+	return result
 }
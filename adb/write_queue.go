@@ -0,0 +1,105 @@
+package adb
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+//writeQueueSize is the number of packets a UsbAdapter buffers for the device, with 64KiB payloads that is 2MiB
+const writeQueueSize = 32
+
+//WriteQueue writes packets in order on its own goroutine. It holds at most size packets, Enqueue blocks while it is full,
+//so a slow device stops the bridge from reading the TCP connection instead of piling up packets in memory.
+//The first failed write stops the queue, the error is returned by the next Enqueue.
+type WriteQueue struct {
+	writeChannel      chan Packet
+	writeErrorChannel chan error
+	stopSignal        chan struct{}
+	writeDone         chan struct{}
+	write             func(Packet) error
+	closeOnce         sync.Once
+}
+
+//NewWriteQueue creates a WriteQueue for up to size packets and starts writing them with write.
+func NewWriteQueue(size int, write func(Packet) error) *WriteQueue {
+	q := &WriteQueue{
+		writeChannel:      make(chan Packet, size),
+		writeErrorChannel: make(chan error, 1),
+		stopSignal:        make(chan struct{}),
+		writeDone:         make(chan struct{}),
+		write:             write,
+	}
+	go q.writeLoop()
+	return q
+}
+
+func (q *WriteQueue) writeLoop() {
+	defer close(q.writeDone)
+	for {
+		select {
+		case packet := <-q.writeChannel:
+			err := q.write(packet)
+			if err != nil {
+				q.writeErrorChannel <- err
+				return
+			}
+		case <-q.stopSignal:
+			return
+		}
+	}
+}
+
+//Enqueue adds packet to the queue and blocks while the queue is full. It returns the error that stopped the queue
+//once, afterwards io.ErrClosedPipe. After Close it returns io.EOF.
+func (q *WriteQueue) Enqueue(packet Packet) error {
+	err := q.stopped()
+	if err != nil {
+		return err
+	}
+	select {
+	case q.writeChannel <- packet:
+		return nil
+	case <-q.stopSignal:
+		return io.EOF
+	case <-q.writeDone:
+		return q.stopped()
+	}
+}
+
+//stopped returns why the queue stopped or nil if it is still writing.
+func (q *WriteQueue) stopped() error {
+	select {
+	case err := <-q.writeErrorChannel:
+		return err
+	default:
+	}
+	select {
+	case <-q.stopSignal:
+		return io.EOF
+	default:
+	}
+	select {
+	case <-q.writeDone:
+		return io.ErrClosedPipe
+	default:
+		return nil
+	}
+}
+
+//Depth returns the number of packets waiting to be written.
+func (q *WriteQueue) Depth() int {
+	return len(q.writeChannel)
+}
+
+//Close stops writing, packets still queued are dropped. It waits up to timeout for a write in progress
+//and returns false if it did not finish in time.
+func (q *WriteQueue) Close(timeout time.Duration) bool {
+	q.closeOnce.Do(func() { close(q.stopSignal) })
+	select {
+	case <-q.writeDone:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
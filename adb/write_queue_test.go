@@ -0,0 +1,72 @@
+package adb_test
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/danielpaulus/go-adb/adb"
+	"github.com/stretchr/testify/assert"
+)
+
+func packetWithArg(arg uint32) adb.Packet {
+	return adb.Packet{Header: adb.PacketHeader{CommandType: adb.Wrte, Arg0: arg}}
+}
+
+func TestWriteQueueKeepsOrder(t *testing.T) {
+	written := make(chan uint32, 100)
+	queue := adb.NewWriteQueue(4, func(packet adb.Packet) error {
+		written <- packet.Header.Arg0
+		return nil
+	})
+	for i := uint32(0); i < 100; i++ {
+		assert.NoError(t, queue.Enqueue(packetWithArg(i)))
+	}
+	for i := uint32(0); i < 100; i++ {
+		assert.Equal(t, i, <-written)
+	}
+	assert.True(t, queue.Close(time.Second))
+	assert.Equal(t, io.EOF, queue.Enqueue(packetWithArg(0)))
+}
+
+func TestWriteQueueAppliesBackpressure(t *testing.T) {
+	device := make(chan struct{})
+	queue := adb.NewWriteQueue(2, func(packet adb.Packet) error {
+		<-device
+		return nil
+	})
+	//one packet is being written, two are queued
+	for i := uint32(0); i < 3; i++ {
+		assert.NoError(t, queue.Enqueue(packetWithArg(i)))
+	}
+	assert.Eventually(t, func() bool { return queue.Depth() == 2 }, time.Second, time.Millisecond)
+
+	enqueued := make(chan error)
+	go func() { enqueued <- queue.Enqueue(packetWithArg(3)) }()
+	select {
+	case <-enqueued:
+		t.Fatal("Enqueue did not block on a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	device <- struct{}{}
+	assert.NoError(t, <-enqueued)
+	close(device)
+	assert.True(t, queue.Close(time.Second))
+}
+
+func TestWriteQueueReturnsWriteErrors(t *testing.T) {
+	failure := errors.New("usb write failed")
+	queue := adb.NewWriteQueue(2, func(packet adb.Packet) error {
+		return failure
+	})
+	assert.NoError(t, queue.Enqueue(packetWithArg(0)))
+	var err error
+	assert.Eventually(t, func() bool {
+		err = queue.Enqueue(packetWithArg(1))
+		return err != nil
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, failure, err)
+	assert.Equal(t, io.ErrClosedPipe, queue.Enqueue(packetWithArg(2)))
+	assert.True(t, queue.Close(time.Second))
+}
@@ -3,10 +3,16 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"os/user"
+	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -25,12 +31,42 @@ func main() {
 	usage := `go-adb client v 0.01
 	
 	Usage:
-	  go-adb single --serial=<serial> --port=<port> --vid=<vid> --pid=<pid>
-	  go-adb daemon [--procperdevice]
+	  go-adb single --serial=<serial> --port=<port> --vid=<vid> --pid=<pid> [--usbpath=<path>] [--serialwarning=<warning>] [--identity=<mode>] [--transfersize=<bytes>] [--transfers=<n>] [--logformat=<format>] [--loglevel=<level>] [--statusfd=<fd>] [--controlfd=<fd>] [--startfd=<fd>] [--apifd=<fd>] [--restorereverses=<json>] [--logcat=<dir>] [--logcatsize=<bytes>] [--recorddir=<dir>] [--keydir=<dir>] [--forwardaddr=<address>] [--socketdir=<dir>] [--maxmem=<bytes>] [--maxfiles=<n>] [--nice=<n>]
+	  go-adb daemon [--procperdevice] [--identity=<mode>] [--portmap=<file>] [--reverses=<file>] [--logcat=<dir>] [--logcatsize=<bytes>] [--recorddir=<dir>] [--network=<addresses>] [--mdns] [--keydir=<dir>] [--forwardaddr=<address>] [--socketdir=<dir>] [--origins=<origins>] [--transfersize=<bytes>] [--transfers=<n>] [--logformat=<format>] [--loglevel=<level>] [--logdir=<dir>] [--maxmem=<bytes>] [--maxfiles=<n>] [--nice=<n>] [--cgroup=<dir>] [--cgroupmem=<bytes>] [--user=<user>]
 	  go-adb listdevices
 
 	Options:
-          -h --help      Show this screen.
+          -h --help               Show this screen.
+          --identity=<mode>       Identify devices by their serial, by the USB port path they are plugged into or by both: serial, port or both [default: serial].
+          --portmap=<file>        Keep the TCP port of every device identity in this JSON file, so devices get the same port after a restart.
+          --reverses=<file>       Keep the reverse forwards of every device in this JSON file, so they are set up again after a restart.
+          --logcat=<dir>          Keep a logcat stream of every device open and archive it in this directory, see GET /devices/{serial}/logcat.
+          --logcatsize=<bytes>    Maximum size of the logcat archive of one device, the oldest entries are removed first [default: 104857600].
+          --recorddir=<dir>       Write screen recordings requested with a file name into this directory, recording to files is disabled without it.
+          --network=<addresses>   Also bridge the devices with adbd listening on these comma separated host:port addresses, f.ex. for adb over Wi-Fi.
+          --mdns                  Also bridge the devices announcing wireless debugging with mDNS in the local network.
+          --forwardaddr=<address>  Open the TCP ports of forwards on this IP address, 0.0.0.0 makes them reachable from other hosts [default: 127.0.0.1].
+          --socketdir=<dir>       Allow forwards to unix sockets of the file system in this directory, they are rejected without it.
+          --origins=<origins>     Comma separated origins besides the REST api itself whose pages may open terminals, f.ex. https://dashboard.example.com:8080.
+          --keydir=<dir>          Keep the adb key of go-adb and the devices it paired with in this directory, otherwise pairings are lost when go-adb exits.
+          --transfersize=<bytes>  Size of one USB bulk transfer [default: 65536].
+          --transfers=<n>         Number of USB transfers in flight per direction, 0 uses one synchronous transfer at a time [default: 8].
+          --usbpath=<path>        USB port path of the device, f.ex. 1-2.3. Used by go-adb when running with --procperdevice.
+          --serialwarning=<warning>  Set to missing or duplicate if --serial was made up by go-adb because the device has no unique serial.
+          --logformat=<format>    Log format, either text or json [default: text].
+          --loglevel=<level>      Log level, it can be changed at runtime with PUT /loglevel/{level} [default: debug].
+          --logdir=<dir>          Additionally write the logs of every device to its own rotating log file in this directory.
+          --statusfd=<fd>         Report the bridge state as JSON lines to this file descriptor. Used by go-adb when running with --procperdevice.
+          --controlfd=<fd>        Receive messages like log level changes as JSON lines from this file descriptor. Used by go-adb when running with --procperdevice.
+          --startfd=<fd>          Wait until this file descriptor is closed before opening the device. Used by go-adb when running with --procperdevice and --cgroup.
+          --apifd=<fd>            Serve the device features of the REST api like forwards, shell or logcat on this listening unix socket. Used by go-adb when running with --procperdevice.
+          --restorereverses=<json>  Set up these reverse forwards and report changes over --statusfd. Used by go-adb when running with --procperdevice.
+          --maxmem=<bytes>        Limit the virtual memory of device processes (RLIMIT_AS).
+          --maxfiles=<n>          Limit the number of open files of device processes (RLIMIT_NOFILE).
+          --nice=<n>              Run device processes with this nice value.
+          --cgroup=<dir>          Move every device process into its own cgroup v2 below this directory, f.ex. /sys/fs/cgroup/go-adb.slice
+          --cgroupmem=<bytes>     Set memory.max of every device cgroup, requires --cgroup.
+          --user=<user>           Run device processes as this user and its primary group, requires go-adb to run as root.
           
 
     go-adb is a drop in relpacement for adb device daemons:
@@ -59,27 +95,145 @@ func main() {
 		return
 
 	}
-	log.SetLevel(log.DebugLevel)
+	logLevel, _ := arguments.String("--loglevel")
+	level, err := log.ParseLevel(logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.SetLevel(level)
+	logFormat, _ := arguments.String("--logformat")
+	err = adb.SetLogFormat(logFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	adb.SetPowerCycleHook(adb.PowerCycle)
+	identity, _ := arguments.String("--identity")
+	err = adb.SetIdentityMode(identity)
+	if err != nil {
+		log.Fatal(err)
+	}
+	transferSize, err := arguments.Int("--transfersize")
+	if err != nil {
+		log.Fatalf("invalid --transfersize: %v", err)
+	}
+	transfers, err := arguments.Int("--transfers")
+	if err != nil {
+		log.Fatalf("invalid --transfers: %v", err)
+	}
+	err = adb.SetStreamConfig(adb.StreamConfig{TransferSize: transferSize, Transfers: transfers})
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	log.WithFields(log.Fields{"args": os.Args, "version": GetVersion()}).Infof("starting go-adb")
 
 	single, _ := arguments.Bool("single")
 	if single {
+		if startFd, _ := arguments.Int("--startfd"); startFd > 0 {
+			err := adb.WaitForStart(startFd)
+			if err != nil {
+				log.Fatalf("failed waiting for the parent process: %v", err)
+			}
+		}
 		serial, _ := arguments.String("--serial")
 		port, _ := arguments.Int("--port")
 		vid, _ := arguments.Int("--vid")
 		pid, _ := arguments.Int("--pid")
 		device := adb.DeviceInfo{SerialNumber: serial, PID: gousb.ID(pid), VID: gousb.ID(vid)}
+		device.SerialWarning, _ = arguments.String("--serialwarning")
+		usbPath, _ := arguments.String("--usbpath")
+		if usbPath != "" {
+			device.Bus, device.Ports, err = adb.ParsePortPath(usbPath)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		statusFd, _ := arguments.Int("--statusfd")
+		controlFd, _ := arguments.Int("--controlfd")
+		limits, err := parseLimits(arguments)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = adb.ApplyLimits(limits)
+		if err != nil {
+			log.Fatal(err)
+		}
+		useKeyDir(arguments)
+		useForwardOptions(arguments)
+		bridge := adb.NewUsbTcpBridge(device, port)
+		if encoded, _ := arguments.String("--restorereverses"); encoded != "" {
+			var reverses []adb.Reverse
+			err := json.Unmarshal([]byte(encoded), &reverses)
+			if err != nil {
+				log.Fatalf("invalid --restorereverses: %v", err)
+			}
+			bridge.ReportReverses(reverses)
+		}
+		if logcatDir, _ := arguments.String("--logcat"); logcatDir != "" {
+			logcatSize, err := arguments.Int("--logcatsize")
+			if err != nil || logcatSize <= 0 {
+				log.Fatalf("invalid --logcatsize: %v", arguments["--logcatsize"])
+			}
+			archive, err := adb.OpenLogcatArchive(logcatDir, device.Identity(), int64(logcatSize))
+			if err != nil {
+				log.Warnf("failed opening logcat archive in %s: %v", logcatDir, err)
+			} else {
+				bridge.ArchiveLogcat(archive)
+			}
+		}
+		apiFd, _ := arguments.Int("--apifd")
+		recordDir, _ := arguments.String("--recorddir")
 		log.Infof("Start in single device mode for device '%s' on port %d", serial, port)
-		startBridge(device, port)
+		startBridge(device, bridge, statusFd, controlFd, apiFd, recordDir)
 		return
 	}
 
 	daemon, _ := arguments.Bool("daemon")
 	if daemon {
 		log.Infof("Start in daemon mode, handling all devices")
+		logDir, _ := arguments.String("--logdir")
+		if logDir != "" {
+			err := adb.EnableLogFiles(logDir, deviceLogMaxSize, deviceLogBackups)
+			if err != nil {
+				log.Fatalf("failed enabling device log files: %v", err)
+			}
+			log.Infof("writing device logs to %s", logDir)
+		}
+		useKeyDir(arguments)
+		useForwardOptions(arguments)
+		if origins, _ := arguments.String("--origins"); origins != "" {
+			rest.AllowOrigins(strings.Split(origins, ","))
+		}
 		processPerDevice, _ := arguments.Bool("--procperdevice")
-		startDaemon(processPerDevice)
+		limits, err := parseLimits(arguments)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if keyDir, _ := arguments.String("--keydir"); keyDir != "" && processPerDevice {
+			//device processes connect with the key of go-adb
+			err := limits.Chown(keyDir)
+			if err != nil {
+				log.Fatalf("failed giving %s to the user of device processes: %v", keyDir, err)
+			}
+		}
+		if socketDir, _ := arguments.String("--socketdir"); socketDir != "" && processPerDevice {
+			//device processes create the sockets of forwards
+			err := limits.Chown(socketDir)
+			if err != nil {
+				log.Fatalf("failed giving %s to the user of device processes: %v", socketDir, err)
+			}
+		}
+		portMap, _ := arguments.String("--portmap")
+		reverseMap, _ := arguments.String("--reverses")
+		logcatDir, _ := arguments.String("--logcat")
+		logcatSize, err := arguments.Int("--logcatsize")
+		if err != nil || logcatSize <= 0 {
+			log.Fatalf("invalid --logcatsize: %v", arguments["--logcatsize"])
+		}
+		recordDir, _ := arguments.String("--recorddir")
+		network, _ := arguments.String("--network")
+		mdns, _ := arguments.Bool("--mdns")
+		startDaemon(processPerDevice, limits, portMap, reverseMap, logcatDir, int64(logcatSize), recordDir, networkSources(network, mdns))
 		return
 	}
 
@@ -87,6 +241,8 @@ func main() {
 
 const deviceBasePort = 16100
 const restInterfacePort = 16000
+const deviceLogMaxSize = 10 * 1024 * 1024
+const deviceLogBackups = 3
 
 //GetVersion reads the contents of the file version.txt and returns it.
 //If the file cannot be read, it returns "could not read version"
@@ -112,32 +268,125 @@ func (LogrusWriter) Write(data []byte) (int, error) {
 	return len(data), nil
 }
 
-func startDaemon(processPerDevice bool) {
+//useKeyDir makes go-adb use the key and paired devices in --keydir, if it is set.
+func useKeyDir(arguments docopt.Opts) {
+	keyDir, _ := arguments.String("--keydir")
+	if keyDir == "" {
+		return
+	}
+	store, err := adb.OpenKeyStore(keyDir)
+	if err != nil {
+		log.Fatalf("failed loading adb key: %v", err)
+	}
+	adb.SetKeyStore(store)
+}
+
+//useForwardOptions applies --forwardaddr and --socketdir to the forwards of devices.
+func useForwardOptions(arguments docopt.Opts) {
+	address, _ := arguments.String("--forwardaddr")
+	err := adb.SetForwardAddress(address)
+	if err != nil {
+		log.Fatal(err)
+	}
+	socketDir, _ := arguments.String("--socketdir")
+	if socketDir == "" {
+		return
+	}
+	err = os.MkdirAll(socketDir, 0755)
+	if err != nil {
+		log.Fatalf("failed creating socket directory %s: %v", socketDir, err)
+	}
+	err = adb.SetForwardSocketDir(socketDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+//networkSources returns the device listers for network devices configured with --network and --mdns.
+func networkSources(network string, mdns bool) []func() ([]adb.DeviceInfo, error) {
+	sources := make([]func() ([]adb.DeviceInfo, error), 0)
+	if network != "" {
+		sources = append(sources, orchestration.NetworkDevices(strings.Split(network, ",")))
+	}
+	if mdns {
+		sources = append(sources, orchestration.MDNSDevices())
+	}
+	return sources
+}
+
+func startDaemon(processPerDevice bool, limits adb.ProcessLimits, portMap string, reverseMap string, logcatDir string, logcatSize int64, recordDir string, sources []func() ([]adb.DeviceInfo, error)) {
+	handover, err := readHandoverState()
+	if err != nil {
+		log.Fatalf("failed reading state handed over by the previous go-adb process: %v", err)
+	}
 
 	var deviceDetector *orchestration.DeviceDetector
 	var manager *orchestration.BridgeManager
 	if processPerDevice {
 		execPath := executable()
 		log.Info("starting device discovery in separate process")
-		deviceDetector = orchestration.NewProcessDeviceDetector(execPath)
+		deviceDetector = orchestration.NewProcessDeviceDetector(execPath, sources...)
 		deviceDetector.StartListening()
 		log.Infof("starting device manager first device will be at port %d", deviceBasePort)
-		manager = orchestration.NewSubProcessBridgeManager(execPath, deviceBasePort)
+		manager = orchestration.NewSubProcessBridgeManager(execPath, deviceBasePort, limits)
 	} else {
 		log.Info("starting device discovery")
-		deviceDetector = orchestration.NewDeviceDetector()
+		deviceDetector = orchestration.NewDeviceDetector(sources...)
 		deviceDetector.StartListening()
 		manager = orchestration.NewBridgeManager(deviceBasePort)
 	}
+	if portMap != "" {
+		err := manager.UsePortMap(portMap)
+		if err != nil {
+			log.Fatalf("failed loading port map %s: %v", portMap, err)
+		}
+	}
+	if reverseMap != "" {
+		err := manager.UseReverseMap(reverseMap)
+		if err != nil {
+			log.Fatalf("failed loading reverse forwards %s: %v", reverseMap, err)
+		}
+	}
+	if logcatDir != "" {
+		err := manager.UseLogcatArchive(logcatDir, logcatSize)
+		if err != nil {
+			log.Fatalf("failed creating logcat archive %s: %v", logcatDir, err)
+		}
+		log.Infof("archiving logcat of devices in %s", logcatDir)
+	}
+	if recordDir != "" {
+		err := manager.UseRecordDir(recordDir)
+		if err != nil {
+			log.Fatalf("failed creating record directory %s: %v", recordDir, err)
+		}
+	}
+	if handover != nil {
+		log.Infof("taking over %d bridges from the previous go-adb process", len(handover.Bridges))
+		manager.RestoreHandover(*handover)
+	}
 
 	deviceDetector.AddListener(manager)
 	log.Infof("starting rest api on port: %d", restInterfacePort)
-	srv := rest.StartHttpServer(restInterfacePort, manager)
+	restListener, err := listenRest(handover)
+	if err != nil {
+		log.Fatalf("failed starting rest api: %v", err)
+	}
+	srv := rest.StartHttpServerOnListener(restListener, manager)
 	log.Info("REST interface is up")
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
 	signal := <-c
+	for signal == syscall.SIGUSR2 {
+		log.Info("upgrade requested")
+		err := upgrade(deviceDetector, manager, restListener)
+		if err == errUpgradeNotStarted {
+			log.Error("upgrade not possible, go-adb keeps running")
+			signal = <-c
+			continue
+		}
+		log.Fatalf("upgrade failed, exiting: %v", err)
+	}
 	log.Infof("os signal:%d received, closing..", signal)
 
 	log.Info("stopping deviceDetector..")
@@ -153,17 +402,204 @@ func startDaemon(processPerDevice bool) {
 	log.Info("REST API shut down. Good bye :-) ")
 }
 
-func startBridge(device adb.DeviceInfo, port int) {
-	bridge := adb.NewUsbTcpBridge(device, port)
+//handoverEnv is the environment variable an upgrading go-adb daemon uses to pass its state to the new binary.
+const handoverEnv = "GOADB_HANDOVER"
+
+var errUpgradeNotStarted = errors.New("upgrade not started")
+
+//upgrade hands all bridges, their ports and the REST listener over to a new go-adb daemon by exec'ing
+//the go-adb binary, which can have been replaced by a new version in the meantime. exec keeps the pid,
+//so systemd does not notice and bridge processes stay our children. It only returns if something failed.
+func upgrade(deviceDetector *orchestration.DeviceDetector, manager *orchestration.BridgeManager, restListener net.Listener) error {
+	execPath := executable()
+	info, err := os.Stat(execPath)
+	if err != nil || info.Mode()&0111 == 0 {
+		log.Errorf("cannot exec %s: %v", execPath, err)
+		return errUpgradeNotStarted
+	}
+	restFile, err := restListener.(*net.TCPListener).File()
+	if err != nil {
+		log.Errorf("cannot hand over rest api listener: %v", err)
+		return errUpgradeNotStarted
+	}
+	inheritedRest, err := adb.InheritableCopy(restFile)
+	restFile.Close()
+	if err != nil {
+		log.Errorf("cannot hand over rest api listener: %v", err)
+		return errUpgradeNotStarted
+	}
+
+	log.Info("stopping deviceDetector..")
+	deviceDetector.Close()
+	log.Info("handing over bridges..")
+	state, files, err := manager.Handover()
+	if err != nil {
+		return err
+	}
+	state.RestFd = int(inheritedRest.Fd())
+	encodedState, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	log.Infof("exec %s for upgrade", execPath)
+	err = syscall.Exec(execPath, os.Args, append(os.Environ(), handoverEnv+"="+string(encodedState)))
+	//the files must not be garbage collected and closed before exec
+	runtime.KeepAlive(files)
+	runtime.KeepAlive(inheritedRest)
+	return err
+}
+
+//readHandoverState returns the state handed over by the previous go-adb daemon or nil
+//if go-adb was not started by an upgrade.
+func readHandoverState() (*orchestration.HandoverState, error) {
+	encodedState, ok := os.LookupEnv(handoverEnv)
+	if !ok {
+		return nil, nil
+	}
+	os.Unsetenv(handoverEnv)
+	var state orchestration.HandoverState
+	err := json.Unmarshal([]byte(encodedState), &state)
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+//listenRest returns the listener of the REST api, either inherited during an upgrade or a new one.
+func listenRest(handover *orchestration.HandoverState) (net.Listener, error) {
+	if handover != nil && handover.RestFd != 0 {
+		restFile := os.NewFile(uintptr(handover.RestFd), "rest")
+		defer restFile.Close()
+		return net.FileListener(restFile)
+	}
+	return net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", restInterfacePort))
+}
+
+//parseLimits reads the resource limit options for device processes.
+func parseLimits(arguments docopt.Opts) (adb.ProcessLimits, error) {
+	var limits adb.ProcessLimits
+	var err error
+	if value, _ := arguments.String("--maxmem"); value != "" {
+		limits.MaxMemory, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return limits, fmt.Errorf("invalid --maxmem: %w", err)
+		}
+	}
+	if value, _ := arguments.String("--maxfiles"); value != "" {
+		limits.MaxFiles, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return limits, fmt.Errorf("invalid --maxfiles: %w", err)
+		}
+	}
+	if value, _ := arguments.String("--nice"); value != "" {
+		limits.Nice, err = strconv.Atoi(value)
+		if err != nil {
+			return limits, fmt.Errorf("invalid --nice: %w", err)
+		}
+	}
+	limits.CgroupParent, _ = arguments.String("--cgroup")
+	if value, _ := arguments.String("--cgroupmem"); value != "" {
+		limits.CgroupMemoryMax, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return limits, fmt.Errorf("invalid --cgroupmem: %w", err)
+		}
+	}
+	if name, _ := arguments.String("--user"); name != "" {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return limits, err
+		}
+		uid, err := strconv.ParseUint(u.Uid, 10, 32)
+		if err != nil {
+			return limits, err
+		}
+		gid, err := strconv.ParseUint(u.Gid, 10, 32)
+		if err != nil {
+			return limits, err
+		}
+		limits.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	}
+	return limits, nil
+}
+
+func startBridge(device adb.DeviceInfo, bridge *adb.UsbTcpBridge, statusFd int, controlFd int, apiFd int, recordDir string) {
 	bridge.Start()
+	var api *http.Server
+	if apiFd > 0 {
+		listener, err := deviceAPIListener(apiFd)
+		if err != nil {
+			log.Errorf("failed serving device api on fd %d: %v", apiFd, err)
+		} else {
+			manager := orchestration.NewSingleBridgeManager(device, bridge)
+			if recordDir != "" {
+				err := manager.UseRecordDir(recordDir)
+				if err != nil {
+					log.Errorf("failed creating record directory %s: %v", recordDir, err)
+				}
+			}
+			api = rest.StartDeviceAPI(listener, manager)
+		}
+	}
+	reportingDone := make(chan struct{})
+	if statusFd > 0 {
+		go reportStatus(bridge, statusFd, reportingDone)
+	}
+	if controlFd > 0 {
+		go receiveControl(controlFd)
+	}
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 	signal := <-c
 	log.Infof("os signal:%d received, closing..", signal)
+	close(reportingDone)
+	if api != nil {
+		api.Close()
+	}
 	bridge.Close()
 	log.Info("single mode bridge is closed")
 }
 
+//deviceAPIListener returns the unix socket the parent go-adb created for the device api, in a directory only the
+//parent can enter.
+func deviceAPIListener(fd int) (net.Listener, error) {
+	file := os.NewFile(uintptr(fd), "api")
+	defer file.Close()
+	return net.FileListener(file)
+}
+
+//reportStatus sends the bridge state to the parent go-adb process over the status pipe.
+//If the pipe breaks, the parent is gone and there is no point in keeping the device claimed.
+func reportStatus(bridge *adb.UsbTcpBridge, statusFd int, done chan struct{}) {
+	statusPipe := os.NewFile(uintptr(statusFd), "status")
+	defer statusPipe.Close()
+	err := adb.ReportStatus(bridge, statusPipe, adb.StatusReportInterval, done)
+	if err != nil {
+		log.Errorf("failed reporting status to parent process, shutting down: %v", err)
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	}
+}
+
+//receiveControl applies the messages of the parent go-adb process, f.ex. log level changes, until it closes the control pipe.
+func receiveControl(controlFd int) {
+	controlPipe := os.NewFile(uintptr(controlFd), "control")
+	defer controlPipe.Close()
+	err := adb.ReadChildControl(controlPipe, func(control adb.ChildControl) {
+		if control.LogLevel == "" {
+			return
+		}
+		level, err := log.ParseLevel(control.LogLevel)
+		if err != nil {
+			log.Warnf("parent process sent invalid log level: %v", err)
+			return
+		}
+		log.Infof("changing log level from %s to %s", log.GetLevel(), level)
+		log.SetLevel(level)
+	})
+	if err != nil {
+		log.Warnf("failed reading control messages of parent process: %v", err)
+	}
+}
+
 func executable() string {
 	ex, err := os.Executable()
 	if err != nil {
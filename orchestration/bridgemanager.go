@@ -1,7 +1,10 @@
 package orchestration
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"sync"
 
 	"github.com/danielpaulus/go-adb/adb"
@@ -15,104 +18,712 @@ import (
 //by just starting a regular UsbTcpBridge.
 type BridgeManager struct {
 	devices          []adb.DeviceInfo
-	basePort         int
-	currentPort      int
+	unbridged        []adb.DeviceInfo
+	fastboot         map[string]*adb.FastbootBridge
+	ports            *PortMap
+	reverses         *ReverseMap
+	logcatDir        string
+	logcatSize       int64
+	recordDir        string
 	bridges          []Bridge
 	processPerDevice bool
 	mux              sync.Mutex
 	closed           bool
 	bridgeProcess    string
+	limits           adb.ProcessLimits
 }
 
 //Bridge is the basic interface for a struct that will bridge USB data to a TCP port.
-//Currently there is the adb/usb_tcp_bridge.go implementation that calls libusb directly and
-//the adb/subprocess_bridge.go which wraps libusb into a separate process.
+//Currently there is the adb/usb_tcp_bridge.go implementation that calls libusb directly,
+//the adb/subprocess_bridge.go which wraps libusb into a separate process and the adb/network_bridge.go
+//for devices attached over the network.
 type Bridge interface {
 	Close() error
 	GetStateName() string
 	GetSerialNumber() string
 	Start() error
+	Details() map[string]interface{}
+	History(n int) []adb.StateTransition
+	Logs(n int) []string
+	Handover() (adb.BridgeHandover, []*os.File, error)
 }
 
+//HandoverState is passed from an upgrading go-adb daemon to the new binary it execs.
+//It contains the port assignments of all devices and the file descriptors of everything
+//that needs to survive the upgrade.
+type HandoverState struct {
+	RestFd  int
+	Bridges []adb.BridgeHandover
+}
+
+//supervisedBridge is implemented by bridges running in a child process. Their supervision
+//status like restart and crash counters is added to the BridgeList and they get log level changes.
+type supervisedBridge interface {
+	SupervisionStatus() map[string]interface{}
+	SetLogLevel(level log.Level)
+}
+
+//forwardingBridge is implemented by bridges running in this process, they have their own adb Session to the device,
+//forward host sockets to services of the device and sockets of the device to the host.
+type forwardingBridge interface {
+	Session() *adb.Session
+	Forwards() *adb.Forwards
+	Reverses() *adb.Reverses
+	ScreenRecorder() *adb.ScreenRecorder
+	ArchiveLogcat(archive *adb.LogcatArchive)
+	LogcatArchive() *adb.LogcatArchive
+}
+
+//featureProcessBridge is implemented by bridges running in a child process that serves their device features,
+//the REST api passes requests for forwards, shell or logcat of these devices to the child.
+type featureProcessBridge interface {
+	RestoreReverses(reverses []adb.Reverse, save func([]adb.Reverse))
+	ArchiveLogcatIn(dir string, maxSize int64)
+	RecordIn(dir string)
+	APISocket() string
+}
+
+var (
+	//ErrBridgeNotFound is returned for serials without bridge
+	ErrBridgeNotFound = errors.New("device not found")
+	//ErrNotSupported is returned for device features the bridge of a device does not support
+	ErrNotSupported = errors.New("not supported by the bridge of the device")
+	//ErrLogcatNotArchived is returned when reading logcat while go-adb does not archive it
+	ErrLogcatNotArchived = errors.New("logcat is not archived, start go-adb with --logcat")
+)
+
 //NewSubProcessBridgeManager will spawn a new process for every device using the subprocessbridge.
 //The first device will be on 0.0.0.0:basePort, the second one on basePort+1 then basePort+2 etc.
-func NewSubProcessBridgeManager(execName string, basePort int) *BridgeManager {
-	return &BridgeManager{currentPort: basePort, basePort: basePort, bridges: make([]Bridge, 0), devices: make([]adb.DeviceInfo, 0),
-		processPerDevice: true, closed: false, bridgeProcess: execName}
+//limits are applied to every process.
+func NewSubProcessBridgeManager(execName string, basePort int, limits adb.ProcessLimits) *BridgeManager {
+	return &BridgeManager{ports: NewPortMap(basePort), reverses: NewReverseMap(), bridges: make([]Bridge, 0), devices: make([]adb.DeviceInfo, 0),
+		fastboot: map[string]*adb.FastbootBridge{}, processPerDevice: true, closed: false, bridgeProcess: execName, limits: limits}
+}
+
+//NewSingleBridgeManager manages only bridge, which bridges device. go-adb single processes use it to serve the
+//device features of their bridge to the REST api of go-adb.
+func NewSingleBridgeManager(device adb.DeviceInfo, bridge Bridge) *BridgeManager {
+	return &BridgeManager{ports: NewPortMap(0), reverses: NewReverseMap(), bridges: []Bridge{bridge}, devices: []adb.DeviceInfo{device},
+		fastboot: map[string]*adb.FastbootBridge{}, processPerDevice: false, closed: false}
 }
 
 //NewBridgeManager starts one process go-adb. USB Code will be used directly in this process for all devices.
 //The first device will be on 0.0.0.0:basePort, the second one on basePort+1 then basePort+2 etc.
 func NewBridgeManager(basePort int) *BridgeManager {
-	return &BridgeManager{currentPort: basePort, basePort: basePort, bridges: make([]Bridge, 0), devices: make([]adb.DeviceInfo, 0),
-		processPerDevice: false, closed: false}
+	return &BridgeManager{ports: NewPortMap(basePort), reverses: NewReverseMap(), bridges: make([]Bridge, 0), devices: make([]adb.DeviceInfo, 0),
+		fastboot: map[string]*adb.FastbootBridge{}, processPerDevice: false, closed: false}
+}
+
+//UsePortMap replaces the port assignments of the manager by the ones stored in file, new assignments are saved to it.
+//It has to be called before the first device is added.
+func (b *BridgeManager) UsePortMap(file string) error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	ports, err := LoadPortMap(file, b.ports.basePort)
+	if err != nil {
+		return err
+	}
+	b.ports = ports
+	return nil
+}
+
+//UseReverseMap keeps the reverse forwards of all devices in file, so they are set up again after a restart.
+//It has to be called before the first device is added.
+func (b *BridgeManager) UseReverseMap(file string) error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	reverses, err := LoadReverseMap(file)
+	if err != nil {
+		return err
+	}
+	b.reverses = reverses
+	return nil
+}
+
+//UseLogcatArchive keeps a logcat stream of every device open and archives it in dir, each device in its own files
+//of at most maxSize bytes together. It has to be called before the first device is added.
+func (b *BridgeManager) UseLogcatArchive(dir string, maxSize int64) error {
+	err := b.makeProcessDir(dir)
+	if err != nil {
+		return err
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.logcatDir = dir
+	b.logcatSize = maxSize
+	return nil
+}
+
+//UseRecordDir lets the REST api write screen recordings into dir, requests only name the file.
+//It has to be called before the first device is added.
+func (b *BridgeManager) UseRecordDir(dir string) error {
+	err := b.makeProcessDir(dir)
+	if err != nil {
+		return err
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.recordDir = dir
+	return nil
+}
+
+//makeProcessDir creates dir, with --procperdevice it is given to the user of the device processes which write into it.
+func (b *BridgeManager) makeProcessDir(dir string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	if !b.processPerDevice {
+		return nil
+	}
+	return b.limits.Chown(dir)
+}
+
+//RecordDir returns the directory screen recordings are written to, empty if UseRecordDir was not called.
+func (b *BridgeManager) RecordDir() string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.recordDir
 }
 
 //DeviceAdded should be called externally by a DeviceDetector, currently it will start a new Bridge for unknown devices
-//or do nothing for devices it already started a Bridge for.
+//or do nothing for devices it already started a Bridge for. Devices are told apart by their identity, see adb.SetIdentityMode.
+//If another device with the same identity is plugged into the same port or a network device got a new address,
+//its bridge is replaced keeping the TCP port.
 func (b *BridgeManager) DeviceAdded(newDevice adb.DeviceInfo) {
-	if isIn(b.devices, newDevice) {
+	added, replaced := b.addDevice(newDevice)
+	//closing a bridge can take a while, f.ex. until its process exited, so it is not done with mux locked.
+	//The new bridge listens on the port of the replaced one, so it is started once that is closed.
+	if replaced != nil {
+		replaced.Close()
+	}
+	if added == nil {
 		return
 	}
+	b.mux.Lock()
+	closed := b.closed
+	b.mux.Unlock()
+	if !closed {
+		added.Start()
+	}
+}
 
+//addDevice adds the bridge for newDevice to the manager without starting it and returns it together with
+//the bridge it replaces, which has to be closed. Both are nil if nothing changed.
+func (b *BridgeManager) addDevice(newDevice adb.DeviceInfo) (Bridge, Bridge) {
 	//prevent the tiny chance of a race condition that if someone attaches a new device,
 	//while a Bridgemanager is closed, we might end up starting a bridge
 	//during shutdown
 	b.mux.Lock()
 	defer b.mux.Unlock()
 	if b.closed {
-		return
+		return nil, nil
+	}
+	if newDevice.Mode == adb.ModeFastboot {
+		b.startFastboot(newDevice)
+	} else {
+		b.stopFastboot(newDevice)
+	}
+	index := findIn(b.devices, newDevice)
+	if !isBridgeable(newDevice) {
+		if index != -1 {
+			//f.ex. adb reboot bootloader, the bridge keeps trying to reconnect
+			b.devices[index].Mode = newDevice.Mode
+			return nil, nil
+		}
+		log.WithFields(log.Fields{"device": newDevice.SerialNumber, "mode": newDevice.Mode}).Info("device is not in ADB mode, not starting a bridge")
+		if unbridgedIndex := findIn(b.unbridged, newDevice); unbridgedIndex != -1 {
+			b.unbridged[unbridgedIndex] = newDevice
+		} else {
+			b.unbridged = append(b.unbridged, newDevice)
+		}
+		return nil, nil
+	}
+	b.unbridged = remove(b.unbridged, newDevice)
+	var replaced Bridge
+	if index != -1 {
+		if b.devices[index].SerialNumber == newDevice.SerialNumber && b.devices[index].NetworkAddress == newDevice.NetworkAddress {
+			//back in ADB mode, maybe with another PID f.ex. in recovery. The bridge reconnects by itself.
+			b.devices[index] = newDevice
+			return nil, nil
+		}
+		log.WithFields(log.Fields{"device": newDevice.SerialNumber, "previous": b.devices[index].SerialNumber, "usbPath": newDevice.PortPath(),
+			"address": newDevice.NetworkAddress}).Info("another device was plugged into the same port or the device moved, replacing its bridge")
+		replaced = b.bridges[index]
+		b.devices = append(b.devices[:index], b.devices[index+1:]...)
+		b.bridges = append(b.bridges[:index], b.bridges[index+1:]...)
 	}
 
 	b.devices = append(b.devices, newDevice)
-	b.startBridge(newDevice)
-	return
+	return b.createBridge(newDevice), replaced
 }
 
-//DeviceRemoved is currently a no-op
+//DeviceRemoved forgets devices that are not bridged and stops fastboot bridges. Bridges are kept, so the device
+//gets the same bridge and port when it comes back, f.ex. after a reboot. Until then its mode is adb.ModeDisconnected.
 func (b *BridgeManager) DeviceRemoved(removedDevice adb.DeviceInfo) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.unbridged = remove(b.unbridged, removedDevice)
+	b.stopFastboot(removedDevice)
+	if index := findIn(b.devices, removedDevice); index != -1 {
+		b.devices[index].Mode = adb.ModeDisconnected
+	}
+}
+
+//startFastboot exposes a device in the bootloader on its port plus adb.FastbootPortOffset.
+//Fastboot bridges always run in the go-adb process, they only claim the device while a client is connected.
+func (b *BridgeManager) startFastboot(device adb.DeviceInfo) {
+	if _, ok := b.fastboot[device.Identity()]; ok {
+		return
+	}
+	port, err := b.ports.Port(device.Identity())
+	if err != nil {
+		log.Warnf("failed saving port map: %v", err)
+	}
+	bridge := adb.NewFastbootBridge(device, port+adb.FastbootPortOffset, adb.OpenFastbootUSB)
+	err = bridge.Start()
+	if err != nil {
+		log.WithFields(log.Fields{"device": device.SerialNumber, "port": port + adb.FastbootPortOffset}).Errorf("failed starting fastboot bridge: %v", err)
+		return
+	}
+	b.fastboot[device.Identity()] = bridge
+}
+
+func (b *BridgeManager) stopFastboot(device adb.DeviceInfo) {
+	bridge, ok := b.fastboot[device.Identity()]
+	if !ok {
+		return
+	}
+	bridge.Close()
+	delete(b.fastboot, device.Identity())
+}
+
+//isBridgeable is true for devices in ADB mode, devices without mode come from go-adb versions that only listed ADB devices.
+func isBridgeable(device adb.DeviceInfo) bool {
+	return device.Mode == "" || device.Mode == adb.ModeADB
 }
 
 //InitialList should be called once externally by a DeviceDetector, it will start a new Bridge for every device
-//contained in the initial list.
+//contained in the initial list, that has no Bridge yet.
 func (b *BridgeManager) InitialList(currentlyConnected []adb.DeviceInfo) {
-	b.devices = currentlyConnected
 	for _, dev := range currentlyConnected {
-		b.startBridge(dev)
+		b.DeviceAdded(dev)
 	}
 }
 
-func createBridge(device adb.DeviceInfo, port int) Bridge {
-	return adb.NewUsbTcpBridge(device, port)
-}
-
-func (b *BridgeManager) startBridge(device adb.DeviceInfo) {
+//createBridge creates the bridge for device and adds it to the manager, it has to be started by the caller.
+//It must be called with mux locked.
+func (b *BridgeManager) createBridge(device adb.DeviceInfo) Bridge {
+	port, err := b.ports.Port(device.Identity())
+	if err != nil {
+		log.Warnf("failed saving port map: %v", err)
+	}
 	var bridge Bridge
-	if b.processPerDevice {
-		bridge = adb.NewSubProcessBridge(device, b.currentPort, b.bridgeProcess)
+	if device.NetworkAddress != "" {
+		bridge = adb.NewNetworkBridge(device, port)
+	} else if b.processPerDevice {
+		bridge = adb.NewSubProcessBridge(device, port, b.bridgeProcess, b.limits)
 	} else {
-		bridge = createBridge(device, b.currentPort)
+		bridge = adb.NewUsbTcpBridge(device, port)
 	}
-	log.WithFields(log.Fields{"device": device.SerialNumber, "port": b.currentPort}).Info("starting usb-bridge")
-	b.currentPort++
+	log.WithFields(log.Fields{"device": device.SerialNumber, "port": port, "usbPath": device.PortPath(), "address": device.NetworkAddress}).Info("starting usb-bridge")
+	b.restoreReverses(device, bridge)
+	b.archiveLogcat(device, bridge)
+	b.recordIn(bridge)
 	b.bridges = append(b.bridges, bridge)
-	bridge.Start()
+	return bridge
+}
+
+//restoreReverses passes the saved reverse forwards of device to its bridge, changes are saved to the ReverseMap.
+//It must be called with mux locked.
+func (b *BridgeManager) restoreReverses(device adb.DeviceInfo, bridge Bridge) {
+	identity := device.Identity()
+	save := func(reverses []adb.Reverse) {
+		b.mux.Lock()
+		defer b.mux.Unlock()
+		err := b.reverses.Set(identity, reverses)
+		if err != nil {
+			log.Warnf("failed saving reverse forwards: %v", err)
+		}
+	}
+	switch bridge := bridge.(type) {
+	case forwardingBridge:
+		bridge.Reverses().Restore(b.reverses.Get(identity), save)
+	case featureProcessBridge:
+		bridge.RestoreReverses(b.reverses.Get(identity), save)
+	}
+}
+
+//archiveLogcat makes bridge archive the log of device in a file named after its identity, so the archive is continued
+//after the device was plugged in again or go-adb restarted. It must be called with mux locked.
+func (b *BridgeManager) archiveLogcat(device adb.DeviceInfo, bridge Bridge) {
+	if b.logcatDir == "" {
+		return
+	}
+	if process, ok := bridge.(featureProcessBridge); ok {
+		process.ArchiveLogcatIn(b.logcatDir, b.logcatSize)
+		return
+	}
+	forwarding, ok := bridge.(forwardingBridge)
+	if !ok {
+		return
+	}
+	archive, err := adb.OpenLogcatArchive(b.logcatDir, device.Identity(), b.logcatSize)
+	if err != nil {
+		log.WithFields(log.Fields{"device": device.SerialNumber, "dir": b.logcatDir}).Warnf("failed opening logcat archive: %v", err)
+		return
+	}
+	forwarding.ArchiveLogcat(archive)
+}
+
+//recordIn passes the record directory to bridges running in a child process, which write the recordings themselves.
+//It must be called with mux locked.
+func (b *BridgeManager) recordIn(bridge Bridge) {
+	if process, ok := bridge.(featureProcessBridge); ok && b.recordDir != "" {
+		process.RecordIn(b.recordDir)
+	}
 }
 
 //BridgeList returns a list of map[string]interface{} that can be converted to JSON easily containing
-//the USB serial, the port and the current state of each bridge.
+//the USB serial, the port, the USB mode, the USB port path or network address if known, a warning for devices without unique serial and the current
+//state of each bridge. For bridges running in a child process it also contains the pid, health, restart backoff and restart
+//and crash counters. Android devices that are not in ADB mode are listed without port and with a hint why they are not bridged.
 func (b *BridgeManager) BridgeList() []map[string]interface{} {
-	result := make([]map[string]interface{}, len(b.bridges))
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	result := make([]map[string]interface{}, 0, len(b.bridges)+len(b.unbridged))
 	for i, bridge := range b.bridges {
 		bridgeData := make(map[string]interface{})
+		if supervised, ok := bridge.(supervisedBridge); ok {
+			bridgeData = supervised.SupervisionStatus()
+		}
+		port, _ := b.ports.Lookup(b.devices[i].Identity())
 		bridgeData["serial"] = bridge.GetSerialNumber()
-		bridgeData["port"] = b.basePort + i
+		bridgeData["port"] = port
 		bridgeData["state"] = bridge.GetStateName()
-		result[i] = bridgeData
+		b.addDeviceData(bridgeData, b.devices[i])
+		result = append(result, bridgeData)
+	}
+	for _, device := range b.unbridged {
+		deviceData := map[string]interface{}{"serial": device.SerialNumber, "state": "notBridged"}
+		b.addDeviceData(deviceData, device)
+		result = append(result, deviceData)
 	}
 	return result
 }
 
+func (b *BridgeManager) addDeviceData(data map[string]interface{}, device adb.DeviceInfo) {
+	mode := device.Mode
+	if mode == "" {
+		mode = adb.ModeADB
+	}
+	data["mode"] = mode
+	if hint := adb.ModeHint(mode); hint != "" {
+		data["hint"] = hint
+	}
+	if path := device.PortPath(); path != "" {
+		data["usbPath"] = path
+	}
+	if address := device.NetworkAddress; address != "" {
+		data["address"] = address
+	}
+	if warning := device.SerialWarning; warning != "" {
+		data["warning"] = fmt.Sprintf("%s serial, identified by USB port", warning)
+	}
+	if fastboot, ok := b.fastboot[device.Identity()]; ok {
+		data["fastbootPort"] = fastboot.GetPort()
+	}
+}
+
+//BridgeDetails returns the full details of the bridge for the device with the given serial.
+//The bool is false if no such bridge exists.
+func (b *BridgeManager) BridgeDetails(serial string) (map[string]interface{}, bool) {
+	bridge, ok := b.findBridge(serial)
+	if !ok {
+		return nil, false
+	}
+	return bridge.Details(), true
+}
+
+//BridgeHistory returns the last n state transitions of the bridge for the device with the given serial.
+//The bool is false if no such bridge exists.
+func (b *BridgeManager) BridgeHistory(serial string, n int) ([]adb.StateTransition, bool) {
+	bridge, ok := b.findBridge(serial)
+	if !ok {
+		return nil, false
+	}
+	return bridge.History(n), true
+}
+
+//BridgeLogs returns the last n log lines of the bridge for the device with the given serial.
+//The bool is false if no such bridge exists.
+func (b *BridgeManager) BridgeLogs(serial string, n int) ([]string, bool) {
+	bridge, ok := b.findBridge(serial)
+	if !ok {
+		return nil, false
+	}
+	return bridge.Logs(n), true
+}
+
+//AddForward forwards the host socket local to the socket remote of the device with the given serial, see adb.Forwards.
+func (b *BridgeManager) AddForward(serial string, local string, remote string) (adb.Forward, error) {
+	forwards, err := b.findForwards(serial)
+	if err != nil {
+		return adb.Forward{}, err
+	}
+	return forwards.Add(local, remote)
+}
+
+//ListForwards returns the forwards of the device with the given serial.
+func (b *BridgeManager) ListForwards(serial string) ([]adb.Forward, error) {
+	forwards, err := b.findForwards(serial)
+	if err != nil {
+		return nil, err
+	}
+	return forwards.List(), nil
+}
+
+//RemoveForward stops forwarding the host socket local to the device with the given serial.
+func (b *BridgeManager) RemoveForward(serial string, local string) error {
+	forwards, err := b.findForwards(serial)
+	if err != nil {
+		return err
+	}
+	return forwards.Remove(local)
+}
+
+func (b *BridgeManager) findForwards(serial string) (*adb.Forwards, error) {
+	forwarding, err := b.findForwardingBridge(serial)
+	if err != nil {
+		return nil, err
+	}
+	return forwarding.Forwards(), nil
+}
+
+//AddReverse makes the device with the given serial forward its socket remote to the host socket local, see adb.Reverses.
+func (b *BridgeManager) AddReverse(serial string, remote string, local string) (adb.Reverse, error) {
+	reverses, err := b.findReverses(serial)
+	if err != nil {
+		return adb.Reverse{}, err
+	}
+	return reverses.Add(remote, local)
+}
+
+//ListReverses returns the reverse forwards of the device with the given serial.
+func (b *BridgeManager) ListReverses(serial string) ([]adb.Reverse, error) {
+	reverses, err := b.findReverses(serial)
+	if err != nil {
+		return nil, err
+	}
+	return reverses.List(), nil
+}
+
+//RemoveReverse stops forwarding the socket remote of the device with the given serial.
+func (b *BridgeManager) RemoveReverse(serial string, remote string) error {
+	reverses, err := b.findReverses(serial)
+	if err != nil {
+		return err
+	}
+	return reverses.Remove(remote)
+}
+
+func (b *BridgeManager) findReverses(serial string) (*adb.Reverses, error) {
+	forwarding, err := b.findForwardingBridge(serial)
+	if err != nil {
+		return nil, err
+	}
+	return forwarding.Reverses(), nil
+}
+
+//OpenShell runs command with the shell v2 protocol on the device with the given serial, see adb.Session.OpenShell.
+func (b *BridgeManager) OpenShell(serial string, command string, term string) (*adb.Shell, error) {
+	forwarding, err := b.findForwardingBridge(serial)
+	if err != nil {
+		return nil, err
+	}
+	return forwarding.Session().OpenShell(command, term)
+}
+
+//OpenTerminal starts an interactive shell in a pseudo terminal on the device with the given serial, see adb.Session.OpenTerminal.
+func (b *BridgeManager) OpenTerminal(serial string, term string, rows int, cols int) (*adb.Shell, error) {
+	forwarding, err := b.findForwardingBridge(serial)
+	if err != nil {
+		return nil, err
+	}
+	return forwarding.Session().OpenTerminal(term, rows, cols)
+}
+
+//Screenshot returns a PNG of the screen of the device with the given serial.
+func (b *BridgeManager) Screenshot(serial string) ([]byte, error) {
+	forwarding, err := b.findForwardingBridge(serial)
+	if err != nil {
+		return nil, err
+	}
+	return forwarding.Session().Screenshot()
+}
+
+//StartScreenRecord starts recording the screen of the device with the given serial to output, see adb.ScreenRecorder.
+func (b *BridgeManager) StartScreenRecord(serial string, options adb.RecordOptions, output io.Writer, name string) (*adb.Recording, error) {
+	forwarding, err := b.findForwardingBridge(serial)
+	if err != nil {
+		return nil, err
+	}
+	return forwarding.ScreenRecorder().Start(options, output, name)
+}
+
+//StopScreenRecord stops recording the screen of the device with the given serial.
+func (b *BridgeManager) StopScreenRecord(serial string) (adb.RecordingInfo, error) {
+	forwarding, err := b.findForwardingBridge(serial)
+	if err != nil {
+		return adb.RecordingInfo{}, err
+	}
+	return forwarding.ScreenRecorder().Stop()
+}
+
+//LogcatArchive returns the archived log of the device with the given serial.
+func (b *BridgeManager) LogcatArchive(serial string) (*adb.LogcatArchive, error) {
+	forwarding, err := b.findForwardingBridge(serial)
+	if err != nil {
+		return nil, err
+	}
+	archive := forwarding.LogcatArchive()
+	if archive == nil {
+		return nil, ErrLogcatNotArchived
+	}
+	return archive, nil
+}
+
+//BridgeAPISocket returns the unix socket of the REST api of the bridge process of the device with the given serial,
+//empty if its bridge runs in this process.
+func (b *BridgeManager) BridgeAPISocket(serial string) string {
+	bridge, ok := b.findBridge(serial)
+	if !ok {
+		return ""
+	}
+	if process, ok := bridge.(featureProcessBridge); ok {
+		return process.APISocket()
+	}
+	return ""
+}
+
+//PowerCycle power cycles the hub port of the device with the given serial. Known devices are located by their USB
+//port path, so devices that cannot be opened anymore can be power cycled too.
+func (b *BridgeManager) PowerCycle(serial string) error {
+	b.mux.Lock()
+	var device *adb.DeviceInfo
+	for i := range b.devices {
+		if b.devices[i].SerialNumber == serial && b.devices[i].NetworkAddress == "" {
+			known := b.devices[i]
+			device = &known
+			break
+		}
+	}
+	b.mux.Unlock()
+	if device == nil {
+		return adb.PowerCycleBySerial(serial)
+	}
+	return adb.PowerCycle(*device)
+}
+
+func (b *BridgeManager) findForwardingBridge(serial string) (forwardingBridge, error) {
+	bridge, ok := b.findBridge(serial)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrBridgeNotFound, serial)
+	}
+	forwarding, ok := bridge.(forwardingBridge)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return forwarding, nil
+}
+
+func (b *BridgeManager) findBridge(serial string) (Bridge, bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	for _, bridge := range b.bridges {
+		if bridge.GetSerialNumber() == serial {
+			return bridge, true
+		}
+	}
+	return nil, false
+}
+
+//SetLogLevel changes the log level of go-adb and passes it to all bridge processes.
+func (b *BridgeManager) SetLogLevel(level log.Level) {
+	log.SetLevel(level)
+	b.mux.Lock()
+	bridges := append([]Bridge{}, b.bridges...)
+	b.mux.Unlock()
+	for _, bridge := range bridges {
+		if supervised, ok := bridge.(supervisedBridge); ok {
+			supervised.SetLogLevel(level)
+		}
+	}
+}
+
+//Handover prepares a zero downtime upgrade. It stops starting new bridges and returns the port assignments
+//and the files the new go-adb process needs to take over all bridges. The files have to be kept open until exec.
+//Bridges running in this process are closed to release their USB devices, their TCP listeners stay open.
+//Bridges of network devices always run in this process.
+//Bridge processes keep running and will be adopted by the new go-adb process.
+func (b *BridgeManager) Handover() (HandoverState, []*os.File, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.closed = true
+	state := HandoverState{Bridges: make([]adb.BridgeHandover, len(b.bridges))}
+	files := make([]*os.File, 0)
+	for i, bridge := range b.bridges {
+		handover, bridgeFiles, err := bridge.Handover()
+		if err != nil {
+			log.WithFields(log.Fields{"device": handover.Device.SerialNumber, "port": handover.Port}).
+				Warnf("failed handing over bridge, it will be restarted: %v", err)
+		}
+		state.Bridges[i] = handover
+		files = append(files, bridgeFiles...)
+	}
+	for _, bridge := range b.bridges {
+		if _, ok := bridge.(supervisedBridge); !ok {
+			bridge.Close()
+		}
+	}
+	//fastboot bridges are started again by the new process once it detects the devices
+	b.closeFastboot()
+	return state, files, nil
+}
+
+//RestoreHandover recreates the bridges of the previous go-adb process with the same ports, taking over their
+//TCP listeners or bridge processes. It has to be called before the manager is added to a DeviceDetector.
+func (b *BridgeManager) RestoreHandover(state HandoverState) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	for _, handover := range state.Bridges {
+		var bridge Bridge
+		var err error
+		if handover.Device.NetworkAddress != "" {
+			bridge, err = adb.NewNetworkBridgeFromHandover(handover)
+		} else if b.processPerDevice {
+			bridge, err = adb.AdoptSubProcessBridge(handover, b.bridgeProcess, b.limits)
+		} else {
+			bridge, err = adb.NewUsbTcpBridgeFromHandover(handover)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"device": handover.Device.SerialNumber, "port": handover.Port}).
+				Warnf("failed taking over bridge: %v", err)
+		}
+		log.WithFields(log.Fields{"device": handover.Device.SerialNumber, "port": handover.Port}).Info("restoring usb-bridge")
+		err = b.ports.Assign(handover.Device.Identity(), handover.Port)
+		if err != nil {
+			log.Warnf("failed saving port map: %v", err)
+		}
+		b.restoreReverses(handover.Device, bridge)
+		b.archiveLogcat(handover.Device, bridge)
+		b.recordIn(bridge)
+		b.devices = append(b.devices, handover.Device)
+		b.bridges = append(b.bridges, bridge)
+		bridge.Start()
+	}
+}
+
 //Close shuts down all bridges gracefully
 //A call to Close is idempotent.
 func (b *BridgeManager) Close() error {
@@ -122,6 +733,7 @@ func (b *BridgeManager) Close() error {
 		return nil
 	}
 	b.closed = true
+	b.closeFastboot()
 	var closeErr error
 	for _, bridge := range b.bridges {
 		err := bridge.Close()
@@ -135,3 +747,10 @@ func (b *BridgeManager) Close() error {
 	}
 	return closeErr
 }
+
+func (b *BridgeManager) closeFastboot() {
+	for identity, bridge := range b.fastboot {
+		bridge.Close()
+		delete(b.fastboot, identity)
+	}
+}
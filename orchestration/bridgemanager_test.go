@@ -2,7 +2,10 @@ package orchestration_test
 
 import (
 	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/danielpaulus/go-adb/adb"
 	"github.com/danielpaulus/go-adb/orchestration"
@@ -18,7 +21,7 @@ func TestBridgeManagerInitialList(t *testing.T) {
 	man := orchestration.NewBridgeManager(basePort)
 
 	man.InitialList([]adb.DeviceInfo{info, info2})
-	const expected = `[{"port":60000,"serial":"test","state":"notInitialized"},{"port":60001,"serial":"test2","state":"notInitialized"}]`
+	const expected = `[{"mode":"adb","port":60000,"serial":"test","state":"notInitialized"},{"mode":"adb","port":60001,"serial":"test2","state":"notInitialized"}]`
 	actual := tojson(man.BridgeList(), t)
 	assert.Equal(t, expected, actual)
 	err := man.Close()
@@ -39,7 +42,7 @@ func TestBridgeManagerAddDevice(t *testing.T) {
 	man.DeviceAdded(info)
 	man.DeviceAdded(info2)
 	man.DeviceAdded(info2)
-	expected = `[{"port":60000,"serial":"test","state":"notInitialized"},{"port":60001,"serial":"test2","state":"notInitialized"}]`
+	expected = `[{"mode":"adb","port":60000,"serial":"test","state":"notInitialized"},{"mode":"adb","port":60001,"serial":"test2","state":"notInitialized"}]`
 	actual = tojson(man.BridgeList(), t)
 	assert.Equal(t, expected, actual)
 
@@ -49,6 +52,27 @@ func TestBridgeManagerAddDevice(t *testing.T) {
 	}
 }
 
+func TestBridgeManagerDetails(t *testing.T) {
+	man := orchestration.NewBridgeManager(basePort)
+	man.InitialList([]adb.DeviceInfo{info, info2})
+
+	details, ok := man.BridgeDetails("test2")
+	if assert.True(t, ok) {
+		assert.Equal(t, "test2", details["serial"])
+		assert.Equal(t, basePort+1, details["port"])
+		assert.Equal(t, info2, details["device"])
+	}
+	_, ok = man.BridgeHistory("unknown", 0)
+	assert.False(t, ok)
+	_, ok = man.BridgeLogs("test", 10)
+	assert.True(t, ok)
+
+	err := man.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func tojson(obj interface{}, t *testing.T) string {
 	json, err := json.Marshal(obj)
 	if err != nil {
@@ -56,3 +80,87 @@ func tojson(obj interface{}, t *testing.T) string {
 	}
 	return string(json)
 }
+
+func TestBridgeManagerListsDevicesInOtherModes(t *testing.T) {
+	fastboot := adb.DeviceInfo{SerialNumber: "fastboot", VID: 5, PID: 7, Mode: adb.ModeFastboot}
+	man := orchestration.NewBridgeManager(basePort)
+	man.InitialList([]adb.DeviceInfo{info, fastboot})
+
+	list := man.BridgeList()
+	if assert.Equal(t, 2, len(list)) {
+		assert.Equal(t, "fastboot", list[1]["serial"])
+		assert.Equal(t, adb.ModeFastboot, list[1]["mode"])
+		assert.Equal(t, "notBridged", list[1]["state"])
+		assert.Equal(t, adb.ModeHint(adb.ModeFastboot), list[1]["hint"])
+		assert.Nil(t, list[1]["port"])
+	}
+
+	rebooted := info
+	rebooted.Mode = adb.ModeFastboot
+	man.DeviceAdded(rebooted)
+	man.DeviceRemoved(fastboot)
+	list = man.BridgeList()
+	if assert.Equal(t, 1, len(list)) {
+		assert.Equal(t, adb.ModeFastboot, list[0]["mode"])
+		assert.Equal(t, basePort, list[0]["port"])
+	}
+	assert.NoError(t, man.Close())
+}
+
+func TestBridgeManagerKeepsBridgeAcrossReboots(t *testing.T) {
+	man := orchestration.NewBridgeManager(basePort)
+	man.InitialList([]adb.DeviceInfo{info})
+
+	man.DeviceRemoved(info)
+	list := man.BridgeList()
+	if assert.Equal(t, 1, len(list)) {
+		assert.Equal(t, adb.ModeDisconnected, list[0]["mode"])
+		assert.Equal(t, adb.ModeHint(adb.ModeDisconnected), list[0]["hint"])
+	}
+
+	recovery := info
+	recovery.PID = 0xd001
+	recovery.Mode = adb.ModeADB
+	man.DeviceAdded(recovery)
+	list = man.BridgeList()
+	if assert.Equal(t, 1, len(list)) {
+		assert.Equal(t, adb.ModeADB, list[0]["mode"])
+		assert.Equal(t, basePort, list[0]["port"])
+		assert.Nil(t, list[0]["hint"])
+	}
+	assert.NoError(t, man.Close())
+}
+
+func TestBridgeManagerIsNotBlockedWhileReplacingBridge(t *testing.T) {
+	adb.SetIdentityMode(adb.IdentityByPortPath)
+	defer adb.SetIdentityMode(adb.IdentityBySerial)
+	//the fake go-adb takes a while to exit after SIGTERM
+	goadb := filepath.Join(t.TempDir(), "go-adb")
+	script := "#!/bin/sh\ntrap 'sleep 2; exit 0' TERM\nwhile true; do sleep 0.1; done\n"
+	if !assert.NoError(t, ioutil.WriteFile(goadb, []byte(script), 0755)) {
+		return
+	}
+	slot := adb.DeviceInfo{SerialNumber: "phone1", VID: 5, PID: 6, Bus: 1, Ports: []int{7}}
+	replacement := adb.DeviceInfo{SerialNumber: "phone2", VID: 5, PID: 6, Bus: 1, Ports: []int{7}}
+	man := orchestration.NewSubProcessBridgeManager(goadb, basePort, adb.ProcessLimits{})
+	man.DeviceAdded(slot)
+	assert.Eventually(t, func() bool { return man.BridgeList()[0]["pid"] != 0 }, 5*time.Second, 10*time.Millisecond)
+
+	replaced := make(chan struct{})
+	go func() {
+		man.DeviceAdded(replacement)
+		close(replaced)
+	}()
+	assert.Eventually(t, func() bool {
+		list := man.BridgeList()
+		return len(list) == 1 && list[0]["serial"] == "phone2"
+	}, time.Second, 10*time.Millisecond)
+	select {
+	case <-replaced:
+		t.Error("the replaced bridge process should still be exiting")
+	default:
+	}
+	<-replaced
+	assert.Eventually(t, func() bool { return man.BridgeList()[0]["pid"] != 0 }, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, man.Close())
+}
@@ -33,23 +33,30 @@ type DeviceDetector struct {
 	logCounter   int
 	done         chan struct{}
 	deviceLister func() ([]adb.DeviceInfo, error)
+	sources      []func() ([]adb.DeviceInfo, error)
+	serials      *adb.SerialTracker
 }
 
 //NewDeviceDetector creates a new detector that checks for new devices every 5s using
-//libusb directly.
-func NewDeviceDetector() *DeviceDetector {
+//libusb directly. The devices of sources, f.ex. NetworkDevices, are detected along with the USB devices.
+func NewDeviceDetector(sources ...func() ([]adb.DeviceInfo, error)) *DeviceDetector {
 	return &DeviceDetector{listeners: make([]DeviceUpdateListener, 0),
 		devices:      make([]adb.DeviceInfo, 0),
 		done:         make(chan struct{}, 0),
-		deviceLister: adb.ListDevices}
+		deviceLister: adb.ListDevices,
+		sources:      sources,
+		serials:      adb.NewSerialTracker()}
 }
 
 //NewProcessDeviceDetector checks for new devices every 5s by calling go-adb listdevices.
-func NewProcessDeviceDetector(execpath string) *DeviceDetector {
+//The devices of sources are detected along with the USB devices.
+func NewProcessDeviceDetector(execpath string, sources ...func() ([]adb.DeviceInfo, error)) *DeviceDetector {
 	return &DeviceDetector{listeners: make([]DeviceUpdateListener, 0),
 		devices:      make([]adb.DeviceInfo, 0),
 		done:         make(chan struct{}, 0),
-		deviceLister: processList(execpath)}
+		deviceLister: processList(execpath),
+		sources:      sources,
+		serials:      adb.NewSerialTracker()}
 }
 
 type deviceResponse struct {
@@ -98,7 +105,7 @@ func (d *DeviceDetector) StartListening() {
 		for {
 			select {
 			case <-d.done:
-				break
+				return
 			case <-time.After(5 * time.Second):
 				d.detect()
 			}
@@ -108,12 +115,24 @@ func (d *DeviceDetector) StartListening() {
 }
 
 func (d *DeviceDetector) detect() {
-	d.mux.Lock()
-	defer d.mux.Unlock()
+	//listing takes seconds with network sources, listeners registering meanwhile must not wait for it
 	devices, err := d.deviceLister()
 	if err != nil {
 		log.Warnf("Error getting devicelist: %+v", err)
 	}
+	var networkDevices []adb.DeviceInfo
+	for _, source := range d.sources {
+		sourceDevices, err := source()
+		if err != nil {
+			log.Warnf("Error getting devicelist: %+v", err)
+		}
+		networkDevices = append(networkDevices, sourceDevices...)
+	}
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.serials.Track(devices, d.devices)
+	devices = append(devices, networkDevices...)
 	d.logCounter++
 	if d.logCounter > 2 {
 		log.Infof("detected devices: %+v", devices)
@@ -121,9 +140,16 @@ func (d *DeviceDetector) detect() {
 	}
 
 	for _, newDevice := range devices {
-		if !isIn(d.devices, newDevice) {
+		index := findIn(d.devices, newDevice)
+		if index == -1 {
 			d.devices = append(d.devices, newDevice)
 			notifyAddListeners(d, newDevice)
+		} else if d.devices[index].SerialNumber != newDevice.SerialNumber || d.devices[index].Mode != newDevice.Mode ||
+			d.devices[index].NetworkAddress != newDevice.NetworkAddress {
+			//the device changed its USB mode or its network address, or with devices identified by port path only,
+			//another device was plugged into the same port
+			d.devices[index] = newDevice
+			notifyAddListeners(d, newDevice)
 		}
 	}
 
@@ -160,7 +186,7 @@ func isIn(devices []adb.DeviceInfo, otherDevice adb.DeviceInfo) bool {
 
 func findIn(devices []adb.DeviceInfo, otherDevice adb.DeviceInfo) int {
 	for index, device := range devices {
-		if device.SerialNumber == otherDevice.SerialNumber {
+		if device.Identity() == otherDevice.Identity() {
 			return index
 		}
 	}
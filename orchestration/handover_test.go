@@ -0,0 +1,78 @@
+package orchestration_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/danielpaulus/go-adb/adb"
+	"github.com/danielpaulus/go-adb/orchestration"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandoverKeepsListenerOfBridge(t *testing.T) {
+	adbd, err := net.Listen("tcp4", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer adbd.Close()
+	go func() {
+		for {
+			conn, err := adbd.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	const port = 60300
+	device := adb.DeviceInfo{SerialNumber: "handover", Mode: adb.ModeADB, NetworkAddress: adbd.Addr().String()}
+	man := orchestration.NewBridgeManager(port)
+	man.DeviceAdded(device)
+
+	state, files, err := man.Handover()
+	if !assert.NoError(t, err) || !assert.Equal(t, 1, len(files)) {
+		return
+	}
+	encoded, err := json.Marshal(state)
+	assert.NoError(t, err)
+	var restored orchestration.HandoverState
+	assert.NoError(t, json.Unmarshal(encoded, &restored))
+	if !assert.Equal(t, 1, len(restored.Bridges)) || !assert.NotEqual(t, 0, restored.Bridges[0].ListenerFd) {
+		return
+	}
+	//like exec, the new bridge owns the file descriptor afterwards
+	fd, err := syscall.Dup(restored.Bridges[0].ListenerFd)
+	assert.NoError(t, err)
+	restored.Bridges[0].ListenerFd = fd
+	files[0].Close()
+
+	//the old bridge is closed, but the port stays bound and connections wait for the new bridge
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	newMan := orchestration.NewBridgeManager(port + 50)
+	newMan.RestoreHandover(restored)
+	defer newMan.Close()
+	list := newMan.BridgeList()
+	if assert.Equal(t, 1, len(list)) {
+		assert.Equal(t, port, list[0]["port"])
+		assert.Equal(t, "handover", list[0]["serial"])
+	}
+	message := []byte("CNXN after the upgrade")
+	_, err = conn.Write(message)
+	assert.NoError(t, err)
+	echo := make([]byte, len(message))
+	_, err = io.ReadFull(conn, echo)
+	assert.NoError(t, err)
+	assert.Equal(t, message, echo)
+}
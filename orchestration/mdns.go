@@ -0,0 +1,217 @@
+package orchestration
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//MDNSServer is the IPv4 multicast address mDNS queries are sent to
+	MDNSServer = "224.0.0.251:5353"
+	//ADBTLSConnectService is announced by devices with wireless debugging enabled
+	ADBTLSConnectService = "_adb-tls-connect._tcp.local."
+
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeSRV = 33
+	dnsClassIN = 1
+	//dnsUnicastResponse asks responders to answer the querying port directly, queries from ports other than 5353
+	//are answered directly anyway
+	dnsUnicastResponse = 0x8000
+)
+
+//MDNSService is one instance of a service found with BrowseMDNS.
+type MDNSService struct {
+	//Instance is the name of the instance, f.ex. adb-SERIAL-abc123._adb-tls-connect._tcp.local.
+	Instance string
+	//Address is the IPv4 address and port of the instance
+	Address string
+}
+
+//BrowseMDNS sends one query for service to server, usually MDNSServer, and collects the answers for timeout.
+//Only instances announced with an SRV and an A record are returned, this is what Android sends.
+//It is a minimal mDNS client good enough for finding adbd, there is no caching, IPv6 or continuous querying.
+func BrowseMDNS(service string, server string, timeout time.Duration) ([]MDNSService, error) {
+	serverAddr, err := net.ResolveUDPAddr("udp4", server)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_, err = conn.WriteToUDP(encodeMDNSQuery(service), serverAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed sending mDNS query: %w", err)
+	}
+	err = conn.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+	answers := newMDNSAnswers()
+	buffer := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			return nil, err
+		}
+		//responses that cannot be parsed are skipped, they might be for somebody else
+		answers.parse(buffer[:n])
+	}
+	return answers.services(service), nil
+}
+
+func encodeMDNSQuery(service string) []byte {
+	message := make([]byte, 12)
+	binary.BigEndian.PutUint16(message[4:], 1)
+	message = appendDNSName(message, service)
+	message = append(message, 0, dnsTypePTR, byte((dnsUnicastResponse|dnsClassIN)>>8), byte(dnsClassIN))
+	return message
+}
+
+func appendDNSName(message []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		message = append(message, byte(len(label)))
+		message = append(message, label...)
+	}
+	return append(message, 0)
+}
+
+type srvRecord struct {
+	target string
+	port   uint16
+}
+
+//mdnsAnswers collects the records of all responses to one query.
+type mdnsAnswers struct {
+	instances map[string][]string
+	srv       map[string]srvRecord
+	addresses map[string]net.IP
+}
+
+func newMDNSAnswers() *mdnsAnswers {
+	return &mdnsAnswers{instances: map[string][]string{}, srv: map[string]srvRecord{}, addresses: map[string]net.IP{}}
+}
+
+//parse adds the records of message, it stops at the first malformed record.
+func (a *mdnsAnswers) parse(message []byte) error {
+	if len(message) < 12 {
+		return errors.New("dns message too short")
+	}
+	questions := int(binary.BigEndian.Uint16(message[4:]))
+	records := int(binary.BigEndian.Uint16(message[6:])) + int(binary.BigEndian.Uint16(message[8:])) + int(binary.BigEndian.Uint16(message[10:]))
+	offset := 12
+	for i := 0; i < questions; i++ {
+		_, next, err := readDNSName(message, offset)
+		if err != nil {
+			return err
+		}
+		offset = next + 4
+	}
+	for i := 0; i < records; i++ {
+		name, next, err := readDNSName(message, offset)
+		if err != nil {
+			return err
+		}
+		if next+10 > len(message) {
+			return errors.New("dns record truncated")
+		}
+		recordType := binary.BigEndian.Uint16(message[next:])
+		length := int(binary.BigEndian.Uint16(message[next+8:]))
+		data := next + 10
+		offset = data + length
+		if offset > len(message) {
+			return errors.New("dns record truncated")
+		}
+		key := strings.ToLower(name)
+		switch recordType {
+		case dnsTypePTR:
+			instance, _, err := readDNSName(message, data)
+			if err != nil {
+				return err
+			}
+			a.instances[key] = append(a.instances[key], instance)
+		case dnsTypeSRV:
+			if length < 7 {
+				return errors.New("dns SRV record too short")
+			}
+			target, _, err := readDNSName(message, data+6)
+			if err != nil {
+				return err
+			}
+			a.srv[key] = srvRecord{target: target, port: binary.BigEndian.Uint16(message[data+4:])}
+		case dnsTypeA:
+			if length == net.IPv4len {
+				a.addresses[key] = append(net.IP{}, message[data:offset]...)
+			}
+		}
+	}
+	return nil
+}
+
+//services returns the instances of service that have an SRV record with a target that has an A record.
+func (a *mdnsAnswers) services(service string) []MDNSService {
+	result := make([]MDNSService, 0)
+	seen := map[string]bool{}
+	for _, instance := range a.instances[strings.ToLower(service)] {
+		srv, ok := a.srv[strings.ToLower(instance)]
+		if !ok || seen[instance] {
+			continue
+		}
+		ip, ok := a.addresses[strings.ToLower(srv.target)]
+		if !ok {
+			continue
+		}
+		seen[instance] = true
+		result = append(result, MDNSService{Instance: instance, Address: net.JoinHostPort(ip.String(), strconv.Itoa(int(srv.port)))})
+	}
+	return result
+}
+
+//readDNSName reads the possibly compressed name at offset and returns it with a trailing dot and the offset after it.
+func readDNSName(message []byte, offset int) (string, int, error) {
+	labels := make([]string, 0)
+	next := -1
+	jumps := 0
+	for {
+		if offset >= len(message) {
+			return "", 0, errors.New("dns name truncated")
+		}
+		length := int(message[offset])
+		switch {
+		case length == 0:
+			if next == -1 {
+				next = offset + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(message) {
+				return "", 0, errors.New("dns name truncated")
+			}
+			jumps++
+			if jumps > 10 {
+				return "", 0, errors.New("dns name has too many pointers")
+			}
+			if next == -1 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(message[offset:]) & 0x3fff)
+		default:
+			if offset+1+length > len(message) {
+				return "", 0, errors.New("dns name truncated")
+			}
+			labels = append(labels, string(message[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package orchestration
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielpaulus/go-adb/adb"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	//networkProbeTimeout is how long adbd of a network device has to accept a connection to be listed
+	networkProbeTimeout = 2 * time.Second
+	//mdnsBrowseTimeout is how long MDNSDevices waits for answers
+	mdnsBrowseTimeout = time.Second
+)
+
+//NetworkDevices returns a device lister for NewDeviceDetector that lists every target, a host:port of adbd,
+//that accepts TCP connections. Devices are identified by their address, so every target keeps its bridge and port.
+func NetworkDevices(targets []string) func() ([]adb.DeviceInfo, error) {
+	return func() ([]adb.DeviceInfo, error) {
+		reachable := make([]bool, len(targets))
+		var wg sync.WaitGroup
+		for i, target := range targets {
+			wg.Add(1)
+			go func(i int, target string) {
+				defer wg.Done()
+				conn, err := net.DialTimeout("tcp", target, networkProbeTimeout)
+				if err != nil {
+					log.WithFields(log.Fields{"address": target}).Debugf("network device not reachable: %v", err)
+					return
+				}
+				conn.Close()
+				reachable[i] = true
+			}(i, target)
+		}
+		wg.Wait()
+		devices := make([]adb.DeviceInfo, 0, len(targets))
+		for i, target := range targets {
+			if reachable[i] {
+				devices = append(devices, NetworkDevice(target, target))
+			}
+		}
+		return devices, nil
+	}
+}
+
+//MDNSDevices returns a device lister for NewDeviceDetector that lists devices announcing wireless debugging
+//with mDNS. Their adbd port changes whenever wireless debugging is turned on, so they are identified by the serial
+//contained in the instance name.
+func MDNSDevices() func() ([]adb.DeviceInfo, error) {
+	return func() ([]adb.DeviceInfo, error) {
+		services, err := BrowseMDNS(ADBTLSConnectService, MDNSServer, mdnsBrowseTimeout)
+		if err != nil {
+			return []adb.DeviceInfo{}, err
+		}
+		devices := make([]adb.DeviceInfo, len(services))
+		for i, service := range services {
+			devices[i] = NetworkDevice(serialFromInstance(service.Instance), service.Address)
+		}
+		return devices, nil
+	}
+}
+
+//NetworkDevice returns the DeviceInfo of the device with serial whose adbd listens on address.
+func NetworkDevice(serial string, address string) adb.DeviceInfo {
+	return adb.DeviceInfo{SerialNumber: serial, Mode: adb.ModeADB, NetworkAddress: address}
+}
+
+//serialFromInstance returns SERIAL for Android instance names like adb-SERIAL-abc123._adb-tls-connect._tcp.local.
+//and the first label for other names.
+func serialFromInstance(instance string) string {
+	name := strings.SplitN(instance, ".", 2)[0]
+	if !strings.HasPrefix(name, "adb-") {
+		return name
+	}
+	name = strings.TrimPrefix(name, "adb-")
+	if end := strings.LastIndex(name, "-"); end > 0 {
+		return name[:end]
+	}
+	return name
+}
@@ -0,0 +1,107 @@
+package orchestration_test
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danielpaulus/go-adb/adb"
+	"github.com/danielpaulus/go-adb/orchestration"
+	"github.com/stretchr/testify/assert"
+)
+
+func dnsName(name string) []byte {
+	encoded := make([]byte, 0)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		encoded = append(encoded, byte(len(label)))
+		encoded = append(encoded, label...)
+	}
+	return append(encoded, 0)
+}
+
+func dnsRecord(name []byte, recordType uint16, data []byte) []byte {
+	record := append([]byte{}, name...)
+	fields := make([]byte, 10)
+	binary.BigEndian.PutUint16(fields, recordType)
+	binary.BigEndian.PutUint16(fields[2:], 1)
+	binary.BigEndian.PutUint32(fields[4:], 120)
+	binary.BigEndian.PutUint16(fields[8:], uint16(len(data)))
+	return append(append(record, fields...), data...)
+}
+
+//adbdAnnouncement is what a phone with wireless debugging answers, the SRV target uses name compression.
+func adbdAnnouncement() []byte {
+	const instance = "adb-R58M123ABC-vWgJpq._adb-tls-connect._tcp.local."
+	message := make([]byte, 12)
+	binary.BigEndian.PutUint16(message[6:], 1)
+	binary.BigEndian.PutUint16(message[10:], 2)
+	message = append(message, dnsRecord(dnsName(orchestration.ADBTLSConnectService), 12, dnsName(instance))...)
+
+	hostOffset := len(message)
+	message = append(message, dnsName("Android.local.")...)
+	message = append(message, 0, 1, 0, 1, 0, 0, 0, 120, 0, 4, 192, 168, 1, 23)
+
+	srv := []byte{0, 0, 0, 0, 0x95, 0x3f, 0xc0, byte(hostOffset)}
+	return append(message, dnsRecord(dnsName(instance), 33, srv)...)
+}
+
+func TestBrowseMDNS(t *testing.T) {
+	responder, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer responder.Close()
+	go func() {
+		query := make([]byte, 512)
+		_, from, err := responder.ReadFromUDP(query)
+		if err != nil {
+			return
+		}
+		responder.WriteToUDP([]byte("garbage"), from)
+		responder.WriteToUDP(adbdAnnouncement(), from)
+	}()
+
+	services, err := orchestration.BrowseMDNS(orchestration.ADBTLSConnectService, responder.LocalAddr().String(), 200*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, []orchestration.MDNSService{{Instance: "adb-R58M123ABC-vWgJpq._adb-tls-connect._tcp.local.", Address: "192.168.1.23:38207"}}, services)
+}
+
+func TestNetworkDevicesListsReachableTargets(t *testing.T) {
+	adbd, err := net.Listen("tcp4", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	unreachable, err := net.Listen("tcp4", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	unreachable.Close()
+	defer adbd.Close()
+
+	devices, err := orchestration.NetworkDevices([]string{adbd.Addr().String(), unreachable.Addr().String()})()
+	assert.NoError(t, err)
+	assert.Equal(t, []adb.DeviceInfo{orchestration.NetworkDevice(adbd.Addr().String(), adbd.Addr().String())}, devices)
+}
+
+func TestBridgeManagerBridgesNetworkDevices(t *testing.T) {
+	man := orchestration.NewSubProcessBridgeManager("go-adb", basePort, adb.ProcessLimits{})
+	device := orchestration.NetworkDevice("R58M123ABC", "127.0.0.1:5555")
+	man.DeviceAdded(device)
+	list := man.BridgeList()
+	if assert.Equal(t, 1, len(list)) {
+		assert.Equal(t, "127.0.0.1:5555", list[0]["address"])
+		assert.Equal(t, basePort, list[0]["port"])
+		assert.Equal(t, "online", list[0]["state"])
+	}
+
+	moved := orchestration.NetworkDevice("R58M123ABC", "127.0.0.1:37000")
+	man.DeviceAdded(moved)
+	details, ok := man.BridgeDetails("R58M123ABC")
+	if assert.True(t, ok) {
+		assert.Equal(t, "127.0.0.1:37000", details["address"])
+		assert.Equal(t, basePort, details["port"])
+	}
+	assert.NoError(t, man.Close())
+}
@@ -0,0 +1,86 @@
+package orchestration
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+//PortMap assigns TCP ports to device identities, see adb.DeviceInfo.Identity. Once assigned, an identity keeps its port.
+//If the PortMap has a file, assignments are loaded from and saved to it so they also survive restarts.
+//PortMap is not safe for concurrent use, the BridgeManager protects it with its mutex.
+type PortMap struct {
+	ports    map[string]int
+	basePort int
+	file     string
+}
+
+//NewPortMap creates an empty PortMap assigning ports starting at basePort.
+func NewPortMap(basePort int) *PortMap {
+	return &PortMap{ports: map[string]int{}, basePort: basePort}
+}
+
+//LoadPortMap creates a PortMap backed by file. The file contains a JSON object mapping identities to ports,
+//f.ex. {"1-2.3": 16100}, it is created once the first port is assigned if it does not exist.
+func LoadPortMap(file string, basePort int) (*PortMap, error) {
+	portMap := NewPortMap(basePort)
+	portMap.file = file
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return portMap, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &portMap.ports)
+	if err != nil {
+		return nil, err
+	}
+	return portMap, nil
+}
+
+//Port returns the port of identity, assigning the lowest free port to new identities.
+func (p *PortMap) Port(identity string) (int, error) {
+	if port, ok := p.ports[identity]; ok {
+		return port, nil
+	}
+	port := p.NextPort()
+	p.ports[identity] = port
+	return port, p.save()
+}
+
+//Lookup returns the port of identity or false if it has none yet.
+func (p *PortMap) Lookup(identity string) (int, bool) {
+	port, ok := p.ports[identity]
+	return port, ok
+}
+
+//Assign sets the port of identity, it is used to restore assignments.
+func (p *PortMap) Assign(identity string, port int) error {
+	p.ports[identity] = port
+	return p.save()
+}
+
+//NextPort returns the port the next new identity will get.
+func (p *PortMap) NextPort() int {
+	used := make(map[int]bool, len(p.ports))
+	for _, port := range p.ports {
+		used[port] = true
+	}
+	port := p.basePort
+	for used[port] {
+		port++
+	}
+	return port
+}
+
+func (p *PortMap) save() error {
+	if p.file == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(p.ports, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p.file, data, 0644)
+}
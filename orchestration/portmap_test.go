@@ -0,0 +1,64 @@
+package orchestration_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/danielpaulus/go-adb/adb"
+	"github.com/danielpaulus/go-adb/orchestration"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPortMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "portmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "ports.json")
+	assert.NoError(t, ioutil.WriteFile(file, []byte(`{"1-7": 60001}`), 0644))
+
+	ports, err := orchestration.LoadPortMap(file, basePort)
+	if !assert.NoError(t, err) {
+		return
+	}
+	port, err := ports.Port("1-3")
+	assert.NoError(t, err)
+	assert.Equal(t, basePort, port)
+	port, _ = ports.Port("1-7")
+	assert.Equal(t, basePort+1, port)
+	port, _ = ports.Port("1-2")
+	assert.Equal(t, basePort+2, port)
+
+	reloaded, err := orchestration.LoadPortMap(file, basePort)
+	if assert.NoError(t, err) {
+		port, ok := reloaded.Lookup("1-2")
+		assert.True(t, ok)
+		assert.Equal(t, basePort+2, port)
+		assert.Equal(t, basePort+3, reloaded.NextPort())
+	}
+}
+
+func TestBridgeManagerKeepsPortOfSlot(t *testing.T) {
+	adb.SetIdentityMode(adb.IdentityByPortPath)
+	defer adb.SetIdentityMode(adb.IdentityBySerial)
+	slot7 := adb.DeviceInfo{SerialNumber: "phone1", VID: 5, PID: 6, Bus: 1, Ports: []int{7}}
+	slot8 := adb.DeviceInfo{SerialNumber: "phone2", VID: 5, PID: 6, Bus: 1, Ports: []int{8}}
+	replacement := adb.DeviceInfo{SerialNumber: "phone3", VID: 5, PID: 6, Bus: 1, Ports: []int{7}}
+
+	man := orchestration.NewBridgeManager(basePort)
+	man.InitialList([]adb.DeviceInfo{slot7, slot8})
+	man.DeviceAdded(replacement)
+
+	list := man.BridgeList()
+	if assert.Equal(t, 2, len(list)) {
+		assert.Equal(t, "phone2", list[0]["serial"])
+		assert.Equal(t, basePort+1, list[0]["port"])
+		assert.Equal(t, "phone3", list[1]["serial"])
+		assert.Equal(t, basePort, list[1]["port"])
+		assert.Equal(t, "1-7", list[1]["usbPath"])
+	}
+	assert.NoError(t, man.Close())
+}
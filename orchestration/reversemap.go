@@ -0,0 +1,63 @@
+package orchestration
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/danielpaulus/go-adb/adb"
+)
+
+//ReverseMap keeps the reverse forwards of every device identity, so they are set up again when go-adb restarts.
+//If the ReverseMap has a file, reverse forwards are loaded from and saved to it.
+//ReverseMap is not safe for concurrent use, the BridgeManager protects it with its mutex.
+type ReverseMap struct {
+	reverses map[string][]adb.Reverse
+	file     string
+}
+
+//NewReverseMap creates an empty ReverseMap that is kept in memory only.
+func NewReverseMap() *ReverseMap {
+	return &ReverseMap{reverses: map[string][]adb.Reverse{}}
+}
+
+//LoadReverseMap creates a ReverseMap backed by file. The file contains a JSON object mapping identities to their
+//reverse forwards, f.ex. {"R58M123ABC": [{"remote": "tcp:8080", "local": "tcp:8080"}]}, it is created on the first change.
+func LoadReverseMap(file string) (*ReverseMap, error) {
+	reverseMap := NewReverseMap()
+	reverseMap.file = file
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return reverseMap, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &reverseMap.reverses)
+	if err != nil {
+		return nil, err
+	}
+	return reverseMap, nil
+}
+
+//Get returns the reverse forwards of identity.
+func (r *ReverseMap) Get(identity string) []adb.Reverse {
+	return r.reverses[identity]
+}
+
+//Set replaces the reverse forwards of identity.
+func (r *ReverseMap) Set(identity string, reverses []adb.Reverse) error {
+	if len(reverses) == 0 {
+		delete(r.reverses, identity)
+	} else {
+		r.reverses[identity] = reverses
+	}
+	if r.file == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(r.reverses, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(r.file, data, 0644)
+}
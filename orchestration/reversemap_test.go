@@ -0,0 +1,41 @@
+package orchestration_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/danielpaulus/go-adb/adb"
+	"github.com/danielpaulus/go-adb/orchestration"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReverseMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reversemap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "reverses.json")
+
+	reverseMap, err := orchestration.LoadReverseMap(file)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Empty(t, reverseMap.Get("phone1"))
+	reverses := []adb.Reverse{{Remote: "tcp:8080", Local: "tcp:8080"}, {Remote: "localabstract:app", Local: "tcp:9000"}}
+	assert.NoError(t, reverseMap.Set("phone1", reverses))
+	assert.NoError(t, reverseMap.Set("phone2", []adb.Reverse{{Remote: "tcp:5000", Local: "tcp:5000"}}))
+	assert.NoError(t, reverseMap.Set("phone2", nil))
+
+	reloaded, err := orchestration.LoadReverseMap(file)
+	if assert.NoError(t, err) {
+		assert.Equal(t, reverses, reloaded.Get("phone1"))
+		assert.Empty(t, reloaded.Get("phone2"))
+	}
+
+	assert.NoError(t, ioutil.WriteFile(file, []byte("not json"), 0644))
+	_, err = orchestration.LoadReverseMap(file)
+	assert.Error(t, err)
+}
@@ -2,17 +2,89 @@ package rest
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/danielpaulus/go-adb/adb"
+	"github.com/danielpaulus/go-adb/orchestration"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 )
 
 type BridgeStatusReporter interface {
 	BridgeList() []map[string]interface{}
+	BridgeDetails(serial string) (map[string]interface{}, bool)
+	BridgeHistory(serial string, n int) ([]adb.StateTransition, bool)
+	BridgeLogs(serial string, n int) ([]string, bool)
+}
+
+//ForwardManager forwards host sockets to services of devices.
+type ForwardManager interface {
+	AddForward(serial string, local string, remote string) (adb.Forward, error)
+	ListForwards(serial string) ([]adb.Forward, error)
+	RemoveForward(serial string, local string) error
+}
+
+//ReverseManager forwards sockets of devices to the host.
+type ReverseManager interface {
+	AddReverse(serial string, remote string, local string) (adb.Reverse, error)
+	ListReverses(serial string) ([]adb.Reverse, error)
+	RemoveReverse(serial string, remote string) error
+}
+
+//ShellManager runs shell commands and interactive shells on devices.
+type ShellManager interface {
+	OpenShell(serial string, command string, term string) (*adb.Shell, error)
+	OpenTerminal(serial string, term string, rows int, cols int) (*adb.Shell, error)
+}
+
+//ScreenManager takes screenshots and screen recordings of devices.
+type ScreenManager interface {
+	Screenshot(serial string) ([]byte, error)
+	StartScreenRecord(serial string, options adb.RecordOptions, output io.Writer, name string) (*adb.Recording, error)
+	StopScreenRecord(serial string) (adb.RecordingInfo, error)
+	//RecordDir returns the directory recordings to a file are written to, empty if recording to files is disabled
+	RecordDir() string
+}
+
+//LogcatManager returns the archived logcat of devices.
+type LogcatManager interface {
+	LogcatArchive(serial string) (*adb.LogcatArchive, error)
+}
+
+//BridgeProcessLocator finds the REST api of bridge processes, which serve the device features of their device.
+type BridgeProcessLocator interface {
+	BridgeAPISocket(serial string) string
+}
+
+//PowerManager power cycles the hub ports of devices.
+type PowerManager interface {
+	PowerCycle(serial string) error
+}
+
+//LogLevelManager changes the log level of go-adb and its bridge processes.
+type LogLevelManager interface {
+	SetLogLevel(level log.Level)
+}
+
+//DeviceManager is everything the REST api needs, orchestration.BridgeManager implements it.
+type DeviceManager interface {
+	BridgeStatusReporter
+	BridgeProcessLocator
+	LogLevelManager
+	PowerManager
+	ForwardManager
+	ReverseManager
+	ShellManager
+	ScreenManager
+	LogcatManager
 }
 
 func HealthHandler(s BridgeStatusReporter) func(w http.ResponseWriter, r *http.Request) {
@@ -31,6 +103,103 @@ func HealthHandler(s BridgeStatusReporter) func(w http.ResponseWriter, r *http.R
 	}
 }
 
+//DeviceDetailHandler returns everything known about the bridge for one device.
+func DeviceDetailHandler(s BridgeStatusReporter) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serial := mux.Vars(r)["serial"]
+		details, ok := s.BridgeDetails(serial)
+		if !ok {
+			serverError(fmt.Sprintf("device %s not found", serial), http.StatusNotFound, w)
+			return
+		}
+		writeJSON(details, w)
+	}
+}
+
+//DeviceHistoryHandler returns the last state transitions of the bridge for one device.
+//The optional query parameter n limits the number of transitions returned.
+func DeviceHistoryHandler(s BridgeStatusReporter) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serial := mux.Vars(r)["serial"]
+		n, err := limitParam(r)
+		if err != nil {
+			serverError("invalid n", http.StatusBadRequest, w)
+			return
+		}
+		history, ok := s.BridgeHistory(serial, n)
+		if !ok {
+			serverError(fmt.Sprintf("device %s not found", serial), http.StatusNotFound, w)
+			return
+		}
+		writeJSON(history, w)
+	}
+}
+
+//DeviceLogsHandler returns the recent log lines of the bridge for one device as plain text.
+//The optional query parameter n limits the number of lines returned.
+func DeviceLogsHandler(s BridgeStatusReporter) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serial := mux.Vars(r)["serial"]
+		n, err := limitParam(r)
+		if err != nil {
+			serverError("invalid n", http.StatusBadRequest, w)
+			return
+		}
+		lines, ok := s.BridgeLogs(serial, n)
+		if !ok {
+			serverError(fmt.Sprintf("device %s not found", serial), http.StatusNotFound, w)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		for _, line := range lines {
+			w.Write([]byte(line + "\n"))
+		}
+	}
+}
+
+//limitParam parses the optional query parameter n, returning 0 if it is not set.
+func limitParam(r *http.Request) (int, error) {
+	value := strings.TrimSpace(r.URL.Query().Get("n"))
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(value)
+}
+
+//LogLevelHandler returns the current global log level.
+func LogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(map[string]string{"level": log.GetLevel().String()}, w)
+}
+
+//SetLogLevelHandler changes the global log level at runtime, also in bridge processes, f.ex. PUT /loglevel/info
+func SetLogLevelHandler(s LogLevelManager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		level, err := log.ParseLevel(mux.Vars(r)["level"])
+		if err != nil {
+			serverError(err.Error(), http.StatusBadRequest, w)
+			return
+		}
+		log.Infof("changing log level from %s to %s", log.GetLevel(), level)
+		s.SetLogLevel(level)
+		writeJSON(map[string]string{"level": level.String()}, w)
+	}
+}
+
+//UpgradeHandler triggers a zero downtime upgrade, which is the same as sending SIGUSR2 to go-adb.
+//The response is sent before the signal, the exec of the upgrade would otherwise close the connection.
+func UpgradeHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info("upgrade requested over REST")
+	w.WriteHeader(http.StatusAccepted)
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	err := syscall.Kill(os.Getpid(), syscall.SIGUSR2)
+	if err != nil {
+		log.Errorf("failed triggering upgrade: %v", err)
+	}
+}
+
 func DeviceResetHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	serial := vars["serial"]
@@ -43,6 +212,22 @@ func DeviceResetHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+//DevicePowerCycleHandler switches the hub port of the device off and on again.
+//This only works for hubs that support per port power switching.
+func DevicePowerCycleHandler(s PowerManager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		serial := vars["serial"]
+		log.Infof("Power cycle requested for: %s", serial)
+		err := s.PowerCycle(serial)
+		if err != nil {
+			serverError(fmt.Sprintf("failed power cycling device %s with error %v", serial, err), 500, w)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
 func DeviceResetVidPidHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	vid, err := strconv.Atoi(vars["vid"])
@@ -64,6 +249,174 @@ func DeviceResetVidPidHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+//AddForwardHandler forwards a host socket to a service of the device without adb server,
+//f.ex. {"local": "tcp:9222", "remote": "localabstract:chrome_devtools_remote"}. It returns the forward,
+//with the port that was picked for tcp:0.
+func AddForwardHandler(f ForwardManager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serial := mux.Vars(r)["serial"]
+		var request struct {
+			Local  string `json:"local"`
+			Remote string `json:"remote"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil || request.Local == "" || request.Remote == "" {
+			serverError("local and remote are required", http.StatusBadRequest, w)
+			return
+		}
+		forward, err := f.AddForward(serial, request.Local, request.Remote)
+		if err != nil {
+			deviceError(err, w)
+			return
+		}
+		writeJSON(forward, w)
+	}
+}
+
+//ForwardsHandler returns the forwards of the device.
+func ForwardsHandler(f ForwardManager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		forwards, err := f.ListForwards(mux.Vars(r)["serial"])
+		if err != nil {
+			deviceError(err, w)
+			return
+		}
+		writeJSON(forwards, w)
+	}
+}
+
+//RemoveForwardHandler stops forwarding the host socket in the path, f.ex. DELETE /devices/{serial}/forwards/tcp:9222
+func RemoveForwardHandler(f ForwardManager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		err := f.RemoveForward(vars["serial"], vars["local"])
+		if err != nil {
+			deviceError(err, w)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+//AddReverseHandler makes the device forward one of its sockets to the host without adb server,
+//f.ex. {"remote": "tcp:8080", "local": "tcp:8080"}. It returns the reverse forward, with the port the device picked for tcp:0.
+func AddReverseHandler(f ReverseManager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serial := mux.Vars(r)["serial"]
+		var request struct {
+			Remote string `json:"remote"`
+			Local  string `json:"local"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil || request.Local == "" || request.Remote == "" {
+			serverError("remote and local are required", http.StatusBadRequest, w)
+			return
+		}
+		reverse, err := f.AddReverse(serial, request.Remote, request.Local)
+		if err != nil {
+			deviceError(err, w)
+			return
+		}
+		writeJSON(reverse, w)
+	}
+}
+
+//ReversesHandler returns the reverse forwards of the device.
+func ReversesHandler(f ReverseManager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reverses, err := f.ListReverses(mux.Vars(r)["serial"])
+		if err != nil {
+			deviceError(err, w)
+			return
+		}
+		writeJSON(reverses, w)
+	}
+}
+
+//RemoveReverseHandler stops forwarding the device socket in the path, f.ex. DELETE /devices/{serial}/reverses/tcp:8080
+func RemoveReverseHandler(f ReverseManager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		err := f.RemoveReverse(vars["serial"], vars["remote"])
+		if err != nil {
+			deviceError(err, w)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+//deviceError maps errors of the device features of bridges, like forwards or shell commands, to status codes.
+func deviceError(err error, w http.ResponseWriter) {
+	switch {
+	case errors.Is(err, orchestration.ErrBridgeNotFound), errors.Is(err, adb.ErrForwardNotFound), errors.Is(err, adb.ErrReverseNotFound),
+		errors.Is(err, adb.ErrNotRecording), errors.Is(err, orchestration.ErrLogcatNotArchived):
+		serverError(err.Error(), http.StatusNotFound, w)
+	case errors.Is(err, orchestration.ErrNotSupported), errors.Is(err, adb.ErrShellV2NotSupported):
+		serverError(err.Error(), http.StatusNotImplemented, w)
+	case errors.Is(err, adb.ErrInvalidSocket), errors.Is(err, adb.ErrInvalidRecordOptions):
+		serverError(err.Error(), http.StatusBadRequest, w)
+	case errors.Is(err, adb.ErrSocketNotAllowed):
+		serverError(err.Error(), http.StatusForbidden, w)
+	case errors.Is(err, adb.ErrDeviceOffline), errors.Is(err, adb.ErrKeyNotAccepted):
+		serverError(err.Error(), http.StatusServiceUnavailable, w)
+	case errors.Is(err, adb.ErrRecording):
+		serverError(err.Error(), http.StatusConflict, w)
+	default:
+		serverError(err.Error(), http.StatusInternalServerError, w)
+	}
+}
+
+//PairingHandler pairs go-adb with a device using the code shown in its wireless debugging settings,
+//f.ex. {"host": "192.168.1.20", "port": 37123, "code": "123456"}. It returns the paired device.
+func PairingHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Host string `json:"host"`
+		Port int    `json:"port"`
+		Code string `json:"code"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || request.Host == "" || request.Port <= 0 || request.Code == "" {
+		serverError("host, port and code are required", http.StatusBadRequest, w)
+		return
+	}
+	store, err := adb.GetKeyStore()
+	if err != nil {
+		serverError(fmt.Sprintf("failed loading key: %v", err), http.StatusInternalServerError, w)
+		return
+	}
+	device, err := adb.Pair(store, net.JoinHostPort(request.Host, strconv.Itoa(request.Port)), request.Code)
+	if errors.Is(err, adb.ErrWrongPairingCode) {
+		serverError(err.Error(), http.StatusForbidden, w)
+		return
+	}
+	if err != nil {
+		serverError(fmt.Sprintf("failed pairing with %s:%d: %v", request.Host, request.Port, err), http.StatusBadGateway, w)
+		return
+	}
+	writeJSON(device, w)
+}
+
+//PairedDevicesHandler returns all devices go-adb paired with.
+func PairedDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	store, err := adb.GetKeyStore()
+	if err != nil {
+		serverError(fmt.Sprintf("failed loading key: %v", err), http.StatusInternalServerError, w)
+		return
+	}
+	writeJSON(store.Paired(), w)
+}
+
+func writeJSON(obj interface{}, w http.ResponseWriter) {
+	json, err := json.Marshal(obj)
+	if err != nil {
+		serverError("failed encoding json", http.StatusInternalServerError, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
+
 func serverError(message string, code int, w http.ResponseWriter) {
 	json, err := json.Marshal(
 		map[string]string{"error": message},
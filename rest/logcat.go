@@ -0,0 +1,115 @@
+package rest
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/danielpaulus/go-adb/adb"
+	"github.com/gorilla/mux"
+)
+
+//LogcatHandler returns the archived logcat of the device as NDJSON, one entry with time, pid, tid, priority, tag and message
+//per line. The optional query parameter since is a time like 2024-05-01T10:00:00Z or a duration like 10m to get the entries
+//of the last 10 minutes, tag only returns entries with this tag. With follow=true the response continues with new entries
+//until the request is closed.
+func LogcatHandler(s LogcatManager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := adb.LogFilter{Tag: query.Get("tag")}
+		if since := query.Get("since"); since != "" {
+			var err error
+			filter.Since, err = sinceParam(since)
+			if err != nil {
+				serverError("invalid since, use a time like 2024-05-01T10:00:00Z or a duration like 10m", http.StatusBadRequest, w)
+				return
+			}
+		}
+		follow := false
+		if value := query.Get("follow"); value != "" {
+			var err error
+			follow, err = strconv.ParseBool(value)
+			if err != nil {
+				serverError("invalid follow", http.StatusBadRequest, w)
+				return
+			}
+		}
+		archive, err := s.LogcatArchive(mux.Vars(r)["serial"])
+		if err != nil {
+			deviceError(err, w)
+			return
+		}
+		if !follow {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+			encoder := json.NewEncoder(w)
+			archive.Read(filter, func(entry adb.LogEntry) error { return encoder.Encode(entry) })
+			return
+		}
+		followLogcat(archive, filter, w)
+	}
+}
+
+func sinceParam(value string) (time.Time, error) {
+	duration, err := time.ParseDuration(value)
+	if err == nil {
+		return time.Now().Add(-duration), nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+//followLogcat takes over the connection, because following logcat takes longer than the write timeout of the server.
+//It writes the archived entries and then every new one until the client disconnects.
+func followLogcat(archive *adb.LogcatArchive, filter adb.LogFilter, w http.ResponseWriter) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		serverError("follow is not supported on this connection", http.StatusInternalServerError, w)
+		return
+	}
+	conn, buffer, err := hijacker.Hijack()
+	if err != nil {
+		serverError(err.Error(), http.StatusInternalServerError, w)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Time{})
+	gone := make(chan struct{})
+	go func() {
+		//the client sends nothing more, reading only returns once it disconnected
+		io.Copy(ioutil.Discard, conn)
+		close(gone)
+	}()
+
+	buffer.WriteString("HTTP/1.1 200 OK\r\nContent-Type: application/x-ndjson\r\nConnection: close\r\n\r\n")
+	encoder := json.NewEncoder(buffer)
+	entries, stop, err := archive.ReadAndFollow(filter, func(entry adb.LogEntry) error { return encoder.Encode(entry) })
+	if err != nil {
+		return
+	}
+	defer stop()
+	if buffer.Flush() != nil {
+		return
+	}
+	for {
+		select {
+		case entry, ok := <-entries:
+			if !ok {
+				return
+			}
+			if !filter.Matches(entry) {
+				continue
+			}
+			if encoder.Encode(entry) != nil {
+				return
+			}
+			if len(entries) == 0 && buffer.Flush() != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
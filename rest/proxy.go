@@ -0,0 +1,89 @@
+package rest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	//proxyDialTimeout is how long connecting to the REST api of a bridge process may take
+	proxyDialTimeout = 5 * time.Second
+	//proxyMaxBody is the largest request body passed to a bridge process, device feature requests are small JSON objects
+	proxyMaxBody = 1024 * 1024
+)
+
+//proxyToBridgeProcess passes requests for devices whose bridge runs in a child process to the REST api of that process,
+//which has the adb Session of the device. Requests for bridges running in this process are handled by handler.
+func proxyToBridgeProcess(s BridgeProcessLocator, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		socket := s.BridgeAPISocket(mux.Vars(r)["serial"])
+		if socket == "" {
+			handler(w, r)
+			return
+		}
+		if websocket.IsWebSocketUpgrade(r) && !allowedOrigin(r) {
+			serverError("origin not allowed", http.StatusForbidden, w)
+			return
+		}
+		proxy(socket, w, r)
+	}
+}
+
+//proxy takes over the connection of the client, because streamed responses like logcat or the terminal take longer
+//than the write timeout of the server, and relays it to the unix socket until one side closes it.
+func proxy(socket string, w http.ResponseWriter, r *http.Request) {
+	//the body cannot be read anymore once the connection is taken over
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, proxyMaxBody+1))
+	if err != nil {
+		serverError("failed reading request", http.StatusBadRequest, w)
+		return
+	}
+	if len(body) > proxyMaxBody {
+		serverError("request too large", http.StatusRequestEntityTooLarge, w)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		serverError("the bridge process cannot be reached on this connection", http.StatusInternalServerError, w)
+		return
+	}
+	child, err := net.DialTimeout("unix", socket, proxyDialTimeout)
+	if err != nil {
+		serverError(fmt.Sprintf("the bridge process of the device is not reachable: %v", err), http.StatusServiceUnavailable, w)
+		return
+	}
+	defer child.Close()
+	conn, buffer, err := hijacker.Hijack()
+	if err != nil {
+		serverError(err.Error(), http.StatusInternalServerError, w)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Time{})
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.TransferEncoding = nil
+	if !websocket.IsWebSocketUpgrade(r) {
+		//the bridge process closes the connection after its response, which ends relaying
+		r.Header.Del("Connection")
+		r.Close = true
+	}
+	if r.Write(child) != nil {
+		return
+	}
+	go func() {
+		//also passes what the client sent after the request, f.ex. WebSocket messages
+		io.Copy(child, buffer)
+		child.Close()
+	}()
+	io.Copy(conn, child)
+}
@@ -0,0 +1,167 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/danielpaulus/go-adb/adb"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+//ScreenshotHandler returns a PNG of the screen of the device.
+func ScreenshotHandler(s ScreenManager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		png, err := s.Screenshot(mux.Vars(r)["serial"])
+		if err != nil {
+			deviceError(err, w)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.WriteHeader(http.StatusOK)
+		w.Write(png)
+	}
+}
+
+//ScreenRecordHandler starts recording the screen of the device as raw H.264, f.ex. {"file": "test.h264", "timeLimit": 60}.
+//With file the recording is written to the file of that name in the record directory of the host in the background
+//and the recording is returned, stop it
+//with StopScreenRecordHandler. Without file the video is streamed in the response until the request is closed, the
+//recording is stopped or its time limit in seconds is reached, 180 seconds by default. size like 1280x720 and bitRate are
+//passed to screenrecord.
+func ScreenRecordHandler(s ScreenManager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serial := mux.Vars(r)["serial"]
+		var request struct {
+			adb.RecordOptions
+			File string `json:"file"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			serverError("invalid json", http.StatusBadRequest, w)
+			return
+		}
+		if request.File != "" {
+			recordToFile(s, serial, request.RecordOptions, request.File, w)
+			return
+		}
+		//the connection is only taken over once the recording started, until then the video waits in the pipe
+		video, output := io.Pipe()
+		recording, err := s.StartScreenRecord(serial, request.RecordOptions, output, "response to "+r.RemoteAddr)
+		if err != nil {
+			deviceError(err, w)
+			return
+		}
+		done := make(chan struct{})
+		go func() {
+			output.CloseWithError(recording.Wait())
+			close(done)
+		}()
+		streamRecording(video, w)
+		//makes a recording that is still running fail writing, if the client went away
+		video.Close()
+		select {
+		case <-done:
+		default:
+			s.StopScreenRecord(serial)
+			<-done
+		}
+	}
+}
+
+//streamRecording takes over the connection, because recordings take longer than the write timeout of the server.
+//It writes the video until it ends or the client disconnects.
+func streamRecording(video io.Reader, w http.ResponseWriter) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		serverError("streaming is not supported on this connection", http.StatusInternalServerError, w)
+		return
+	}
+	conn, buffer, err := hijacker.Hijack()
+	if err != nil {
+		serverError(err.Error(), http.StatusInternalServerError, w)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Time{})
+	gone := make(chan struct{})
+	go func() {
+		//the client sends nothing more, reading only returns once it disconnected
+		io.Copy(ioutil.Discard, conn)
+		close(gone)
+	}()
+
+	buffer.WriteString("HTTP/1.1 200 OK\r\nContent-Type: video/h264\r\nConnection: close\r\n\r\n")
+	if buffer.Flush() != nil {
+		return
+	}
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(conn, video)
+		close(copied)
+	}()
+	select {
+	case <-copied:
+	case <-gone:
+	}
+}
+
+//recordToFile starts recording the screen to the file named name in the record directory and answers with the running recording.
+func recordToFile(s ScreenManager, serial string, options adb.RecordOptions, name string, w http.ResponseWriter) {
+	dir := s.RecordDir()
+	if dir == "" {
+		serverError("recording to a file is disabled, start go-adb with --recorddir", http.StatusBadRequest, w)
+		return
+	}
+	//only names of files in the record directory are accepted, not paths anywhere on the host
+	if strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		serverError("file must be a file name without directory", http.StatusBadRequest, w)
+		return
+	}
+	file := filepath.Join(dir, name)
+	//recordings are never overwritten
+	output, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		serverError(fmt.Sprintf("%s exists already", name), http.StatusConflict, w)
+		return
+	}
+	if err != nil {
+		serverError(fmt.Sprintf("failed creating %s: %v", name, err), http.StatusBadRequest, w)
+		return
+	}
+	recording, err := s.StartScreenRecord(serial, options, output, file)
+	if err != nil {
+		output.Close()
+		os.Remove(file)
+		deviceError(err, w)
+		return
+	}
+	go func() {
+		err := recording.Wait()
+		if err != nil {
+			log.WithFields(log.Fields{"serial": serial, "file": file}).Warnf("screen recording failed: %v", err)
+		}
+		output.Close()
+	}()
+	writeJSON(recording.Info(), w)
+}
+
+//StopScreenRecordHandler stops recording the screen of the device and returns the recording.
+func StopScreenRecordHandler(s ScreenManager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info, err := s.StopScreenRecord(mux.Vars(r)["serial"])
+		if err != nil {
+			deviceError(err, w)
+			return
+		}
+		writeJSON(info, w)
+	}
+}
+
@@ -2,6 +2,8 @@ package rest
 
 import (
 	"fmt"
+	"mime"
+	"net"
 	"net/http"
 	pprof "net/http/pprof"
 	"time"
@@ -10,6 +12,9 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+//writeTimeout is how long the server takes at most to write a response, it also limits streamed responses
+const writeTimeout = 60 * time.Second
+
 //limitNumClients uses a go channel to rate limit a handler.
 // It is a golang buffered channel so you can put maxClients empty structs
 //into the channel without blocking. The maxClients+1 invocation will block
@@ -24,6 +29,48 @@ func limitNumClients(f http.HandlerFunc, maxClients int) http.HandlerFunc {
 	}
 }
 
+//rejectOverLimit limits a handler of long running requests like recordings or terminals to maxClients at a time.
+//Unlike limitNumClients, further requests do not wait for a free slot but get 503 Service Unavailable.
+func rejectOverLimit(f http.HandlerFunc, maxClients int) http.HandlerFunc {
+	sema := make(chan struct{}, maxClients)
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case sema <- struct{}{}:
+		default:
+			serverError("too many requests running, try again later", http.StatusServiceUnavailable, w)
+			return
+		}
+		defer func() { <-sema }()
+		f(w, req)
+	}
+}
+
+//sameOrigin rejects requests changing something, all but GET requests, from pages of other origins than allowedOrigin
+//accepts. Browsers send simple cross site requests like forms or text/plain POSTs without asking the server first.
+func sameOrigin(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && !allowedOrigin(req) {
+			serverError("origin not allowed", http.StatusForbidden, w)
+			return
+		}
+		f(w, req)
+	}
+}
+
+//jsonBody rejects requests whose body is not declared as JSON. Browsers only send JSON to other sites after a CORS
+//preflight, which go-adb does not answer.
+func jsonBody(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if err != nil || mediaType != "application/json" {
+			serverError("Content-Type must be application/json", http.StatusUnsupportedMediaType, w)
+			return
+		}
+		f(w, req)
+	}
+}
+
 func notFoundHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		serverError("not found", http.StatusNotFound, w)
@@ -38,18 +85,80 @@ func methodNotAllowedHandler() http.Handler {
 
 //CreateRouter creates a new router and exposes the workspace to
 //the http handlers.
-func CreateRouter(s BridgeStatusReporter) *mux.Router {
+func CreateRouter(s DeviceManager) *mux.Router {
 	r := mux.NewRouter()
 	r.MethodNotAllowedHandler = methodNotAllowedHandler()
 	r.NotFoundHandler = notFoundHandler()
 
 	r.HandleFunc("/devices", limitNumClients(HealthHandler(s), 1)).Methods("GET")
-	r.HandleFunc("/devices/{serial}/reset", limitNumClients(DeviceResetHandler, 1)).Methods("POST")
-	r.HandleFunc("/devices/{vid}/{pid}/reset", limitNumClients(DeviceResetVidPidHandler, 1)).Methods("POST")
+	//reading the state of one device is cheap, a slow client must not hold up the others
+	r.HandleFunc("/devices/{serial}", DeviceDetailHandler(s)).Methods("GET")
+	r.HandleFunc("/devices/{serial}/history", DeviceHistoryHandler(s)).Methods("GET")
+	r.HandleFunc("/devices/{serial}/logs", DeviceLogsHandler(s)).Methods("GET")
+	addDeviceFeatureRoutes(r, s, func(handler http.HandlerFunc) http.HandlerFunc { return sameOrigin(proxyToBridgeProcess(s, handler)) })
+	r.HandleFunc("/devices/{serial}/reset", limitNumClients(sameOrigin(DeviceResetHandler), 1)).Methods("POST")
+	r.HandleFunc("/devices/{serial}/powercycle", limitNumClients(sameOrigin(DevicePowerCycleHandler(s)), 1)).Methods("POST")
+	r.HandleFunc("/devices/{vid}/{pid}/reset", limitNumClients(sameOrigin(DeviceResetVidPidHandler), 1)).Methods("POST")
+	r.HandleFunc("/pairing", limitNumClients(sameOrigin(jsonBody(PairingHandler)), 1)).Methods("POST")
+	r.HandleFunc("/pairing", limitNumClients(PairedDevicesHandler, 1)).Methods("GET")
+	r.HandleFunc("/upgrade", limitNumClients(sameOrigin(UpgradeHandler), 1)).Methods("POST")
+	r.HandleFunc("/loglevel", limitNumClients(LogLevelHandler, 1)).Methods("GET")
+	r.HandleFunc("/loglevel/{level}", limitNumClients(sameOrigin(SetLogLevelHandler(s)), 1)).Methods("PUT")
 	attachProfiler(r)
 	return r
 }
 
+//addDeviceFeatureRoutes adds the routes of the device features of bridges, like forwards, shell or logcat.
+//Their handlers are wrapped with wrap, requests with a body are only accepted as JSON.
+func addDeviceFeatureRoutes(r *mux.Router, s DeviceManager, wrap func(http.HandlerFunc) http.HandlerFunc) {
+	r.HandleFunc("/devices/{serial}/forwards", limitNumClients(jsonBody(wrap(AddForwardHandler(s))), 1)).Methods("POST")
+	r.HandleFunc("/devices/{serial}/forwards", limitNumClients(wrap(ForwardsHandler(s)), 1)).Methods("GET")
+	r.HandleFunc("/devices/{serial}/forwards/{local:.+}", limitNumClients(wrap(RemoveForwardHandler(s)), 1)).Methods("DELETE")
+	r.HandleFunc("/devices/{serial}/reverses", limitNumClients(jsonBody(wrap(AddReverseHandler(s))), 1)).Methods("POST")
+	r.HandleFunc("/devices/{serial}/reverses", limitNumClients(wrap(ReversesHandler(s)), 1)).Methods("GET")
+	r.HandleFunc("/devices/{serial}/reverses/{remote:.+}", limitNumClients(wrap(RemoveReverseHandler(s)), 1)).Methods("DELETE")
+	r.HandleFunc("/devices/{serial}/shell", rejectOverLimit(jsonBody(wrap(ShellHandler(s))), 10)).Methods("POST")
+	r.HandleFunc("/devices/{serial}/terminal", rejectOverLimit(wrap(TerminalHandler(s)), 100)).Methods("GET")
+	r.HandleFunc("/devices/{serial}/screenshot", limitNumClients(wrap(ScreenshotHandler(s)), 10)).Methods("GET")
+	r.HandleFunc("/devices/{serial}/screenrecord", rejectOverLimit(jsonBody(wrap(ScreenRecordHandler(s))), 10)).Methods("POST")
+	r.HandleFunc("/devices/{serial}/screenrecord", limitNumClients(wrap(StopScreenRecordHandler(s)), 1)).Methods("DELETE")
+	r.HandleFunc("/devices/{serial}/logcat", rejectOverLimit(wrap(LogcatHandler(s)), 100)).Methods("GET")
+}
+
+//CreateDeviceRouter creates the router a go-adb single process serves the device features of its bridge with.
+func CreateDeviceRouter(s DeviceManager) *mux.Router {
+	r := mux.NewRouter()
+	r.MethodNotAllowedHandler = methodNotAllowedHandler()
+	r.NotFoundHandler = notFoundHandler()
+	addDeviceFeatureRoutes(r, s, trustOrigin)
+	return r
+}
+
+//trustOrigin removes the Origin header of requests to the device api. go-adb checked it before passing the request on,
+//with its own AllowOrigins, and only the user of go-adb can connect to the socket of the device api.
+func trustOrigin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del("Origin")
+		handler(w, r)
+	}
+}
+
+//StartDeviceAPI serves the device features of a go-adb single process on listener, see CreateDeviceRouter.
+func StartDeviceAPI(listener net.Listener, s DeviceManager) *http.Server {
+	srv := &http.Server{
+		Handler:      CreateDeviceRouter(s),
+		WriteTimeout: writeTimeout,
+		ReadTimeout:  60 * time.Second,
+	}
+	go func() {
+		err := srv.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.WithFields(log.Fields{"err": err}).Error("device api server failed")
+		}
+	}()
+	return srv
+}
+
 //attachProfiler enables pprof rest interfaces on the gorilla mux
 func attachProfiler(router *mux.Router) {
 	router.HandleFunc("/debug/pprof/", pprof.Index)
@@ -70,18 +179,31 @@ func attachProfiler(router *mux.Router) {
 //CreateHTTPServer creates a *http.Server with routes added by the Createrouter func.
 //It also configures timeouts, which is important because default timeouts are set to 0
 //which can cause tcp connections being open indefinitely.
-func CreateHTTPServer(address string, s BridgeStatusReporter) *http.Server {
+func CreateHTTPServer(address string, s DeviceManager) *http.Server {
 	srv := &http.Server{
 		Handler:      CreateRouter(s),
 		Addr:         address,
-		WriteTimeout: 60 * time.Second,
+		WriteTimeout: writeTimeout,
 		ReadTimeout:  60 * time.Second,
 	}
 
 	return srv
 }
 
-func StartHttpServer(restInterfacePort int, s BridgeStatusReporter) *http.Server {
+//StartHttpServerOnListener serves the REST api on an existing listener, f.ex. one inherited during an upgrade.
+func StartHttpServerOnListener(listener net.Listener, s DeviceManager) *http.Server {
+	srv := CreateHTTPServer(listener.Addr().String(), s)
+
+	go func() {
+		err := srv.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.WithFields(log.Fields{"err": err}).Fatal("wrapper http server failed")
+		}
+	}()
+	return srv
+}
+
+func StartHttpServer(restInterfacePort int, s DeviceManager) *http.Server {
 	srv := CreateHTTPServer(fmt.Sprintf("0.0.0.0:%d", restInterfacePort), s)
 
 	go func() {
@@ -0,0 +1,163 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/danielpaulus/go-adb/adb"
+	"github.com/gorilla/mux"
+)
+
+const (
+	//shellTimeout is the timeout of shell commands that do not set one
+	shellTimeout = 30 * time.Second
+	//shellMaxTimeout ends commands before the server ends the response
+	shellMaxTimeout = writeTimeout - 5*time.Second
+)
+
+//shellLine is one line of the NDJSON output of ShellHandler, only one of its fields is set.
+//Output that is not UTF-8 text is sent base64 encoded in stdoutBase64 or stderrBase64.
+type shellLine struct {
+	Stdout       *string `json:"stdout,omitempty"`
+	Stderr       *string `json:"stderr,omitempty"`
+	StdoutBase64 []byte  `json:"stdoutBase64,omitempty"`
+	StderrBase64 []byte  `json:"stderrBase64,omitempty"`
+	Exit         *int    `json:"exit,omitempty"`
+	Error        string  `json:"error,omitempty"`
+}
+
+//ShellHandler runs a command with the shell v2 protocol without adb server, f.ex. {"command": "getprop", "timeout": 10}.
+//The output is streamed as NDJSON while the command runs, one {"stdout": "..."} or {"stderr": "..."} line per chunk,
+//or {"stdoutBase64": "..."} and {"stderrBase64": "..."} for output that is not UTF-8 text,
+//followed by {"exit": 0} with the exit status, or {"error": "..."} if the command timed out or the device disconnected.
+//The timeout is given in seconds. Closing the request kills the command.
+func ShellHandler(s ShellManager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serial := mux.Vars(r)["serial"]
+		var request struct {
+			Command string  `json:"command"`
+			Timeout float64 `json:"timeout"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil || request.Command == "" {
+			serverError("command is required", http.StatusBadRequest, w)
+			return
+		}
+		timeout := time.Duration(request.Timeout * float64(time.Second))
+		if timeout <= 0 {
+			timeout = shellTimeout
+		}
+		if timeout > shellMaxTimeout {
+			serverError(fmt.Sprintf("timeout must not be longer than %v", shellMaxTimeout), http.StatusBadRequest, w)
+			return
+		}
+		shell, err := s.OpenShell(serial, request.Command, "")
+		if err != nil {
+			deviceError(err, w)
+			return
+		}
+		defer shell.Close()
+		//the command gets EOF instead of waiting for input forever
+		shell.CloseStdin()
+
+		var timedOut int32
+		timer := time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			shell.Close()
+		})
+		defer timer.Stop()
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-r.Context().Done():
+				shell.Close()
+			case <-done:
+			}
+		}()
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		streamShell(shell, w, func() string {
+			if atomic.LoadInt32(&timedOut) == 1 {
+				return fmt.Sprintf("command timed out after %v", timeout)
+			}
+			return "the device closed the shell without exit status"
+		})
+	}
+}
+
+//streamShell writes the packets of shell as NDJSON lines until the command exited or the stream was closed.
+func streamShell(shell *adb.Shell, w http.ResponseWriter, closedReason func() string) {
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	var stdout, stderr adb.TextChunker
+	//the bytes of a character that never got completed are passed on before the last line
+	flushRest := func() {
+		if rest := stdout.Rest(); len(rest) > 0 {
+			encoder.Encode(shellLine{StdoutBase64: rest})
+		}
+		if rest := stderr.Rest(); len(rest) > 0 {
+			encoder.Encode(shellLine{StderrBase64: rest})
+		}
+	}
+	for {
+		id, data, err := shell.ReadPacket()
+		if err != nil {
+			flushRest()
+			message := closedReason()
+			if err != io.EOF {
+				message = err.Error()
+			}
+			encoder.Encode(shellLine{Error: message})
+			return
+		}
+		var line shellLine
+		switch id {
+		case adb.ShellStdout:
+			chunk, text := stdout.Next(data)
+			if len(chunk) == 0 {
+				continue
+			}
+			if text {
+				output := string(chunk)
+				line.Stdout = &output
+			} else {
+				line.StdoutBase64 = chunk
+			}
+		case adb.ShellStderr:
+			chunk, text := stderr.Next(data)
+			if len(chunk) == 0 {
+				continue
+			}
+			if text {
+				output := string(chunk)
+				line.Stderr = &output
+			} else {
+				line.StderrBase64 = chunk
+			}
+		case adb.ShellExit:
+			flushRest()
+			exit := 0
+			if len(data) > 0 {
+				exit = int(data[0])
+			}
+			line.Exit = &exit
+		default:
+			continue
+		}
+		if encoder.Encode(line) != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if id == adb.ShellExit {
+			return
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danielpaulus/go-adb/adb"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	terminalType = "xterm-256color"
+	terminalRows = 24
+	terminalCols = 80
+	//terminalCloseTimeout is how long the browser has to answer the close message after the shell ended
+	terminalCloseTimeout = 5 * time.Second
+)
+
+//terminalUpgrader only accepts WebSockets of pages served by the REST api itself and of the origins set with AllowOrigins,
+//other pages would get a shell on the device through the browser of anyone who can reach go-adb.
+var terminalUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	CheckOrigin:     allowedOrigin,
+}
+
+//allowedOrigins are the origins besides the REST api itself whose pages may open terminals, f.ex. https://dashboard:8080
+var allowedOrigins []string
+
+//AllowOrigins lets pages of these origins open terminals, f.ex. a dashboard served from another host than the REST api.
+//It has to be called before the server is started.
+func AllowOrigins(origins []string) {
+	allowedOrigins = origins
+}
+
+//allowedOrigin accepts requests without Origin header and from the host of the request like the default of gorilla/websocket,
+//and requests from the origins set with AllowOrigins.
+func allowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range allowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+//terminalSize is the text message a browser sends when the terminal was resized, f.ex. {"rows": 40, "cols": 120}.
+type terminalSize struct {
+	Rows int `json:"rows"`
+	Cols int `json:"cols"`
+}
+
+//TerminalHandler upgrades to a WebSocket relaying an interactive shell of the device, f.ex. for xterm.js.
+//Binary messages of the browser are the input of the shell, text messages change the window size like terminalSize.
+//The output of the shell is sent in binary messages, the WebSocket is closed with the exit status when the shell ends.
+//The optional query parameters rows, cols and term set the initial size and type of the terminal.
+func TerminalHandler(s ShellManager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serial := mux.Vars(r)["serial"]
+		query := r.URL.Query()
+		rows, err := sizeParam(query.Get("rows"), terminalRows)
+		if err != nil {
+			serverError("invalid rows", http.StatusBadRequest, w)
+			return
+		}
+		cols, err := sizeParam(query.Get("cols"), terminalCols)
+		if err != nil {
+			serverError("invalid cols", http.StatusBadRequest, w)
+			return
+		}
+		term := query.Get("term")
+		if term == "" {
+			term = terminalType
+		}
+		shell, err := s.OpenTerminal(serial, term, rows, cols)
+		if err != nil {
+			deviceError(err, w)
+			return
+		}
+		defer shell.Close()
+		conn, err := terminalUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			//Upgrade answered the request already
+			return
+		}
+		defer conn.Close()
+		logger := log.WithFields(log.Fields{"serial": serial, "remote": r.RemoteAddr})
+		logger.Info("terminal opened")
+		go relayShellOutput(shell, conn)
+		relayTerminalInput(conn, shell)
+		logger.Info("terminal closed")
+	}
+}
+
+func sizeParam(value string, fallback int) (int, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil || size <= 0 || size > 10000 {
+		return 0, fmt.Errorf("invalid terminal size %s", value)
+	}
+	return size, nil
+}
+
+//relayTerminalInput passes the messages of the browser to the shell until the WebSocket is closed.
+func relayTerminalInput(conn *websocket.Conn, shell *adb.Shell) {
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		switch messageType {
+		case websocket.BinaryMessage:
+			_, err = shell.Write(data)
+		case websocket.TextMessage:
+			var size terminalSize
+			if json.Unmarshal(data, &size) != nil || size.Rows <= 0 || size.Cols <= 0 {
+				continue
+			}
+			err = shell.Resize(size.Rows, size.Cols)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+//relayShellOutput sends the output of the shell to the browser and closes the WebSocket once the shell ended.
+func relayShellOutput(shell *adb.Shell, conn *websocket.Conn) {
+	reason := "shell closed"
+	for {
+		id, data, err := shell.ReadPacket()
+		if err != nil {
+			break
+		}
+		if id == adb.ShellExit && len(data) > 0 {
+			reason = fmt.Sprintf("exit status %d", data[0])
+			break
+		}
+		if id != adb.ShellStdout && id != adb.ShellStderr {
+			continue
+		}
+		if conn.WriteMessage(websocket.BinaryMessage, data) != nil {
+			break
+		}
+	}
+	deadline := time.Now().Add(terminalCloseTimeout)
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason), deadline)
+	//ends relayTerminalInput if the browser does not answer
+	conn.SetReadDeadline(deadline)
+}